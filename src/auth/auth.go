@@ -0,0 +1,154 @@
+package auth
+
+import (
+  "crypto/sha256"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+)
+
+// An operation a token may be allowed to perform on a range of keys.
+type Permission string
+
+const (
+  // Read values, e.g. /get, and list or watch keys.
+  PERMISSION_READ Permission = "read"
+  // Write values, e.g. /set and /delete.
+  PERMISSION_WRITE Permission = "write"
+  // Administer the server, e.g. /metrics and /admin/snapshot. Admin
+  // endpoints cover every key, so require a grant on the empty prefix.
+  PERMISSION_ADMIN Permission = "admin"
+)
+
+// Permissions on every key beginning with a prefix; the empty prefix covers
+// every key.
+type Grant struct {
+  Prefix string `json:"prefix"`
+  Permissions []Permission `json:"permissions"`
+}
+
+// A token and the roles whose grants it holds.
+type tokenConfig struct {
+  // Identifies the token in logs, e.g. the team or tool using it.
+  Name string `json:"name"`
+  Token string `json:"token"`
+  Roles []string `json:"roles"`
+  // Optional; binds the token to a namespace, which its requests use by
+  // default and may not leave.
+  Namespace string `json:"namespace"`
+}
+
+// The JSON config file, e.g.
+// {
+//   "roles": {
+//     "ci": [ { "prefix": "builds/", "permissions": [ "read", "write" ] } ],
+//     "operator": [ { "prefix": "", "permissions": [ "read", "admin" ] } ]
+//   },
+//   "tokens": [ { "name": "ci-runner", "token": "...", "roles": [ "ci" ] } ]
+// }
+type config struct {
+  Roles map[string][]Grant `json:"roles"`
+  Tokens []tokenConfig `json:"tokens"`
+}
+
+// The holder of a token, and the permissions its roles grant.
+type Principal struct {
+  // The token's name in the config file.
+  Name string
+  // The namespace the token is bound to, or "" if unbound.
+  Namespace string
+  grants []Grant
+}
+
+/**
+ * Return whether the principal holds `permission` on every key beginning
+ * with `prefix`. For a single key, pass the key itself.
+ */
+func (p *Principal) Allowed(permission Permission, prefix string) bool {
+  for _, grant := range p.grants {
+    if !strings.HasPrefix(prefix, grant.Prefix) {
+      continue
+    }
+    for _, granted := range grant.Permissions {
+      if granted == permission {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// Maps tokens to the principals holding them. Create instances via
+// LoadPolicy or ParsePolicy.
+type Policy struct {
+  // Keyed by the SHA-256 digest of each token, so that lookups do not leak
+  // how much of a guessed token matches through their timing.
+  principals map[[sha256.Size]byte]*Principal
+}
+
+// Load a Policy from a JSON config file.
+func LoadPolicy(path string) (*Policy, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  policy, err := ParsePolicy(data)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid auth config %v: %w", path, err)
+  }
+  return policy, nil
+}
+
+// Parse a Policy from the contents of a JSON config file.
+func ParsePolicy(data []byte) (*Policy, error) {
+  var parsed config
+  if err := json.Unmarshal(data, &parsed); err != nil {
+    return nil, err
+  }
+
+  for role, grants := range parsed.Roles {
+    for _, grant := range grants {
+      for _, permission := range grant.Permissions {
+        if permission != PERMISSION_READ && permission != PERMISSION_WRITE &&
+            permission != PERMISSION_ADMIN {
+          return nil, errors.New(fmt.Sprintf(
+            "Role %v has unknown permission %q", role, permission))
+        }
+      }
+    }
+  }
+
+  p := &Policy{}
+  p.principals = make(map[[sha256.Size]byte]*Principal)
+  for _, token := range parsed.Tokens {
+    if token.Token == "" {
+      return nil, errors.New(fmt.Sprintf("Token %q is empty", token.Name))
+    }
+    digest := sha256.Sum256([]byte(token.Token))
+    if _, ok := p.principals[digest]; ok {
+      return nil, errors.New(fmt.Sprintf("Token %q is listed twice", token.Name))
+    }
+
+    principal := &Principal{ Name: token.Name, Namespace: token.Namespace }
+    for _, role := range token.Roles {
+      grants, ok := parsed.Roles[role]
+      if !ok {
+        return nil, errors.New(fmt.Sprintf("Token %q has unknown role %v", token.Name, role))
+      }
+      principal.grants = append(principal.grants, grants...)
+    }
+    p.principals[digest] = principal
+  }
+  return p, nil
+}
+
+// Return the principal holding the token, if it is known.
+func (p *Policy) Authenticate(token string) (*Principal, bool) {
+  if token == "" {
+    return nil, false
+  }
+  principal, ok := p.principals[sha256.Sum256([]byte(token))]
+  return principal, ok
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+  "testing"
+)
+
+const (
+  TEST_CONFIG = `{
+    "roles": {
+      "ci": [
+        { "prefix": "builds/", "permissions": [ "read", "write" ] },
+        { "prefix": "releases/", "permissions": [ "read" ] }
+      ],
+      "operator": [ { "prefix": "", "permissions": [ "admin" ] } ]
+    },
+    "tokens": [
+      { "name": "ci-runner", "token": "ci-token", "roles": [ "ci" ] },
+      { "name": "oncall", "token": "oncall-token", "roles": [ "ci", "operator" ] }
+    ]
+  }`
+)
+
+func TestPolicyGrantsPermissionsOnPrefixes(t *testing.T) {
+  policy, err := ParsePolicy([]byte(TEST_CONFIG))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+
+  ci, ok := policy.Authenticate("ci-token")
+  if !ok || ci.Name != "ci-runner" {
+    t.Fatalf("Expected the ci-runner token to authenticate, got %v", ci)
+  }
+  cases := []struct {
+    permission Permission
+    key string
+    allowed bool
+  }{
+    { PERMISSION_WRITE, "builds/123", true },
+    { PERMISSION_READ, "builds/", true },
+    { PERMISSION_READ, "releases/1.0", true },
+    { PERMISSION_WRITE, "releases/1.0", false },
+    { PERMISSION_READ, "secrets/key", false },
+    // Listing every key requires a grant covering every key.
+    { PERMISSION_READ, "", false },
+    { PERMISSION_READ, "builds", false },
+    { PERMISSION_ADMIN, "", false },
+  }
+  for _, c := range cases {
+    if ci.Allowed(c.permission, c.key) != c.allowed {
+      t.Errorf("Expected %v on %q to be allowed: %v", c.permission, c.key, c.allowed)
+    }
+  }
+
+  oncall, _ := policy.Authenticate("oncall-token")
+  if !oncall.Allowed(PERMISSION_ADMIN, "") || !oncall.Allowed(PERMISSION_WRITE, "builds/1") {
+    t.Errorf("Expected a token to hold the grants of all its roles")
+  }
+}
+
+func TestPolicyRejectsUnknownTokens(t *testing.T) {
+  policy, _ := ParsePolicy([]byte(TEST_CONFIG))
+  for _, token := range []string{ "", "ci-toke", "unknown" } {
+    if _, ok := policy.Authenticate(token); ok {
+      t.Errorf("Expected token %q not to authenticate", token)
+    }
+  }
+}
+
+func TestParsePolicyRejectsInvalidConfigs(t *testing.T) {
+  configs := []string{
+    `{ "roles": { "r": [ { "prefix": "", "permissions": [ "delete" ] } ] } }`,
+    `{ "tokens": [ { "name": "a", "token": "t", "roles": [ "missing" ] } ] }`,
+    `{ "tokens": [ { "name": "a", "token": "" } ] }`,
+    `{ "tokens": [ { "name": "a", "token": "t" }, { "name": "b", "token": "t" } ] }`,
+    `not json`,
+  }
+  for _, config := range configs {
+    if _, err := ParsePolicy([]byte(config)); err == nil {
+      t.Errorf("Expected an error parsing %v", config)
+    }
+  }
+}
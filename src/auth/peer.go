@@ -0,0 +1,107 @@
+package auth
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // Carries the signature of a request sent by another node; see PeerKey.
+  HEADER_PEER_SIGNATURE = "X-Peer-Signature"
+  // How far a signature's time may be from the receiver's clock, either way.
+  PEER_SIGNATURE_MAX_AGE = time.Minute
+  // The shortest secret accepted, in bytes.
+  MIN_PEER_SECRET_BYTES = 16
+)
+
+// A secret shared by every node of a cluster. Nodes sign the requests they
+// send each other with it, e.g. requests forwarded to a key's owner, so that
+// clients cannot pose as nodes. Create instances via LoadPeerKey or
+// MakePeerKey.
+type PeerKey struct {
+  secret []byte
+}
+
+// Make a PeerKey from a secret of at least MIN_PEER_SECRET_BYTES bytes.
+func MakePeerKey(secret []byte) (*PeerKey, error) {
+  if len(secret) < MIN_PEER_SECRET_BYTES {
+    return nil, errors.New(fmt.Sprintf("The peer secret must be at least %v bytes",
+      MIN_PEER_SECRET_BYTES))
+  }
+  return &PeerKey{ secret: append([]byte{}, secret...) }, nil
+}
+
+// Load a PeerKey from a file holding the secret; surrounding whitespace is
+// ignored.
+func LoadPeerKey(path string) (*PeerKey, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  key, err := MakePeerKey(bytes.TrimSpace(data))
+  if err != nil {
+    return nil, fmt.Errorf("Invalid peer secret file %v: %w", path, err)
+  }
+  return key, nil
+}
+
+/**
+ * Sign the request as sent by `node`, replacing any signature it carries.
+ * The signature covers the node, the method, the URI and the time, but not
+ * the body. A nil key removes any signature instead.
+ */
+func (k *PeerKey) Sign(r *http.Request, node string) {
+  if k == nil {
+    r.Header.Del(HEADER_PEER_SIGNATURE)
+    return
+  }
+  timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+  r.Header.Set(HEADER_PEER_SIGNATURE,
+    timestamp + " " + k.mac(timestamp, node, r) + " " + node)
+}
+
+/**
+ * Return the node which signed the request, or false if it is unsigned,
+ * forged, or signed more than PEER_SIGNATURE_MAX_AGE ago. A nil key
+ * verifies nothing.
+ */
+func (k *PeerKey) Verify(r *http.Request) (string, bool) {
+  if k == nil {
+    return "", false
+  }
+  fields := strings.SplitN(r.Header.Get(HEADER_PEER_SIGNATURE), " ", 3)
+  if len(fields) != 3 {
+    return "", false
+  }
+  timestamp, signature, node := fields[0], fields[1], fields[2]
+
+  seconds, err := strconv.ParseInt(timestamp, 10, 64)
+  if err != nil {
+    return "", false
+  }
+  age := time.Since(time.Unix(seconds, 0))
+  if age > PEER_SIGNATURE_MAX_AGE || age < -PEER_SIGNATURE_MAX_AGE {
+    return "", false
+  }
+
+  if !hmac.Equal([]byte(signature), []byte(k.mac(timestamp, node, r))) {
+    return "", false
+  }
+  return node, true
+}
+
+// Return the hex encoded HMAC of a signature's fields.
+func (k *PeerKey) mac(timestamp string, node string, r *http.Request) string {
+  mac := hmac.New(sha256.New, k.secret)
+  fmt.Fprintf(mac, "%v\n%v\n%v\n%v", timestamp, node, r.Method, r.URL.RequestURI())
+  return hex.EncodeToString(mac.Sum(nil))
+}
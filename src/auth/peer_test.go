@@ -0,0 +1,65 @@
+package auth
+
+import (
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+const (
+  TEST_PEER_SECRET = "0123456789abcdef"
+)
+
+func TestPeerKeyVerifiesItsOwnSignatures(t *testing.T) {
+  key, err := MakePeerKey([]byte(TEST_PEER_SECRET))
+  if err != nil {
+    t.Fatalf("Error making peer key: %v", err)
+  }
+  req := httptest.NewRequest("POST", "/set?key=a", nil)
+  key.Sign(req, "localhost:8081")
+
+  if node, ok := key.Verify(req); !ok || node != "localhost:8081" {
+    t.Errorf("Expected the signature to verify, got %v %v", node, ok)
+  }
+
+  other, _ := MakePeerKey([]byte("fedcba9876543210"))
+  if _, ok := other.Verify(req); ok {
+    t.Errorf("Expected another key to reject the signature")
+  }
+  var missing *PeerKey
+  if _, ok := missing.Verify(req); ok {
+    t.Errorf("Expected a nil key to verify nothing")
+  }
+
+  moved := httptest.NewRequest("POST", "/delete?key=a", nil)
+  moved.Header = req.Header
+  if _, ok := key.Verify(moved); ok {
+    t.Errorf("Expected the signature not to cover another URI")
+  }
+}
+
+func TestPeerKeyRejectsForgedAndStaleSignatures(t *testing.T) {
+  key, _ := MakePeerKey([]byte(TEST_PEER_SECRET))
+  req := httptest.NewRequest("GET", "/get?key=a", nil)
+  key.Sign(req, "localhost:8081")
+  fields := strings.SplitN(req.Header.Get(HEADER_PEER_SIGNATURE), " ", 3)
+
+  for _, signature := range []string{
+    "",
+    "localhost:8081",
+    fields[0] + " " + fields[1] + " localhost:8082",
+    strconv.FormatInt(time.Now().Add(-2 * PEER_SIGNATURE_MAX_AGE).Unix(), 10) + " " +
+      fields[1] + " " + fields[2],
+  } {
+    req.Header.Set(HEADER_PEER_SIGNATURE, signature)
+    if _, ok := key.Verify(req); ok {
+      t.Errorf("Expected %q to be rejected", signature)
+    }
+  }
+
+  if _, err := MakePeerKey([]byte("short")); err == nil {
+    t.Errorf("Expected a short secret to be rejected")
+  }
+}
@@ -0,0 +1,233 @@
+package certs
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "os"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // How often the files are checked for changes, at most.
+  RELOAD_CHECK_INTERVAL = 5 * time.Second
+)
+
+// The files loaded by a KeyPair or CertPool, and their state when loaded.
+type watchedFiles struct {
+  paths []string
+  // The modification time and size of each file when last loaded.
+  modTimes []time.Time
+  sizes []int64
+  lastCheck time.Time
+}
+
+// Record the current state of the files.
+func (f *watchedFiles) record() error {
+  f.modTimes = make([]time.Time, len(f.paths))
+  f.sizes = make([]int64, len(f.paths))
+  for i, path := range f.paths {
+    info, err := os.Stat(path)
+    if err != nil {
+      return err
+    }
+    f.modTimes[i] = info.ModTime()
+    f.sizes[i] = info.Size()
+  }
+  f.lastCheck = time.Now()
+  return nil
+}
+
+/**
+ * Return whether any file changed since it was recorded. Checks at most once
+ * per RELOAD_CHECK_INTERVAL, so that handshakes rarely stat the files.
+ */
+func (f *watchedFiles) changed() bool {
+  if time.Since(f.lastCheck) < RELOAD_CHECK_INTERVAL {
+    return false
+  }
+  f.lastCheck = time.Now()
+
+  for i, path := range f.paths {
+    info, err := os.Stat(path)
+    if err != nil {
+      // E.g. mid-rotation; keep using the loaded files.
+      return false
+    }
+    if !info.ModTime().Equal(f.modTimes[i]) || info.Size() != f.sizes[i] {
+      return true
+    }
+  }
+  return false
+}
+
+// A certificate and private key loaded from PEM files, which are reloaded
+// when they change, e.g. when a certificate is renewed. Create instances via
+// LoadKeyPair.
+type KeyPair struct {
+  files *watchedFiles
+  certificate *tls.Certificate
+  // Guards `files` and `certificate`.
+  mutex *sync.Mutex
+  // Logs reloads; may be nil.
+  logger *logging.Logger
+}
+
+// Load a certificate, and any intermediates, and its private key. Reloads
+// are logged to `logger`, which may be nil.
+func LoadKeyPair(certFile string, keyFile string, logger *logging.Logger) (*KeyPair, error) {
+  k := &KeyPair{}
+  k.files = &watchedFiles{ paths: []string{ certFile, keyFile } }
+  k.mutex = &sync.Mutex{}
+  k.logger = logger
+  if err := k.load(); err != nil {
+    return nil, err
+  }
+  return k, nil
+}
+
+/**
+ * Load the files.
+ *
+ * <p> This method assumes the mutex is held, or the KeyPair is unshared.
+ */
+func (k *KeyPair) load() error {
+  if err := k.files.record(); err != nil {
+    return err
+  }
+  certificate, err := tls.LoadX509KeyPair(k.files.paths[0], k.files.paths[1])
+  if err != nil {
+    return fmt.Errorf("Error loading key pair %v: %w", k.files.paths, err)
+  }
+  k.certificate = &certificate
+  return nil
+}
+
+/**
+ * Return the certificate, first reloading it if its files changed. If they
+ * cannot be loaded, e.g. while only one of them is replaced, the previous
+ * certificate is returned.
+ */
+func (k *KeyPair) Certificate() *tls.Certificate {
+  defer k.mutex.Unlock()
+  k.mutex.Lock()
+
+  if k.files.changed() {
+    previous := k.certificate
+    if err := k.load(); err != nil {
+      k.logger.Warn("Keeping the previous certificate", "err", err)
+      k.certificate = previous
+    } else {
+      k.logger.Info("Reloaded certificate", "file", k.files.paths[0])
+    }
+  }
+  return k.certificate
+}
+
+// A bundle of CA certificates loaded from a PEM file, which is reloaded when
+// it changes. Create instances via LoadCertPool.
+type CertPool struct {
+  files *watchedFiles
+  pool *x509.CertPool
+  // Guards `files` and `pool`.
+  mutex *sync.Mutex
+  // Logs reloads; may be nil.
+  logger *logging.Logger
+}
+
+// Load a bundle of one or more PEM encoded CA certificates. Reloads are
+// logged to `logger`, which may be nil.
+func LoadCertPool(file string, logger *logging.Logger) (*CertPool, error) {
+  p := &CertPool{}
+  p.files = &watchedFiles{ paths: []string{ file } }
+  p.mutex = &sync.Mutex{}
+  p.logger = logger
+  if err := p.load(); err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+/**
+ * Load the file.
+ *
+ * <p> This method assumes the mutex is held, or the CertPool is unshared.
+ */
+func (p *CertPool) load() error {
+  if err := p.files.record(); err != nil {
+    return err
+  }
+  bundle, err := os.ReadFile(p.files.paths[0])
+  if err != nil {
+    return err
+  }
+
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(bundle) {
+    return errors.New(fmt.Sprintf("No certificates found in %v", p.files.paths[0]))
+  }
+  p.pool = pool
+  return nil
+}
+
+// Return the pool, first reloading it if its file changed.
+func (p *CertPool) Pool() *x509.CertPool {
+  defer p.mutex.Unlock()
+  p.mutex.Lock()
+
+  if p.files.changed() {
+    previous := p.pool
+    if err := p.load(); err != nil {
+      p.logger.Warn("Keeping the previous CA bundle", "err", err)
+      p.pool = previous
+    } else {
+      p.logger.Info("Reloaded CA bundle", "file", p.files.paths[0])
+    }
+  }
+  return p.pool
+}
+
+/**
+ * Return a server TLS config presenting the key pair's certificate. If
+ * `clientCas` is not nil, clients must present a certificate signed by one of
+ * its CAs. Both are reloaded when their files change, taking effect for new
+ * connections.
+ */
+func ServerConfig(keyPair *KeyPair, clientCas *CertPool) *tls.Config {
+  return &tls.Config{
+    MinVersion: tls.VersionTLS12,
+    GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+      config := &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        Certificates: []tls.Certificate{ *keyPair.Certificate() },
+      }
+      if clientCas != nil {
+        config.ClientCAs = clientCas.Pool()
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+      }
+      return config, nil
+    },
+  }
+}
+
+/**
+ * Return a client TLS config. Server certificates are verified against
+ * `rootCas`, or the system's CAs if nil. If `keyPair` is not nil, its
+ * certificate is presented to servers which request one, and reloaded when
+ * its files change. Both may be nil.
+ */
+func ClientConfig(keyPair *KeyPair, rootCas *CertPool) *tls.Config {
+  config := &tls.Config{ MinVersion: tls.VersionTLS12 }
+  if rootCas != nil {
+    config.RootCAs = rootCas.Pool()
+  }
+  if keyPair != nil {
+    config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+      return keyPair.Certificate(), nil
+    }
+  }
+  return config
+}
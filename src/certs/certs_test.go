@@ -0,0 +1,97 @@
+package certs
+
+import (
+  "crypto/x509"
+  "os"
+  "testing"
+  "time"
+)
+
+// Return the common name of the key pair's current certificate.
+func commonName(t *testing.T, k *KeyPair) string {
+  leaf, err := x509.ParseCertificate(k.Certificate().Certificate[0])
+  if err != nil {
+    t.Fatalf("Error parsing certificate: %v", err)
+  }
+  return leaf.Subject.CommonName
+}
+
+// Make the next call check the files for changes.
+func expireCheck(files *watchedFiles) {
+  files.lastCheck = time.Now().Add(-RELOAD_CHECK_INTERVAL)
+}
+
+func TestKeyPairReloadsChangedFiles(t *testing.T) {
+  testCerts, err := WriteTestCertificates(t.TempDir())
+  if err != nil {
+    t.Fatalf("Error writing certificates: %v", err)
+  }
+  k, err := LoadKeyPair(testCerts.ServerCertFile, testCerts.ServerKeyFile, nil)
+  if err != nil {
+    t.Fatalf("Error loading key pair: %v", err)
+  }
+
+  testCerts.Issue("renewed", testCerts.ServerCertFile, testCerts.ServerKeyFile)
+  if name := commonName(t, k); name != "server" {
+    t.Errorf("Expected files to be checked at most every interval, got %v", name)
+  }
+
+  expireCheck(k.files)
+  if name := commonName(t, k); name != "renewed" {
+    t.Errorf("Expected the renewed certificate, got %v", name)
+  }
+}
+
+func TestKeyPairKeepsCertificateWhenReloadFails(t *testing.T) {
+  testCerts, _ := WriteTestCertificates(t.TempDir())
+  k, err := LoadKeyPair(testCerts.ServerCertFile, testCerts.ServerKeyFile, nil)
+  if err != nil {
+    t.Fatalf("Error loading key pair: %v", err)
+  }
+
+  // Replace only the certificate, so that it no longer matches the key.
+  testCerts.Issue("renewed", testCerts.ServerCertFile, testCerts.ClientKeyFile)
+  expireCheck(k.files)
+  if name := commonName(t, k); name != "server" {
+    t.Errorf("Expected the previous certificate, got %v", name)
+  }
+}
+
+// Return whether the certificate in `certFile` is signed by a CA in the pool.
+func verifies(t *testing.T, p *CertPool, certFile string) bool {
+  k, err := LoadKeyPair(certFile, certFile[:len(certFile) - len(".pem")] + "-key.pem", nil)
+  if err != nil {
+    t.Fatalf("Error loading key pair: %v", err)
+  }
+  leaf, _ := x509.ParseCertificate(k.Certificate().Certificate[0])
+  _, err = leaf.Verify(x509.VerifyOptions{ Roots: p.Pool() })
+  return err == nil
+}
+
+func TestCertPoolReloadsChangedFile(t *testing.T) {
+  testCerts, _ := WriteTestCertificates(t.TempDir())
+  p, err := LoadCertPool(testCerts.CaFile, nil)
+  if err != nil {
+    t.Fatalf("Error loading CA bundle: %v", err)
+  }
+
+  otherCerts, _ := WriteTestCertificates(t.TempDir())
+  if verifies(t, p, otherCerts.ServerCertFile) {
+    t.Fatalf("Expected another CA's certificate not to verify")
+  }
+
+  bundle, _ := os.ReadFile(otherCerts.CaFile)
+  os.WriteFile(testCerts.CaFile, append(bundle, '\n'), 0600)
+  expireCheck(p.files)
+  if !verifies(t, p, otherCerts.ServerCertFile) {
+    t.Errorf("Expected the changed CA bundle to be reloaded")
+  }
+}
+
+func TestCertPoolRejectsBundleWithoutCertificates(t *testing.T) {
+  path := t.TempDir() + "/empty.pem"
+  os.WriteFile(path, []byte("not a certificate"), 0600)
+  if _, err := LoadCertPool(path, nil); err == nil {
+    t.Errorf("Expected an error loading a bundle without certificates")
+  }
+}
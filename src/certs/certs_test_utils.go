@@ -0,0 +1,109 @@
+package certs
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "math/big"
+  "net"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// Certificates for tests, generated at test time: a self-signed CA, and a
+// server and client certificate signed by it. Every certificate is valid
+// for localhost, 127.0.0.1 and ::1.
+type TestCertificates struct {
+  CaFile string
+  ServerCertFile string
+  ServerKeyFile string
+  ClientCertFile string
+  ClientKeyFile string
+
+  ca *x509.Certificate
+  caKey *ecdsa.PrivateKey
+  serial int64
+}
+
+// Generate the CA, server and client certificates as PEM files in `directory`.
+func WriteTestCertificates(directory string) (*TestCertificates, error) {
+  c := &TestCertificates{}
+  c.CaFile = filepath.Join(directory, "ca.pem")
+  c.ServerCertFile = filepath.Join(directory, "server.pem")
+  c.ServerKeyFile = filepath.Join(directory, "server-key.pem")
+  c.ClientCertFile = filepath.Join(directory, "client.pem")
+  c.ClientKeyFile = filepath.Join(directory, "client-key.pem")
+
+  var err error
+  if c.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+    return nil, err
+  }
+  template := c.template("Test CA")
+  template.IsCA = true
+  template.BasicConstraintsValid = true
+  template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &c.caKey.PublicKey, c.caKey)
+  if err != nil {
+    return nil, err
+  }
+  if c.ca, err = x509.ParseCertificate(der); err != nil {
+    return nil, err
+  }
+  if err := writePem(c.CaFile, "CERTIFICATE", der); err != nil {
+    return nil, err
+  }
+
+  if err := c.Issue("server", c.ServerCertFile, c.ServerKeyFile); err != nil {
+    return nil, err
+  }
+  if err := c.Issue("client", c.ClientCertFile, c.ClientKeyFile); err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+// Write a new certificate and key signed by the CA, e.g. to test reloading.
+func (c *TestCertificates) Issue(commonName string, certFile string, keyFile string) error {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return err
+  }
+  template := c.template(commonName)
+  template.KeyUsage = x509.KeyUsageDigitalSignature
+  template.ExtKeyUsage = []x509.ExtKeyUsage{
+    x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &key.PublicKey, c.caKey)
+  if err != nil {
+    return err
+  }
+
+  keyDer, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return err
+  }
+  if err := writePem(keyFile, "EC PRIVATE KEY", keyDer); err != nil {
+    return err
+  }
+  return writePem(certFile, "CERTIFICATE", der)
+}
+
+func (c *TestCertificates) template(commonName string) *x509.Certificate {
+  c.serial++
+  return &x509.Certificate{
+    SerialNumber: big.NewInt(c.serial),
+    Subject: pkix.Name{ CommonName: commonName },
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(24 * time.Hour),
+    DNSNames: []string{ "localhost" },
+    IPAddresses: []net.IP{ net.ParseIP("127.0.0.1"), net.ParseIP("::1") },
+  }
+}
+
+func writePem(path string, blockType string, der []byte) error {
+  return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{ Type: blockType, Bytes: der }), 0600)
+}
@@ -2,15 +2,41 @@ package client
 
 import (
   "bytes"
+  "context"
   "encoding/json"
   "errors"
   "fmt"
+  "io"
   "io/ioutil"
   "net/http"
+  "net/url"
+  "sort"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/ring"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+const (
+  // /get response headers describing the value's attributes, if any.
+  HEADER_EXPIRES_AT = "X-Expires-At"
+  HEADER_METADATA = "X-Metadata"
+  // Selects the namespace of a request.
+  HEADER_NAMESPACE = "X-Namespace"
 )
 
 var (
   EMPTY_BUFFER []byte
+  // Returned by Get calls for keys with no value on the server.
+  ErrNotFound = errors.New("Key not found")
+  // Returned when the server requires a token, and none or an unknown one
+  // was given; see ClientOptions.
+  ErrUnauthorized = errors.New("Unauthorized")
+  // Returned when the client's token lacks permission for the request.
+  ErrForbidden = errors.New("Forbidden")
+  // Returned by Set calls which would exceed the namespace's quota.
+  ErrQuotaExceeded = errors.New("Quota exceeded")
 )
 
 // A thin wrapper around a HTTP Client. Used to 
@@ -20,12 +46,99 @@ type Client struct {
     getUrl string
     // The URL of the Set Endpoint, e.g. `http://localhost:8080/set`.
     setUrl string
+    // The URL of the Snapshot Endpoint, e.g.
+    // `http://localhost:8080/admin/snapshot`.
+    snapshotUrl string
+    // The URL of the Keys Endpoint, e.g. `http://localhost:8080/keys`.
+    keysUrl string
+    // The URL of the Delete Endpoint, e.g. `http://localhost:8080/delete`.
+    deleteUrl string
+    // The URL of the Watch Endpoint, e.g. `http://localhost:8080/watch`.
+    watchUrl string
     httpClient *http.Client
+    // In cluster mode, the ring partitioning keys between nodes, and a
+    // client for each node; otherwise nil.
+    ring *ring.Ring
+    nodes map[string]*Client
+    // Traces Get, Set and Delete calls; may be nil.
+    tracer *tracing.Tracer
+    // The deadline of each Get, Set and Delete call, or 0 for none.
+    timeout time.Duration
+    // Logs certificate reloads and dropped watch streams; may be nil.
+    logger *logging.Logger
+    // Whether the client has TLS options, so cluster nodes listed without a
+    // scheme are reached over `https://`.
+    secure bool
+}
+
+// Configures optional Client behaviour.
+type ClientOptions struct {
+  // Optional; configures TLS for `https://` server URLs, and cluster nodes
+  // listed without a scheme.
+  Tls *TlsOptions
+  // Optional; sent with every request as an `Authorization: Bearer` token,
+  // for servers which require authentication.
+  Token string
+  // Optional; the namespace of every request, for servers which have
+  // namespaces. Servers select the token's namespace, if it is bound to
+  // one, or else the default namespace.
+  Namespace string
+  // Optional; traces Get, Set and Delete calls, and sends each call's span
+  // as a traceparent header, so that the server continues its trace.
+  Tracer *tracing.Tracer
+  // Optional; how long each Get, Set and Delete call may take, unless its
+  // context has an earlier deadline. Calls past it fail with an error
+  // wrapping context.DeadlineExceeded.
+  Timeout time.Duration
+  // Optional; logs certificate reloads and dropped watch streams.
+  Logger *logging.Logger
+}
+
+// Adds the client's headers, e.g. its token, to every request.
+type headerTransport struct {
+  header http.Header
+  next http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+  // RoundTrippers must not modify the caller's request.
+  req = req.Clone(req.Context())
+  for name, values := range t.header {
+    req.Header[name] = values
+  }
+  return t.next.RoundTrip(req)
+}
+
+// The outcome of rebalancing a single node; see `Client.Rebalance`.
+type RebalanceReport struct {
+  // The number of keys the node streamed to their new owners.
+  Moved int `json:"moved"`
+  // The number of keys the node failed to move.
+  Failed int `json:"failed"`
 }
 
 type KeyValuePair struct {
   Key string
   Value string
+  // The number of seconds until the value expires, or 0 if it never expires.
+  Ttl int64 `json:",omitempty"`
+  Metadata map[string]string `json:",omitempty"`
+}
+
+// Optional attributes of a /set call.
+type SetOptions struct {
+  // How long until the value expires, or 0 if it never expires. Rounded up
+  // to the nearest second.
+  Ttl time.Duration
+  // Arbitrary metadata stored alongside the value.
+  Metadata map[string]string
+}
+
+// The attributes of a value returned by a /get call.
+type Attributes struct {
+  // When the value expires, or the zero time if it never expires.
+  ExpiresAt time.Time
+  Metadata map[string]string
 }
 
 /** 
@@ -34,13 +147,52 @@ type KeyValuePair struct {
  * HTTP error code, etc.) 
 */
 func (c *Client) Get(key string) ([]byte, error) {
+  return c.GetContext(context.Background(), key)
+}
+
+// As Get, abandoning the call once `ctx` is cancelled or past its deadline.
+func (c *Client) GetContext(ctx context.Context, key string) ([]byte, error) {
+  value, _, err := c.GetWithAttributesContext(ctx, key)
+  return value, err
+}
+
+/**
+ * Invoke a /get request for a specified `key` on the API server. Returns the
+ * stored value and its attributes, if any, or any errors.
+ */
+func (c *Client) GetWithAttributes(key string) ([]byte, *Attributes, error) {
+  return c.GetWithAttributesContext(context.Background(), key)
+}
+
+// As GetWithAttributes, abandoning the call once `ctx` is cancelled or past
+// its deadline.
+func (c *Client) GetWithAttributesContext(
+    ctx context.Context,
+    key string) ([]byte, *Attributes, error) {
+  if node := c.route(key); node != c {
+    return node.GetWithAttributesContext(ctx, key)
+  }
+
   if len(key) == 0 {
-    return EMPTY_BUFFER, errors.New("GET cannot be called on an empty key.")
+    return EMPTY_BUFFER, nil, errors.New("GET cannot be called on an empty key.")
   }
 
-  req, err := http.NewRequest("GET", c.getUrl, nil)
+  ctx, cancel, span := c.startCall(ctx, "Client.Get", key)
+  defer cancel()
+  value, attributes, err := c.get(ctx, key, span)
+  span.SetAttribute("value.bytes", len(value))
+  endSpan(span, err)
+  return value, attributes, err
+}
+
+// Invoke a /get request, continuing the trace of `ctx`.
+func (c *Client) get(
+    ctx context.Context,
+    key string,
+    span *tracing.Span) ([]byte, *Attributes, error) {
+  req, err := c.newRequest(ctx, "GET", c.getUrl, nil)
   if err != nil {
-    return EMPTY_BUFFER, err
+    return EMPTY_BUFFER, nil, err
   }
 
   // Add the key as a query parameter to the request.
@@ -51,24 +203,30 @@ func (c *Client) Get(key string) ([]byte, error) {
   // Execute the request.
   resp, err := c.httpClient.Do(req) 
   if err != nil {
-    return EMPTY_BUFFER, err
+    return EMPTY_BUFFER, nil, err
   }
+  defer resp.Body.Close()
+  span.SetAttribute("http.status_code", resp.StatusCode)
   
-  if resp.StatusCode != http.StatusOK {
+  if resp.StatusCode == http.StatusNotFound {
+    return EMPTY_BUFFER, nil, fmt.Errorf("%w: %v", ErrNotFound, key)
+  } else if resp.StatusCode != http.StatusOK {
     // The server was not able to service this request.
-    return EMPTY_BUFFER, errors.New(fmt.Sprintf("HttpError %v from server",
-resp.StatusCode))
+    return EMPTY_BUFFER, nil, httpError(resp.StatusCode,
+      fmt.Sprintf("HttpError %v from server", resp.StatusCode))
   }
 
-  defer resp.Body.Close()
   buffer, err := ioutil.ReadAll(resp.Body)
-
   if err != nil {
     // Error reading the response body.
-    return EMPTY_BUFFER, err
+    return EMPTY_BUFFER, nil, err
   }
-  
-  return buffer, nil
+
+  attributes, err := parseAttributeHeaders(resp.Header)
+  if err != nil {
+    return EMPTY_BUFFER, nil, err
+  }
+  return buffer, attributes, nil
 }
 
 /**
@@ -77,6 +235,34 @@ resp.StatusCode))
  * otherwise.
  */
 func (c *Client) Set(key string, value []byte) error {
+  return c.SetContext(context.Background(), key, value)
+}
+
+// As Set, abandoning the call once `ctx` is cancelled or past its deadline.
+// An abandoned value may still have been stored.
+func (c *Client) SetContext(ctx context.Context, key string, value []byte) error {
+  return c.SetWithOptionsContext(ctx, key, value, nil)
+}
+
+/**
+ * Invoke the /set API with the provided `key`->`value` pair and options,
+ * which may be nil. Return any failures or nil otherwise.
+ */
+func (c *Client) SetWithOptions(key string, value []byte, options *SetOptions) error {
+  return c.SetWithOptionsContext(context.Background(), key, value, options)
+}
+
+// As SetWithOptions, abandoning the call once `ctx` is cancelled or past its
+// deadline. An abandoned value may still have been stored.
+func (c *Client) SetWithOptionsContext(
+    ctx context.Context,
+    key string,
+    value []byte,
+    options *SetOptions) error {
+  if node := c.route(key); node != c {
+    return node.SetWithOptionsContext(ctx, key, value, options)
+  }
+
   if len(key) == 0 {
     return errors.New("Cannot SET an empty key.")
   }
@@ -90,27 +276,438 @@ func (c *Client) Set(key string, value []byte) error {
     Key: key,
     Value: string(value),
   }
+  if options != nil {
+    if options.Ttl < 0 {
+      return errors.New("Cannot SET a negative TTL.")
+    }
+    kv.Ttl = int64((options.Ttl + time.Second - 1) / time.Second)
+    kv.Metadata = options.Metadata
+  }
  
   jsonKv, err := json.Marshal(kv)
   if err != nil {
     return err
   }
 
-  // Execute the /set request.   
-  resp, postErr := 
-    http.Post(c.setUrl, "application/json", bytes.NewBuffer(jsonKv)) 
-  if postErr != nil {
-    return postErr
+  ctx, cancel, span := c.startCall(ctx, "Client.Set", key)
+  defer cancel()
+  span.SetAttribute("value.bytes", len(value))
+  err = c.post(ctx, c.setUrl, jsonKv, span, func(statusCode int) error {
+    return httpError(statusCode,
+      fmt.Sprintf("HttpError %v when setting %v -> %v", statusCode, key, value))
+  })
+  endSpan(span, err)
+  return err
+}
+
+/**
+ * Invoke the /delete API for `key`. Deleting a missing key succeeds.
+ */
+func (c *Client) Delete(key string) error {
+  return c.DeleteContext(context.Background(), key)
+}
+
+// As Delete, abandoning the call once `ctx` is cancelled or past its
+// deadline. An abandoned key may still have been deleted.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+  if node := c.route(key); node != c {
+    return node.DeleteContext(ctx, key)
+  }
+
+  if len(key) == 0 {
+    return errors.New("Cannot DELETE an empty key.")
+  }
+
+  body, err := json.Marshal(map[string]string{ "Key": key })
+  if err != nil {
+    return err
+  }
+
+  ctx, cancel, span := c.startCall(ctx, "Client.Delete", key)
+  defer cancel()
+  err = c.post(ctx, c.deleteUrl, body, span, func(statusCode int) error {
+    return httpError(statusCode,
+      fmt.Sprintf("HttpError %v when deleting %v", statusCode, key))
+  })
+  endSpan(span, err)
+  return err
+}
+
+/**
+ * POST a JSON `body` to `url`, continuing the trace of `ctx`. Responses
+ * other than 200 are returned as the error `failed` makes of their status.
+ */
+func (c *Client) post(
+    ctx context.Context,
+    url string,
+    body []byte,
+    span *tracing.Span,
+    failed func(statusCode int) error) error {
+  req, err := c.newRequest(ctx, "POST", url, bytes.NewReader(body))
+  if err != nil {
+    return err
   }
+  req.Header.Set("Content-Type", "application/json")
 
-  if resp.StatusCode != http.StatusOK {
-    return errors.New(
-      fmt.Sprintf("HttpError %v when setting %v -> %v", resp.StatusCode, key, value))
+  resp, err := c.httpClient.Do(req)
+  if err != nil {
+    return err
   }
+  defer resp.Body.Close()
+  span.SetAttribute("http.status_code", resp.StatusCode)
 
+  if resp.StatusCode != http.StatusOK {
+    return failed(resp.StatusCode)
+  }
   return nil
 }
 
+// Make a request carrying the traceparent of the span in `ctx`, if any.
+func (c *Client) newRequest(
+    ctx context.Context,
+    method string,
+    url string,
+    body io.Reader) (*http.Request, error) {
+  req, err := http.NewRequestWithContext(ctx, method, url, body)
+  if err != nil {
+    return nil, err
+  }
+  tracing.Inject(ctx, req.Header)
+  return req, nil
+}
+
+/**
+ * Start a call on `key` within `ctx`: apply the client's timeout, if any,
+ * and start its client span, which is nil if tracing is off. Release the
+ * context via the returned CancelFunc once the call finishes.
+ */
+func (c *Client) startCall(
+    ctx context.Context,
+    name string,
+    key string) (context.Context, context.CancelFunc, *tracing.Span) {
+  cancel := context.CancelFunc(func() {})
+  if c.timeout > 0 {
+    ctx, cancel = context.WithTimeout(ctx, c.timeout)
+  }
+  ctx, span := c.tracer.Start(ctx, name, tracing.KIND_CLIENT)
+  span.SetAttribute("key", key)
+  return ctx, cancel, span
+}
+
+// End a client span, failing it if `err` is set. A missing key is not a
+// failure.
+func endSpan(span *tracing.Span, err error) {
+  if err != nil && !errors.Is(err, ErrNotFound) {
+    span.SetError(err)
+  }
+  span.End()
+}
+
+/**
+ * Invoke the /keys API, returning every key which begins with `prefix` in
+ * sorted order. An empty prefix lists every key. In cluster mode, every
+ * node's keys are listed.
+ */
+func (c *Client) Keys(prefix string) ([]string, error) {
+  return c.KeysContext(context.Background(), prefix)
+}
+
+// As Keys, abandoning the call once `ctx` is cancelled or past its deadline.
+func (c *Client) KeysContext(ctx context.Context, prefix string) ([]string, error) {
+  if c.ring != nil {
+    return c.clusterKeys(ctx, prefix)
+  }
+
+  req, err := c.newRequest(ctx, "GET",
+    c.keysUrl + "?prefix=" + url.QueryEscape(prefix), nil)
+  if err != nil {
+    return nil, err
+  }
+  resp, err := c.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return nil, httpError(resp.StatusCode,
+      fmt.Sprintf("HttpError %v from server", resp.StatusCode))
+  }
+
+  var response struct {
+    Keys []string `json:"keys"`
+  }
+  if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+    return nil, err
+  }
+  return response.Keys, nil
+}
+
+/**
+ * Invoke the /admin/snapshot API, streaming the snapshot archive into `w`.
+ * Return any failures (e.g. a connection failure, an HTTP error code, etc.)
+ * or nil otherwise.
+ */
+func (c *Client) Snapshot(w io.Writer) error {
+  return c.SnapshotContext(context.Background(), w)
+}
+
+// As Snapshot, abandoning the call once `ctx` is cancelled or past its
+// deadline. `w` may hold part of the archive by then.
+func (c *Client) SnapshotContext(ctx context.Context, w io.Writer) error {
+  if c.ring != nil {
+    return errors.New("Snapshots are taken per node; use a client for a single node.")
+  }
+
+  req, err := c.newRequest(ctx, "GET", c.snapshotUrl, nil)
+  if err != nil {
+    return err
+  }
+  resp, err := c.httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return httpError(resp.StatusCode, fmt.Sprintf("HttpError %v from server", resp.StatusCode))
+  }
+
+  _, err = io.Copy(w, resp.Body)
+  return err
+}
+
+// Return the client for the node owning `key`, or `c` itself outside of
+// cluster mode.
+func (c *Client) route(key string) *Client {
+  if c.ring == nil {
+    return c
+  }
+  return c.nodes[c.ring.Owner(key)]
+}
+
+// List the keys of every node in the cluster, in sorted order.
+func (c *Client) clusterKeys(ctx context.Context, prefix string) ([]string, error) {
+  var keys []string
+  for _, node := range c.ring.Nodes() {
+    nodeKeys, err := c.nodes[node].KeysContext(ctx, prefix)
+    if err != nil {
+      return nil, err
+    }
+    keys = append(keys, nodeKeys...)
+  }
+
+  // A key may briefly live on two nodes while the cluster is rebalanced.
+  sort.Strings(keys)
+  unique := keys[:0]
+  for i, key := range keys {
+    if i == 0 || key != keys[i - 1] {
+      unique = append(unique, key)
+    }
+  }
+  return unique, nil
+}
+
+/**
+ * Move the cluster to a new membership: every current and new node adopts
+ * `nodes`, then streams the keys it no longer owns to their new owners, with
+ * the client's token. The client routes by the new membership once every
+ * node succeeds. Returns the report of each node.
+ */
+func (c *Client) Rebalance(nodes []string) (map[string]*RebalanceReport, error) {
+  return c.RebalanceContext(context.Background(), nodes)
+}
+
+/**
+ * As Rebalance, abandoning the call once `ctx` is cancelled or past its
+ * deadline. Nodes which were already rebalanced keep the new membership, so
+ * an abandoned rebalance should be retried.
+ */
+func (c *Client) RebalanceContext(
+    ctx context.Context,
+    nodes []string) (map[string]*RebalanceReport, error) {
+  if c.ring == nil {
+    return nil, errors.New("Rebalance requires a cluster client.")
+  }
+
+  newRing, err := ring.MakeRing(nodes, 0)
+  if err != nil {
+    return nil, err
+  }
+
+  // Rebalance every node of the old and new memberships, e.g. so that a
+  // departing node hands over its keys.
+  members := c.ring.Nodes()
+  for _, node := range nodes {
+    if !c.ring.Contains(node) {
+      members = append(members, node)
+    }
+  }
+
+  body, err := json.Marshal(map[string][]string{ "nodes": nodes })
+  if err != nil {
+    return nil, err
+  }
+
+  reports := make(map[string]*RebalanceReport)
+  for _, node := range members {
+    req, err := c.newRequest(ctx, "POST", c.nodeUrl(node) + "/admin/rebalance",
+      bytes.NewReader(body))
+    if err != nil {
+      return reports, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+      return reports, err
+    }
+
+    report := &RebalanceReport{}
+    err = json.NewDecoder(resp.Body).Decode(report)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+      return reports, httpError(resp.StatusCode, fmt.Sprintf("HttpError %v rebalancing %v",
+        resp.StatusCode, node))
+    } else if err != nil {
+      return reports, err
+    }
+    reports[node] = report
+  }
+
+  c.adoptRing(newRing)
+  return reports, nil
+}
+
+// Return an error for an unsuccessful response, wrapping ErrUnauthorized,
+// ErrForbidden or ErrQuotaExceeded for those statuses.
+func httpError(statusCode int, message string) error {
+  switch statusCode {
+  case http.StatusUnauthorized:
+    return fmt.Errorf("%w: %v", ErrUnauthorized, message)
+  case http.StatusForbidden:
+    return fmt.Errorf("%w: %v", ErrForbidden, message)
+  case http.StatusInsufficientStorage:
+    return fmt.Errorf("%w: %v", ErrQuotaExceeded, message)
+  }
+  return errors.New(message)
+}
+
+// Return the URL of a cluster node, e.g. `http://localhost:8081` for
+// `localhost:8081`, or `https://localhost:8081` for a client with TLS.
+func (c *Client) nodeUrl(node string) string {
+  return nodeUrl(node, c.secure)
+}
+
+func nodeUrl(node string, secure bool) string {
+  if strings.Contains(node, "://") {
+    return node
+  } else if secure {
+    return "https://" + node
+  }
+  return "http://" + node
+}
+
+// Parse the attribute headers of a /get response, returning nil if there are
+// none.
+func parseAttributeHeaders(header http.Header) (*Attributes, error) {
+  expiresAt := header.Get(HEADER_EXPIRES_AT)
+  metadata := header.Get(HEADER_METADATA)
+  if expiresAt == "" && metadata == "" {
+    return nil, nil
+  }
+
+  attributes := &Attributes{}
+  if expiresAt != "" {
+    parsed, err := time.Parse(time.RFC3339Nano, expiresAt)
+    if err != nil {
+      return nil, err
+    }
+    attributes.ExpiresAt = parsed
+  }
+  if metadata != "" {
+    if err := json.Unmarshal([]byte(metadata), &attributes.Metadata); err != nil {
+      return nil, err
+    }
+  }
+  return attributes, nil
+}
+
+/**
+ * Construct a Client for a cluster of `nodes`, e.g. `localhost:8081`, which
+ * sends each request directly to the node owning its key. The nodes must be
+ * listed exactly as the servers were configured; with TLS options, they are
+ * reached over `https://`. `options` may be nil, and
+ * apply to the requests sent to every node, including rebalancing.
+ */
+func MakeClusterClient(nodes []string, options *ClientOptions) (*Client, error) {
+  keyRing, err := ring.MakeRing(nodes, 0)
+  if err != nil {
+    return nil, err
+  }
+
+  c, err := MakeClientWithOptions(nodeUrl(nodes[0], options != nil && options.Tls != nil),
+    options)
+  if err != nil {
+    return nil, err
+  }
+  c.adoptRing(keyRing)
+  return c, nil
+}
+
+// Route requests by `keyRing`, making a client for each of its nodes which
+// shares this client's options and connections.
+func (c *Client) adoptRing(keyRing *ring.Ring) {
+  nodes := make(map[string]*Client)
+  for _, node := range keyRing.Nodes() {
+    nodeClient := MakeClient(c.nodeUrl(node))
+    nodeClient.httpClient = c.httpClient
+    nodeClient.tracer = c.tracer
+    nodeClient.timeout = c.timeout
+    nodeClient.logger = c.logger
+    nodeClient.secure = c.secure
+    nodes[node] = nodeClient
+  }
+  c.ring = keyRing
+  c.nodes = nodes
+}
+
+// Construct a Client with optional behaviour, e.g. TLS or a token. `options`
+// may be nil.
+func MakeClientWithOptions(serverUrl string, options *ClientOptions) (*Client, error) {
+  c := MakeClient(serverUrl)
+  if options == nil {
+    return c, nil
+  }
+  c.tracer = options.Tracer
+  c.timeout = options.Timeout
+  c.logger = options.Logger
+
+  var transport http.RoundTripper = http.DefaultTransport
+  if options.Tls != nil {
+    tlsConfig, err := loadTlsConfig(options.Tls, c.logger)
+    if err != nil {
+      return nil, err
+    }
+
+    tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+    tlsTransport.TLSClientConfig = tlsConfig
+    transport = tlsTransport
+    c.secure = true
+  }
+  header := http.Header{}
+  if options.Token != "" {
+    header.Set("Authorization", "Bearer " + options.Token)
+  }
+  if options.Namespace != "" {
+    header.Set(HEADER_NAMESPACE, options.Namespace)
+  }
+  if len(header) > 0 {
+    transport = &headerTransport{ header: header, next: transport }
+  }
+  c.httpClient.Transport = transport
+  return c, nil
+}
+
 // Construct Client instances.
 func MakeClient(serverUrl string) *Client {
   c := &Client {}
@@ -118,6 +715,10 @@ func MakeClient(serverUrl string) *Client {
   c.httpClient = &http.Client {}
   c.getUrl = fmt.Sprintf("%s/get", serverUrl)
   c.setUrl = fmt.Sprintf("%s/set", serverUrl)
+  c.snapshotUrl = fmt.Sprintf("%s/admin/snapshot", serverUrl)
+  c.keysUrl = fmt.Sprintf("%s/keys", serverUrl)
+  c.deleteUrl = fmt.Sprintf("%s/delete", serverUrl)
+  c.watchUrl = fmt.Sprintf("%s/watch", serverUrl)
 
   return c
 }
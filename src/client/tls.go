@@ -0,0 +1,42 @@
+package client
+
+import (
+  "crypto/tls"
+  "errors"
+  "buildbuddy.takehome.com/src/certs"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+// Configures TLS for `https://` server URLs. The files are PEM encoded.
+type TlsOptions struct {
+  // Optional; a bundle of CAs which sign the server's certificate. If unset,
+  // the system's CAs are trusted.
+  CaFile string
+  // Optional; a client certificate and its private key, presented to servers
+  // which require mutual TLS. They are reloaded when they change.
+  CertFile string
+  KeyFile string
+}
+
+// Build the client's TLS config from the options, logging reloads to `logger`.
+func loadTlsConfig(options *TlsOptions, logger *logging.Logger) (*tls.Config, error) {
+  if (options.CertFile == "") != (options.KeyFile == "") {
+    return nil, errors.New("A client certificate requires both CertFile and KeyFile")
+  }
+
+  var err error
+  var keyPair *certs.KeyPair
+  if options.CertFile != "" {
+    if keyPair, err = certs.LoadKeyPair(options.CertFile, options.KeyFile, logger); err != nil {
+      return nil, err
+    }
+  }
+
+  var rootCas *certs.CertPool
+  if options.CaFile != "" {
+    if rootCas, err = certs.LoadCertPool(options.CaFile, logger); err != nil {
+      return nil, err
+    }
+  }
+  return certs.ClientConfig(keyPair, rootCas), nil
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // The latest revision when a /watch stream starts, as `<epoch>-<revision>`.
+  HEADER_WATCH_REVISION = "X-Watch-Revision"
+
+  // How long to wait before reconnecting a dropped /watch stream.
+  WATCH_RETRY_INTERVAL = time.Second
+)
+
+var (
+  // Returned when resuming a watch from a revision the server no longer
+  // retains, e.g. after it restarted. Re-read the watched keys, then start
+  // a new watch.
+  ErrRevisionUnavailable = errors.New("Watch revision no longer available")
+)
+
+// A change to a key streamed by the /watch API.
+type WatchEvent struct {
+  // Identifies the server process which assigned the revision; revisions
+  // restart whenever the server does.
+  Epoch uint64 `json:"epoch"`
+  Revision uint64 `json:"revision"`
+  // One of "set", "delete" or "expire".
+  Type string `json:"type"`
+  Key string `json:"key"`
+  // The new value of a set event.
+  Value []byte `json:"value"`
+}
+
+// Optional parameters of a Watch call.
+type WatchOptions struct {
+  // Replay the changes after this revision before streaming new ones, e.g. to
+  // resume an earlier watch. If 0, only new changes are streamed.
+  Since uint64
+  // The epoch of the event `Since` was taken from. Revisions of other epochs,
+  // e.g. issued before the server restarted, end with ErrRevisionUnavailable.
+  Epoch uint64
+}
+
+// A running watch. Events arrive on the Events channel, which is closed when
+// the watch ends; Err then reports why. Create instances via Client.Watch.
+type Watcher struct {
+  events chan *WatchEvent
+  cancel context.CancelFunc
+  ctx context.Context
+  // Guards `err`.
+  mutex *sync.Mutex
+  err error
+}
+
+// The channel of events, closed when the watch ends.
+func (w *Watcher) Events() <-chan *WatchEvent {
+  return w.events
+}
+
+// Return why the watch ended, or nil if it was closed or is still running.
+func (w *Watcher) Err() error {
+  defer w.mutex.Unlock()
+  w.mutex.Lock()
+
+  return w.err
+}
+
+// Stop the watch. The Events channel is closed shortly after.
+func (w *Watcher) Close() {
+  w.cancel()
+}
+
+/**
+ * Invoke the /watch API, streaming changes to keys which begin with `prefix`.
+ * `options` may be nil. If the stream drops, the watcher reconnects and
+ * resumes from the last revision it received, so no change is missed; if the
+ * server no longer retains that revision, e.g. as it restarted, the watch
+ * ends with ErrRevisionUnavailable.
+ *
+ * <p> Events are delivered in order. Changes made through other servers,
+ * e.g. other cluster nodes or replicas, are not included.
+ */
+func (c *Client) Watch(prefix string, options *WatchOptions) (*Watcher, error) {
+  if c.ring != nil {
+    return nil, errors.New("Watches are per node; use a client for a single node.")
+  }
+
+  w := &Watcher{}
+  w.events = make(chan *WatchEvent, 64)
+  w.ctx, w.cancel = context.WithCancel(context.Background())
+  w.mutex = &sync.Mutex{}
+
+  var epoch, since uint64
+  resume := false
+  if options != nil && options.Since > 0 {
+    epoch, since, resume = options.Epoch, options.Since, true
+  }
+
+  // Connect synchronously, so that e.g. an unavailable revision is reported
+  // to the caller directly.
+  resp, err := c.connectWatch(w.ctx, prefix, epoch, since, resume)
+  if err != nil {
+    w.cancel()
+    return nil, err
+  }
+
+  go c.runWatch(w, prefix, resp)
+  return w, nil
+}
+
+/**
+ * Deliver events from the stream, reconnecting whenever it drops, until the
+ * watcher is closed or can no longer resume.
+ */
+func (c *Client) runWatch(w *Watcher, prefix string, resp *http.Response) {
+  defer close(w.events)
+  defer w.cancel()
+
+  // The stream's epoch and latest revision; the epoch stays the same until
+  // the server restarts, after which resuming fails.
+  var epoch, revision uint64
+  fields := strings.SplitN(resp.Header.Get(HEADER_WATCH_REVISION), "-", 2)
+  if len(fields) == 2 {
+    epoch, _ = strconv.ParseUint(fields[0], 10, 64)
+    revision, _ = strconv.ParseUint(fields[1], 10, 64)
+  }
+
+  for {
+    last, err := readEvents(w, resp.Body)
+    resp.Body.Close()
+    if last != nil && last.Revision > revision {
+      epoch, revision = last.Epoch, last.Revision
+    }
+    if w.ctx.Err() != nil {
+      return
+    }
+    if err != nil && err != io.EOF {
+      c.logger.Warn("Watch stream dropped; reconnecting", "prefix", prefix, "err", err)
+    }
+
+    // Reconnect, resuming after the last revision seen.
+    for {
+      select {
+      case <-w.ctx.Done():
+        return
+      case <-time.After(WATCH_RETRY_INTERVAL):
+      }
+
+      resp, err = c.connectWatch(w.ctx, prefix, epoch, revision, true)
+      if errors.Is(err, ErrRevisionUnavailable) {
+        w.mutex.Lock()
+        w.err = err
+        w.mutex.Unlock()
+        return
+      } else if err == nil {
+        break
+      }
+    }
+  }
+}
+
+// Open a /watch stream, optionally resuming after revision `since` of
+// `epoch`.
+func (c *Client) connectWatch(
+    ctx context.Context,
+    prefix string,
+    epoch uint64,
+    since uint64,
+    resume bool) (*http.Response, error) {
+  query := url.Values{}
+  query.Set("prefix", prefix)
+  if resume {
+    query.Set("since", fmt.Sprintf("%v-%v", epoch, since))
+  }
+
+  req, err := http.NewRequestWithContext(ctx, "GET", c.watchUrl + "?" + query.Encode(), nil)
+  if err != nil {
+    return nil, err
+  }
+
+  resp, err := c.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+
+  if resp.StatusCode == http.StatusGone {
+    resp.Body.Close()
+    return nil, fmt.Errorf("%w: %v", ErrRevisionUnavailable, since)
+  } else if resp.StatusCode != http.StatusOK {
+    resp.Body.Close()
+    return nil, httpError(resp.StatusCode,
+      fmt.Sprintf("HttpError %v from server", resp.StatusCode))
+  }
+  return resp, nil
+}
+
+/**
+ * Parse server-sent events from the stream onto the watcher's channel until
+ * the stream ends, returning the last event delivered, if any. Each event's
+ * data line holds the whole event as JSON; other fields are ignored.
+ */
+func readEvents(w *Watcher, body io.Reader) (*WatchEvent, error) {
+  var last *WatchEvent
+  var data []byte
+  reader := bufio.NewReader(body)
+  for {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+      return last, err
+    }
+
+    line = strings.TrimRight(line, "\r\n")
+    if strings.HasPrefix(line, "data:") {
+      data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+      continue
+    } else if line != "" || data == nil {
+      continue
+    }
+
+    // A blank line ends the event.
+    event := &WatchEvent{}
+    err = json.Unmarshal(data, event)
+    data = nil
+    if err != nil {
+      return last, err
+    }
+
+    select {
+    case w.events <- event:
+      last = event
+    case <-w.ctx.Done():
+      return last, w.ctx.Err()
+    }
+  }
+}
@@ -0,0 +1,661 @@
+package config
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // Environment variables override the config file, e.g.
+  // `BUILDBUDDY_ADDRESS=:8081` for `--address`.
+  ENV_PREFIX = "BUILDBUDDY_"
+  DEFAULT_ADDRESS = ":8080"
+  DEFAULT_CACHE_BYTES = 64 * 1024 * 1024
+  DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+  // The store directory of each storage engine, unless `--directory` is set.
+  DEFAULT_DIRECTORY = "/tmp/buildbuddy"
+  DEFAULT_LOG_DIRECTORY = "/tmp/buildbuddy-log"
+  DEFAULT_RAFT_DIRECTORY = "/tmp/buildbuddy-raft"
+  DEFAULT_OUTPUT = "table"
+  DEFAULT_LOG_LEVEL = "info"
+  // The REPL's history file, in the home directory.
+  DEFAULT_HISTORY_FILE = ".buildbuddy_history"
+)
+
+// A comma separated list, e.g. `localhost:8081,localhost:8082`; a JSON array
+// in config files.
+type List []string
+
+func (l *List) String() string {
+  return strings.Join(*l, ",")
+}
+
+func (l *List) Set(value string) error {
+  *l = nil
+  for _, item := range strings.Split(value, ",") {
+    if item = strings.TrimSpace(item); item != "" {
+      *l = append(*l, item)
+    }
+  }
+  return nil
+}
+
+// A duration such as `10s`, also in config files.
+type Duration time.Duration
+
+func (d *Duration) String() string {
+  return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(value string) error {
+  parsed, err := time.ParseDuration(value)
+  if err != nil {
+    return err
+  }
+  *d = Duration(parsed)
+  return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+  return json.Marshal(time.Duration(d).String())
+}
+
+// The configuration of the server and its REPL. Each field is set by the
+// flag, config file key and environment variable of the same name, e.g.
+// `--max_in_flight`, `max_in_flight` and `BUILDBUDDY_MAX_IN_FLIGHT`.
+// Create instances via Load or Default.
+type Config struct {
+  // The address to serve the HTTP API on, and the directory to store values
+  // in. Both must differ between servers running on the same machine.
+  Address string `json:"address"`
+  // If set, the admin routes and probes are served from this address
+  // instead, optionally only to local clients.
+  AdminAddress string `json:"admin_address"`
+  AdminLocalOnly bool `json:"admin_local_only"`
+  // Defaults to a directory per storage engine; see StoreDirectory.
+  Directory string `json:"directory"`
+  LogStructuredStorage bool `json:"log_structured_storage"`
+
+  EnableCaching bool `json:"enable_caching"`
+  CacheBytes int `json:"cache_bytes"`
+
+  EnableCompression bool `json:"enable_compression"`
+  EnableDeduplication bool `json:"enable_deduplication"`
+  EncryptionKeyfile string `json:"encryption_keyfile"`
+  MaxStoreBytes int64 `json:"max_store_bytes"`
+  MaxStoreFiles int `json:"max_store_files"`
+
+  // This node's name among replicas, cluster nodes or Raft nodes; defaults
+  // to its address.
+  NodeId string `json:"node_id"`
+  ReplicaPeers List `json:"replica_peers"`
+  WriteQuorum int `json:"write_quorum"`
+  ReadQuorum int `json:"read_quorum"`
+  ClusterNodes List `json:"cluster_nodes"`
+  RaftNodes List `json:"raft_nodes"`
+  // A file holding the secret shared by every node, which signs the
+  // requests they send each other.
+  PeerSecretFile string `json:"peer_secret_file"`
+
+  RespAddress string `json:"resp_address"`
+  RespMaxConnections int `json:"resp_max_connections"`
+  MemcacheAddress string `json:"memcache_address"`
+  MemcacheMaxConnections int `json:"memcache_max_connections"`
+
+  TlsCertFile string `json:"tls_cert_file"`
+  TlsKeyFile string `json:"tls_key_file"`
+  TlsClientCaFile string `json:"tls_client_ca_file"`
+  AuthConfig string `json:"auth_config"`
+  NamespacesConfig string `json:"namespaces_config"`
+  NamespacesDirectory string `json:"namespaces_directory"`
+
+  RateLimitConfig string `json:"rate_limit_config"`
+  RateLimitRps float64 `json:"rate_limit_rps"`
+  RateLimitBurst int `json:"rate_limit_burst"`
+  MaxInFlight int `json:"max_in_flight"`
+  MaxQueued int `json:"max_queued"`
+  ShutdownTimeout Duration `json:"shutdown_timeout"`
+  // The file `serve` writes its process ID to once it is ready.
+  PidFile string `json:"pid_file"`
+  // The minimum level and format of the server's log, written to stderr,
+  // and whether it records every request.
+  LogLevel string `json:"log_level"`
+  LogFormat string `json:"log_format"`
+  AccessLog bool `json:"access_log"`
+  // The file spans are appended to as JSON lines; tracing is off if unset.
+  TraceFile string `json:"trace_file"`
+
+  // The client options of the REPL and one-shot commands. The URL defaults
+  // to the local server at Address.
+  Url string `json:"url"`
+  TlsCaFile string `json:"tls_ca_file"`
+  TlsClientCertFile string `json:"tls_client_cert_file"`
+  TlsClientKeyFile string `json:"tls_client_key_file"`
+  AuthToken string `json:"auth_token"`
+  Namespace string `json:"namespace"`
+  // How long each get, set and delete may take, or 0 to wait indefinitely.
+  CallTimeout Duration `json:"call_timeout"`
+  // The REPL's output format, table, json or raw, and its history file.
+  Output string `json:"output"`
+  HistoryFile string `json:"history_file"`
+
+  // Set only by flags: the config file, and whether to print the effective
+  // config rather than serve.
+  ConfigFile string `json:"-"`
+  PrintConfig bool `json:"-"`
+}
+
+// Return the config used when nothing is configured.
+func Default() *Config {
+  c := &Config{}
+  c.Address = DEFAULT_ADDRESS
+  c.CacheBytes = DEFAULT_CACHE_BYTES
+  c.ShutdownTimeout = Duration(DEFAULT_SHUTDOWN_TIMEOUT)
+  c.Output = DEFAULT_OUTPUT
+  c.LogLevel = DEFAULT_LOG_LEVEL
+  c.LogFormat = logging.FORMAT_TEXT
+  c.AccessLog = true
+  return c
+}
+
+/**
+ * Return a flag set bound to the config's fields, each defaulting to the
+ * field's current value.
+ */
+func (c *Config) flagSet() *flag.FlagSet {
+  fs := flag.NewFlagSet("buildbuddy", flag.ContinueOnError)
+  fs.StringVar(&c.Address, "address", c.Address, "The address to serve the HTTP API on")
+  fs.StringVar(&c.AdminAddress, "admin_address", c.AdminAddress,
+    "Serve the admin routes, e.g. /admin/status, on this address rather than --address")
+  fs.BoolVar(&c.AdminLocalOnly, "admin_local_only", c.AdminLocalOnly,
+    "Serve the admin address only to clients on this machine")
+  fs.StringVar(&c.Directory, "directory", c.Directory,
+    "The directory to store values in (default " + DEFAULT_DIRECTORY + ", or " +
+    DEFAULT_LOG_DIRECTORY + " or " + DEFAULT_RAFT_DIRECTORY + " for those engines)")
+  fs.BoolVar(&c.LogStructuredStorage, "log_structured_storage", c.LogStructuredStorage,
+    "Store values in an append-only log rather than a file per key")
+
+  fs.BoolVar(&c.EnableCaching, "enable_caching", c.EnableCaching,
+    "Cache values in memory")
+  fs.IntVar(&c.CacheBytes, "cache_bytes", c.CacheBytes, "The cache's capacity, in bytes")
+
+  fs.BoolVar(&c.EnableCompression, "enable_compression", c.EnableCompression,
+    "Compress values which benefit from it")
+  fs.BoolVar(&c.EnableDeduplication, "enable_deduplication", c.EnableDeduplication,
+    "Store identical values once")
+  fs.StringVar(&c.EncryptionKeyfile, "encryption_keyfile", c.EncryptionKeyfile,
+    "Encrypt values with the keys in this file")
+  fs.Int64Var(&c.MaxStoreBytes, "max_store_bytes", c.MaxStoreBytes,
+    "Evict values beyond this many bytes; 0 is unlimited")
+  fs.IntVar(&c.MaxStoreFiles, "max_store_files", c.MaxStoreFiles,
+    "Evict values beyond this many files; 0 is unlimited")
+
+  fs.StringVar(&c.NodeId, "node_id", c.NodeId, "This node's name; defaults to its address, with the hostname when replicating")
+  fs.Var(&c.ReplicaPeers, "replica_peers", "Replicate values to these comma separated peers")
+  fs.IntVar(&c.WriteQuorum, "write_quorum", c.WriteQuorum,
+    "Replicas acknowledging a write; defaults to a majority")
+  fs.IntVar(&c.ReadQuorum, "read_quorum", c.ReadQuorum,
+    "Replicas answering a read; defaults to a majority")
+  fs.Var(&c.ClusterNodes, "cluster_nodes", "Partition keys between these comma separated nodes")
+  fs.Var(&c.RaftNodes, "raft_nodes", "Replicate writes via Raft across these comma separated nodes")
+  fs.StringVar(&c.PeerSecretFile, "peer_secret_file", c.PeerSecretFile,
+    "Sign requests between nodes with the secret in this file, shared by every node")
+
+  fs.StringVar(&c.RespAddress, "resp_address", c.RespAddress,
+    "Also serve the Redis protocol on this address")
+  fs.IntVar(&c.RespMaxConnections, "resp_max_connections", c.RespMaxConnections,
+    "The most RESP connections at once; 0 selects the default")
+  fs.StringVar(&c.MemcacheAddress, "memcache_address", c.MemcacheAddress,
+    "Also serve the memcached text protocol on this address")
+  fs.IntVar(&c.MemcacheMaxConnections, "memcache_max_connections", c.MemcacheMaxConnections,
+    "The most memcached connections at once; 0 selects the default")
+
+  fs.StringVar(&c.TlsCertFile, "tls_cert_file", c.TlsCertFile,
+    "Serve the HTTP API over TLS with this certificate")
+  fs.StringVar(&c.TlsKeyFile, "tls_key_file", c.TlsKeyFile, "The TLS certificate's key")
+  fs.StringVar(&c.TlsClientCaFile, "tls_client_ca_file", c.TlsClientCaFile,
+    "Require client certificates signed by these CAs")
+  fs.StringVar(&c.AuthConfig, "auth_config", c.AuthConfig,
+    "Require tokens from this auth config file")
+  fs.StringVar(&c.NamespacesConfig, "namespaces_config", c.NamespacesConfig,
+    "Serve the namespaces in this config file")
+  fs.StringVar(&c.NamespacesDirectory, "namespaces_directory", c.NamespacesDirectory,
+    "The directory of the namespaces' stores; defaults to the directory suffixed -namespaces")
+
+  fs.StringVar(&c.RateLimitConfig, "rate_limit_config", c.RateLimitConfig,
+    "Load rate limits from this file, which the flags below override")
+  fs.Float64Var(&c.RateLimitRps, "rate_limit_rps", c.RateLimitRps,
+    "Requests per second per client; 0 is unlimited")
+  fs.IntVar(&c.RateLimitBurst, "rate_limit_burst", c.RateLimitBurst,
+    "Requests per client at once after being idle")
+  fs.IntVar(&c.MaxInFlight, "max_in_flight", c.MaxInFlight,
+    "API calls served at once; 0 is unlimited")
+  fs.IntVar(&c.MaxQueued, "max_queued", c.MaxQueued,
+    "API calls queued beyond max_in_flight")
+  fs.Var(&c.ShutdownTimeout, "shutdown_timeout",
+    "How long shutdown waits for API calls in flight")
+  fs.StringVar(&c.PidFile, "pid_file", c.PidFile,
+    "Write the process ID to this file once serving")
+  fs.StringVar(&c.LogLevel, "log_level", c.LogLevel,
+    "The minimum level logged: debug, info, warn or error")
+  fs.StringVar(&c.LogFormat, "log_format", c.LogFormat,
+    "The format of log entries: text (key=value) or json")
+  fs.BoolVar(&c.AccessLog, "access_log", c.AccessLog,
+    "Log every request served, with its status, latency and sizes")
+  fs.StringVar(&c.TraceFile, "trace_file", c.TraceFile,
+    "Append a trace span of each request and store operation to this file")
+
+  fs.StringVar(&c.Url, "url", c.Url,
+    "The server the REPL and one-shot commands call; defaults to the local server")
+
+  fs.StringVar(&c.TlsCaFile, "tls_ca_file", c.TlsCaFile,
+    "The CAs the REPL, and with TLS nodes calling each other, trust")
+  fs.StringVar(&c.TlsClientCertFile, "tls_client_cert_file", c.TlsClientCertFile,
+    "The certificate the REPL, and with TLS nodes calling each other, present")
+  fs.StringVar(&c.TlsClientKeyFile, "tls_client_key_file", c.TlsClientKeyFile,
+    "The key of the certificate the REPL presents")
+  fs.StringVar(&c.AuthToken, "auth_token", c.AuthToken, "The token the REPL sends")
+  fs.StringVar(&c.Namespace, "namespace", c.Namespace, "The namespace the REPL uses")
+  fs.Var(&c.CallTimeout, "call_timeout",
+    "How long each REPL get, set and delete may take; 0 waits indefinitely")
+  fs.StringVar(&c.Output, "output", c.Output,
+    "The format of the REPL's results: table, json or raw")
+  fs.StringVar(&c.HistoryFile, "history_file", c.HistoryFile,
+    "The REPL's history file; defaults to ~/" + DEFAULT_HISTORY_FILE)
+
+  fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Load options from this JSON or YAML file")
+  fs.BoolVar(&c.PrintConfig, "print_config", c.PrintConfig,
+    "Print the effective config as JSON, and exit")
+  return fs
+}
+
+/**
+ * Load the config from `args`, e.g. os.Args[1:], the environment, via
+ * `getenv`, and the config file named by `--config` or BUILDBUDDY_CONFIG.
+ * Flags override the environment, which overrides the file, which
+ * overrides the defaults. Returns an error for unknown options, malformed
+ * values, and invalid combinations of options.
+ */
+func Load(args []string, getenv func(string) string) (*Config, error) {
+  c, positional, err := LoadWithArgs(args, getenv)
+  if err != nil {
+    return nil, err
+  }
+  if len(positional) > 0 {
+    return nil, errors.New(fmt.Sprintf("Unexpected argument %q", positional[0]))
+  }
+  return c, nil
+}
+
+/**
+ * Load the config as Load does, from the flags leading `args`, also
+ * returning the arguments after them, e.g. `[key value]` for
+ * `--url=http://localhost:8081 key value`.
+ */
+func LoadWithArgs(args []string, getenv func(string) string) (*Config, []string, error) {
+  // Parse the flags first, to find the config file and fail fast.
+  parsed := Default()
+  fs := parsed.flagSet()
+  if err := fs.Parse(args); err != nil {
+    return nil, nil, err
+  }
+  positional := fs.Args()
+  flags := make(map[string]string)
+  fs.Visit(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+
+  c := Default()
+  fs = c.flagSet()
+  configFile := getenv(ENV_PREFIX + "CONFIG")
+  if path, ok := flags["config"]; ok {
+    configFile = path
+  }
+  if configFile != "" {
+    if err := loadFile(fs, configFile); err != nil {
+      return nil, nil, fmt.Errorf("Invalid config file %v: %w", configFile, err)
+    }
+  }
+
+  var err error
+  fs.VisitAll(func(f *flag.Flag) {
+    value := getenv(envName(f.Name))
+    if value == "" || err != nil {
+      return
+    }
+    if setErr := fs.Set(f.Name, value); setErr != nil {
+      err = fmt.Errorf("Invalid %v: %w", envName(f.Name), setErr)
+    }
+  })
+  if err != nil {
+    return nil, nil, err
+  }
+
+  for name, value := range flags {
+    if err := fs.Set(name, value); err != nil {
+      return nil, nil, fmt.Errorf("Invalid --%v: %w", name, err)
+    }
+  }
+  c.ConfigFile = configFile
+
+  if err := c.Validate(); err != nil {
+    return nil, nil, err
+  }
+  return c, positional, nil
+}
+
+// Return the environment variable overriding an option, e.g.
+// BUILDBUDDY_MAX_IN_FLIGHT.
+func envName(option string) string {
+  return ENV_PREFIX + strings.ToUpper(option)
+}
+
+/**
+ * Set the options in a config file: a JSON object, or for `.yaml` and `.yml`
+ * files, flat `key: value` YAML, e.g.
+ *   address: ":8081"
+ *   cluster_nodes: [ "localhost:8081", "localhost:8082" ]
+ */
+func loadFile(fs *flag.FlagSet, path string) error {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return err
+  }
+
+  var values map[string]string
+  extension := strings.ToLower(filepath.Ext(path))
+  if extension == ".yaml" || extension == ".yml" {
+    values, err = parseYaml(data)
+  } else {
+    values, err = parseJson(data)
+  }
+  if err != nil {
+    return err
+  }
+
+  for key, value := range values {
+    if fs.Lookup(key) == nil || key == "config" {
+      return errors.New(fmt.Sprintf("Unknown option %q", key))
+    }
+    if err := fs.Set(key, value); err != nil {
+      return fmt.Errorf("Invalid %v: %w", key, err)
+    }
+  }
+  return nil
+}
+
+// Flatten a JSON object's values into their flag syntax.
+func parseJson(data []byte) (map[string]string, error) {
+  var raw map[string]json.RawMessage
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  if err := decoder.Decode(&raw); err != nil {
+    return nil, err
+  }
+
+  values := make(map[string]string)
+  for key, message := range raw {
+    var text string
+    var list []string
+    if json.Unmarshal(message, &text) == nil {
+      values[key] = text
+    } else if json.Unmarshal(message, &list) == nil {
+      values[key] = strings.Join(list, ",")
+    } else if message[0] == '{' || message[0] == '[' {
+      return nil, errors.New(fmt.Sprintf("Option %q must be a scalar or list of strings", key))
+    } else {
+      // A number or boolean, in the syntax its flag parses.
+      values[key] = string(message)
+    }
+  }
+  return values, nil
+}
+
+// Parse flat YAML: `key: value` lines, where values may be quoted or inline
+// lists, and `#` starts a comment.
+func parseYaml(data []byte) (map[string]string, error) {
+  values := make(map[string]string)
+  scanner := bufio.NewScanner(bytes.NewReader(data))
+  for lineNumber := 1; scanner.Scan(); lineNumber++ {
+    line := stripYamlComment(scanner.Text())
+    if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+      continue
+    }
+    if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(line, "- ") {
+      return nil, errors.New(fmt.Sprintf(
+        "Line %v: only flat `key: value` YAML is supported", lineNumber))
+    }
+
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      return nil, errors.New(fmt.Sprintf("Line %v: expected `key: value`", lineNumber))
+    }
+    key := strings.TrimSpace(line[:colon])
+    value := strings.TrimSpace(line[colon + 1:])
+    if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+      var items []string
+      for _, item := range strings.Split(value[1:len(value) - 1], ",") {
+        if item = unquoteYaml(strings.TrimSpace(item)); item != "" {
+          items = append(items, item)
+        }
+      }
+      value = strings.Join(items, ",")
+    } else {
+      value = unquoteYaml(value)
+    }
+    values[key] = value
+  }
+  return values, scanner.Err()
+}
+
+// Remove a trailing `# comment`, unless the `#` is quoted.
+func stripYamlComment(line string) string {
+  var quote rune
+  for i, r := range line {
+    switch {
+    case quote != 0 && r == quote:
+      quote = 0
+    case quote == 0 && (r == '"' || r == '\''):
+      quote = r
+    case quote == 0 && r == '#' && (i == 0 || line[i - 1] == ' ' || line[i - 1] == '\t'):
+      return strings.TrimRight(line[:i], " \t")
+    }
+  }
+  return strings.TrimRight(line, " \t")
+}
+
+func unquoteYaml(value string) string {
+  if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value) - 1] == value[0] {
+    return value[1:len(value) - 1]
+  }
+  return value
+}
+
+/**
+ * Return an error describing every invalid option or combination of
+ * options, or nil if the config is valid.
+ */
+func (c *Config) Validate() error {
+  var problems []string
+  problem := func(format string, args ...interface{}) {
+    problems = append(problems, fmt.Sprintf(format, args...))
+  }
+
+  if c.Address == "" {
+    problem("address must be set")
+  }
+  if c.AdminLocalOnly && c.AdminAddress == "" {
+    problem("admin_local_only requires admin_address")
+  }
+  counts := map[string]int64{
+    "cache_bytes": int64(c.CacheBytes),
+    "max_store_bytes": c.MaxStoreBytes,
+    "max_store_files": int64(c.MaxStoreFiles),
+    "write_quorum": int64(c.WriteQuorum),
+    "read_quorum": int64(c.ReadQuorum),
+    "resp_max_connections": int64(c.RespMaxConnections),
+    "memcache_max_connections": int64(c.MemcacheMaxConnections),
+    "rate_limit_burst": int64(c.RateLimitBurst),
+    "max_in_flight": int64(c.MaxInFlight),
+    "max_queued": int64(c.MaxQueued),
+  }
+  for name, count := range counts {
+    if count < 0 {
+      problem("%v must not be negative", name)
+    }
+  }
+  if c.RateLimitRps < 0 || c.ShutdownTimeout < 0 || c.CallTimeout < 0 {
+    problem("rate_limit_rps, shutdown_timeout and call_timeout must not be negative")
+  }
+  if c.Output != "table" && c.Output != "json" && c.Output != "raw" {
+    problem("output must be table, json or raw")
+  }
+  if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+    problem("log_level must be debug, info, warn or error")
+  }
+  if c.LogFormat != logging.FORMAT_TEXT && c.LogFormat != logging.FORMAT_JSON {
+    problem("log_format must be text or json")
+  }
+  if c.EnableCaching && c.CacheBytes == 0 {
+    problem("enable_caching requires a cache_bytes above 0")
+  }
+
+  replicated := len(c.ReplicaPeers) > 0
+  clustered := len(c.ClusterNodes) > 0
+  raftEnabled := len(c.RaftNodes) > 0
+  if c.LogStructuredStorage &&
+      (c.EnableCompression || c.EnableDeduplication || c.EncryptionKeyfile != "") {
+    problem("Compression, deduplication and encryption require the filestore")
+  }
+  if c.LogStructuredStorage && raftEnabled {
+    problem("Raft cannot be combined with log structured storage")
+  }
+  if raftEnabled && (replicated || clustered || c.EnableCaching) {
+    problem("Raft cannot be combined with replication, cluster mode or caching")
+  }
+  if raftEnabled && (c.MaxStoreBytes > 0 || c.MaxStoreFiles > 0) {
+    // Each node would evict by its own access order, outside the log.
+    problem("Raft cannot be combined with max_store_bytes or max_store_files")
+  }
+  if replicated && c.EnableCaching {
+    // A cache would serve values overwritten via another peer.
+    problem("Caching cannot be combined with replication")
+  }
+  if clustered && replicated {
+    problem("Cluster mode cannot be combined with replication")
+  }
+  if clustered && c.PeerSecretFile == "" {
+    // Otherwise nodes cannot tell requests forwarded by other nodes from
+    // clients posing as them.
+    problem("Cluster mode requires peer_secret_file")
+  }
+  if raftEnabled && c.PeerSecretFile == "" {
+    // Otherwise clients could make followers serve requests locally.
+    problem("Raft requires peer_secret_file")
+  }
+  if clustered && (c.RespAddress != "" || c.MemcacheAddress != "") {
+    // The listeners serve every key from the local store, bypassing the ring.
+    problem("Cluster mode cannot be combined with the RESP or memcached listeners")
+  }
+  if c.TlsCertFile != "" || c.TlsKeyFile != "" {
+    if c.TlsCertFile == "" || c.TlsKeyFile == "" {
+      problem("tls_cert_file and tls_key_file must be set together")
+    }
+  } else if c.TlsClientCaFile != "" {
+    problem("tls_client_ca_file requires tls_cert_file")
+  }
+  if c.AuthConfig != "" && replicated && c.PeerSecretFile == "" {
+    // Replicas do not present tokens, but sign their calls with the secret.
+    problem("Auth with replication requires peer_secret_file")
+  }
+  if c.NamespacesConfig != "" &&
+      (c.LogStructuredStorage || replicated || clustered || raftEnabled) {
+    // Namespaces are FileStores local to this server.
+    problem("Namespaces cannot be combined with log structured storage, replication, " +
+      "cluster mode or Raft")
+  }
+
+  if len(problems) > 0 {
+    sort.Strings(problems)
+    return errors.New("Invalid config: " + strings.Join(problems, "; "))
+  }
+  return nil
+}
+
+// Return the directory to store values in: `directory` if set, otherwise
+// the storage engine's default.
+func (c *Config) StoreDirectory() string {
+  switch {
+  case c.Directory != "":
+    return c.Directory
+  case c.LogStructuredStorage:
+    return DEFAULT_LOG_DIRECTORY
+  case len(c.RaftNodes) > 0:
+    return DEFAULT_RAFT_DIRECTORY
+  }
+  return DEFAULT_DIRECTORY
+}
+
+// Return this node's name among its peers: `node_id` if set, otherwise its
+// address, e.g. `localhost:8081` for `:8081`.
+func (c *Config) NodeName() string {
+  if c.NodeId != "" {
+    return c.NodeId
+  }
+  if strings.HasPrefix(c.Address, ":") {
+    return "localhost" + c.Address
+  }
+  return c.Address
+}
+
+// Return this node's ID among its replication peers: `node_id` if set,
+// otherwise its address, with the machine's hostname in place of a missing or
+// loopback host, e.g. `build-3:8080` for `:8080`. Unlike the bare address,
+// the default differs between nodes on different hosts.
+func (c *Config) ReplicaNodeId() string {
+  if c.NodeId != "" {
+    return c.NodeId
+  }
+  host, port, err := net.SplitHostPort(c.Address)
+  if err != nil {
+    return c.Address
+  }
+  ip := net.ParseIP(host)
+  if host == "" || host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+    if hostname, err := os.Hostname(); err == nil {
+      host = hostname
+    }
+  }
+  return net.JoinHostPort(host, port)
+}
+
+// Return a copy of the config to report, with defaults resolved and the
+// REPL's token redacted.
+func (c *Config) Redacted() *Config {
+  redacted := *c
+  redacted.Directory = c.StoreDirectory()
+  if redacted.AuthToken != "" {
+    redacted.AuthToken = "<redacted>"
+  }
+  return &redacted
+}
+
+// Write the effective config as JSON, e.g. for `--print_config`; see
+// Redacted.
+func (c *Config) Write(w io.Writer) error {
+  encoded, err := json.MarshalIndent(c.Redacted(), "", "  ")
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Fprintln(w, string(encoded))
+  return err
+}
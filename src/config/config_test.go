@@ -0,0 +1,189 @@
+package config
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Write a config file into a temporary directory, returning its path.
+func writeConfigFile(t *testing.T, name string, contents string) string {
+  path := filepath.Join(t.TempDir(), name)
+  if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+    t.Fatalf("Error writing config file: %v", err)
+  }
+  return path
+}
+
+// Return a getenv reading `env` rather than the process' environment.
+func fakeEnv(env map[string]string) func(string) string {
+  return func(name string) string { return env[name] }
+}
+
+func TestLoadDefaults(t *testing.T) {
+  c, err := Load(nil, fakeEnv(nil))
+  if err != nil {
+    t.Fatalf("Error loading config: %v", err)
+  }
+  if c.Address != DEFAULT_ADDRESS || c.CacheBytes != DEFAULT_CACHE_BYTES ||
+      time.Duration(c.ShutdownTimeout) != DEFAULT_SHUTDOWN_TIMEOUT {
+    t.Errorf("Expected the defaults, got %+v", c)
+  }
+  if c.StoreDirectory() != DEFAULT_DIRECTORY {
+    t.Errorf("Expected the filestore's default directory, got %v", c.StoreDirectory())
+  }
+}
+
+func TestLoadFlagsOverrideEnvOverrideFile(t *testing.T) {
+  path := writeConfigFile(t, "config.json", `{
+    "address": ":8081",
+    "directory": "/tmp/file",
+    "cache_bytes": 1024,
+    "enable_caching": true,
+    "cluster_nodes": [ "localhost:8081", "localhost:8082" ],
+    "peer_secret_file": "/etc/buildbuddy/peer_secret"
+  }`)
+  env := map[string]string{
+    "BUILDBUDDY_CONFIG": path,
+    "BUILDBUDDY_DIRECTORY": "/tmp/env",
+    "BUILDBUDDY_CACHE_BYTES": "2048",
+  }
+
+  c, err := Load([]string{ "--cache_bytes=4096" }, fakeEnv(env))
+  if err != nil {
+    t.Fatalf("Error loading config: %v", err)
+  }
+  if c.Address != ":8081" || !c.EnableCaching {
+    t.Errorf("Expected the file's options, got %+v", c)
+  }
+  if c.Directory != "/tmp/env" {
+    t.Errorf("Expected the environment to override the file, got %v", c.Directory)
+  }
+  if c.CacheBytes != 4096 {
+    t.Errorf("Expected the flag to override the environment, got %v", c.CacheBytes)
+  }
+  if strings.Join(c.ClusterNodes, ",") != "localhost:8081,localhost:8082" {
+    t.Errorf("Expected the file's list, got %v", c.ClusterNodes)
+  }
+  if c.ConfigFile != path {
+    t.Errorf("Expected the config file to be recorded, got %v", c.ConfigFile)
+  }
+}
+
+func TestLoadYaml(t *testing.T) {
+  path := writeConfigFile(t, "config.yaml", `# A replica.
+address: "localhost:8082"  # quoted, as it contains a colon
+replica_peers: [ localhost:8081, "localhost:8083" ]
+write_quorum: 2
+shutdown_timeout: 5s
+auth_token: 'a#b'
+`)
+
+  c, err := Load([]string{ "--config", path }, fakeEnv(nil))
+  if err != nil {
+    t.Fatalf("Error loading config: %v", err)
+  }
+  if c.Address != "localhost:8082" || c.WriteQuorum != 2 || c.AuthToken != "a#b" {
+    t.Errorf("Expected the file's options, got %+v", c)
+  }
+  if strings.Join(c.ReplicaPeers, ",") != "localhost:8081,localhost:8083" {
+    t.Errorf("Expected the inline list, got %v", c.ReplicaPeers)
+  }
+  if time.Duration(c.ShutdownTimeout) != 5 * time.Second {
+    t.Errorf("Expected a 5s shutdown timeout, got %v", c.ShutdownTimeout)
+  }
+  if c.NodeName() != "localhost:8082" {
+    t.Errorf("Expected the node to be named by its address, got %v", c.NodeName())
+  }
+}
+
+func TestLoadRejectsInvalidOptions(t *testing.T) {
+  unknownKey := writeConfigFile(t, "config.json", `{ "adress": ":8081" }`)
+  nested := writeConfigFile(t, "config.yml", "tls:\n  cert_file: cert.pem\n")
+  for _, testCase := range []struct {
+    args []string
+    env map[string]string
+    expected string
+  }{
+    { []string{ "--config=" + unknownKey }, nil, "Unknown option" },
+    { []string{ "--config=" + nested }, nil, "only flat" },
+    { []string{ "serve" }, nil, "Unexpected argument" },
+    { nil, map[string]string{ "BUILDBUDDY_CACHE_BYTES": "lots" }, "BUILDBUDDY_CACHE_BYTES" },
+    { []string{ "--enable_caching", "--cache_bytes=0" }, nil, "cache_bytes" },
+    { []string{ "--tls_cert_file=cert.pem" }, nil, "tls_key_file" },
+    {
+      []string{ "--cluster_nodes=localhost:8080,b:8080", "--memcache_address=:11211" },
+      nil,
+      "Cluster mode cannot be combined with the RESP or memcached listeners",
+    },
+    {
+      []string{ "--cluster_nodes=localhost:8080,b:8080" },
+      nil,
+      "Cluster mode requires peer_secret_file",
+    },
+    { []string{ "--raft_nodes=localhost:8080,b:8080" }, nil, "Raft requires peer_secret_file" },
+    {
+      []string{ "--replica_peers=b:8080", "--auth_config=auth.json" },
+      nil,
+      "Auth with replication requires peer_secret_file",
+    },
+    {
+      []string{ "--log_structured_storage", "--enable_compression", "--raft_nodes=a,b" },
+      nil,
+      "Compression, deduplication and encryption require the filestore",
+    },
+    {
+      []string{ "--raft_nodes=a,b", "--max_store_files=100" },
+      nil,
+      "Raft cannot be combined with max_store_bytes or max_store_files",
+    },
+  } {
+    _, err := Load(testCase.args, fakeEnv(testCase.env))
+    if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+      t.Errorf("Expected %v %v to fail with %q, got %v",
+        testCase.args, testCase.env, testCase.expected, err)
+    }
+  }
+}
+
+func TestReplicaNodeIdDefaultsToTheHostname(t *testing.T) {
+  hostname, err := os.Hostname()
+  if err != nil {
+    t.Skipf("No hostname: %v", err)
+  }
+  cases := map[string]string{
+    ":8080": hostname + ":8080",
+    "localhost:8081": hostname + ":8081",
+    "0.0.0.0:8082": hostname + ":8082",
+    "10.0.0.7:8080": "10.0.0.7:8080",
+  }
+  for address, expected := range cases {
+    c := &Config{ Address: address }
+    if id := c.ReplicaNodeId(); id != expected {
+      t.Errorf("Expected node ID %v for %v, got %v", expected, address, id)
+    }
+  }
+  if id := (&Config{ Address: ":8080", NodeId: "node-a" }).ReplicaNodeId(); id != "node-a" {
+    t.Errorf("Expected node_id to take precedence, got %v", id)
+  }
+}
+
+func TestWriteRedactsToken(t *testing.T) {
+  c := Default()
+  c.AuthToken = "secret"
+  c.RaftNodes = List{ "a", "b" }
+
+  var output strings.Builder
+  if err := c.Write(&output); err != nil {
+    t.Fatalf("Error writing config: %v", err)
+  }
+  if strings.Contains(output.String(), `"secret"`) {
+    t.Errorf("Expected the token to be redacted, got %v", output.String())
+  }
+  if !strings.Contains(output.String(), DEFAULT_RAFT_DIRECTORY) ||
+      !strings.Contains(output.String(), `"shutdown_timeout": "30s"`) {
+    t.Errorf("Expected the resolved directory and timeout, got %v", output.String())
+  }
+}
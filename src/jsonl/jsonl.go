@@ -0,0 +1,387 @@
+package jsonl
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "time"
+  "unicode/utf8"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  // How often the progress callback is invoked, in records.
+  PROGRESS_INTERVAL_RECORDS = 1000
+
+  // The encoding of values which are not valid UTF-8, which JSON strings
+  // cannot hold byte for byte.
+  ENCODING_BASE64 = "base64"
+)
+
+// A single line of a JSON Lines file, e.g.
+// { "key": "a key", "value": "a value", "ttl": 60, "metadata": { "a": "b" } }
+type Record struct {
+  Key string `json:"key"`
+  Value string `json:"value"`
+  // How Value is written in the file: empty for UTF-8 text, or
+  // ENCODING_BASE64. Sinks and sources always see the decoded value.
+  Encoding string `json:"encoding,omitempty"`
+  // The number of seconds until the value expires, or 0 if it never expires.
+  Ttl int64 `json:"ttl,omitempty"`
+  // Arbitrary metadata stored alongside the value.
+  Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// A failure to import or export a single record.
+type RecordError struct {
+  // The 1-indexed line of the record within the file.
+  Line int
+  // The record's key, if known.
+  Key string
+  Err error
+}
+
+func (e *RecordError) Error() string {
+  return fmt.Sprintf("line %v (key %q): %v", e.Line, e.Key, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+  return e.Err
+}
+
+// The outcome of an import or export.
+type Report struct {
+  // The number of records successfully imported or exported.
+  Records int
+  // The number of records which failed; see Errors.
+  Failed int
+  // The number of bytes of JSON Lines read or written.
+  Bytes int64
+  // How long the import or export has run.
+  Duration time.Duration
+  Errors []*RecordError
+}
+
+// The number of records imported or exported per second.
+func (r *Report) RecordsPerSecond() float64 {
+  if r.Duration <= 0 {
+    return 0
+  }
+  return float64(r.Records) / r.Duration.Seconds()
+}
+
+// The number of bytes read or written per second.
+func (r *Report) BytesPerSecond() float64 {
+  if r.Duration <= 0 {
+    return 0
+  }
+  return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+func (r *Report) String() string {
+  return fmt.Sprintf("%v records (%v failed), %v bytes in %v (%.1f records/s, %.1f bytes/s)",
+    r.Records, r.Failed, r.Bytes, r.Duration.Round(time.Millisecond),
+    r.RecordsPerSecond(), r.BytesPerSecond())
+}
+
+// Invoked periodically with the report so far.
+type ProgressFunc func(report *Report)
+
+// The destination of an import.
+type Sink interface {
+  /**
+   * Store the record, converting its relative TTL into an expiry.
+   */
+  Put(record *Record) error
+}
+
+// The origin of an export.
+type Source interface {
+  /**
+   * Return every key to export.
+   */
+  Keys() ([]string, error)
+
+  /**
+   * Return the record for a key, with its remaining TTL. Returns an error
+   * wrapping os.ErrNotExist if the key was removed or expired after it was
+   * listed.
+   */
+  Get(key string) (*Record, error)
+}
+
+/**
+ * Import every record in `r` into `sink`. Malformed records and failed writes
+ * are reported per record, and do not stop the import; only a failure to read
+ * `r` is returned as an error. `progress` may be nil.
+ */
+func Import(r io.Reader, sink Sink, progress ProgressFunc) (*Report, error) {
+  start := time.Now()
+  report := &Report{}
+  reader := bufio.NewReader(r)
+
+  for line := 1; ; line++ {
+    // Values may be arbitrarily large, so read whole lines rather than using
+    // a bufio.Scanner with its fixed maximum token size.
+    bytesRead, readErr := reader.ReadBytes('\n')
+    if readErr != nil && readErr != io.EOF {
+      report.Duration = time.Since(start)
+      return report, readErr
+    }
+    report.Bytes += int64(len(bytesRead))
+
+    if trimmed := bytes.TrimSpace(bytesRead); len(trimmed) > 0 {
+      if err := importRecord(trimmed, sink); err != nil {
+        err.Line = line
+        report.Failed++
+        report.Errors = append(report.Errors, err)
+      } else {
+        report.Records++
+      }
+
+      if progress != nil &&
+          (report.Records + report.Failed) % PROGRESS_INTERVAL_RECORDS == 0 {
+        report.Duration = time.Since(start)
+        progress(report)
+      }
+    }
+
+    if readErr == io.EOF {
+      break
+    }
+  }
+
+  report.Duration = time.Since(start)
+  return report, nil
+}
+
+// Parse and store a single record. The returned error's line is unset.
+func importRecord(line []byte, sink Sink) *RecordError {
+  var record Record
+  if err := json.Unmarshal(line, &record); err != nil {
+    return &RecordError{ Err: err }
+  }
+
+  if record.Key == "" {
+    return &RecordError{ Err: errors.New("Missing key") }
+  }
+  switch record.Encoding {
+  case "":
+  case ENCODING_BASE64:
+    value, err := base64.StdEncoding.DecodeString(record.Value)
+    if err != nil {
+      return &RecordError{ Key: record.Key, Err: err }
+    }
+    record.Value = string(value)
+    record.Encoding = ""
+  default:
+    return &RecordError{
+      Key: record.Key,
+      Err: errors.New(fmt.Sprintf("Unknown encoding %q", record.Encoding)),
+    }
+  }
+  if record.Ttl < 0 {
+    return &RecordError{ Key: record.Key, Err: errors.New("Negative TTL") }
+  }
+
+  if err := sink.Put(&record); err != nil {
+    return &RecordError{ Key: record.Key, Err: err }
+  }
+  return nil
+}
+
+/**
+ * Export every key in `source` to `w`, one record per line. Keys which expire
+ * or are removed during the export are skipped; other failures to read a key
+ * are reported per record. Only a failure to list keys or write to `w` is
+ * returned as an error. `progress` may be nil.
+ */
+func Export(source Source, w io.Writer, progress ProgressFunc) (*Report, error) {
+  start := time.Now()
+  report := &Report{}
+
+  keys, err := source.Keys()
+  if err != nil {
+    return report, err
+  }
+
+  writer := bufio.NewWriter(w)
+  for i, key := range keys {
+    record, err := source.Get(key)
+    if errors.Is(err, os.ErrNotExist) {
+      continue
+    } else if err != nil {
+      report.Failed++
+      report.Errors = append(report.Errors,
+        &RecordError{ Line: report.Records + 1, Key: key, Err: err })
+    } else {
+      if !utf8.ValidString(record.Value) {
+        // Marshalling would replace the invalid bytes.
+        record.Value = base64.StdEncoding.EncodeToString([]byte(record.Value))
+        record.Encoding = ENCODING_BASE64
+      }
+      line, err := json.Marshal(record)
+      if err != nil {
+        report.Duration = time.Since(start)
+        return report, err
+      }
+      line = append(line, '\n')
+      if _, err := writer.Write(line); err != nil {
+        report.Duration = time.Since(start)
+        return report, err
+      }
+      report.Records++
+      report.Bytes += int64(len(line))
+    }
+
+    if progress != nil && (i + 1) % PROGRESS_INTERVAL_RECORDS == 0 {
+      report.Duration = time.Since(start)
+      progress(report)
+    }
+  }
+
+  err = writer.Flush()
+  report.Duration = time.Since(start)
+  return report, err
+}
+
+// Return the whole seconds remaining until `expiresAt`, rounded up, or 0 if
+// the value never expires.
+func remainingTtl(expiresAt time.Time) int64 {
+  if expiresAt.IsZero() {
+    return 0
+  }
+  remaining := time.Until(expiresAt)
+  if remaining <= 0 {
+    // The value expired after it was read; keep the shortest TTL rather
+    // than exporting it as permanent.
+    return 1
+  }
+  return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// Imports into, and exports from, a KeyValueStore such as a FileStore.
+type storeAdapter struct {
+  kvStore store.KeyValueStore
+}
+
+/**
+ * Adapt a store for importing. Records with a TTL or metadata are rejected
+ * unless the store supports attributes.
+ */
+func MakeStoreSink(kvStore store.KeyValueStore) Sink {
+  return &storeAdapter{ kvStore: kvStore }
+}
+
+/**
+ * Adapt a store for exporting. The store must be able to list its keys.
+ */
+func MakeStoreSource(kvStore store.KeyValueStore) (Source, error) {
+  if _, ok := kvStore.(store.KeyLister); !ok {
+    return nil, errors.New("Store cannot list its keys")
+  }
+  return &storeAdapter{ kvStore: kvStore }, nil
+}
+
+func (s *storeAdapter) Put(record *Record) error {
+  attributes := &store.Attributes{ Metadata: record.Metadata }
+  if record.Ttl > 0 {
+    attributes.ExpiresAt = time.Now().Add(time.Duration(record.Ttl) * time.Second)
+  }
+
+  if attributes.IsEmpty() {
+    return s.kvStore.Set(context.Background(), store.Key(record.Key), store.Value(record.Value))
+  }
+
+  attributeStore, ok := s.kvStore.(store.AttributeKeyValueStore)
+  if !ok {
+    return errors.New("Store does not support a TTL or metadata")
+  }
+  return attributeStore.SetWithAttributes(
+    context.Background(), store.Key(record.Key), store.Value(record.Value), attributes)
+}
+
+func (s *storeAdapter) Keys() ([]string, error) {
+  keys, err := s.kvStore.(store.KeyLister).Keys(context.Background())
+  if err != nil {
+    return nil, err
+  }
+
+  names := make([]string, 0, len(keys))
+  for _, key := range keys {
+    names = append(names, string(key))
+  }
+  return names, nil
+}
+
+func (s *storeAdapter) Get(key string) (*Record, error) {
+  record := &Record{ Key: key }
+  if attributeStore, ok := s.kvStore.(store.AttributeKeyValueStore); ok {
+    value, attributes, err := attributeStore.GetWithAttributes(context.Background(), store.Key(key))
+    if err != nil {
+      return nil, err
+    }
+    record.Value = string(value)
+    if attributes != nil {
+      record.Ttl = remainingTtl(attributes.ExpiresAt)
+      record.Metadata = attributes.Metadata
+    }
+    return record, nil
+  }
+
+  value, err := s.kvStore.Get(context.Background(), store.Key(key))
+  if err != nil {
+    return nil, err
+  }
+  record.Value = string(value)
+  return record, nil
+}
+
+// Imports into, and exports from, a running server via its API.
+type clientAdapter struct {
+  c *client.Client
+}
+
+// Adapt a client for importing.
+func MakeClientSink(c *client.Client) Sink {
+  return &clientAdapter{ c: c }
+}
+
+// Adapt a client for exporting.
+func MakeClientSource(c *client.Client) Source {
+  return &clientAdapter{ c: c }
+}
+
+func (a *clientAdapter) Put(record *Record) error {
+  return a.c.SetWithOptions(record.Key, []byte(record.Value), &client.SetOptions{
+    Ttl: time.Duration(record.Ttl) * time.Second,
+    Metadata: record.Metadata,
+  })
+}
+
+func (a *clientAdapter) Keys() ([]string, error) {
+  return a.c.Keys("")
+}
+
+func (a *clientAdapter) Get(key string) (*Record, error) {
+  value, attributes, err := a.c.GetWithAttributes(key)
+  if errors.Is(err, client.ErrNotFound) {
+    return nil, fmt.Errorf("%w: %v", os.ErrNotExist, err)
+  } else if err != nil {
+    return nil, err
+  }
+
+  record := &Record{ Key: key, Value: string(value) }
+  if attributes != nil {
+    record.Ttl = remainingTtl(attributes.ExpiresAt)
+    record.Metadata = attributes.Metadata
+  }
+  return record, nil
+}
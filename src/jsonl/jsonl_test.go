@@ -0,0 +1,159 @@
+package jsonl
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+  "buildbuddy.takehome.com/src/store"
+)
+
+func makeTestFileStore(t *testing.T) *store.FileStore {
+  fs, err := store.MakeFileStore(t.TempDir(), nil)
+  if err != nil {
+    t.Fatalf("Error making filestore: %v", err)
+  }
+  return fs
+}
+
+func TestImportReportsPerRecordErrors(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t)
+  input := strings.Join([]string{
+    `{"key":"a","value":"1"}`,
+    `not json`,
+    ``,
+    `{"value":"no key"}`,
+    `{"key":"b","value":"2","ttl":60,"metadata":{"tool":"bazel"}}`,
+    `{"key":"c","value":"3","ttl":-1}`,
+  }, "\n")
+
+  report, err := Import(strings.NewReader(input), MakeStoreSink(fs), nil)
+  if err != nil {
+    t.Fatalf("Error importing: %v", err)
+  }
+
+  if report.Records != 2 || report.Failed != 3 ||
+      report.Bytes != int64(len(input)) {
+    t.Errorf("Expected 2 records and 3 failures, got %v", report)
+  }
+
+  lines := []int{}
+  for _, recordErr := range report.Errors {
+    lines = append(lines, recordErr.Line)
+  }
+  if fmt.Sprint(lines) != "[2 4 6]" || report.Errors[2].Key != "c" {
+    t.Errorf("Expected errors on lines 2, 4 and 6, got %v", report.Errors)
+  }
+
+  _, attributes, err := fs.GetWithAttributes(ctx, store.Key("b"))
+  if err != nil || attributes.Metadata["tool"] != "bazel" ||
+      time.Until(attributes.ExpiresAt) <= 0 {
+    t.Errorf("Expected b to be stored with a TTL and metadata, got %v", attributes)
+  }
+}
+
+func TestExportRoundTrips(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t)
+  fs.Set(ctx, store.Key("a"), store.Value("1"))
+  fs.SetWithAttributes(ctx, store.Key("b"), store.Value("2"), &store.Attributes{
+    ExpiresAt: time.Now().Add(time.Minute),
+    Metadata: map[string]string{ "tool": "bazel" },
+  })
+
+  source, err := MakeStoreSource(fs)
+  if err != nil {
+    t.Fatalf("Error making source: %v", err)
+  }
+  var exported bytes.Buffer
+  report, err := Export(source, &exported, nil)
+  if err != nil || report.Records != 2 || report.Failed != 0 {
+    t.Fatalf("Expected 2 exported records, got %v (%v)", report, err)
+  }
+
+  expected := `{"key":"a","value":"1"}` + "\n" +
+    `{"key":"b","value":"2","ttl":60,"metadata":{"tool":"bazel"}}` + "\n"
+  if exported.String() != expected {
+    t.Errorf("Expected %v, got %v", expected, exported.String())
+  }
+
+  imported := makeTestFileStore(t)
+  if report, err := Import(&exported, MakeStoreSink(imported), nil);
+      err != nil || report.Records != 2 {
+    t.Fatalf("Expected 2 imported records, got %v (%v)", report, err)
+  }
+  if value, _ := imported.Get(ctx, store.Key("b")); value != store.Value("2") {
+    t.Errorf("Expected b -> 2, got %v", value)
+  }
+}
+
+func TestExportRoundTripsBinaryValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t)
+  binary := store.Value([]byte{ 0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 'a', 0x80 })
+  fs.Set(ctx, store.Key("binary"), binary)
+  fs.Set(ctx, store.Key("text"), store.Value("héllo"))
+
+  source, _ := MakeStoreSource(fs)
+  var exported bytes.Buffer
+  if report, err := Export(source, &exported, nil); err != nil || report.Records != 2 {
+    t.Fatalf("Expected 2 exported records, got %v (%v)", report, err)
+  }
+  expected := `{"key":"binary","value":"H4sIAP/+YYA=","encoding":"base64"}` + "\n" +
+    `{"key":"text","value":"héllo"}` + "\n"
+  if exported.String() != expected {
+    t.Errorf("Expected %v, got %v", expected, exported.String())
+  }
+
+  imported := makeTestFileStore(t)
+  if report, err := Import(&exported, MakeStoreSink(imported), nil);
+      err != nil || report.Records != 2 {
+    t.Fatalf("Expected 2 imported records, got %v (%v)", report, err)
+  }
+  if value, _ := imported.Get(ctx, store.Key("binary")); value != binary {
+    t.Errorf("Expected the binary value byte for byte, got %v", []byte(value))
+  }
+  if value, _ := imported.Get(ctx, store.Key("text")); value != store.Value("héllo") {
+    t.Errorf("Expected text -> héllo, got %v", value)
+  }
+
+  input := `{"key":"a","value":"not base64!","encoding":"base64"}` + "\n" +
+    `{"key":"b","value":"1","encoding":"rot13"}`
+  if report, _ := Import(strings.NewReader(input), MakeStoreSink(imported), nil); report.Failed != 2 {
+    t.Errorf("Expected invalid and unknown encodings to fail, got %v", report)
+  }
+}
+
+func TestImportReportsProgress(t *testing.T) {
+  var input strings.Builder
+  for i := 0; i < 2 * PROGRESS_INTERVAL_RECORDS + 1; i++ {
+    fmt.Fprintf(&input, `{"key":"key%v","value":"value"}` + "\n", i)
+  }
+
+  calls := 0
+  report, err := Import(strings.NewReader(input.String()),
+    MakeStoreSink(makeTestFileStore(t)), func(*Report) { calls++ })
+  if err != nil || report.Records != 2 * PROGRESS_INTERVAL_RECORDS + 1 {
+    t.Fatalf("Expected every record to be imported, got %v (%v)", report, err)
+  }
+  if calls != 2 {
+    t.Errorf("Expected 2 progress calls, got %v", calls)
+  }
+}
+
+func TestImportRejectsAttributesForUnsupportedStore(t *testing.T) {
+  fs := &store.FakeKeyValueStore{}
+  report, _ := Import(strings.NewReader(`{"key":"a","value":"1","ttl":5}`),
+    MakeStoreSink(fs), nil)
+
+  if report.Failed != 1 || len(fs.SetCalls) != 0 {
+    t.Errorf("Expected the record with a TTL to fail, got %v", report)
+  }
+
+  if _, err := MakeStoreSource(fs); err == nil {
+    t.Errorf("Expected an error exporting a store which cannot list its keys")
+  }
+}
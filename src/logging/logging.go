@@ -0,0 +1,331 @@
+package logging
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "unicode"
+)
+
+const (
+  // The formats of log entries: `key=value` pairs, or a JSON object per line.
+  FORMAT_TEXT = "text"
+  FORMAT_JSON = "json"
+  // The header carrying a request's ID, which is propagated to other nodes
+  // and echoed in the response.
+  HEADER_REQUEST_ID = "X-Request-ID"
+  // Request IDs longer than this, or holding spaces or control characters,
+  // are replaced.
+  MAX_REQUEST_ID_LENGTH = 128
+)
+
+// The severity of an entry. Entries below a Logger's level are dropped.
+type Level int
+
+const (
+  LEVEL_DEBUG Level = iota
+  LEVEL_INFO
+  LEVEL_WARN
+  LEVEL_ERROR
+)
+
+var (
+  levelNames = map[Level]string{
+    LEVEL_DEBUG: "debug",
+    LEVEL_INFO: "info",
+    LEVEL_WARN: "warn",
+    LEVEL_ERROR: "error",
+  }
+  // Fields which may hold user data or secrets, and so are only logged as
+  // their size.
+  redactedKeys = map[string]bool{
+    "value": true,
+    "body": true,
+    "token": true,
+    "authorization": true,
+  }
+)
+
+func (l Level) String() string {
+  if name, ok := levelNames[l]; ok {
+    return name
+  }
+  return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Parse a level's name, e.g. `debug`, in any case.
+func ParseLevel(name string) (Level, error) {
+  for level, levelName := range levelNames {
+    if strings.EqualFold(name, levelName) {
+      return level, nil
+    }
+  }
+  return LEVEL_INFO, errors.New(fmt.Sprintf(
+    "Unknown log level %q; expected debug, info, warn or error", name))
+}
+
+type Options struct {
+  // The minimum level to write; defaults to LEVEL_INFO.
+  Level Level
+  // FORMAT_TEXT (the default) or FORMAT_JSON.
+  Format string
+}
+
+// A key and its value, attached to an entry.
+type field struct {
+  key string
+  value interface{}
+}
+
+// The destination shared by a Logger and those derived from it via With, so
+// that concurrent entries are not interleaved.
+type sink struct {
+  out io.Writer
+  mutex *sync.Mutex
+  now func() time.Time
+}
+
+// A leveled logger writing structured entries, e.g.
+//   time=2026-01-02T15:04:05.000Z level=info msg="Served request" status=200
+// Fields named in `redactedKeys`, e.g. `value`, are replaced by their size.
+// A nil Logger discards every entry, so components may be made without one.
+// Create instances via MakeLogger.
+type Logger struct {
+  sink *sink
+  level Level
+  format string
+  // Attached to every entry, e.g. a request ID; see With.
+  fields []field
+}
+
+// Make a Logger writing to `out`. `options` may be nil.
+func MakeLogger(out io.Writer, options *Options) (*Logger, error) {
+  if options == nil {
+    options = &Options{ Level: LEVEL_INFO }
+  }
+  format := options.Format
+  if format == "" {
+    format = FORMAT_TEXT
+  }
+  if format != FORMAT_TEXT && format != FORMAT_JSON {
+    return nil, errors.New(fmt.Sprintf(
+      "Unknown log format %q; expected %v or %v", format, FORMAT_TEXT, FORMAT_JSON))
+  }
+  if _, ok := levelNames[options.Level]; !ok {
+    return nil, errors.New(fmt.Sprintf("Unknown log level %v", options.Level))
+  }
+
+  l := &Logger{}
+  l.sink = &sink{ out: out, mutex: &sync.Mutex{}, now: time.Now }
+  l.level = options.Level
+  l.format = format
+  return l, nil
+}
+
+/**
+ * Return a Logger attaching the alternating keys and values to every entry,
+ * e.g. `logger.With("namespace", "team-a")`, in addition to this Logger's.
+ */
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+  if l == nil {
+    return nil
+  }
+  derived := *l
+  derived.fields = append(append([]field{}, l.fields...), toFields(keyvals)...)
+  return &derived
+}
+
+// Return whether entries at `level` are written, e.g. to skip building
+// expensive fields.
+func (l *Logger) Enabled(level Level) bool {
+  return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(message string, keyvals ...interface{}) {
+  l.log(LEVEL_DEBUG, message, keyvals)
+}
+
+func (l *Logger) Info(message string, keyvals ...interface{}) {
+  l.log(LEVEL_INFO, message, keyvals)
+}
+
+func (l *Logger) Warn(message string, keyvals ...interface{}) {
+  l.log(LEVEL_WARN, message, keyvals)
+}
+
+func (l *Logger) Error(message string, keyvals ...interface{}) {
+  l.log(LEVEL_ERROR, message, keyvals)
+}
+
+// Write an entry of the message and fields, if `level` is enabled.
+func (l *Logger) log(level Level, message string, keyvals []interface{}) {
+  if !l.Enabled(level) {
+    return
+  }
+
+  fields := []field{
+    { key: "time", value: l.sink.now().UTC().Format("2006-01-02T15:04:05.000Z07:00") },
+    { key: "level", value: level.String() },
+    { key: "msg", value: message },
+  }
+  fields = append(fields, l.fields...)
+  fields = append(fields, toFields(keyvals)...)
+
+  buffer := &bytes.Buffer{}
+  if l.format == FORMAT_JSON {
+    writeJson(buffer, fields)
+  } else {
+    writeText(buffer, fields)
+  }
+  buffer.WriteByte('\n')
+
+  defer l.sink.mutex.Unlock()
+  l.sink.mutex.Lock()
+  l.sink.out.Write(buffer.Bytes())
+}
+
+// Pair up alternating keys and values, redacting sensitive ones. A trailing
+// key without a value is logged under `!missing`.
+func toFields(keyvals []interface{}) []field {
+  fields := make([]field, 0, (len(keyvals) + 1) / 2)
+  for i := 0; i < len(keyvals); i += 2 {
+    if i + 1 == len(keyvals) {
+      fields = append(fields, field{ key: "!missing", value: keyvals[i] })
+      break
+    }
+    key := fmt.Sprint(keyvals[i])
+    value := keyvals[i + 1]
+    if redactedKeys[strings.ToLower(key)] {
+      value = redact(value)
+    }
+    fields = append(fields, field{ key: key, value: value })
+  }
+  return fields
+}
+
+// Describe a sensitive value without revealing it, e.g. `<redacted 12 bytes>`.
+func redact(value interface{}) string {
+  switch v := value.(type) {
+  case string:
+    return fmt.Sprintf("<redacted %d bytes>", len(v))
+  case []byte:
+    return fmt.Sprintf("<redacted %d bytes>", len(v))
+  case fmt.Stringer:
+    return fmt.Sprintf("<redacted %d bytes>", len(v.String()))
+  }
+  return "<redacted>"
+}
+
+// Return the value as logged: errors and Stringers by their text.
+func simplify(value interface{}) interface{} {
+  switch v := value.(type) {
+  case nil:
+    return nil
+  case error:
+    return v.Error()
+  case time.Duration:
+    return v.String()
+  case fmt.Stringer:
+    return v.String()
+  case []byte:
+    return string(v)
+  }
+  return value
+}
+
+// Write `key=value` pairs, quoting values which are empty or hold spaces,
+// quotes or `=`.
+func writeText(buffer *bytes.Buffer, fields []field) {
+  for i, f := range fields {
+    if i > 0 {
+      buffer.WriteByte(' ')
+    }
+    buffer.WriteString(f.key)
+    buffer.WriteByte('=')
+    text := fmt.Sprint(simplify(f.value))
+    if needsQuoting(text) {
+      text = strconv.Quote(text)
+    }
+    buffer.WriteString(text)
+  }
+}
+
+func needsQuoting(text string) bool {
+  if text == "" {
+    return true
+  }
+  for _, r := range text {
+    if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+      return true
+    }
+  }
+  return false
+}
+
+// Write the fields as a JSON object, in order. Values which cannot be
+// encoded are written as text.
+func writeJson(buffer *bytes.Buffer, fields []field) {
+  buffer.WriteByte('{')
+  for i, f := range fields {
+    if i > 0 {
+      buffer.WriteByte(',')
+    }
+    key, _ := json.Marshal(f.key)
+    buffer.Write(key)
+    buffer.WriteByte(':')
+    value, err := json.Marshal(simplify(f.value))
+    if err != nil {
+      value, _ = json.Marshal(fmt.Sprint(f.value))
+    }
+    buffer.Write(value)
+  }
+  buffer.WriteByte('}')
+}
+
+type requestIdKey struct{}
+
+// Return a context carrying the request's ID; see RequestId.
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+  return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// Return the request ID the context carries, or "".
+func RequestId(ctx context.Context) string {
+  requestId, _ := ctx.Value(requestIdKey{}).(string)
+  return requestId
+}
+
+// Return a random request ID, e.g. `4f1c2a9be07d3186`.
+func NewRequestId() string {
+  id := make([]byte, 8)
+  if _, err := rand.Read(id); err != nil {
+    return strconv.FormatInt(time.Now().UnixNano(), 16)
+  }
+  return hex.EncodeToString(id)
+}
+
+/**
+ * Return whether a request ID received from a client may be used as is:
+ * non-empty, at most MAX_REQUEST_ID_LENGTH characters, and printable ASCII
+ * without spaces, so that it cannot forge log entries.
+ */
+func ValidRequestId(requestId string) bool {
+  if requestId == "" || len(requestId) > MAX_REQUEST_ID_LENGTH {
+    return false
+  }
+  for _, c := range []byte(requestId) {
+    if c <= ' ' || c > '~' {
+      return false
+    }
+  }
+  return true
+}
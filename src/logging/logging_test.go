@@ -0,0 +1,97 @@
+package logging
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Make a logger writing to a buffer at a fixed time.
+func makeTestLogger(t *testing.T, options *Options) (*Logger, *bytes.Buffer) {
+  output := &bytes.Buffer{}
+  l, err := MakeLogger(output, options)
+  if err != nil {
+    t.Fatalf("Error making logger: %v", err)
+  }
+  l.sink.now = func() time.Time { return time.Unix(0, 0) }
+  return l, output
+}
+
+func TestTextEntriesQuoteValues(t *testing.T) {
+  l, output := makeTestLogger(t, nil)
+  l.With("request_id", "abc").Info("Served request", "path", "/get",
+    "err", errors.New("not found"), "status", 404)
+
+  expected := `time=1970-01-01T00:00:00.000Z level=info msg="Served request" ` +
+    `request_id=abc path=/get err="not found" status=404` + "\n"
+  if output.String() != expected {
+    t.Errorf("Expected %q, got %q", expected, output.String())
+  }
+}
+
+func TestJsonEntriesKeepFieldOrder(t *testing.T) {
+  l, output := makeTestLogger(t, &Options{ Level: LEVEL_DEBUG, Format: FORMAT_JSON })
+  l.Debug("Cache miss", "key", "a key", "bytes", 3)
+
+  expected := `{"time":"1970-01-01T00:00:00.000Z","level":"debug","msg":"Cache miss",` +
+    `"key":"a key","bytes":3}` + "\n"
+  if output.String() != expected {
+    t.Errorf("Expected %q, got %q", expected, output.String())
+  }
+  var decoded map[string]interface{}
+  if err := json.Unmarshal(output.Bytes(), &decoded); err != nil {
+    t.Errorf("Expected valid JSON: %v", err)
+  }
+}
+
+func TestEntriesBelowLevelAreDropped(t *testing.T) {
+  l, output := makeTestLogger(t, &Options{ Level: LEVEL_WARN })
+  l.Debug("debug")
+  l.Info("info")
+  l.Warn("warn")
+  l.Error("error")
+  if lines := strings.Count(output.String(), "\n"); lines != 2 {
+    t.Errorf("Expected only warn and error entries, got %q", output.String())
+  }
+
+  var discard *Logger
+  discard.With("a", "b").Error("dropped")
+  if discard.Enabled(LEVEL_ERROR) {
+    t.Errorf("Expected a nil logger to discard entries")
+  }
+}
+
+func TestValuesAreRedacted(t *testing.T) {
+  l, output := makeTestLogger(t, nil)
+  l.Info("Set", "key", "k", "value", "a secret value", "Authorization", "Bearer secret")
+  if strings.Contains(output.String(), "secret") {
+    t.Errorf("Expected values to be redacted, got %q", output.String())
+  }
+  if !strings.Contains(output.String(), `value="<redacted 14 bytes>"`) {
+    t.Errorf("Expected the value's size, got %q", output.String())
+  }
+}
+
+func TestParseLevelAndRequestIds(t *testing.T) {
+  if level, err := ParseLevel("WARN"); err != nil || level != LEVEL_WARN {
+    t.Errorf("Expected LEVEL_WARN, got %v (%v)", level, err)
+  }
+  if _, err := ParseLevel("verbose"); err == nil {
+    t.Errorf("Expected an unknown level to be rejected")
+  }
+  if _, err := MakeLogger(&bytes.Buffer{}, &Options{ Format: "xml" }); err == nil {
+    t.Errorf("Expected an unknown format to be rejected")
+  }
+
+  if !ValidRequestId(NewRequestId()) {
+    t.Errorf("Expected generated request IDs to be valid")
+  }
+  for _, invalid := range []string{ "", "a b", "a\nlevel=error", strings.Repeat("a", 129) } {
+    if ValidRequestId(invalid) {
+      t.Errorf("Expected %q to be an invalid request ID", invalid)
+    }
+  }
+}
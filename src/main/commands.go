@@ -0,0 +1,155 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/config"
+)
+
+// The exit codes of the binary, e.g. for scripts calling `get`.
+const (
+  EXIT_OK = 0
+  // The command failed, e.g. as the server was unreachable.
+  EXIT_FAILURE = 1
+  // The command line or config was invalid.
+  EXIT_USAGE = 2
+  // `get` found no value for the key.
+  EXIT_NOT_FOUND = 3
+  // The server refused the token, or its permissions.
+  EXIT_DENIED = 4
+)
+
+/**
+ * Make the client of the REPL and one-shot commands: for `--url`, or the
+ * local server at `--address`. It trusts `--tls_ca_file`, presents
+ * `--tls_client_cert_file` to servers requiring client certificates,
+ * sends `--auth_token` and `--namespace`, and gives up on calls after
+ * `--call_timeout`.
+ */
+func makeClient(conf *config.Config) (*client.Client, error) {
+  serverUrl := conf.Url
+  if serverUrl == "" {
+    serverUrl = localUrl(conf.Address)
+    if conf.TlsCertFile != "" {
+      serverUrl = "https://" + strings.TrimPrefix(serverUrl, "http://")
+    }
+  }
+
+  return client.MakeClientWithOptions(serverUrl, clientOptions(conf))
+}
+
+// Return the options of clients configured by `conf`, e.g. its token.
+func clientOptions(conf *config.Config) *client.ClientOptions {
+  clientOptions := &client.ClientOptions{
+    Token: conf.AuthToken,
+    Namespace: conf.Namespace,
+    Timeout: time.Duration(conf.CallTimeout),
+  }
+  // Servers with TLS, e.g. cluster nodes listed without a scheme, are
+  // reached over `https://`.
+  if conf.TlsCaFile != "" || conf.TlsClientCertFile != "" || conf.TlsCertFile != "" {
+    clientOptions.Tls = &client.TlsOptions{
+      CaFile: conf.TlsCaFile,
+      CertFile: conf.TlsClientCertFile,
+      KeyFile: conf.TlsClientKeyFile,
+    }
+  }
+  return clientOptions
+}
+
+// Return the exit code of a failed call.
+func exitCode(err error) int {
+  switch {
+  case errors.Is(err, client.ErrNotFound):
+    return EXIT_NOT_FOUND
+  case errors.Is(err, client.ErrUnauthorized), errors.Is(err, client.ErrForbidden):
+    return EXIT_DENIED
+  }
+  return EXIT_FAILURE
+}
+
+/**
+ * Run a one-shot command against the server, returning the exit code.
+ *   get <key>: Write the value to stdout, as is.
+ *   set <key> [value]: Set the value, read from stdin if omitted or `-`.
+ *   delete <key>: Delete the key; deleting a missing key succeeds.
+ *   list [prefix]: Write the keys with the prefix to stdout, one per line.
+ * Errors are written to stderr.
+ */
+func runCommand(
+    command string, conf *config.Config, args []string,
+    stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+  usage := map[string]string{
+    "get": "get [flags] <key>",
+    "set": "set [flags] <key> [value]",
+    "delete": "delete [flags] <key>",
+    "list": "list [flags] [prefix]",
+  }[command]
+  minArgs, maxArgs := 1, 1
+  switch command {
+  case "set":
+    maxArgs = 2
+  case "list":
+    minArgs = 0
+  }
+  if len(args) < minArgs || len(args) > maxArgs {
+    fmt.Fprintln(stderr, "Usage:", usage)
+    return EXIT_USAGE
+  }
+
+  c, err := makeClient(conf)
+  if err != nil {
+    fmt.Fprintln(stderr, "Error making client:", err)
+    return EXIT_USAGE
+  }
+
+  switch command {
+  case "get":
+    value, err := c.Get(args[0])
+    if err != nil {
+      fmt.Fprintln(stderr, "Error getting", args[0] + ":", err)
+      return exitCode(err)
+    }
+    stdout.Write(value)
+  case "set":
+    var value []byte
+    if len(args) == 2 && args[1] != "-" {
+      value = []byte(args[1])
+    } else if value, err = io.ReadAll(stdin); err != nil {
+      fmt.Fprintln(stderr, "Error reading the value:", err)
+      return EXIT_FAILURE
+    }
+    if err := c.Set(args[0], value); err != nil {
+      fmt.Fprintln(stderr, "Error setting", args[0] + ":", err)
+      return exitCode(err)
+    }
+  case "delete":
+    if err := c.Delete(args[0]); err != nil {
+      fmt.Fprintln(stderr, "Error deleting", args[0] + ":", err)
+      return exitCode(err)
+    }
+  case "list":
+    prefix := ""
+    if len(args) == 1 {
+      prefix = args[0]
+    }
+    keys, err := c.Keys(prefix)
+    if err != nil {
+      fmt.Fprintln(stderr, "Error listing keys:", err)
+      return exitCode(err)
+    }
+    for _, key := range keys {
+      fmt.Fprintln(stdout, key)
+    }
+  }
+  return EXIT_OK
+}
+
+// Return whether `command` is run by runCommand.
+func isOneShotCommand(command string) bool {
+  return command == "get" || command == "set" || command == "delete" || command == "list"
+}
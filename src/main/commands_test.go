@@ -0,0 +1,98 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "io"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Run a one-shot command against the server at `serverUrl`, returning its
+// exit code and output.
+func runTestCommand(serverUrl string, stdin string, args ...string) (int, string) {
+  conf := config.Default()
+  conf.Url = serverUrl
+  var stdout, stderr bytes.Buffer
+  code := runCommand(args[0], conf, args[1:], strings.NewReader(stdin), &stdout, &stderr)
+  return code, stdout.String()
+}
+
+func TestOneShotCommands(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  testServer := httptest.NewServer(server.MakeServerWithStores(fs, nil).Handler())
+  defer testServer.Close()
+  serverUrl := testServer.URL
+
+  if code, _ := runTestCommand(serverUrl, "", "set", "greeting", "hello world"); code != EXIT_OK {
+    t.Errorf("Expected set to succeed, got exit code %v", code)
+  }
+  if code, _ := runTestCommand(serverUrl, "from stdin", "set", "other"); code != EXIT_OK {
+    t.Errorf("Expected set from stdin to succeed, got exit code %v", code)
+  }
+  if code, output := runTestCommand(serverUrl, "", "get", "greeting"); code != EXIT_OK ||
+      output != "hello world" {
+    t.Errorf("Expected the value as is, got %v %q", code, output)
+  }
+  if code, output := runTestCommand(serverUrl, "", "list"); code != EXIT_OK ||
+      output != "greeting\nother\n" {
+    t.Errorf("Expected a key per line, got %v %q", code, output)
+  }
+
+  if code, _ := runTestCommand(serverUrl, "", "delete", "greeting"); code != EXIT_OK {
+    t.Errorf("Expected delete to succeed, got exit code %v", code)
+  }
+  if code, _ := runTestCommand(serverUrl, "", "get", "greeting"); code != EXIT_NOT_FOUND {
+    t.Errorf("Expected a missing key to exit %v, got %v", EXIT_NOT_FOUND, code)
+  }
+  if code, _ := runTestCommand(serverUrl, "", "get", "a", "b"); code != EXIT_USAGE {
+    t.Errorf("Expected extra arguments to exit %v, got %v", EXIT_USAGE, code)
+  }
+}
+
+func TestOneShotCommandsFailWithoutServer(t *testing.T) {
+  testServer := httptest.NewServer(nil)
+  serverUrl := testServer.URL
+  testServer.Close()
+
+  if code, _ := runTestCommand(serverUrl, "", "get", "key"); code != EXIT_FAILURE {
+    t.Errorf("Expected an unreachable server to exit %v, got %v", EXIT_FAILURE, code)
+  }
+}
+
+func TestWriteFileAtomicallyKeepsTheOldFileOnFailure(t *testing.T) {
+  directory := t.TempDir()
+  path := filepath.Join(directory, "snapshot.tar")
+  os.WriteFile(path, []byte("old"), 0644)
+
+  err := writeFileAtomically(path, func(w io.Writer) error {
+    w.Write([]byte("partial"))
+    return errors.New("Connection reset")
+  })
+  if err == nil {
+    t.Fatalf("Expected the write's error")
+  }
+  if contents, _ := os.ReadFile(path); string(contents) != "old" {
+    t.Errorf("Expected the old file to be kept, got %q", contents)
+  }
+
+  if err := writeFileAtomically(path, func(w io.Writer) error {
+    _, err := w.Write([]byte("new"))
+    return err
+  }); err != nil {
+    t.Fatalf("Error writing file: %v", err)
+  }
+  if contents, _ := os.ReadFile(path); string(contents) != "new" {
+    t.Errorf("Expected the file to be replaced, got %q", contents)
+  }
+  if entries, _ := os.ReadDir(directory); len(entries) != 1 {
+    t.Errorf("Expected no temporary files to be left behind, got %v", entries)
+  }
+}
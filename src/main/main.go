@@ -1,100 +1,361 @@
 package main
 
 import (
-  "bufio"
+  "errors"
+  "flag"
   "fmt"
+  "io"
   "strings"
   "os"
-  "buildbuddy.takehome.com/src/server"
+  "path/filepath"
+  "os/signal"
+  "syscall"
+  "time"
   "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/jsonl"
+  "buildbuddy.takehome.com/src/raft"
+  "buildbuddy.takehome.com/src/replication"
+  "buildbuddy.takehome.com/src/server"
   "buildbuddy.takehome.com/src/store"
 )
 
 const (
-  flagEnableCaching = "--enable_caching"
+  // The timeout of calls between Raft nodes.
+  RAFT_TRANSPORT_TIMEOUT = 2 * time.Second
 )
 
 func main() {
-  var fs *store.FileStore
-  var cache *store.Cache
+  os.Exit(run(os.Args[1:]))
+}
+
+/**
+ * Run the command line, returning the exit code. Without a subcommand, the
+ * server is run with the REPL reading stdin; see runSubcommand and
+ * runCommand for the others.
+ */
+func run(args []string) int {
+  command := ""
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    command, args = args[0], args[1:]
+  }
+  if command != "" && command != "serve" && command != "repl" && !isOneShotCommand(command) {
+    if err := runSubcommand(command, args); err != nil {
+      fmt.Println("Error:", err)
+      return EXIT_FAILURE
+    }
+    return EXIT_OK
+  }
+
+  // Options come from flags, BUILDBUDDY_* environment variables and an
+  // optional `--config` file; `--help` lists them.
+  conf, positional, err := config.LoadWithArgs(args, os.Getenv)
+  if errors.Is(err, flag.ErrHelp) {
+    return EXIT_OK
+  } else if err != nil {
+    fmt.Println("Error loading config; aborting.", err)
+    return EXIT_USAGE
+  }
+  if conf.PrintConfig {
+    conf.Write(os.Stdout)
+    return EXIT_OK
+  }
+
+  if isOneShotCommand(command) {
+    return runCommand(command, conf, positional, os.Stdin, os.Stdout, os.Stderr)
+  }
+  if len(positional) > 0 {
+    fmt.Println("Unexpected argument", positional[0])
+    return EXIT_USAGE
+  }
+  switch command {
+  case "serve":
+    return runServe(conf)
+  case "repl":
+    return runRemoteRepl(conf)
+  }
+  return runServerWithRepl(conf)
+}
+
+/**
+ * Run the server with the REPL reading stdin, shutting the server down on
+ * `exit`, the end of stdin, or SIGINT/SIGTERM, whichever comes first.
+ * Returns the exit code.
+ */
+func runServerWithRepl(conf *config.Config) int {
+  d, err := startDaemon(conf)
+  if err != nil {
+    fmt.Println("Error starting server; aborting.", err)
+    return EXIT_FAILURE
+  }
+  c, err := makeClient(conf)
+  if err != nil {
+    fmt.Println("Error making client; aborting.", err)
+    d.shutdown()
+    return EXIT_USAGE
+  }
+
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  go func() {
+    <-signals
+    d.shutdown()
+    os.Exit(EXIT_OK)
+  }()
+
+  err = runRepl(conf, c, d.rotateKeys)
+  d.shutdown()
+  if err != nil {
+    fmt.Println("Error:", err)
+    return EXIT_FAILURE
+  }
+  return EXIT_OK
+}
+
+// Return the URL the REPL uses to reach the server listening on `address`,
+// e.g. `http://localhost:8081` for `:8081`.
+func localUrl(address string) string {
+  if strings.HasPrefix(address, ":") {
+    return "http://localhost" + address
+  }
+  return "http://" + address
+}
+
+// The storage engines which the server cannot make itself.
+var STORE_FACTORIES = &server.StoreFactories{
+  Raft: makeRaftStore,
+  Replicate: replicate,
+}
+
+// Make the Raft store of the config's `raft_nodes`; see server.StoreFactories.
+func makeRaftStore(
+    c *config.Config,
+    fsOptions *store.FileStoreOptions,
+    options *server.ServerOptions) (store.KeyValueStore, error) {
+  self := c.NodeName()
+  var peers []string
+  for _, node := range c.RaftNodes {
+    if node != self {
+      peers = append(peers, node)
+    }
+  }
+
+  return raft.MakeRaftStore(self, peers, c.StoreDirectory(),
+    raft.MakeHttpTransport(RAFT_TRANSPORT_TIMEOUT, &raft.HttpTransportOptions{
+      PeerKey: options.PeerKey,
+      Tls: options.PeerTls,
+      Logger: options.Logger,
+    }),
+    &raft.RaftStoreOptions{
+      Node: raft.NodeOptions{ Logger: options.Logger },
+      FileStore: fsOptions,
+    })
+}
+
+// Replicate the store to the config's `replica_peers`; see
+// server.StoreFactories.
+func replicate(
+    c *config.Config,
+    kvStore store.KeyValueStore,
+    options *server.ServerOptions) (store.KeyValueStore, error) {
+  return replication.MakeReplicatedStore(kvStore, c.ReplicaPeers,
+    &replication.ReplicationOptions{
+      NodeId: c.ReplicaNodeId(),
+      WriteQuorum: c.WriteQuorum,
+      ReadQuorum: c.ReadQuorum,
+      PeerKey: options.PeerKey,
+      Tls: options.PeerTls,
+      Logger: options.Logger,
+    })
+}
+
+// Return the importer/exporter for a subcommand: the FileStore in the
+// `--directory` option's directory if set, otherwise the running server at
+// `--address`.
+func jsonlEndpoint(args []string) (store.KeyValueStore, *client.Client, error) {
+  c, err := config.Load(args, os.Getenv)
+  if err != nil {
+    return nil, nil, err
+  }
+  if c.Directory == "" {
+    return nil, client.MakeClient(localUrl(c.Address)), nil
+  }
+
+  fsOptions, err := server.FileStoreOptions(c, nil)
+  if err != nil {
+    return nil, nil, err
+  }
+  fs, err := store.MakeFileStore(c.Directory, fsOptions)
+  return fs, nil, err
+}
 
-  var err error
-  fs, err = store.MakeFileStore("/tmp/buildbuddy")
+// Print a progress line during an import or export.
+func printProgress(report *jsonl.Report) {
+  fmt.Println("Progress:", report)
+}
+
+// Print the per-record errors and summary of an import or export.
+func printReport(report *jsonl.Report) {
+  for _, recordErr := range report.Errors {
+    fmt.Println("Error:", recordErr)
+  }
+  fmt.Println("Done:", report)
+}
+
+/**
+ * Write the file at `path` via `write`, into a temporary file in the same
+ * directory which is renamed into place only once `write` succeeds. On
+ * failure, any existing file at `path` is left untouched.
+ */
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+  tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".tmp-*")
   if err != nil {
-    fmt.Println("Error making filestore; aborting.")
-    return 
+    return err
+  }
+  // Fails harmlessly once the file has been renamed.
+  defer os.Remove(tmpFile.Name())
+
+  if err := write(tmpFile); err != nil {
+    tmpFile.Close()
+    return err
+  }
+  if err := tmpFile.Chmod(0644); err != nil {
+    tmpFile.Close()
+    return err
+  }
+  if err := tmpFile.Sync(); err != nil {
+    tmpFile.Close()
+    return err
   }
+  if err := tmpFile.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmpFile.Name(), path)
+}
 
-  
-  // Optionally configure a cache.
-  if (flagEnabled(flagEnableCaching, os.Args)) {
-    cache, err = store.MakeCache(/* capacityBytes= */ 10)
+// Run a subcommand other than `serve`, `repl` and the one-shot commands,
+// returning any error that occurred.
+//   snapshot <archive> [flags]: Snapshot the filestore of the server at
+//     `--url`, or the local one, into a tar archive.
+//   restore <archive> <directory>: Restore a snapshot archive into a fresh
+//     directory. Interrupted restores can be resumed by re-running them.
+//   import <file> [--directory=<dir>]: Import JSON Lines records into the
+//     running server, or directly into the filestore in <dir>.
+//   export <file> [--directory=<dir>]: Export every key of the running
+//     server, or of the filestore in <dir>, as JSON Lines.
+//   rebalance <nodes> <new nodes> [flags]: Move a cluster to a new
+//     membership, streaming keys to their new owners. Both are comma
+//     separated, e.g. `localhost:8081,localhost:8082`. Requests carry the
+//     `--auth_token`, if set.
+// Writing a filestore directory directly must only be done while no server
+// is using it.
+func runSubcommand(subcommand string, args []string) error {
+  switch subcommand {
+  case "snapshot":
+    if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+      return errors.New("Usage: snapshot <archive> [flags]")
+    }
+
+    conf, err := config.Load(args[1:], os.Getenv)
     if err != nil {
-      fmt.Println("Error making cache; aborting.")
-      return
-    }
-  }
-   
-  s := server.MakeServer(fs, cache)
-  c := client.MakeClient("http://localhost:8080")
-  reader := bufio.NewReader(os.Stdin)
-  go s.Start() // Spin the server on a background thread. 
-  
-  // Accept user input, and convert it into either a Get or Set.
-  for {
-    userInput, err := reader.ReadString('\n')
+      return err
+    }
+    c, err := makeClient(conf)
     if err != nil {
-      fmt.Println("Error when reading input", err)
-      return
+      return err
     }
 
-    // Split on empty space, and execute either a GET or SET call.
-    tokens := strings.Fields(userInput) 
-    if strings.EqualFold(userInput, "exit") {
-      return
+    // A failed snapshot must not replace, or leave behind, a truncated archive.
+    if err := writeFileAtomically(args[0], c.Snapshot); err != nil {
+      return err
+    }
+    fmt.Println("Wrote snapshot to", args[0])
+    return nil
+  case "restore":
+    if len(args) != 2 {
+      return errors.New("Usage: restore <archive> <directory>")
     }
 
-    if len(tokens) < 2 {
-      fmt.Println("Invalid input.")
-      continue
+    archive, err := os.Open(args[0])
+    if err != nil {
+      return err
     }
+    defer archive.Close()
 
-    operation := tokens[0]
-    // Require exactly two tokens, e.g. GET <key>.
-    if strings.EqualFold(operation, "GET") && len(tokens) == 2 {
-      key := tokens[1]
-      resp, err := c.Get(key)
-      if err != nil {
-        fmt.Println("Error getting", key, ":", err)
-      } else {
-        fmt.Println("GET", key, "->", string(resp)) 
-      }
-   } else if strings.EqualFold(operation, "SET") && len(tokens) >= 3 {
-      // Require 3+ tokens, e.g. SET <key> <one space> <value with spaces>
-      key := tokens[1]
-      keyIdxStart := strings.Index(userInput, tokens[1])
-
-      // The value is one character (i.e. a space) after the end of <key>. 
-      value := userInput[keyIdxStart + len(tokens[1]) + 1:]
-      
-      if err := c.Set(key, []byte(value)); err != nil {
-        fmt.Println("Error setting", key, "->", value, "error:", err)
-      } else {
-        fmt.Println("SET", key, "->", value)
+    result, err := store.RestoreSnapshot(archive, args[1])
+    if err != nil {
+      return err
+    }
+    fmt.Println("Restored", result.Restored, "files, skipped", result.Skipped,
+      "files already present.")
+    return nil
+  case "rebalance":
+    if len(args) < 2 || strings.HasPrefix(args[0], "-") || strings.HasPrefix(args[1], "-") {
+      return errors.New("Usage: rebalance <nodes> <new nodes> [flags]")
+    }
+
+    conf, err := config.Load(args[2:], os.Getenv)
+    if err != nil {
+      return err
+    }
+    c, err := client.MakeClusterClient(strings.Split(args[0], ","), clientOptions(conf))
+    if err != nil {
+      return err
+    }
+
+    reports, err := c.Rebalance(strings.Split(args[1], ","))
+    for node, report := range reports {
+      fmt.Println(node, "moved", report.Moved, "keys,", report.Failed, "failed.")
+    }
+    return err
+  case "import":
+    if len(args) < 1 || strings.HasPrefix(args[0], "--") {
+      return errors.New("Usage: import <file> [--directory=<dir>]")
+    }
+
+    input, err := os.Open(args[0])
+    if err != nil {
+      return err
+    }
+    defer input.Close()
+
+    kvStore, c, err := jsonlEndpoint(args[1:])
+    if err != nil {
+      return err
+    }
+    sink := jsonl.MakeClientSink(c)
+    if kvStore != nil {
+      sink = jsonl.MakeStoreSink(kvStore)
+    }
+
+    report, err := jsonl.Import(input, sink, printProgress)
+    printReport(report)
+    return err
+  case "export":
+    if len(args) < 1 || strings.HasPrefix(args[0], "--") {
+      return errors.New("Usage: export <file> [--directory=<dir>]")
+    }
+
+    kvStore, c, err := jsonlEndpoint(args[1:])
+    if err != nil {
+      return err
+    }
+    source := jsonl.MakeClientSource(c)
+    if kvStore != nil {
+      if source, err = jsonl.MakeStoreSource(kvStore); err != nil {
+        return err
       }
-    } else {
-      fmt.Println("Invalid input:", userInput)
-    } 
-  }
-}
+    }
 
-// Return whether the flag is enabled from the command line invocation,
-// e.g. `./execute_target --enable-caching`.
-func flagEnabled(flag string, args []string) bool {
-  for _, value := range args {
-    if value == flag  {
-      return true
+    output, err := os.Create(args[0])
+    if err != nil {
+      return err
     }
+    defer output.Close()
+
+    report, err := jsonl.Export(source, output, printProgress)
+    printReport(report)
+    return err
   }
-  return false
+  return errors.New(fmt.Sprintf("Unknown subcommand %v", subcommand))
 }
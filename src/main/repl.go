@@ -0,0 +1,49 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/repl"
+)
+
+/**
+ * Run the REPL on stdin, calling the server via `c`, until `exit` or the
+ * end of stdin. `rotateKeys` serves ROTATE_KEYS; it is nil if the keys are
+ * not local.
+ */
+func runRepl(conf *config.Config, c *client.Client, rotateKeys func() error) error {
+  historyFile := conf.HistoryFile
+  if historyFile == "" {
+    if home, err := os.UserHomeDir(); err == nil {
+      historyFile = filepath.Join(home, config.DEFAULT_HISTORY_FILE)
+    }
+  }
+
+  r, err := repl.MakeRepl(c, &repl.Options{
+    Output: conf.Output,
+    HistoryFile: historyFile,
+    RotateKeys: rotateKeys,
+  })
+  if err != nil {
+    return err
+  }
+  return r.Run(os.Stdin, os.Stdout)
+}
+
+// Run `repl`: the REPL against `--url` or the local server, returning the
+// exit code.
+func runRemoteRepl(conf *config.Config) int {
+  c, err := makeClient(conf)
+  if err != nil {
+    fmt.Println("Error making client; aborting.", err)
+    return EXIT_USAGE
+  }
+  if err := runRepl(conf, c, nil); err != nil {
+    fmt.Println("Error:", err)
+    return EXIT_FAILURE
+  }
+  return EXIT_OK
+}
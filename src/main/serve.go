@@ -0,0 +1,260 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net"
+  "net/http"
+  "os"
+  "os/signal"
+  "strconv"
+  "sync"
+  "syscall"
+  "time"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/memcache"
+  "buildbuddy.takehome.com/src/resp"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+// A running server and its optional RESP and memcached listeners. Create
+// instances via startDaemon.
+type daemon struct {
+  conf *config.Config
+  // Shared by the server, its stores and listeners; writes to stderr.
+  logger *logging.Logger
+  // Exports the server's spans; nil unless `--trace_file` is set.
+  tracer *tracing.Tracer
+  server *server.Server
+  // The server's store if it is a filestore, whose keys can be rotated.
+  fs *store.FileStore
+  // Listeners sharing the server's stores, closed before it shuts down.
+  frontends []interface{ Close() error }
+  // Closed once the HTTP API stops serving.
+  served chan struct{}
+  shutdownOnce *sync.Once
+}
+
+/**
+ * Open the configured stores and bind every listener, then serve in the
+ * background. Once this returns, the daemon accepts connections; listeners
+ * which cannot be bound, e.g. as the address is in use, are an error.
+ */
+func startDaemon(conf *config.Config) (*daemon, error) {
+  logger, err := server.MakeLogger(conf, os.Stderr)
+  if err != nil {
+    return nil, err
+  }
+  tracer, err := server.MakeTracer(conf, logger)
+  if err != nil {
+    return nil, err
+  }
+  s, err := server.MakeServer(conf, logger, tracer, STORE_FACTORIES)
+  if err != nil {
+    tracer.Close()
+    return nil, err
+  }
+
+  d := &daemon{}
+  d.conf = conf
+  d.logger = logger
+  d.tracer = tracer
+  d.server = s
+  d.fs = s.FileStore()
+  d.served = make(chan struct{})
+  d.shutdownOnce = &sync.Once{}
+
+  // Bind every listener before serving any, so that readiness means all of
+  // them accept connections.
+  var listeners []net.Listener
+  var serves []func(net.Listener) error
+  listen := func(address string, serve func(net.Listener) error) error {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+      return err
+    }
+    listeners = append(listeners, listener)
+    serves = append(serves, serve)
+    return nil
+  }
+
+  err = listen(conf.Address, s.Serve)
+  // Optionally serve the admin routes and probes separately, e.g.
+  // `--admin_address=localhost:9090`.
+  if err == nil && conf.AdminAddress != "" {
+    err = listen(conf.AdminAddress, s.ServeAdmin)
+  }
+  // Optionally serve the Redis protocol too, e.g. `--resp_address=:6379`.
+  if err == nil && conf.RespAddress != "" {
+    respServer := resp.MakeServer(s, &resp.Options{
+      MaxConnections: conf.RespMaxConnections,
+      Auth: s.Policy(),
+      Logger: logger,
+    })
+    d.frontends = append(d.frontends, respServer)
+    err = listen(conf.RespAddress, respServer.Serve)
+  }
+  // Optionally serve the memcached text protocol, e.g.
+  // `--memcache_address=:11211`.
+  if err == nil && conf.MemcacheAddress != "" {
+    memcacheServer := memcache.MakeServer(s, &memcache.Options{
+      MaxConnections: conf.MemcacheMaxConnections,
+      Auth: s.Policy(),
+      Logger: logger,
+    })
+    d.frontends = append(d.frontends, memcacheServer)
+    err = listen(conf.MemcacheAddress, memcacheServer.Serve)
+  }
+  if err != nil {
+    for _, listener := range listeners {
+      listener.Close()
+    }
+    s.Shutdown(context.Background())
+    tracer.Close()
+    return nil, err
+  }
+
+  go func() {
+    if err := serves[0](listeners[0]); err != nil && err != http.ErrServerClosed {
+      logger.Error("Error serving", "address", conf.Address, "err", err)
+    }
+    close(d.served)
+  }()
+  for i := 1; i < len(listeners); i++ {
+    go func(serve func(net.Listener) error, listener net.Listener) {
+      if err := serve(listener); err != nil && err != http.ErrServerClosed {
+        logger.Error("Error serving", "address", listener.Addr(), "err", err)
+      }
+    }(serves[i], listeners[i])
+  }
+  return d, nil
+}
+
+/**
+ * Stop the listeners, drain API calls in flight for up to
+ * `--shutdown_timeout`, and close the stores. Later calls wait for the
+ * first to finish.
+ */
+func (d *daemon) shutdown() {
+  d.shutdownOnce.Do(func() {
+    d.logger.Info("Shutting down")
+    for _, frontend := range d.frontends {
+      frontend.Close()
+    }
+    ctx, cancel := context.WithTimeout(context.Background(),
+      time.Duration(d.conf.ShutdownTimeout))
+    defer cancel()
+    if err := d.server.Shutdown(ctx); err != nil {
+      d.logger.Error("Error shutting down", "err", err)
+    }
+    <-d.served
+    if err := d.tracer.Close(); err != nil {
+      d.logger.Error("Error closing the trace file", "err", err)
+    }
+  })
+}
+
+/**
+ * Reload `--encryption_keyfile` and re-encrypt existing values with its
+ * active key in the background, printing the outcome once done.
+ */
+func (d *daemon) rotateKeys() error {
+  if d.conf.EncryptionKeyfile == "" {
+    return errors.New("Encryption is not enabled; pass --encryption_keyfile")
+  }
+  if d.fs == nil {
+    return errors.New("Key rotation requires the filestore.")
+  }
+
+  keyring, err := store.LoadKeyring(d.conf.EncryptionKeyfile)
+  if err != nil {
+    return fmt.Errorf("Error loading keyfile: %w", err)
+  }
+
+  done := d.fs.RotateKeys(keyring)
+  d.logger.Info("Rotating keys in the background", "key_id", keyring.ActiveKeyId())
+  go func() {
+    if err := <-done; err != nil {
+      d.logger.Error("Key rotation finished with errors", "err", err)
+    } else {
+      d.logger.Info("Key rotation complete")
+    }
+  }()
+  return nil
+}
+
+/**
+ * Run the `serve` subcommand: serve until SIGINT or SIGTERM, without reading
+ * stdin. Once every listener is bound, writes `--pid_file` and notifies
+ * systemd of readiness if run as a `Type=notify` unit. SIGHUP rotates the
+ * encryption keys. Returns the exit code.
+ */
+func runServe(conf *config.Config) int {
+  d, err := startDaemon(conf)
+  if err != nil {
+    fmt.Println("Error starting server; aborting.", err)
+    return EXIT_FAILURE
+  }
+
+  if conf.PidFile != "" {
+    pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+    if err := os.WriteFile(conf.PidFile, pid, 0644); err != nil {
+      fmt.Println("Error writing PID file; aborting.", err)
+      d.shutdown()
+      return EXIT_FAILURE
+    }
+    defer os.Remove(conf.PidFile)
+  }
+  if err := notifySystemd("READY=1"); err != nil {
+    d.logger.Warn("Error notifying systemd", "err", err)
+  }
+  d.logger.Info("Serving", "address", conf.Address)
+
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+  for {
+    select {
+    case received := <-signals:
+      if received == syscall.SIGHUP {
+        if err := d.rotateKeys(); err != nil {
+          d.logger.Error("Error rotating keys", "err", err)
+        }
+        continue
+      }
+      notifySystemd("STOPPING=1")
+      d.shutdown()
+      return EXIT_OK
+    case <-d.served:
+      // Serving failed, rather than being shut down.
+      d.shutdown()
+      return EXIT_FAILURE
+    }
+  }
+}
+
+/**
+ * Send a state, e.g. `READY=1`, to the systemd service manager via the
+ * socket in $NOTIFY_SOCKET. Does nothing unless run by systemd.
+ */
+func notifySystemd(state string) error {
+  socket := os.Getenv("NOTIFY_SOCKET")
+  if socket == "" {
+    return nil
+  }
+  // A leading `@` names a socket in the abstract namespace.
+  if socket[0] == '@' {
+    socket = "\x00" + socket[1:]
+  }
+
+  conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{ Name: socket, Net: "unixgram" })
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  _, err = conn.Write([]byte(state))
+  return err
+}
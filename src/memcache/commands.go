@@ -0,0 +1,540 @@
+package memcache
+
+import (
+  "errors"
+  "fmt"
+  "hash/fnv"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  // Reported by `version` and `stats`; this frontend implements a subset of
+  // the text protocol of this version.
+  MEMCACHED_VERSION = "1.6.0"
+  // The metadata entry holding a value's client flags. Values without it,
+  // e.g. those written via the HTTP API, have flags 0.
+  FLAGS_METADATA_KEY = "memcache_flags"
+)
+
+// Handles a command, whose name is args[0]. Returns an error only if the
+// connection can no longer be used, e.g. a data block was malformed.
+type commandHandler func(c *conn, args []string) error
+
+type command struct {
+  handler commandHandler
+  // The number of arguments including the name: exactly `arity` if
+  // positive, at least -`arity` if negative. Excludes a `noreply`.
+  arity int
+  // Whether a trailing `noreply` argument suppresses the reply.
+  noreply bool
+  // Whether a data block follows the command line, whose size is args[4].
+  data bool
+  // With an auth policy, the permissions the connection's token must hold
+  // on every key (or prefix) returned by `keysOf`. Commands without any are
+  // allowed before authenticating.
+  permissions []auth.Permission
+  keysOf func(args []string) []string
+}
+
+var (
+  readOnly = []auth.Permission{ auth.PERMISSION_READ }
+  writeOnly = []auth.Permission{ auth.PERMISSION_WRITE }
+  readWrite = []auth.Permission{ auth.PERMISSION_READ, auth.PERMISSION_WRITE }
+  adminOnly = []auth.Permission{ auth.PERMISSION_ADMIN }
+)
+
+// The supported commands, by name.
+var commands = map[string]*command{
+  "get": { handleGet, -2, false, false, readOnly, everyKey },
+  "gets": { handleGet, -2, false, false, readOnly, everyKey },
+  "set": { handleStorage, 5, true, true, writeOnly, firstKey },
+  "add": { handleStorage, 5, true, true, writeOnly, firstKey },
+  "replace": { handleStorage, 5, true, true, writeOnly, firstKey },
+  "cas": { handleStorage, 6, true, true, readWrite, firstKey },
+  "delete": { handleDelete, 2, true, false, writeOnly, firstKey },
+  "incr": { handleIncrDecr, 3, true, false, readWrite, firstKey },
+  "decr": { handleIncrDecr, 3, true, false, readWrite, firstKey },
+  "touch": { handleTouch, 3, true, false, writeOnly, firstKey },
+  "stats": { handleStats, 1, false, false, adminOnly, everyPrefix },
+  "version": { handleVersion, 1, false, false, nil, nil },
+  "quit": { handleQuit, 1, false, false, nil, nil },
+}
+
+// Execute a command line, writing its reply.
+func (c *conn) execute(line string) error {
+  c.noreply = false
+  args := strings.Fields(line)
+  if len(args) == 0 {
+    c.reply("ERROR")
+    return nil
+  }
+
+  cmd, ok := commands[args[0]]
+  if !ok {
+    c.reply("ERROR")
+    return nil
+  }
+
+  if cmd.noreply && len(args) == cmd.arity + 1 && args[len(args) - 1] == "noreply" {
+    c.noreply = true
+    args = args[:len(args) - 1]
+  }
+  if (cmd.arity > 0 && len(args) != cmd.arity) ||
+      (cmd.arity < 0 && len(args) < -cmd.arity) {
+    c.reply("ERROR")
+    return nil
+  }
+
+  if c.server.policy != nil && c.principal == nil && args[0] == "set" {
+    return c.authenticate(args)
+  }
+  if !c.authorize(cmd, args) {
+    if cmd.data {
+      // Skip the refused command's data block, so the next line parses.
+      if size, err := strconv.Atoi(args[4]); err == nil && size >= 0 {
+        return discardData(c.reader, size)
+      }
+    }
+    return nil
+  }
+  return cmd.handler(c, args)
+}
+
+/**
+ * Authenticate the connection from the data block of a `set`, as memcached
+ * does for the text protocol: `<username> <token>`, where the key and the
+ * username are ignored. Replies STORED once authenticated.
+ */
+func (c *conn) authenticate(args []string) error {
+  size, err := strconv.Atoi(args[4])
+  if err != nil || size < 0 || size > MAX_LINE_BYTES {
+    c.clientError("bad command line format")
+    return nil
+  }
+
+  data, err := readData(c.reader, size)
+  if err == errBadDataChunk {
+    c.noreply = false
+    c.clientError(err.Error())
+    return err
+  } else if err != nil {
+    return err
+  }
+
+  fields := strings.Fields(string(data))
+  if len(fields) == 2 {
+    if principal, ok := c.server.policy.Authenticate(fields[1]); ok {
+      c.principal = principal
+      c.reply("STORED")
+      return nil
+    }
+  }
+  c.clientError("authentication failure")
+  return nil
+}
+
+/**
+ * Return whether the connection may run the command, replying with an error
+ * if not: before authenticating, or if its token lacks a permission on one
+ * of the keys.
+ */
+func (c *conn) authorize(cmd *command, args []string) bool {
+  if c.server.policy == nil || len(cmd.permissions) == 0 {
+    return true
+  }
+  if c.principal == nil {
+    c.clientError("unauthenticated")
+    return false
+  }
+
+  for _, key := range cmd.keysOf(args) {
+    for _, permission := range cmd.permissions {
+      if !c.principal.Allowed(permission, key) {
+        c.server.logger.Warn("Denied memcached command", "principal", c.principal.Name,
+          "command", args[0], "permission", permission, "key", key)
+        c.clientError("access denied")
+        return false
+      }
+    }
+  }
+  return true
+}
+
+// The key of commands taking a single key.
+func firstKey(args []string) []string {
+  return args[1:2]
+}
+
+// The keys of commands taking only keys.
+func everyKey(args []string) []string {
+  return args[1:]
+}
+
+// Commands covering every key, i.e. the empty prefix.
+func everyPrefix(args []string) []string {
+  return []string{ "" }
+}
+
+// Write a reply line, unless the command was sent with `noreply`.
+func (c *conn) reply(line string) {
+  if !c.noreply {
+    c.writer.WriteString(line + "\r\n")
+  }
+}
+
+func (c *conn) clientError(message string) {
+  c.reply("CLIENT_ERROR " + message)
+}
+
+// Reply with a store error, other than a missing key.
+func (c *conn) storeError(err error) {
+  c.server.logger.Error("Memcached store error", "err", err)
+  c.reply("SERVER_ERROR " + strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// Read a key within a transaction, reporting whether it exists.
+func lookup(tx server.Transaction, key string) (store.Value, *store.Attributes, bool, error) {
+  value, attributes, err := tx.Get(store.Key(key))
+  if errors.Is(err, os.ErrNotExist) {
+    return store.EMPTY_VALUE, nil, false, nil
+  } else if err != nil {
+    return store.EMPTY_VALUE, nil, false, err
+  }
+  return value, attributes, true, nil
+}
+
+// Return the client flags stored in the value's attributes.
+func flagsOf(attributes *store.Attributes) uint32 {
+  if attributes == nil {
+    return 0
+  }
+  flags, _ := strconv.ParseUint(attributes.Metadata[FLAGS_METADATA_KEY], 10, 32)
+  return uint32(flags)
+}
+
+/**
+ * Return the CAS token of a value: a hash of its version, which changes on
+ * every write through this frontend or a replicated store. Values without a
+ * version, e.g. those written via the HTTP API, are hashed by content.
+ */
+func casToken(value store.Value, attributes *store.Attributes) uint64 {
+  hash := fnv.New64a()
+  if attributes != nil && !attributes.Version.IsZero() {
+    hash.Write([]byte(attributes.Version.String()))
+    return hash.Sum64()
+  }
+
+  hash.Write([]byte(value))
+  if attributes != nil {
+    fmt.Fprintf(hash, "\x00%v\x00%v", attributes.ExpiresAt.UnixNano(), attributes.Metadata)
+  }
+  return hash.Sum64()
+}
+
+// Return the attributes of a value written with the flags and expiry.
+func (s *Server) attributes(flags uint32, expiresAt time.Time) *store.Attributes {
+  attributes := &store.Attributes{ ExpiresAt: expiresAt, Version: s.nextVersion() }
+  if flags != 0 {
+    attributes.Metadata = map[string]string{
+      FLAGS_METADATA_KEY: strconv.FormatUint(uint64(flags), 10),
+    }
+  }
+  return attributes
+}
+
+// Return a copy of the attributes, with a new version.
+func (s *Server) rewrittenAttributes(attributes *store.Attributes) *store.Attributes {
+  rewritten := &store.Attributes{}
+  if attributes != nil {
+    *rewritten = *attributes
+  }
+  rewritten.Version = s.nextVersion()
+  return rewritten
+}
+
+// get <key>*, gets <key>*: the values of the keys present, with CAS tokens
+// for gets.
+func handleGet(c *conn, args []string) error {
+  keys := args[1:]
+  for _, key := range keys {
+    if !validKey(key) {
+      c.clientError("bad command line format")
+      return nil
+    }
+  }
+
+  type item struct {
+    key string
+    value store.Value
+    attributes *store.Attributes
+  }
+  var items []item
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    for _, key := range keys {
+      value, attributes, exists, err := lookup(tx, key)
+      if err != nil {
+        return err
+      } else if exists {
+        items = append(items, item{ key, value, attributes })
+      }
+    }
+    return nil
+  })
+
+  c.server.count(func(stats *serverStats) {
+    stats.cmdGet += int64(len(keys))
+    stats.getHits += int64(len(items))
+    stats.getMisses += int64(len(keys) - len(items))
+  })
+  if err != nil {
+    c.storeError(err)
+    return nil
+  }
+
+  for _, item := range items {
+    header := fmt.Sprintf("VALUE %v %v %v", item.key, flagsOf(item.attributes), len(item.value))
+    if args[0] == "gets" {
+      header += fmt.Sprintf(" %v", casToken(item.value, item.attributes))
+    }
+    c.reply(header)
+    c.reply(string(item.value))
+  }
+  c.reply("END")
+  return nil
+}
+
+/**
+ * set|add|replace <key> <flags> <exptime> <bytes> [noreply], followed by
+ * the data block. add stores only a missing key, and replace only an
+ * existing one.
+ *
+ * <p> cas <key> <flags> <exptime> <bytes> <cas unique> [noreply] stores only
+ * if the key is unchanged since a gets returned the CAS token.
+ */
+func handleStorage(c *conn, args []string) error {
+  size, err := strconv.Atoi(args[4])
+  if err != nil || size < 0 {
+    c.clientError("bad command line format")
+    return nil
+  }
+  if size > c.server.maxItemBytes {
+    c.reply("SERVER_ERROR object too large for cache")
+    return discardData(c.reader, size)
+  }
+
+  data, err := readData(c.reader, size)
+  if err == errBadDataChunk {
+    c.noreply = false
+    c.clientError(err.Error())
+    return err
+  } else if err != nil {
+    return err
+  }
+
+  mode, key := args[0], args[1]
+  flags, flagsErr := strconv.ParseUint(args[2], 10, 32)
+  expiresAt, exptimeErr := parseExptime(args[3], time.Now())
+  var cas uint64
+  var casErr error
+  if mode == "cas" {
+    cas, casErr = strconv.ParseUint(args[5], 10, 64)
+  }
+  if !validKey(key) || flagsErr != nil || exptimeErr != nil || casErr != nil {
+    c.clientError("bad command line format")
+    return nil
+  }
+
+  c.server.count(func(stats *serverStats) { stats.cmdSet++ })
+  var result string
+  err = c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    if mode != "set" {
+      value, attributes, exists, err := lookup(tx, key)
+      if err != nil {
+        return err
+      }
+
+      switch {
+      case mode == "add" && exists, mode == "replace" && !exists:
+        result = "NOT_STORED"
+        return nil
+      case mode == "cas" && !exists:
+        result = "NOT_FOUND"
+        return nil
+      case mode == "cas" && casToken(value, attributes) != cas:
+        result = "EXISTS"
+        return nil
+      }
+    }
+
+    result = "STORED"
+    return tx.Set(store.Key(key), store.Value(data), c.server.attributes(uint32(flags), expiresAt))
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply(result)
+  }
+  return nil
+}
+
+// delete <key> [noreply]
+func handleDelete(c *conn, args []string) error {
+  key := args[1]
+  if !validKey(key) {
+    c.clientError("bad command line format")
+    return nil
+  }
+
+  var result string
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    _, _, exists, err := lookup(tx, key)
+    if err != nil {
+      return err
+    } else if !exists {
+      result = "NOT_FOUND"
+      return nil
+    }
+
+    result = "DELETED"
+    return tx.Delete(store.Key(key))
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply(result)
+  }
+  return nil
+}
+
+/**
+ * incr|decr <key> <delta> [noreply]: replies with the new value. The value
+ * must be a decimal unsigned 64-bit integer; incr wraps around on overflow,
+ * and decr stops at 0, as in memcached. Flags and expiry are kept.
+ */
+func handleIncrDecr(c *conn, args []string) error {
+  key := args[1]
+  if !validKey(key) {
+    c.clientError("bad command line format")
+    return nil
+  }
+  delta, err := strconv.ParseUint(args[2], 10, 64)
+  if err != nil {
+    c.clientError("invalid numeric delta argument")
+    return nil
+  }
+
+  var result string
+  err = c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    value, attributes, exists, err := lookup(tx, key)
+    if err != nil {
+      return err
+    } else if !exists {
+      result = "NOT_FOUND"
+      return nil
+    }
+
+    n, err := strconv.ParseUint(string(value), 10, 64)
+    if err != nil {
+      result = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+      return nil
+    }
+
+    if args[0] == "incr" {
+      n += delta
+    } else if delta > n {
+      n = 0
+    } else {
+      n -= delta
+    }
+    result = strconv.FormatUint(n, 10)
+    return tx.Set(store.Key(key), store.Value(result), c.server.rewrittenAttributes(attributes))
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply(result)
+  }
+  return nil
+}
+
+// touch <key> <exptime> [noreply]: updates the expiry of an existing key.
+func handleTouch(c *conn, args []string) error {
+  key := args[1]
+  expiresAt, err := parseExptime(args[2], time.Now())
+  if !validKey(key) || err != nil {
+    c.clientError("bad command line format")
+    return nil
+  }
+
+  c.server.count(func(stats *serverStats) { stats.cmdTouch++ })
+  var result string
+  err = c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    value, attributes, exists, err := lookup(tx, key)
+    if err != nil {
+      return err
+    } else if !exists {
+      result = "NOT_FOUND"
+      return nil
+    }
+
+    result = "TOUCHED"
+    rewritten := c.server.rewrittenAttributes(attributes)
+    rewritten.ExpiresAt = expiresAt
+    return tx.Set(store.Key(key), value, rewritten)
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply(result)
+  }
+  return nil
+}
+
+// stats: replies with server, connection and command counters.
+func handleStats(c *conn, args []string) error {
+  stats := c.server.snapshotStats()
+  lines := []struct {
+    name string
+    value interface{}
+  }{
+    { "pid", os.Getpid() },
+    { "uptime", stats.uptimeSeconds },
+    { "time", time.Now().Unix() },
+    { "version", MEMCACHED_VERSION },
+    { "curr_connections", stats.currConnections },
+    { "max_connections", stats.maxConnections },
+    { "total_connections", stats.totalConnections },
+    { "rejected_connections", stats.rejectedConnections },
+    { "cmd_get", stats.cmdGet },
+    { "cmd_set", stats.cmdSet },
+    { "cmd_touch", stats.cmdTouch },
+    { "get_hits", stats.getHits },
+    { "get_misses", stats.getMisses },
+  }
+  for _, line := range lines {
+    c.reply(fmt.Sprintf("STAT %v %v", line.name, line.value))
+  }
+  c.reply("END")
+  return nil
+}
+
+func handleVersion(c *conn, args []string) error {
+  c.reply("VERSION " + MEMCACHED_VERSION)
+  return nil
+}
+
+// quit: the connection closes without a reply.
+func handleQuit(c *conn, args []string) error {
+  c.quit = true
+  return nil
+}
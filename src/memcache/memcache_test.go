@@ -0,0 +1,354 @@
+package memcache
+
+import (
+  "bufio"
+  "context"
+  "fmt"
+  "net"
+  "strings"
+  "testing"
+  "time"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// A memcached server over a filestore-backed server.Server, listening on a
+// free port.
+func startTestServer(t *testing.T, options *Options) (string, *server.Server) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  backend := server.MakeServerWithStores(fs, nil)
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  s := MakeServer(backend, options)
+  go s.Serve(listener)
+  t.Cleanup(func() { s.Close() })
+  return listener.Addr().String(), backend
+}
+
+// A raw client connection.
+type testConn struct {
+  t *testing.T
+  conn net.Conn
+  reader *bufio.Reader
+}
+
+func dial(t *testing.T, address string) *testConn {
+  conn, err := net.Dial("tcp", address)
+  if err != nil {
+    t.Fatalf("Error connecting: %v", err)
+  }
+  t.Cleanup(func() { conn.Close() })
+  conn.SetDeadline(time.Now().Add(5 * time.Second))
+  return &testConn{ t: t, conn: conn, reader: bufio.NewReader(conn) }
+}
+
+func (c *testConn) send(request string) {
+  if _, err := c.conn.Write([]byte(request)); err != nil {
+    c.t.Fatalf("Error writing: %v", err)
+  }
+}
+
+func (c *testConn) readLine() string {
+  line, err := c.reader.ReadString('\n')
+  if err != nil {
+    c.t.Fatalf("Error reading reply: %v", err)
+  }
+  return line
+}
+
+// Read the reply to a retrieval command, up to and including END.
+func (c *testConn) readValues() string {
+  var reply string
+  for {
+    line := c.readLine()
+    reply += line
+    if line == "END\r\n" || strings.HasSuffix(line, "ERROR\r\n") {
+      return reply
+    }
+  }
+}
+
+// Send a request and check its single line reply.
+func (c *testConn) expect(request string, want string) {
+  c.send(request)
+  if got := c.readLine(); got != want {
+    c.t.Errorf("Expected %q for %q, got %q", want, request, got)
+  }
+}
+
+// Send a retrieval request and check its reply.
+func (c *testConn) expectValues(request string, want string) {
+  c.send(request)
+  if got := c.readValues(); got != want {
+    c.t.Errorf("Expected %q for %q, got %q", want, request, got)
+  }
+}
+
+// Return the CAS token of a key via gets.
+func (c *testConn) casToken(key string) string {
+  c.send("gets " + key + "\r\n")
+  fields := strings.Fields(c.readValues())
+  if len(fields) < 5 || fields[0] != "VALUE" {
+    c.t.Fatalf("Expected a value for gets %v, got %v", key, fields)
+  }
+  return fields[4]
+}
+
+func TestStorageCommands(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expectValues("get key\r\n", "END\r\n")
+  c.expect("replace key 0 0 5\r\nvalue\r\n", "NOT_STORED\r\n")
+  c.expect("add key 0 0 5\r\nvalue\r\n", "STORED\r\n")
+  c.expect("add key 0 0 5\r\nother\r\n", "NOT_STORED\r\n")
+  c.expect("replace key 0 0 9\r\nnew value\r\n", "STORED\r\n")
+  c.expect("set other 0 0 0\r\n\r\n", "STORED\r\n")
+  c.expectValues("get key other missing\r\n",
+    "VALUE key 0 9\r\nnew value\r\nVALUE other 0 0\r\n\r\nEND\r\n")
+
+  c.expect("delete key\r\n", "DELETED\r\n")
+  c.expect("delete key\r\n", "NOT_FOUND\r\n")
+  c.expectValues("get key\r\n", "END\r\n")
+}
+
+func TestCasUsesTokensFromGets(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("cas key 0 0 5 1\r\nvalue\r\n", "NOT_FOUND\r\n")
+  c.expect("set key 0 0 5\r\nvalue\r\n", "STORED\r\n")
+  token := c.casToken("key")
+
+  c.expect("cas key 0 0 5 " + token + "\r\nfirst\r\n", "STORED\r\n")
+  // The token is stale after the write, even though nothing else changed.
+  c.expect("cas key 0 0 6 " + token + "\r\nsecond\r\n", "EXISTS\r\n")
+  c.expectValues("get key\r\n", "VALUE key 0 5\r\nfirst\r\nEND\r\n")
+
+  if next := c.casToken("key"); next == token {
+    t.Errorf("Expected a new CAS token after a write, got %v again", next)
+  }
+}
+
+func TestCasTokensOfValuesWrittenViaHttp(t *testing.T) {
+  address, backend := startTestServer(t, nil)
+  c := dial(t, address)
+
+  backend.Set(context.Background(), store.Key("key"), store.Value("value"), nil)
+  token := c.casToken("key")
+  if c.casToken("key") != token {
+    t.Errorf("Expected a stable CAS token for an unchanged value")
+  }
+
+  backend.Set(context.Background(), store.Key("key"), store.Value("changed"), nil)
+  c.expect("cas key 0 0 5 " + token + "\r\nfirst\r\n", "EXISTS\r\n")
+  c.expect("cas key 0 0 5 " + c.casToken("key") + "\r\nfirst\r\n", "STORED\r\n")
+}
+
+func TestFlagsAndExptime(t *testing.T) {
+  address, backend := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("set key 4294967295 0 5\r\nvalue\r\n", "STORED\r\n")
+  c.expectValues("get key\r\n", "VALUE key 4294967295 5\r\nvalue\r\nEND\r\n")
+  c.expect("set key 4294967296 0 5\r\nvalue\r\n", "CLIENT_ERROR bad command line format\r\n")
+
+  c.expect("set expiring 0 100 5\r\nvalue\r\n", "STORED\r\n")
+  if _, attributes, err := backend.Get(context.Background(), store.Key("expiring")); err != nil ||
+      time.Until(attributes.ExpiresAt) < 99 * time.Second ||
+      time.Until(attributes.ExpiresAt) > 100 * time.Second {
+    t.Errorf("Expected a relative exptime to expire in 100s, got %v (%v)", attributes, err)
+  }
+
+  c.expect("set absolute 0 4102444800 5\r\nvalue\r\n", "STORED\r\n")
+  if _, attributes, err := backend.Get(context.Background(), store.Key("absolute")); err != nil ||
+      !attributes.ExpiresAt.Equal(time.Unix(4102444800, 0)) {
+    t.Errorf("Expected an absolute exptime, got %v (%v)", attributes, err)
+  }
+
+  c.expect("set expired 0 -1 5\r\nvalue\r\n", "STORED\r\n")
+  c.expect("set past 0 1000000000 5\r\nvalue\r\n", "STORED\r\n")
+  c.expectValues("get expired past\r\n", "END\r\n")
+}
+
+func TestTouch(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("touch key 10\r\n", "NOT_FOUND\r\n")
+  c.expect("set key 7 0 5\r\nvalue\r\n", "STORED\r\n")
+  token := c.casToken("key")
+
+  c.expect("touch key 10\r\n", "TOUCHED\r\n")
+  if c.casToken("key") == token {
+    t.Errorf("Expected touch to change the CAS token")
+  }
+  c.expectValues("get key\r\n", "VALUE key 7 5\r\nvalue\r\nEND\r\n")
+
+  c.expect("touch key -1\r\n", "TOUCHED\r\n")
+  c.expectValues("get key\r\n", "END\r\n")
+}
+
+func TestIncrDecr(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("incr counter 1\r\n", "NOT_FOUND\r\n")
+  c.expect("set counter 3 0 2\r\n10\r\n", "STORED\r\n")
+  c.expect("incr counter 5\r\n", "15\r\n")
+  c.expect("decr counter 20\r\n", "0\r\n")
+  c.expectValues("get counter\r\n", "VALUE counter 3 1\r\n0\r\nEND\r\n")
+
+  c.expect("set counter 0 0 20\r\n18446744073709551615\r\n", "STORED\r\n")
+  c.expect("incr counter 2\r\n", "1\r\n")
+
+  c.expect("incr counter x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+  c.expect("set text 0 0 3\r\nabc\r\n", "STORED\r\n")
+  c.expect("incr text 1\r\n",
+    "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+}
+
+func TestNoreplyAndPipelining(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  // Send every command in one write, before reading any reply.
+  var pipeline strings.Builder
+  var want strings.Builder
+  for i := 0; i < 50; i++ {
+    value := fmt.Sprintf("%v", i)
+    fmt.Fprintf(&pipeline, "set key%v 0 0 %v noreply\r\n%v\r\n", i, len(value), value)
+    fmt.Fprintf(&pipeline, "get key%v\r\n", i)
+    fmt.Fprintf(&want, "VALUE key%v 0 %v\r\n%v\r\nEND\r\n", i, len(value), value)
+  }
+  pipeline.WriteString("delete key0 noreply\r\nincr key1 1 noreply\r\nget key0 key1\r\n")
+  want.WriteString("VALUE key1 0 1\r\n2\r\nEND\r\n")
+  c.send(pipeline.String())
+
+  var got string
+  for i := 0; i < 51; i++ {
+    got += c.readValues()
+  }
+  if got != want.String() {
+    t.Errorf("Expected only the replies to gets, in order, got %q", got)
+  }
+}
+
+func TestRefusesOversizedValues(t *testing.T) {
+  address, _ := startTestServer(t, &Options{ MaxItemBytes: 4 })
+  c := dial(t, address)
+
+  c.expect("set key 0 0 5\r\nvalue\r\n", "SERVER_ERROR object too large for cache\r\n")
+  // The data block was skipped, so the connection remains usable.
+  c.expect("set key 0 0 4\r\nsome\r\n", "STORED\r\n")
+}
+
+func TestProtocolErrors(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("flush_all\r\n", "ERROR\r\n")
+  c.expect("get\r\n", "ERROR\r\n")
+  c.expect("version\r\n", "VERSION " + MEMCACHED_VERSION + "\r\n")
+  c.expect("set " + strings.Repeat("k", MAX_KEY_BYTES + 1) + " 0 0 1\r\nv\r\n",
+    "CLIENT_ERROR bad command line format\r\n")
+
+  // A data block longer than declared cannot be parsed further.
+  c.expect("set key 0 0 1\r\nvalue\r\n", "CLIENT_ERROR bad data chunk\r\n")
+  if _, err := c.reader.ReadString('\n'); err == nil {
+    t.Errorf("Expected the connection to close")
+  }
+}
+
+func TestStats(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("set key 0 0 5\r\nvalue\r\n", "STORED\r\n")
+  c.expectValues("get key missing\r\n", "VALUE key 0 5\r\nvalue\r\nEND\r\n")
+
+  c.send("stats\r\n")
+  stats := c.readValues()
+  for _, want := range []string{
+    "STAT curr_connections 1\r\n",
+    "STAT cmd_get 2\r\n",
+    "STAT cmd_set 1\r\n",
+    "STAT get_hits 1\r\n",
+    "STAT get_misses 1\r\n",
+  } {
+    if !strings.Contains(stats, want) {
+      t.Errorf("Expected stats to contain %q, got %q", want, stats)
+    }
+  }
+}
+
+func TestRefusesConnectionsOverTheLimit(t *testing.T) {
+  address, _ := startTestServer(t, &Options{ MaxConnections: 1 })
+  first := dial(t, address)
+  first.expect("version\r\n", "VERSION " + MEMCACHED_VERSION + "\r\n")
+
+  second := dial(t, address)
+  if reply := second.readLine(); reply != "SERVER_ERROR too many open connections\r\n" {
+    t.Errorf("Expected the second connection to be refused, got %q", reply)
+  }
+}
+
+func TestRequiresAuthWithAPolicy(t *testing.T) {
+  policy, err := auth.ParsePolicy([]byte(`{
+    "roles": {
+      "builds": [ { "prefix": "builds-", "permissions": [ "read", "write" ] } ]
+    },
+    "tokens": [ { "name": "ci", "token": "ci-token", "roles": [ "builds" ] } ]
+  }`))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+  address, _ := startTestServer(t, &Options{ Auth: policy })
+  c := dial(t, address)
+
+  c.expect("get builds-1\r\n", "CLIENT_ERROR unauthenticated\r\n")
+  c.expect("set auth 0 0 14\r\nci wrong-token\r\n", "CLIENT_ERROR authentication failure\r\n")
+  c.expect("delete builds-1\r\n", "CLIENT_ERROR unauthenticated\r\n")
+
+  c.expect("set auth 0 0 11\r\nci ci-token\r\n", "STORED\r\n")
+  c.expect("set builds-1 0 0 5\r\nvalue\r\n", "STORED\r\n")
+  c.send("get builds-1\r\n")
+  if got := c.readValues(); got != "VALUE builds-1 0 5\r\nvalue\r\nEND\r\n" {
+    t.Errorf("Expected the value, got %q", got)
+  }
+
+  // Refused storage commands skip their data block.
+  c.expect("set other 0 0 5\r\nvalue\r\n", "CLIENT_ERROR access denied\r\n")
+  c.expect("get builds-1 other\r\n", "CLIENT_ERROR access denied\r\n")
+  c.expect("stats\r\n", "CLIENT_ERROR access denied\r\n")
+  c.expect("version\r\n", "VERSION " + MEMCACHED_VERSION + "\r\n")
+}
+
+func TestParseExptime(t *testing.T) {
+  now := time.Unix(1000, 0)
+  cases := []struct {
+    exptime string
+    expiresAt time.Time
+  }{
+    { "0", time.Time{} },
+    { "-1", now },
+    { "60", now.Add(time.Minute) },
+    { fmt.Sprintf("%v", MAX_RELATIVE_EXPTIME), now.Add(MAX_RELATIVE_EXPTIME * time.Second) },
+    { fmt.Sprintf("%v", MAX_RELATIVE_EXPTIME + 1), time.Unix(MAX_RELATIVE_EXPTIME + 1, 0) },
+  }
+  for _, c := range cases {
+    if expiresAt, err := parseExptime(c.exptime, now); err != nil || !expiresAt.Equal(c.expiresAt) {
+      t.Errorf("Expected exptime %v to expire at %v, got %v (%v)",
+        c.exptime, c.expiresAt, expiresAt, err)
+    }
+  }
+
+  if _, err := parseExptime("soon", now); err == nil {
+    t.Errorf("Expected an error for a non-numeric exptime")
+  }
+}
@@ -0,0 +1,101 @@
+package memcache
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+  "time"
+)
+
+const (
+  // The longest key accepted, as in memcached.
+  MAX_KEY_BYTES = 250
+  // The longest command line accepted, e.g. a `get` of many keys.
+  MAX_LINE_BYTES = 64 * 1024
+  // Exptimes up to this many seconds are relative to now; larger ones are
+  // absolute Unix times, as in memcached.
+  MAX_RELATIVE_EXPTIME = 60 * 60 * 24 * 30
+)
+
+var (
+  // Returned for a command line which is too long. The connection is closed
+  // after replying, as the rest of the line cannot be skipped reliably.
+  errLineTooLong = errors.New("line too long")
+  // Returned for a data block which is not terminated by CRLF.
+  errBadDataChunk = errors.New("bad data chunk")
+)
+
+// Read a command line terminated by CRLF (or LF alone).
+func readLine(reader *bufio.Reader) (string, error) {
+  var line []byte
+  for {
+    fragment, isPrefix, err := reader.ReadLine()
+    if err != nil {
+      return "", err
+    }
+    line = append(line, fragment...)
+    if len(line) > MAX_LINE_BYTES {
+      return "", errLineTooLong
+    }
+    if !isPrefix {
+      return string(line), nil
+    }
+  }
+}
+
+// Read the data block of a storage command: `n` bytes followed by CRLF.
+func readData(reader *bufio.Reader, n int) ([]byte, error) {
+  data := make([]byte, n + 2)
+  if _, err := io.ReadFull(reader, data); err != nil {
+    return nil, err
+  }
+  if data[n] != '\r' || data[n + 1] != '\n' {
+    return nil, errBadDataChunk
+  }
+  return data[:n], nil
+}
+
+// Skip the data block of a storage command which is being refused.
+func discardData(reader *bufio.Reader, n int) error {
+  _, err := reader.Discard(n + 2)
+  return err
+}
+
+// Return whether the key is acceptable: non-empty, at most MAX_KEY_BYTES and
+// free of control characters.
+func validKey(key string) bool {
+  if len(key) == 0 || len(key) > MAX_KEY_BYTES {
+    return false
+  }
+  for i := 0; i < len(key); i++ {
+    if key[i] <= ' ' || key[i] == 0x7f {
+      return false
+    }
+  }
+  return true
+}
+
+/**
+ * Parse an exptime into an expiry time, or the zero time if the value never
+ * expires. 0 never expires, a negative exptime has already expired, values
+ * up to MAX_RELATIVE_EXPTIME are seconds from now, and larger ones are Unix
+ * times.
+ */
+func parseExptime(exptime string, now time.Time) (time.Time, error) {
+  seconds, err := strconv.ParseInt(exptime, 10, 64)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("invalid exptime %q", exptime)
+  }
+
+  switch {
+  case seconds == 0:
+    return time.Time{}, nil
+  case seconds < 0:
+    return now, nil
+  case seconds <= MAX_RELATIVE_EXPTIME:
+    return now.Add(time.Duration(seconds) * time.Second), nil
+  }
+  return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,275 @@
+package memcache
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "net"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  DEFAULT_MAX_CONNECTIONS = 1024
+  // The largest value accepted by default, as in memcached.
+  DEFAULT_MAX_ITEM_BYTES = 1024 * 1024
+  // The node ID of versions assigned to values written by this frontend.
+  VERSION_NODE_ID = "memcache"
+)
+
+// The store stack commands run against; implemented by server.Server, so
+// memcached and HTTP clients share its store, cache and /watch streams.
+type Backend interface {
+  Atomically(ctx context.Context, fn func(tx server.Transaction) error) error
+}
+
+// Configures a memcached Server. Zero fields select defaults.
+type Options struct {
+  // Connections beyond this limit are refused with an error reply.
+  MaxConnections int
+  // Storage commands with larger values are refused.
+  MaxItemBytes int
+  // If set, connections must authenticate with a token, which the policy
+  // authorizes for the keys of each command, as over HTTP. The first `set`
+  // authenticates, with the data `<username> <token>`.
+  Auth *auth.Policy
+  // Logs store and connection errors; may be nil.
+  Logger *logging.Logger
+}
+
+// Counters reported by `stats`.
+type serverStats struct {
+  uptimeSeconds int64
+  currConnections int64
+  maxConnections int64
+  totalConnections int64
+  rejectedConnections int64
+  cmdGet int64
+  getHits int64
+  getMisses int64
+  cmdSet int64
+  cmdTouch int64
+}
+
+// A TCP listener speaking the memcached text protocol, so that memcached
+// clients can use the store. Commands from a connection are executed in order,
+// and pipelined commands are answered in a single write. Create instances via
+// MakeServer.
+type Server struct {
+  backend Backend
+  maxConnections int
+  maxItemBytes int
+  // Authenticates connections; nil if they need not authenticate.
+  policy *auth.Policy
+  started time.Time
+
+  listener net.Listener
+  // Every open connection, and the cancellation of its context.
+  connections map[net.Conn]context.CancelFunc
+  closed bool
+  // The timestamp of the last version assigned.
+  lastVersion int64
+  stats serverStats
+  // Guards the listener, connections, versions and counters.
+  mutex *sync.Mutex
+  logger *logging.Logger
+}
+
+// A single client connection.
+type conn struct {
+  server *Server
+  // Cancelled once the connection is closed, e.g. as the server shuts down,
+  // abandoning its store calls.
+  ctx context.Context
+  reader *bufio.Reader
+  writer *bufio.Writer
+  // Set for a command sent with `noreply`, suppressing its reply.
+  noreply bool
+  // Set by `quit`; the connection closes once pending replies are sent.
+  quit bool
+  // The holder of the token the connection authenticated with, if any.
+  principal *auth.Principal
+}
+
+// Make a Server over the backend. `options` may be nil.
+func MakeServer(backend Backend, options *Options) *Server {
+  s := &Server{}
+  s.backend = backend
+  s.maxConnections = DEFAULT_MAX_CONNECTIONS
+  s.maxItemBytes = DEFAULT_MAX_ITEM_BYTES
+  if options != nil && options.MaxConnections > 0 {
+    s.maxConnections = options.MaxConnections
+  }
+  if options != nil && options.MaxItemBytes > 0 {
+    s.maxItemBytes = options.MaxItemBytes
+  }
+  s.started = time.Now()
+  s.connections = make(map[net.Conn]context.CancelFunc)
+  s.mutex = &sync.Mutex{}
+  if options != nil {
+    s.policy = options.Auth
+    s.logger = options.Logger
+  }
+  return s
+}
+
+// Listen on `address`, e.g. `:11211`, and serve connections until Close.
+func (s *Server) ListenAndServe(address string) error {
+  listener, err := net.Listen("tcp", address)
+  if err != nil {
+    return err
+  }
+  return s.Serve(listener)
+}
+
+// Serve connections from the listener until Close.
+func (s *Server) Serve(listener net.Listener) error {
+  s.mutex.Lock()
+  if s.closed {
+    s.mutex.Unlock()
+    listener.Close()
+    return errors.New("memcached server closed")
+  }
+  s.listener = listener
+  s.mutex.Unlock()
+
+  for {
+    netConn, err := listener.Accept()
+    if err != nil {
+      s.mutex.Lock()
+      closed := s.closed
+      s.mutex.Unlock()
+      if closed {
+        return nil
+      }
+      return err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    if !s.admit(netConn, cancel) {
+      cancel()
+      netConn.Write([]byte("SERVER_ERROR too many open connections\r\n"))
+      netConn.Close()
+      continue
+    }
+    go s.serveConn(ctx, netConn)
+  }
+}
+
+// Track a new connection and the cancellation of its context, unless the
+// limit is reached.
+func (s *Server) admit(netConn net.Conn, cancel context.CancelFunc) bool {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  s.stats.totalConnections++
+  if s.closed || len(s.connections) >= s.maxConnections {
+    s.stats.rejectedConnections++
+    return false
+  }
+  s.connections[netConn] = cancel
+  return true
+}
+
+// Stop listening and close every connection.
+func (s *Server) Close() error {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  s.closed = true
+  for netConn, cancel := range s.connections {
+    cancel()
+    netConn.Close()
+  }
+
+  if s.listener != nil {
+    return s.listener.Close()
+  }
+  return nil
+}
+
+// Apply `fn` to the counters.
+func (s *Server) count(fn func(stats *serverStats)) {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  fn(&s.stats)
+}
+
+func (s *Server) snapshotStats() serverStats {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  stats := s.stats
+  stats.uptimeSeconds = int64(time.Since(s.started) / time.Second)
+  stats.currConnections = int64(len(s.connections))
+  stats.maxConnections = int64(s.maxConnections)
+  return stats
+}
+
+/**
+ * Return a new version for a value written by this frontend, from which its
+ * CAS token is derived. Versions increase strictly, even if the clock does
+ * not.
+ */
+func (s *Server) nextVersion() store.Version {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  timestamp := time.Now().UnixNano()
+  if timestamp <= s.lastVersion {
+    timestamp = s.lastVersion + 1
+  }
+  s.lastVersion = timestamp
+  return store.Version{ Timestamp: timestamp, NodeId: VERSION_NODE_ID }
+}
+
+/**
+ * Execute the connection's commands in order, within `ctx`. Replies are buffered while
+ * more pipelined commands are already waiting, and flushed once the input
+ * is drained.
+ */
+func (s *Server) serveConn(ctx context.Context, netConn net.Conn) {
+  defer func() {
+    s.mutex.Lock()
+    cancel := s.connections[netConn]
+    delete(s.connections, netConn)
+    s.mutex.Unlock()
+    cancel()
+    netConn.Close()
+  }()
+
+  c := &conn{}
+  c.server = s
+  c.ctx = ctx
+  c.reader = bufio.NewReader(netConn)
+  c.writer = bufio.NewWriter(netConn)
+
+  for !c.quit {
+    line, err := readLine(c.reader)
+    if err == errLineTooLong {
+      c.clientError(err.Error())
+      c.writer.Flush()
+      return
+    } else if err != nil {
+      return
+    }
+
+    if err := c.execute(line); err != nil {
+      // The stream can no longer be parsed, e.g. a data block ended early.
+      c.writer.Flush()
+      return
+    }
+
+    if c.reader.Buffered() == 0 || c.quit {
+      if err := c.writer.Flush(); err != nil {
+        s.logger.Debug("Error writing memcached reply", "err", err)
+        return
+      }
+    }
+  }
+}
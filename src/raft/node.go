@@ -0,0 +1,963 @@
+package raft
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "math/rand"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  DEFAULT_TICK_INTERVAL = 50 * time.Millisecond
+  // Followers campaign after between ELECTION_TICKS and twice as many ticks
+  // without hearing from a leader.
+  DEFAULT_ELECTION_TICKS = 10
+  // Leaders send heartbeats every HEARTBEAT_TICKS ticks.
+  DEFAULT_HEARTBEAT_TICKS = 2
+  // The log is compacted into a snapshot once this many entries have been
+  // applied since the last snapshot.
+  DEFAULT_SNAPSHOT_THRESHOLD = 1024
+  // The most entries sent in a single append.
+  DEFAULT_MAX_ENTRIES_PER_MESSAGE = 256
+)
+
+var (
+  // Returned when a proposal's entry was replaced by another leader's, or its
+  // leader stepped down before it committed. The proposal may or may not
+  // have been applied.
+  ErrProposalDropped = fmt.Errorf("%w: Proposal dropped; its outcome is unknown", store.ErrUnavailable)
+  ErrTimeout = fmt.Errorf("%w: Timed out waiting for the Raft cluster", store.ErrUnavailable)
+  ErrStopped = fmt.Errorf("%w: Raft node stopped", store.ErrUnavailable)
+)
+
+// Returned when a request reaches a node which is not the leader.
+type NotLeaderError struct {
+  // The leader, if known.
+  Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+  if e.Leader == "" {
+    return "Not the Raft leader; no leader is known"
+  }
+  return fmt.Sprintf("Not the Raft leader; the leader is %v", e.Leader)
+}
+
+// Not being the leader is a (possibly transient) unavailability.
+func (e *NotLeaderError) Unwrap() error {
+  return store.ErrUnavailable
+}
+
+type Role int
+
+const (
+  ROLE_FOLLOWER Role = iota
+  ROLE_CANDIDATE
+  ROLE_LEADER
+)
+
+func (r Role) String() string {
+  switch r {
+  case ROLE_CANDIDATE:
+    return "candidate"
+  case ROLE_LEADER:
+    return "leader"
+  }
+  return "follower"
+}
+
+// A single entry of the replicated log. Entries with no command are no-ops,
+// appended by each new leader.
+type Entry struct {
+  Index uint64 `json:"index"`
+  Term uint64 `json:"term"`
+  Command []byte `json:"command,omitempty"`
+}
+
+// Configures a Node's timing, compaction and logging. Zero fields select
+// defaults.
+type NodeOptions struct {
+  TickInterval time.Duration
+  ElectionTicks int
+  HeartbeatTicks int
+  SnapshotThreshold uint64
+  MaxEntriesPerMessage int
+  // Logs elections and errors; may be nil.
+  Logger *logging.Logger
+}
+
+// A point-in-time view of a node's state.
+type Status struct {
+  Id string
+  Role Role
+  Term uint64
+  // The current leader, if known.
+  Leader string
+  CommitIndex uint64
+  AppliedIndex uint64
+  SnapshotIndex uint64
+  // The number of entries in the log, not counting those compacted into the
+  // snapshot.
+  LogEntries int
+}
+
+// A command awaiting commitment.
+type proposal struct {
+  command []byte
+  // The term the entry was appended in; if another entry is committed at its
+  // index, the proposal was dropped.
+  term uint64
+  done chan error
+}
+
+// A linearizable read awaiting confirmation; see `Node.ReadIndex`.
+type readRequest struct {
+  // The commit index when the read arrived; the read is served once it has
+  // been applied.
+  readIndex uint64
+  // The heartbeat round confirming the leader is still the leader.
+  context uint64
+  acks map[string]bool
+  done chan error
+}
+
+// A member of a Raft cluster with a fixed membership. The node's state is
+// owned by a single goroutine, which processes ticks, messages, proposals
+// and reads in turn; other goroutines interact with it through channels.
+// Create instances via MakeNode.
+type Node struct {
+  id string
+  // Every other member of the cluster.
+  peers []string
+  transport Transport
+  storage *storage
+  stateMachine StateMachine
+  options NodeOptions
+
+  role Role
+  term uint64
+  votedFor string
+  leader string
+  // The entries after the snapshot; entry i lives at log[i - snapshotIndex - 1].
+  log []Entry
+  snapshotIndex uint64
+  snapshotTerm uint64
+  commitIndex uint64
+  lastApplied uint64
+
+  electionElapsed int
+  electionTimeout int
+  heartbeatElapsed int
+  votes map[string]bool
+
+  // Leader state.
+  nextIndex map[string]uint64
+  matchIndex map[string]uint64
+  // The index of the no-op appended when this node became leader. Reads
+  // wait for it to commit, so that the commit index reflects every prior
+  // leader's writes.
+  termStartIndex uint64
+  proposals map[uint64]*proposal
+  reads []*readRequest
+  readContext uint64
+
+  inbox chan *Message
+  proposeRequests chan *proposal
+  readRequests chan *readRequest
+  stop chan struct{}
+  stopped chan struct{}
+  // Set if the node stopped because its state could not be persisted; see
+  // fail. Written before `stopped` is closed.
+  failure error
+  random *rand.Rand
+
+  // Guards `status`, which is published after every step for other
+  // goroutines.
+  statusMutex *sync.Mutex
+  status Status
+}
+
+/**
+ * Make a node and start its goroutine. `peers` lists every other member of
+ * the cluster, and `directory` holds the node's log and snapshots; the
+ * state machine must already reflect the snapshot in `directory`, if any.
+ * `options` may be nil.
+ */
+func MakeNode(
+    id string,
+    peers []string,
+    directory string,
+    stateMachine StateMachine,
+    transport Transport,
+    options *NodeOptions) (*Node, error) {
+  storage, state, meta, entries, err := openStorage(directory)
+  if err != nil {
+    return nil, err
+  }
+
+  n := &Node{}
+  n.id = id
+  n.peers = peers
+  n.transport = transport
+  n.storage = storage
+  n.stateMachine = stateMachine
+  if options != nil {
+    n.options = *options
+  }
+  n.applyDefaultOptions()
+
+  n.term = state.Term
+  n.votedFor = state.VotedFor
+  n.log = entries
+  n.snapshotIndex = meta.Index
+  n.snapshotTerm = meta.Term
+  // The state machine reflects at least the snapshot; committed entries
+  // after it are re-applied once the commit index is learned.
+  n.commitIndex = meta.Index
+  n.lastApplied = meta.Index
+
+  n.inbox = make(chan *Message, 1024)
+  n.proposeRequests = make(chan *proposal, 256)
+  n.readRequests = make(chan *readRequest, 256)
+  n.stop = make(chan struct{})
+  n.stopped = make(chan struct{})
+  n.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+  n.statusMutex = &sync.Mutex{}
+  n.becomeFollower(n.term, "")
+  n.publishStatus()
+
+  go n.run()
+  return n, nil
+}
+
+func (n *Node) applyDefaultOptions() {
+  if n.options.TickInterval <= 0 {
+    n.options.TickInterval = DEFAULT_TICK_INTERVAL
+  }
+  if n.options.ElectionTicks <= 0 {
+    n.options.ElectionTicks = DEFAULT_ELECTION_TICKS
+  }
+  if n.options.HeartbeatTicks <= 0 {
+    n.options.HeartbeatTicks = DEFAULT_HEARTBEAT_TICKS
+  }
+  if n.options.SnapshotThreshold == 0 {
+    n.options.SnapshotThreshold = DEFAULT_SNAPSHOT_THRESHOLD
+  }
+  if n.options.MaxEntriesPerMessage <= 0 {
+    n.options.MaxEntriesPerMessage = DEFAULT_MAX_ENTRIES_PER_MESSAGE
+  }
+}
+
+/**
+ * Deliver a message from another node. Messages are dropped if the node is
+ * overloaded; Raft retries them.
+ */
+func (n *Node) Receive(msg *Message) {
+  select {
+  case n.inbox <- msg:
+  default:
+  }
+}
+
+/**
+ * Replicate a command and apply it to the state machine, returning the
+ * state machine's result once it has been applied on this node. Returns a
+ * NotLeaderError unless this node is the leader.
+ *
+ * <p> Stops waiting, returning the context's error, once `ctx` ends. A
+ * command already proposed may still be committed and applied.
+ */
+func (n *Node) Propose(ctx context.Context, command []byte, timeout time.Duration) error {
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+
+  p := &proposal{ command: command, done: make(chan error, 1) }
+  select {
+  case n.proposeRequests <- p:
+  case <-timer.C:
+    return ErrTimeout
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-n.stopped:
+    return n.stoppedError()
+  }
+  return n.await(ctx, p.done, timer)
+}
+
+/**
+ * Wait until a read of the state machine would be linearizable: this node
+ * confirms it is still the leader with a quorum, and applies every entry
+ * committed before the call. Returns a NotLeaderError unless this node is
+ * the leader.
+ */
+func (n *Node) ReadIndex(ctx context.Context, timeout time.Duration) error {
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+
+  r := &readRequest{ done: make(chan error, 1) }
+  select {
+  case n.readRequests <- r:
+  case <-timer.C:
+    return ErrTimeout
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-n.stopped:
+    return n.stoppedError()
+  }
+  return n.await(ctx, r.done, timer)
+}
+
+func (n *Node) await(ctx context.Context, done chan error, timer *time.Timer) error {
+  select {
+  case err := <-done:
+    return err
+  case <-timer.C:
+    return ErrTimeout
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-n.stopped:
+    // The node may have answered just before stopping.
+    select {
+    case err := <-done:
+      return err
+    default:
+      return n.stoppedError()
+    }
+  }
+}
+
+// Return a snapshot of the node's state.
+func (n *Node) Status() Status {
+  defer n.statusMutex.Unlock()
+  n.statusMutex.Lock()
+
+  return n.status
+}
+
+// Return why the node stopped. Must only be called once `stopped` is closed.
+func (n *Node) stoppedError() error {
+  if n.failure != nil {
+    return n.failure
+  }
+  return ErrStopped
+}
+
+// Stop the node's goroutine, failing any waiting proposals and reads.
+func (n *Node) Stop() {
+  select {
+  case <-n.stop:
+  default:
+    close(n.stop)
+  }
+  <-n.stopped
+}
+
+func (n *Node) run() {
+  ticker := time.NewTicker(n.options.TickInterval)
+  defer ticker.Stop()
+  defer close(n.stopped)
+
+  for {
+    select {
+    case <-ticker.C:
+      n.tick()
+    case msg := <-n.inbox:
+      n.step(msg)
+    case p := <-n.proposeRequests:
+      n.propose(p)
+    case r := <-n.readRequests:
+      n.read(r)
+    case <-n.stop:
+      n.failPending(ErrStopped)
+      return
+    }
+    if n.failure != nil {
+      n.failPending(n.failure)
+      n.publishStatus()
+      return
+    }
+
+    n.applyCommitted()
+    n.publishStatus()
+  }
+}
+
+func (n *Node) publishStatus() {
+  defer n.statusMutex.Unlock()
+  n.statusMutex.Lock()
+
+  n.status = Status{
+    Id: n.id,
+    Role: n.role,
+    Term: n.term,
+    Leader: n.leader,
+    CommitIndex: n.commitIndex,
+    AppliedIndex: n.lastApplied,
+    SnapshotIndex: n.snapshotIndex,
+    LogEntries: len(n.log),
+  }
+}
+
+func (n *Node) tick() {
+  if n.role == ROLE_LEADER {
+    n.heartbeatElapsed++
+    if n.heartbeatElapsed >= n.options.HeartbeatTicks {
+      n.heartbeatElapsed = 0
+      n.broadcastAppend()
+    }
+    return
+  }
+
+  n.electionElapsed++
+  if n.electionElapsed >= n.electionTimeout {
+    n.campaign()
+  }
+}
+
+// The number of nodes, including this one, which form a majority.
+func (n *Node) quorum() int {
+  return (len(n.peers) + 1) / 2 + 1
+}
+
+func (n *Node) lastIndex() uint64 {
+  return n.snapshotIndex + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+  term, _ := n.termAt(n.lastIndex())
+  return term
+}
+
+// Return the term of the entry at `index`, or false if it is beyond the log
+// or compacted away.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+  if index == n.snapshotIndex {
+    return n.snapshotTerm, true
+  } else if index < n.snapshotIndex || index > n.lastIndex() {
+    return 0, false
+  }
+  return n.log[index - n.snapshotIndex - 1].Term, true
+}
+
+func (n *Node) entryAt(index uint64) Entry {
+  return n.log[index - n.snapshotIndex - 1]
+}
+
+/**
+ * Stop the node once its state could not be persisted, e.g. on a full disk.
+ * Continuing would risk breaking Raft's guarantees, e.g. by voting twice in
+ * a term after a restart. Waiting and later calls fail with an error
+ * wrapping ErrStopped, and so store.ErrUnavailable.
+ */
+func (n *Node) fail(err error) {
+  if n.failure != nil {
+    return
+  }
+  n.options.Logger.Error("Stopping the Raft node after a storage failure", "node", n.id, "err", err)
+  n.failure = fmt.Errorf("%w after a storage failure: %v", ErrStopped, err)
+}
+
+// Durably record the term and vote, returning false if the node failed.
+func (n *Node) saveHardState() bool {
+  if err := n.storage.saveHardState(
+      &hardState{ Term: n.term, VotedFor: n.votedFor }); err != nil {
+    n.fail(err)
+    return false
+  }
+  return true
+}
+
+func (n *Node) resetElectionTimer() {
+  n.electionElapsed = 0
+  n.electionTimeout = n.options.ElectionTicks + n.random.Intn(n.options.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+  if term > n.term {
+    n.term = term
+    n.votedFor = ""
+    if !n.saveHardState() {
+      return
+    }
+  }
+  if n.role == ROLE_LEADER {
+    n.failPending(&NotLeaderError{ Leader: leader })
+  }
+  n.role = ROLE_FOLLOWER
+  n.leader = leader
+  n.resetElectionTimer()
+}
+
+func (n *Node) campaign() {
+  n.role = ROLE_CANDIDATE
+  n.term++
+  n.votedFor = n.id
+  n.leader = ""
+  if !n.saveHardState() {
+    return
+  }
+  n.resetElectionTimer()
+
+  n.votes = map[string]bool{ n.id: true }
+  if len(n.votes) >= n.quorum() {
+    n.becomeLeader()
+    return
+  }
+
+  for _, peer := range n.peers {
+    n.send(&Message{
+      Type: MSG_VOTE,
+      To: peer,
+      LastLogIndex: n.lastIndex(),
+      LastLogTerm: n.lastTerm(),
+    })
+  }
+}
+
+func (n *Node) becomeLeader() {
+  n.role = ROLE_LEADER
+  n.leader = n.id
+  n.heartbeatElapsed = 0
+  n.nextIndex = make(map[string]uint64)
+  n.matchIndex = make(map[string]uint64)
+  for _, peer := range n.peers {
+    n.nextIndex[peer] = n.lastIndex() + 1
+    n.matchIndex[peer] = 0
+  }
+  n.proposals = make(map[uint64]*proposal)
+  n.options.Logger.Info("Became the Raft leader", "node", n.id, "term", n.term)
+
+  // Commit an entry from this term, which commits every earlier entry.
+  n.termStartIndex = n.lastIndex() + 1
+  if err := n.appendLocal(nil); err != nil {
+    return
+  }
+  n.advanceCommit()
+  n.broadcastAppend()
+}
+
+// Append a command to the leader's log. The node fails if the entry cannot
+// be persisted.
+func (n *Node) appendLocal(command []byte) error {
+  entry := Entry{ Index: n.lastIndex() + 1, Term: n.term, Command: command }
+  if err := n.storage.appendEntries([]Entry{ entry }); err != nil {
+    n.fail(err)
+    return n.failure
+  }
+  n.log = append(n.log, entry)
+  return nil
+}
+
+func (n *Node) propose(p *proposal) {
+  if n.role != ROLE_LEADER {
+    p.done <- &NotLeaderError{ Leader: n.leader }
+    return
+  }
+
+  if err := n.appendLocal(p.command); err != nil {
+    p.done <- err
+    return
+  }
+  p.term = n.term
+  n.proposals[n.lastIndex()] = p
+  n.advanceCommit()
+  n.broadcastAppend()
+}
+
+func (n *Node) read(r *readRequest) {
+  if n.role != ROLE_LEADER {
+    r.done <- &NotLeaderError{ Leader: n.leader }
+    return
+  }
+
+  r.readIndex = n.commitIndex
+  if r.readIndex < n.termStartIndex {
+    r.readIndex = n.termStartIndex
+  }
+  n.readContext++
+  r.context = n.readContext
+  r.acks = map[string]bool{ n.id: true }
+  n.reads = append(n.reads, r)
+
+  // Confirm leadership with a round of heartbeats.
+  n.broadcastAppend()
+}
+
+// Fail every waiting proposal and read, e.g. on losing leadership.
+func (n *Node) failPending(err error) {
+  for index, p := range n.proposals {
+    if _, ok := err.(*NotLeaderError); ok {
+      p.done <- ErrProposalDropped
+    } else {
+      p.done <- err
+    }
+    delete(n.proposals, index)
+  }
+  for _, r := range n.reads {
+    r.done <- err
+  }
+  n.reads = nil
+}
+
+func (n *Node) send(msg *Message) {
+  msg.From = n.id
+  msg.Term = n.term
+  n.transport.Send(msg)
+}
+
+func (n *Node) broadcastAppend() {
+  for _, peer := range n.peers {
+    n.sendAppend(peer)
+  }
+}
+
+// Send the peer the entries it is missing, or the snapshot if they have been
+// compacted away. Empty appends serve as heartbeats.
+func (n *Node) sendAppend(peer string) {
+  next := n.nextIndex[peer]
+  if next <= n.snapshotIndex {
+    n.sendSnapshot(peer)
+    return
+  }
+
+  prevIndex := next - 1
+  prevTerm, _ := n.termAt(prevIndex)
+  var entries []Entry
+  for index := next; index <= n.lastIndex() &&
+      len(entries) < n.options.MaxEntriesPerMessage; index++ {
+    entries = append(entries, n.entryAt(index))
+  }
+
+  n.send(&Message{
+    Type: MSG_APPEND,
+    To: peer,
+    PrevLogIndex: prevIndex,
+    PrevLogTerm: prevTerm,
+    Entries: entries,
+    LeaderCommit: n.commitIndex,
+    ReadContext: n.readContext,
+  })
+}
+
+func (n *Node) sendSnapshot(peer string) {
+  snapshot, err := n.storage.readSnapshot()
+  if err != nil {
+    n.options.Logger.Error("Error reading the Raft snapshot", "err", err)
+    return
+  }
+
+  n.send(&Message{
+    Type: MSG_SNAPSHOT,
+    To: peer,
+    SnapshotIndex: n.snapshotIndex,
+    SnapshotTerm: n.snapshotTerm,
+    Snapshot: snapshot,
+    ReadContext: n.readContext,
+  })
+}
+
+func (n *Node) step(msg *Message) {
+  if msg.Term > n.term {
+    leader := ""
+    if msg.Type == MSG_APPEND || msg.Type == MSG_SNAPSHOT {
+      leader = msg.From
+    }
+    n.becomeFollower(msg.Term, leader)
+    if n.failure != nil {
+      return
+    }
+  } else if msg.Term < n.term {
+    // Tell a stale sender the current term, so it steps down.
+    switch msg.Type {
+    case MSG_VOTE:
+      n.send(&Message{ Type: MSG_VOTE_RESPONSE, To: msg.From })
+    case MSG_APPEND, MSG_SNAPSHOT:
+      n.send(&Message{ Type: MSG_APPEND_RESPONSE, To: msg.From })
+    }
+    return
+  }
+
+  switch msg.Type {
+  case MSG_VOTE:
+    n.handleVote(msg)
+  case MSG_VOTE_RESPONSE:
+    n.handleVoteResponse(msg)
+  case MSG_APPEND:
+    n.handleAppend(msg)
+  case MSG_SNAPSHOT:
+    n.handleSnapshot(msg)
+  case MSG_APPEND_RESPONSE:
+    n.handleAppendResponse(msg)
+  }
+}
+
+func (n *Node) handleVote(msg *Message) {
+  upToDate := msg.LastLogTerm > n.lastTerm() ||
+    (msg.LastLogTerm == n.lastTerm() && msg.LastLogIndex >= n.lastIndex())
+  canVote := n.votedFor == "" || n.votedFor == msg.From
+
+  granted := canVote && upToDate && n.role == ROLE_FOLLOWER
+  if granted {
+    n.votedFor = msg.From
+    if !n.saveHardState() {
+      // Never grant a vote which would be forgotten on restart.
+      return
+    }
+    n.resetElectionTimer()
+  }
+  n.send(&Message{ Type: MSG_VOTE_RESPONSE, To: msg.From, Granted: granted })
+}
+
+func (n *Node) handleVoteResponse(msg *Message) {
+  if n.role != ROLE_CANDIDATE || !msg.Granted {
+    return
+  }
+
+  n.votes[msg.From] = true
+  if len(n.votes) >= n.quorum() {
+    n.becomeLeader()
+  }
+}
+
+func (n *Node) handleAppend(msg *Message) {
+  if n.role != ROLE_FOLLOWER || n.leader != msg.From {
+    n.becomeFollower(msg.Term, msg.From)
+  }
+  n.resetElectionTimer()
+
+  prevIndex, prevTerm, entries := msg.PrevLogIndex, msg.PrevLogTerm, msg.Entries
+  if prevIndex < n.snapshotIndex {
+    // Entries up to the snapshot are committed, so they match.
+    skip := n.snapshotIndex - prevIndex
+    if uint64(len(entries)) <= skip {
+      n.replyAppend(msg, true, prevIndex + uint64(len(entries)))
+      return
+    }
+    entries = entries[skip:]
+    prevIndex, prevTerm = n.snapshotIndex, n.snapshotTerm
+  }
+
+  if term, ok := n.termAt(prevIndex); !ok || term != prevTerm {
+    // Hint where the leader should retry from.
+    hint := n.lastIndex()
+    if prevIndex <= hint {
+      hint = prevIndex - 1
+    }
+    n.replyAppend(msg, false, hint)
+    return
+  }
+
+  for i, entry := range entries {
+    if term, ok := n.termAt(entry.Index); ok {
+      if term == entry.Term {
+        continue
+      }
+
+      // A conflicting entry from a deposed leader; it was never committed.
+      n.log = n.log[:entry.Index - n.snapshotIndex - 1]
+      if err := n.storage.rewriteLog(n.log); err != nil {
+        n.fail(err)
+        return
+      }
+    }
+
+    if err := n.storage.appendEntries(entries[i:]); err != nil {
+      n.fail(err)
+      return
+    }
+    n.log = append(n.log, entries[i:]...)
+    break
+  }
+
+  lastNew := prevIndex + uint64(len(entries))
+  // Only entries known to match the leader's log may be committed.
+  commitIndex := msg.LeaderCommit
+  if lastNew < commitIndex {
+    commitIndex = lastNew
+  }
+  if commitIndex > n.commitIndex {
+    n.commitIndex = commitIndex
+  }
+  n.replyAppend(msg, true, lastNew)
+}
+
+func (n *Node) replyAppend(msg *Message, success bool, matchIndex uint64) {
+  n.send(&Message{
+    Type: MSG_APPEND_RESPONSE,
+    To: msg.From,
+    Success: success,
+    MatchIndex: matchIndex,
+    ReadContext: msg.ReadContext,
+  })
+}
+
+func (n *Node) handleSnapshot(msg *Message) {
+  if n.role != ROLE_FOLLOWER || n.leader != msg.From {
+    n.becomeFollower(msg.Term, msg.From)
+  }
+  n.resetElectionTimer()
+
+  if msg.SnapshotIndex <= n.commitIndex {
+    n.replyAppend(msg, true, msg.SnapshotIndex)
+    return
+  }
+
+  // Restore the state machine before recording the snapshot, so that a crash
+  // in between never leaves the snapshot ahead of the state machine.
+  if err := n.stateMachine.Restore(bytes.NewReader(msg.Snapshot)); err != nil {
+    n.options.Logger.Error("Error restoring the Raft snapshot", "err", err)
+    return
+  }
+
+  // Keep any entries following the snapshot if the log agrees with it.
+  if term, ok := n.termAt(msg.SnapshotIndex); ok && term == msg.SnapshotTerm {
+    n.log = append([]Entry{}, n.log[msg.SnapshotIndex - n.snapshotIndex:]...)
+  } else {
+    n.log = nil
+  }
+
+  meta := &snapshotMeta{ Index: msg.SnapshotIndex, Term: msg.SnapshotTerm }
+  if err := n.storage.saveSnapshot(meta, msg.Snapshot); err != nil {
+    n.fail(err)
+    return
+  }
+  if err := n.storage.rewriteLog(n.log); err != nil {
+    n.fail(err)
+    return
+  }
+
+  n.snapshotIndex, n.snapshotTerm = msg.SnapshotIndex, msg.SnapshotTerm
+  n.commitIndex, n.lastApplied = msg.SnapshotIndex, msg.SnapshotIndex
+  n.replyAppend(msg, true, msg.SnapshotIndex)
+}
+
+func (n *Node) handleAppendResponse(msg *Message) {
+  if n.role != ROLE_LEADER {
+    return
+  }
+
+  // Any response in this term confirms this node is still the leader.
+  for _, r := range n.reads {
+    if r.context <= msg.ReadContext {
+      r.acks[msg.From] = true
+    }
+  }
+
+  if msg.Success {
+    if msg.MatchIndex > n.matchIndex[msg.From] {
+      n.matchIndex[msg.From] = msg.MatchIndex
+    }
+    if n.matchIndex[msg.From] + 1 > n.nextIndex[msg.From] {
+      n.nextIndex[msg.From] = n.matchIndex[msg.From] + 1
+    }
+    n.advanceCommit()
+
+    if n.nextIndex[msg.From] <= n.lastIndex() {
+      n.sendAppend(msg.From)
+    }
+    return
+  }
+
+  next := n.nextIndex[msg.From] - 1
+  if msg.MatchIndex + 1 < next {
+    next = msg.MatchIndex + 1
+  }
+  if next < 1 {
+    next = 1
+  }
+  n.nextIndex[msg.From] = next
+  n.sendAppend(msg.From)
+}
+
+// Commit the latest entry of this term stored on a majority of nodes.
+func (n *Node) advanceCommit() {
+  if n.role != ROLE_LEADER {
+    return
+  }
+
+  for index := n.lastIndex(); index > n.commitIndex; index-- {
+    if term, _ := n.termAt(index); term != n.term {
+      // Entries of earlier terms are only committed by a later entry.
+      return
+    }
+
+    replicas := 1
+    for _, peer := range n.peers {
+      if n.matchIndex[peer] >= index {
+        replicas++
+      }
+    }
+    if replicas >= n.quorum() {
+      n.commitIndex = index
+      return
+    }
+  }
+}
+
+// Apply newly committed entries, then serve confirmed reads and compact the
+// log if needed.
+func (n *Node) applyCommitted() {
+  for n.lastApplied < n.commitIndex {
+    entry := n.entryAt(n.lastApplied + 1)
+    var err error
+    if len(entry.Command) > 0 {
+      if err = n.stateMachine.Apply(entry.Command); err != nil {
+        n.options.Logger.Error("Error applying Raft entry", "index", entry.Index, "err", err)
+      }
+    }
+    n.lastApplied = entry.Index
+
+    if p, ok := n.proposals[entry.Index]; ok {
+      if p.term == entry.Term {
+        p.done <- err
+      } else {
+        p.done <- ErrProposalDropped
+      }
+      delete(n.proposals, entry.Index)
+    }
+  }
+
+  pending := n.reads[:0]
+  for _, r := range n.reads {
+    if len(r.acks) >= n.quorum() && n.lastApplied >= r.readIndex {
+      r.done <- nil
+    } else {
+      pending = append(pending, r)
+    }
+  }
+  n.reads = pending
+
+  n.maybeCompact()
+}
+
+// Replace the applied entries with a snapshot once enough have accumulated.
+func (n *Node) maybeCompact() {
+  if n.lastApplied - n.snapshotIndex < n.options.SnapshotThreshold {
+    return
+  }
+
+  var snapshot bytes.Buffer
+  if err := n.stateMachine.Snapshot(&snapshot); err != nil {
+    n.options.Logger.Error("Error taking a Raft snapshot", "err", err)
+    return
+  }
+
+  term, _ := n.termAt(n.lastApplied)
+  meta := &snapshotMeta{ Index: n.lastApplied, Term: term }
+  if err := n.storage.saveSnapshot(meta, snapshot.Bytes()); err != nil {
+    n.options.Logger.Error("Error saving a Raft snapshot", "err", err)
+    return
+  }
+
+  remaining := append([]Entry{}, n.log[n.lastApplied - n.snapshotIndex:]...)
+  if err := n.storage.rewriteLog(remaining); err != nil {
+    n.options.Logger.Error("Error compacting the Raft log", "err", err)
+    return
+  }
+  n.log = remaining
+  n.snapshotIndex, n.snapshotTerm = meta.Index, meta.Term
+}
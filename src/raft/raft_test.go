@@ -0,0 +1,359 @@
+package raft
+
+import (
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "strings"
+  "time"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// In-process nodes connected by a simulated network.
+type testRaftCluster struct {
+  ids []string
+  stores []*RaftStore
+  network *MemoryNetwork
+}
+
+func testRaftOptions() *RaftStoreOptions {
+  return &RaftStoreOptions{
+    Node: NodeOptions{ TickInterval: 5 * time.Millisecond, ElectionTicks: 10 },
+    RequestTimeout: 500 * time.Millisecond,
+  }
+}
+
+func makeTestRaftCluster(t *testing.T, ids []string, options *RaftStoreOptions) *testRaftCluster {
+  cluster := &testRaftCluster{}
+  cluster.ids = ids
+  cluster.network = MakeMemoryNetwork()
+  for i, id := range ids {
+    var peers []string
+    peers = append(peers, ids[:i]...)
+    peers = append(peers, ids[i+1:]...)
+
+    s, err := MakeRaftStore(id, peers, t.TempDir(), cluster.network, options)
+    if err != nil {
+      t.Fatalf("Error making Raft store: %v", err)
+    }
+    t.Cleanup(s.Stop)
+    cluster.network.Register(s.Node())
+    cluster.stores = append(cluster.stores, s)
+  }
+  return cluster
+}
+
+/**
+ * Wait for one of the nodes in `candidates` (or any node, if empty) to lead,
+ * returning its index.
+ */
+func (c *testRaftCluster) waitForLeader(t *testing.T, candidates ...int) int {
+  if len(candidates) == 0 {
+    for i := range c.stores {
+      candidates = append(candidates, i)
+    }
+  }
+
+  for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+    for _, i := range candidates {
+      if c.stores[i].IsLeader() {
+        return i
+      }
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("Expected a leader among %v", candidates)
+  return -1
+}
+
+// Wait for a single-node store to elect itself.
+func waitUntilLeader(t *testing.T, s *RaftStore) {
+  for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+    if s.IsLeader() {
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("Expected %v to become leader", s.node.id)
+}
+
+// Wait for the node's state machine to hold the value, without a read-index.
+func waitForValue(t *testing.T, s *RaftStore, key string, value string) {
+  ctx := context.Background()
+  for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+    if stored, err := s.stateMachine.Store().Get(ctx, store.Key(key)); err == nil &&
+        string(stored) == value {
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Errorf("Expected %v to apply %v=%v", s.node.id, key, value)
+}
+
+func TestRaftReplicatesWritesThroughTheLeader(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestRaftCluster(t, []string{ "a", "b", "c" }, testRaftOptions())
+  leader := cluster.waitForLeader(t)
+
+  if err := cluster.stores[leader].Set(ctx, KEY, VALUE); err != nil {
+    t.Fatalf("Error setting via the leader: %v", err)
+  }
+  if value, err := cluster.stores[leader].Get(ctx, KEY); err != nil || value != VALUE {
+    t.Errorf("Expected to read %v from the leader, got %v (%v)", VALUE, value, err)
+  }
+
+  for i, s := range cluster.stores {
+    waitForValue(t, s, string(KEY), string(VALUE))
+    if i == leader {
+      continue
+    }
+
+    var notLeader *NotLeaderError
+    if _, err := s.Get(ctx, KEY); !errors.As(err, &notLeader) ||
+        notLeader.Leader != cluster.ids[leader] {
+      t.Errorf("Expected followers to name the leader, got %v", err)
+    }
+  }
+}
+
+func TestRaftFailsOverWhenTheLeaderIsPartitioned(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestRaftCluster(t, []string{ "a", "b", "c" }, testRaftOptions())
+  oldLeader := cluster.waitForLeader(t)
+  cluster.stores[oldLeader].Set(ctx, KEY, VALUE)
+
+  var others []int
+  for i := range cluster.stores {
+    if i != oldLeader {
+      others = append(others, i)
+    }
+  }
+  cluster.network.Partition([]string{ cluster.ids[oldLeader] })
+
+  // The isolated leader can neither commit writes nor serve linearizable reads.
+  if err := cluster.stores[oldLeader].Set(ctx, KEY, "stale"); err == nil {
+    t.Errorf("Expected a write without a quorum to fail")
+  }
+  if _, err := cluster.stores[oldLeader].Get(ctx, KEY); err == nil {
+    t.Errorf("Expected a read without a quorum to fail")
+  }
+
+  newLeader := cluster.waitForLeader(t, others...)
+  if value, err := cluster.stores[newLeader].Get(ctx, KEY); err != nil || value != VALUE {
+    t.Errorf("Expected the new leader to have %v, got %v (%v)", VALUE, value, err)
+  }
+  if err := cluster.stores[newLeader].Set(ctx, KEY2, VALUE); err != nil {
+    t.Fatalf("Error setting via the new leader: %v", err)
+  }
+
+  // Once healed, the old leader discards its uncommitted write and catches up.
+  cluster.network.Heal()
+  waitForValue(t, cluster.stores[oldLeader], string(KEY2), string(VALUE))
+  waitForValue(t, cluster.stores[oldLeader], string(KEY), string(VALUE))
+}
+
+func TestRaftCompactsTheLogAndCatchesUpViaSnapshot(t *testing.T) {
+  ctx := context.Background()
+  options := testRaftOptions()
+  options.Node.SnapshotThreshold = 10
+  cluster := makeTestRaftCluster(t, []string{ "a", "b", "c" }, options)
+  leader := cluster.waitForLeader(t)
+
+  lagging := (leader + 1) % 3
+  cluster.network.Partition([]string{ cluster.ids[lagging] })
+  for i := 0; i < 50; i++ {
+    key := store.Key(fmt.Sprintf("key%v", i))
+    if err := cluster.stores[leader].Set(ctx, key, VALUE); err != nil {
+      t.Fatalf("Error setting %v: %v", key, err)
+    }
+  }
+
+  status := cluster.stores[leader].Node().Status()
+  if status.SnapshotIndex == 0 || status.LogEntries >= 10 {
+    t.Errorf("Expected the leader's log to be compacted, got %+v", status)
+  }
+
+  cluster.network.Heal()
+  waitForValue(t, cluster.stores[lagging], "key49", string(VALUE))
+  if status := cluster.stores[lagging].Node().Status(); status.SnapshotIndex == 0 {
+    t.Errorf("Expected the lagging node to install a snapshot, got %+v", status)
+  }
+  if keys, _ := cluster.stores[lagging].stateMachine.Store().Keys(ctx); len(keys) != 50 {
+    t.Errorf("Expected the lagging node to have 50 keys, got %v", len(keys))
+  }
+}
+
+func TestRaftRecoversStateAfterRestart(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  options := testRaftOptions()
+  options.Node.SnapshotThreshold = 3
+
+  s, err := MakeRaftStore("a", nil, directory, MakeMemoryNetwork(), options)
+  if err != nil {
+    t.Fatalf("Error making Raft store: %v", err)
+  }
+  waitUntilLeader(t, s)
+  for i := 0; i < 5; i++ {
+    if err := s.Set(ctx, store.Key(fmt.Sprintf("key%v", i)), VALUE); err != nil {
+      t.Fatalf("Error setting key%v: %v", i, err)
+    }
+  }
+  s.Delete(ctx, "key0")
+  s.Stop()
+
+  restarted, err := MakeRaftStore("a", nil, directory, MakeMemoryNetwork(), options)
+  if err != nil {
+    t.Fatalf("Error restarting Raft store: %v", err)
+  }
+  defer restarted.Stop()
+
+  waitUntilLeader(t, restarted)
+  if keys, err := restarted.Keys(ctx); err != nil || len(keys) != 4 {
+    t.Errorf("Expected 4 keys after restarting, got %v (%v)", keys, err)
+  }
+  if status := restarted.Node().Status(); status.Term < 2 {
+    t.Errorf("Expected the term to survive restarts, got %+v", status)
+  }
+}
+
+/**
+ * Serve each of three Raft stores from a server, signing forwarded requests
+ * with a shared peer key, and return the servers' URLs and the index of the
+ * leader.
+ */
+func serveTestRaftCluster(t *testing.T) ([]string, int) {
+  handlers := make([]http.Handler, 3)
+  var ids []string
+  for i := 0; i < 3; i++ {
+    i := i
+    testServer := httptest.NewServer(
+      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        handlers[i].ServeHTTP(w, r)
+      }))
+    t.Cleanup(testServer.Close)
+    ids = append(ids, testServer.URL)
+  }
+
+  // Nodes are named by their server's address, so servers forward to them.
+  cluster := makeTestRaftCluster(t, ids, testRaftOptions())
+  peerKey, _ := auth.MakePeerKey([]byte("test-peer-secret"))
+  for i, s := range cluster.stores {
+    raftServer, err := server.MakeServerWithOptions(s, nil,
+      &server.ServerOptions{ PeerKey: peerKey })
+    if err != nil {
+      t.Fatalf("Error making server: %v", err)
+    }
+    handlers[i] = raftServer.Handler()
+  }
+  return ids, cluster.waitForLeader(t)
+}
+
+func TestRaftServersForwardRequestsToTheLeader(t *testing.T) {
+  ids, leader := serveTestRaftCluster(t)
+
+  follower := client.MakeClient(ids[(leader + 1) % 3])
+  if err := follower.Set(string(KEY), []byte(VALUE)); err != nil {
+    t.Fatalf("Error setting via a follower: %v", err)
+  }
+  if value, err := follower.Get(string(KEY)); err != nil || string(value) != string(VALUE) {
+    t.Errorf("Expected to read %v via a follower, got %v (%v)", VALUE, value, err)
+  }
+  if keys, err := follower.Keys(""); err != nil || len(keys) != 1 {
+    t.Errorf("Expected to list keys via a follower, got %v (%v)", keys, err)
+  }
+}
+
+func TestRaftFollowersForwardRequestsClaimingToBeForwarded(t *testing.T) {
+  ids, leader := serveTestRaftCluster(t)
+
+  // A follower serving the set itself would fail, having no leadership.
+  req, _ := http.NewRequest("POST", ids[(leader + 1) % 3] + "/set",
+    strings.NewReader(fmt.Sprintf(`{"key":%q,"value":%q}`, KEY, VALUE)))
+  req.Header.Set(server.HEADER_CLUSTER_FORWARDED, ids[leader])
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatalf("Error sending a set claiming to be forwarded: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    t.Errorf("Expected the set to be forwarded to the leader, got %v", resp.StatusCode)
+  }
+}
+
+func TestHttpTransportSignsMessagesOverTls(t *testing.T) {
+  peerKey, _ := auth.MakePeerKey([]byte("test-peer-secret"))
+  senders := make(chan string, 1)
+  testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    node, _ := peerKey.Verify(r)
+    senders <- node
+  }))
+  t.Cleanup(testServer.Close)
+
+  // Peers are named without a scheme, so are reached over TLS.
+  rootCas := x509.NewCertPool()
+  rootCas.AddCert(testServer.Certificate())
+  transport := MakeHttpTransport(time.Second, &HttpTransportOptions{
+    PeerKey: peerKey,
+    Tls: &tls.Config{ RootCAs: rootCas },
+  })
+  transport.Send(&Message{
+    Type: MSG_VOTE,
+    From: "localhost:8081",
+    To: strings.TrimPrefix(testServer.URL, "https://"),
+  })
+  select {
+  case node := <-senders:
+    if node != "localhost:8081" {
+      t.Errorf("Expected the message to be signed by its sender, got %q", node)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Timed out waiting for the message")
+  }
+}
+
+func TestRaftNodesStopOnStorageFailures(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  cluster := &testRaftCluster{ ids: []string{ "a" }, network: MakeMemoryNetwork() }
+  s, err := MakeRaftStore("a", nil, directory, cluster.network, testRaftOptions())
+  if err != nil {
+    t.Fatalf("Error making Raft store: %v", err)
+  }
+  t.Cleanup(s.Stop)
+  cluster.stores = []*RaftStore{ s }
+  cluster.waitForLeader(t)
+
+  // Appending to the log now fails, as on a failed disk.
+  os.RemoveAll(directory)
+  if err := s.Set(ctx, KEY, VALUE); !errors.Is(err, store.ErrUnavailable) {
+    t.Errorf("Expected the write to fail as unavailable, got %v", err)
+  }
+  if _, err := s.Get(ctx, KEY); !errors.Is(err, ErrStopped) {
+    t.Errorf("Expected the node to have stopped, got %v", err)
+  }
+}
+
+func TestRaftStoresRefuseToEvict(t *testing.T) {
+  options := testRaftOptions()
+  options.FileStore = &store.FileStoreOptions{ MaxFiles: 1 }
+  if _, err := MakeRaftStore("a", []string{ "b" }, t.TempDir(), MakeMemoryNetwork(), options); err == nil {
+    t.Errorf("Expected an evicting filestore to be rejected")
+  }
+}
+
+const (
+  KEY store.Key = "key"
+  KEY2 store.Key = "key2"
+  VALUE store.Value = "value"
+)
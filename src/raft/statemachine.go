@@ -0,0 +1,177 @@
+package raft
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // Names the generation directory holding the live FileStore.
+  CURRENT_FILE_NAME = "CURRENT"
+  GENERATION_DIRECTORY_PREFIX = "data-"
+
+  COMMAND_SET = "set"
+  COMMAND_DELETE = "delete"
+)
+
+// The state replicated by the log. Apply must be deterministic, so that
+// every node reaches the same state from the same entries.
+type StateMachine interface {
+  Apply(command []byte) error
+  // Write the state, e.g. to compact the log.
+  Snapshot(w io.Writer) error
+  // Replace the state with a snapshot.
+  Restore(r io.Reader) error
+}
+
+// A command of the FileStoreStateMachine.
+type command struct {
+  Op string `json:"op"`
+  Key store.Key `json:"key"`
+  Value []byte `json:"value,omitempty"`
+  // Unix nanoseconds, or 0 if the value never expires. Absolute, so that
+  // replaying the entry later yields the same expiry.
+  ExpiresAt int64 `json:"expires_at,omitempty"`
+  Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// A StateMachine which stores its keys in a FileStore. Snapshots are
+// restored into a fresh generation directory, which then replaces the live
+// one, so a failed restore never damages the current state. Create
+// instances via MakeFileStoreStateMachine.
+type FileStoreStateMachine struct {
+  directory string
+  options *store.FileStoreOptions
+  // The FileStores' logger; may be nil.
+  logger *logging.Logger
+  generation int
+  fs *store.FileStore
+  // Guards `generation` and `fs`, which a restore swaps.
+  mutex *sync.RWMutex
+}
+
+/**
+ * Open the state machine in `directory`, reusing the live generation if one
+ * exists. `options` configures every generation's FileStore, and may be nil.
+ * It must not set MaxBytes or MaxFiles: each node evicts by its own access
+ * order, outside the log, so evicting replicas would diverge.
+ */
+func MakeFileStoreStateMachine(
+    directory string,
+    options *store.FileStoreOptions) (*FileStoreStateMachine, error) {
+  if options != nil && (options.MaxBytes > 0 || options.MaxFiles > 0) {
+    return nil, errors.New("Raft state machines cannot evict keys; MaxBytes and MaxFiles must be 0")
+  }
+  if err := os.MkdirAll(directory, 0755); err != nil {
+    return nil, err
+  }
+
+  m := &FileStoreStateMachine{}
+  m.directory = directory
+  m.options = options
+  if options != nil {
+    m.logger = options.Logger
+  }
+  m.mutex = &sync.RWMutex{}
+
+  current, err := ioutil.ReadFile(filepath.Join(directory, CURRENT_FILE_NAME))
+  if err == nil {
+    m.generation, err = strconv.Atoi(strings.TrimSpace(string(current)))
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Invalid %v file in %v", CURRENT_FILE_NAME, directory))
+    }
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+
+  m.fs, err = store.MakeFileStore(m.generationDirectory(m.generation), options)
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+func (m *FileStoreStateMachine) generationDirectory(generation int) string {
+  return filepath.Join(m.directory, fmt.Sprintf("%v%v", GENERATION_DIRECTORY_PREFIX, generation))
+}
+
+// Return the live FileStore, for reads.
+func (m *FileStoreStateMachine) Store() *store.FileStore {
+  defer m.mutex.RUnlock()
+  m.mutex.RLock()
+
+  return m.fs
+}
+
+func (m *FileStoreStateMachine) Apply(encoded []byte) error {
+  var cmd command
+  if err := json.Unmarshal(encoded, &cmd); err != nil {
+    return err
+  }
+
+  fs := m.Store()
+  switch cmd.Op {
+  case COMMAND_SET:
+    attributes := &store.Attributes{ Metadata: cmd.Metadata }
+    if cmd.ExpiresAt != 0 {
+      attributes.ExpiresAt = time.Unix(0, cmd.ExpiresAt)
+    }
+    // Committed commands must be applied, whatever became of the proposer.
+    return fs.SetWithAttributes(context.Background(), cmd.Key, store.Value(cmd.Value), attributes)
+  case COMMAND_DELETE:
+    return fs.Delete(context.Background(), cmd.Key)
+  }
+  return errors.New(fmt.Sprintf("Unknown state machine command %v", cmd.Op))
+}
+
+func (m *FileStoreStateMachine) Snapshot(w io.Writer) error {
+  return m.Store().Snapshot(w)
+}
+
+func (m *FileStoreStateMachine) Restore(r io.Reader) error {
+  defer m.mutex.Unlock()
+  m.mutex.Lock()
+
+  generation := m.generation + 1
+  directory := m.generationDirectory(generation)
+  // Discard any earlier, interrupted restore of this generation.
+  if err := os.RemoveAll(directory); err != nil {
+    return err
+  }
+  if _, err := store.RestoreSnapshot(r, directory); err != nil {
+    os.RemoveAll(directory)
+    return err
+  }
+
+  fs, err := store.MakeFileStore(directory, m.options)
+  if err != nil {
+    os.RemoveAll(directory)
+    return err
+  }
+
+  // Switch generations atomically, then discard the old one.
+  if err := writeFileAtomically(filepath.Join(m.directory, CURRENT_FILE_NAME),
+      []byte(strconv.Itoa(generation))); err != nil {
+    os.RemoveAll(directory)
+    return err
+  }
+  previous := m.generationDirectory(m.generation)
+  m.generation = generation
+  m.fs = fs
+  if err := os.RemoveAll(previous); err != nil {
+    m.logger.Warn("Error removing the previous state machine generation", "err", err)
+  }
+  return nil
+}
@@ -0,0 +1,213 @@
+package raft
+
+import (
+  "bufio"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+)
+
+const (
+  STATE_FILE_NAME = "state.json"
+  LOG_FILE_NAME = "log.jsonl"
+  SNAPSHOT_META_FILE_NAME = "snapshot.json"
+  SNAPSHOT_FILE_NAME = "snapshot.tar"
+)
+
+// The durable vote state of a node. It must survive restarts, so that a node
+// never votes twice in a term.
+type hardState struct {
+  Term uint64 `json:"term"`
+  VotedFor string `json:"voted_for"`
+}
+
+// Describes the snapshot which replaces every log entry up to its index.
+type snapshotMeta struct {
+  Index uint64 `json:"index"`
+  Term uint64 `json:"term"`
+}
+
+// Persists a node's vote state, log and latest snapshot in a directory. The
+// log is a JSON Lines file, appended to and fsynced as entries arrive, and
+// rewritten when it is truncated or compacted.
+type storage struct {
+  directory string
+}
+
+/**
+ * Open the storage in `directory`, creating it if needed, and load its
+ * contents. Entries covered by the snapshot are dropped, e.g. if a node
+ * crashed between saving a snapshot and compacting its log.
+ */
+func openStorage(directory string) (*storage, *hardState, *snapshotMeta, []Entry, error) {
+  if err := os.MkdirAll(directory, 0755); err != nil {
+    return nil, nil, nil, nil, err
+  }
+  s := &storage{}
+  s.directory = directory
+
+  state := &hardState{}
+  if err := readJsonFile(s.path(STATE_FILE_NAME), state); err != nil {
+    return nil, nil, nil, nil, err
+  }
+
+  meta := &snapshotMeta{}
+  if err := readJsonFile(s.path(SNAPSHOT_META_FILE_NAME), meta); err != nil {
+    return nil, nil, nil, nil, err
+  }
+
+  entries, err := s.readLog()
+  if err != nil {
+    return nil, nil, nil, nil, err
+  }
+
+  live := entries[:0]
+  for _, entry := range entries {
+    if entry.Index > meta.Index {
+      live = append(live, entry)
+    }
+  }
+  return s, state, meta, live, nil
+}
+
+// Durably record the node's term and vote.
+func (s *storage) saveHardState(state *hardState) error {
+  contents, err := json.Marshal(state)
+  if err != nil {
+    return err
+  }
+  return writeFileAtomically(s.path(STATE_FILE_NAME), contents)
+}
+
+// Durably append entries to the log.
+func (s *storage) appendEntries(entries []Entry) error {
+  file, err := os.OpenFile(s.path(LOG_FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+
+  writer := bufio.NewWriter(file)
+  for _, entry := range entries {
+    line, err := json.Marshal(entry)
+    if err != nil {
+      file.Close()
+      return err
+    }
+    writer.Write(append(line, '\n'))
+  }
+
+  if err := writer.Flush(); err != nil {
+    file.Close()
+    return err
+  }
+  if err := file.Sync(); err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
+
+// Durably replace the log, e.g. after truncating conflicting entries.
+func (s *storage) rewriteLog(entries []Entry) error {
+  var contents []byte
+  for _, entry := range entries {
+    line, err := json.Marshal(entry)
+    if err != nil {
+      return err
+    }
+    contents = append(append(contents, line...), '\n')
+  }
+  return writeFileAtomically(s.path(LOG_FILE_NAME), contents)
+}
+
+/**
+ * Durably record a snapshot. The snapshot is written before its metadata, so
+ * a crash never leaves metadata describing a missing snapshot.
+ */
+func (s *storage) saveSnapshot(meta *snapshotMeta, snapshot []byte) error {
+  if err := writeFileAtomically(s.path(SNAPSHOT_FILE_NAME), snapshot); err != nil {
+    return err
+  }
+
+  contents, err := json.Marshal(meta)
+  if err != nil {
+    return err
+  }
+  return writeFileAtomically(s.path(SNAPSHOT_META_FILE_NAME), contents)
+}
+
+// Read the latest snapshot, or nil if there is none.
+func (s *storage) readSnapshot() ([]byte, error) {
+  snapshot, err := ioutil.ReadFile(s.path(SNAPSHOT_FILE_NAME))
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  return snapshot, err
+}
+
+func (s *storage) readLog() ([]Entry, error) {
+  file, err := os.Open(s.path(LOG_FILE_NAME))
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  var entries []Entry
+  reader := bufio.NewReader(file)
+  for {
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+      // A partial final line is an append interrupted by a crash; it was
+      // never acknowledged, so it is dropped.
+      break
+    }
+
+    var entry Entry
+    if err := json.Unmarshal(line, &entry); err != nil {
+      break
+    }
+    entries = append(entries, entry)
+  }
+  return entries, nil
+}
+
+func (s *storage) path(name string) string {
+  return filepath.Join(s.directory, name)
+}
+
+// Read a JSON file into `v`, leaving `v` unchanged if the file is missing.
+func readJsonFile(path string, v interface{}) error {
+  contents, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  return json.Unmarshal(contents, v)
+}
+
+// Replace a file via a fsynced temporary file and a rename, so that readers
+// never observe a partial write.
+func writeFileAtomically(path string, contents []byte) error {
+  tmpPath := path + ".tmp"
+  file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil {
+    return err
+  }
+
+  if _, err := file.Write(contents); err != nil {
+    file.Close()
+    return err
+  }
+  if err := file.Sync(); err != nil {
+    file.Close()
+    return err
+  }
+  if err := file.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, path)
+}
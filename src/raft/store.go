@@ -0,0 +1,184 @@
+package raft
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "path/filepath"
+  "time"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  DEFAULT_REQUEST_TIMEOUT = 5 * time.Second
+)
+
+// Configures a RaftStore. Zero fields select defaults.
+type RaftStoreOptions struct {
+  Node NodeOptions
+  // Configures the state machine's FileStore; may be nil.
+  FileStore *store.FileStoreOptions
+  // How long writes and reads wait for the cluster.
+  RequestTimeout time.Duration
+}
+
+// A linearizable KeyValueStore replicated across a fixed cluster of nodes via
+// Raft. Writes are committed to a majority of nodes' logs before they are
+// applied, and reads confirm leadership with a majority via read-index
+// before reading the state machine. Only the leader serves requests; others
+// return a NotLeaderError naming it, for the server to forward requests to.
+// Create instances via MakeRaftStore.
+type RaftStore struct {
+  node *Node
+  stateMachine *FileStoreStateMachine
+  timeout time.Duration
+}
+
+/**
+ * Make the store of the node `id`, where `peers` lists every other node of
+ * the cluster. Nodes are named by the address their server listens on,
+ * e.g. `localhost:8081`, so that requests can be forwarded to the leader.
+ * `options` may be nil.
+ */
+func MakeRaftStore(
+    id string,
+    peers []string,
+    directory string,
+    transport Transport,
+    options *RaftStoreOptions) (*RaftStore, error) {
+  if options == nil {
+    options = &RaftStoreOptions{}
+  }
+
+  stateMachine, err := MakeFileStoreStateMachine(filepath.Join(directory, "state"),
+    options.FileStore)
+  if err != nil {
+    return nil, err
+  }
+
+  node, err := MakeNode(id, peers, filepath.Join(directory, "raft"), stateMachine,
+    transport, &options.Node)
+  if err != nil {
+    return nil, err
+  }
+
+  s := &RaftStore{}
+  s.node = node
+  s.stateMachine = stateMachine
+  s.timeout = options.RequestTimeout
+  if s.timeout <= 0 {
+    s.timeout = DEFAULT_REQUEST_TIMEOUT
+  }
+  return s, nil
+}
+
+// Return the store's node, e.g. to connect it to a MemoryNetwork.
+func (s *RaftStore) Node() *Node {
+  return s.node
+}
+
+func (s *RaftStore) IsLeader() bool {
+  return s.node.Status().Role == ROLE_LEADER
+}
+
+// Return the current leader, or "" if none is known.
+func (s *RaftStore) Leader() string {
+  return s.node.Status().Leader
+}
+
+func (s *RaftStore) Set(ctx context.Context, key store.Key, value store.Value) error {
+  return s.SetWithAttributes(ctx, key, value, nil)
+}
+
+func (s *RaftStore) SetWithAttributes(
+    ctx context.Context,
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  cmd := &command{ Op: COMMAND_SET, Key: key, Value: []byte(value) }
+  if attributes != nil {
+    cmd.Metadata = attributes.Metadata
+    if !attributes.ExpiresAt.IsZero() {
+      cmd.ExpiresAt = attributes.ExpiresAt.UnixNano()
+    }
+  }
+  return s.propose(ctx, cmd)
+}
+
+func (s *RaftStore) Delete(ctx context.Context, key store.Key) error {
+  return s.propose(ctx, &command{ Op: COMMAND_DELETE, Key: key })
+}
+
+func (s *RaftStore) propose(ctx context.Context, cmd *command) error {
+  encoded, err := json.Marshal(cmd)
+  if err != nil {
+    return err
+  }
+  return s.node.Propose(ctx, encoded, s.timeout)
+}
+
+func (s *RaftStore) Get(ctx context.Context, key store.Key) (store.Value, error) {
+  value, _, err := s.GetWithAttributes(ctx, key)
+  return value, err
+}
+
+func (s *RaftStore) GetWithAttributes(
+    ctx context.Context,
+    key store.Key) (store.Value, *store.Attributes, error) {
+  if err := s.node.ReadIndex(ctx, s.timeout); err != nil {
+    return store.EMPTY_VALUE, nil, err
+  }
+  return s.stateMachine.Store().GetWithAttributes(ctx, key)
+}
+
+func (s *RaftStore) Keys(ctx context.Context) ([]store.Key, error) {
+  if err := s.node.ReadIndex(ctx, s.timeout); err != nil {
+    return nil, err
+  }
+  return s.stateMachine.Store().Keys(ctx)
+}
+
+func (s *RaftStore) Stats() map[string]int64 {
+  status := s.node.Status()
+  stats := s.stateMachine.Store().Stats()
+  stats["raft_term"] = int64(status.Term)
+  stats["raft_commit_index"] = int64(status.CommitIndex)
+  stats["raft_applied_index"] = int64(status.AppliedIndex)
+  stats["raft_snapshot_index"] = int64(status.SnapshotIndex)
+  stats["raft_log_entries"] = int64(status.LogEntries)
+  stats["raft_is_leader"] = 0
+  if status.Role == ROLE_LEADER {
+    stats["raft_is_leader"] = 1
+  }
+  return stats
+}
+
+// Serve messages from other nodes sent by an HttpTransport.
+func (s *RaftStore) ReplicaHandler() http.Handler {
+  return messageHandler(s.node)
+}
+
+// Check that the local store is healthy and that a leader is known, i.e.
+// that writes can be committed.
+func (s *RaftStore) CheckHealth() error {
+  if err := s.stateMachine.Store().CheckHealth(); err != nil {
+    return err
+  }
+  if s.Leader() == "" {
+    return errors.New("No Raft leader is known")
+  }
+  return nil
+}
+
+// Stop the node. The store must not be used afterwards.
+func (s *RaftStore) Stop() {
+  s.node.Stop()
+}
+
+// Stop the node, so that no further entries are applied, then close the
+// state machine's store.
+func (s *RaftStore) Close() error {
+  s.Stop()
+  return s.stateMachine.Store().Close()
+}
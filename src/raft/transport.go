@@ -0,0 +1,209 @@
+package raft
+
+import (
+  "bytes"
+  "crypto/tls"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // The route nodes receive messages on, beneath the server's /replica/ routes.
+  RAFT_MESSAGE_PATH = "/replica/raft"
+)
+
+type MessageType int
+
+const (
+  MSG_VOTE MessageType = iota
+  MSG_VOTE_RESPONSE
+  MSG_APPEND
+  MSG_APPEND_RESPONSE
+  MSG_SNAPSHOT
+)
+
+// A message between nodes. Responses to both appends and snapshots are
+// MSG_APPEND_RESPONSE.
+type Message struct {
+  Type MessageType `json:"type"`
+  From string `json:"from"`
+  To string `json:"to"`
+  Term uint64 `json:"term"`
+
+  // Vote requests carry the candidate's last log entry.
+  LastLogIndex uint64 `json:"last_log_index,omitempty"`
+  LastLogTerm uint64 `json:"last_log_term,omitempty"`
+  Granted bool `json:"granted,omitempty"`
+
+  // Appends carry the entries following PrevLogIndex.
+  PrevLogIndex uint64 `json:"prev_log_index,omitempty"`
+  PrevLogTerm uint64 `json:"prev_log_term,omitempty"`
+  Entries []Entry `json:"entries,omitempty"`
+  LeaderCommit uint64 `json:"leader_commit,omitempty"`
+
+  // Responses report the follower's last matching entry or, on failure, the
+  // index the leader should retry from.
+  Success bool `json:"success,omitempty"`
+  MatchIndex uint64 `json:"match_index,omitempty"`
+
+  // The leader's latest read, echoed in responses to confirm its leadership.
+  ReadContext uint64 `json:"read_context,omitempty"`
+
+  SnapshotIndex uint64 `json:"snapshot_index,omitempty"`
+  SnapshotTerm uint64 `json:"snapshot_term,omitempty"`
+  Snapshot []byte `json:"snapshot,omitempty"`
+}
+
+// Delivers messages between nodes. Delivery is best-effort: messages may be
+// dropped, delayed or reordered, and Raft retries as needed.
+type Transport interface {
+  Send(msg *Message)
+}
+
+// A simulated network connecting in-process nodes, which can be partitioned
+// to test failures. Create instances via MakeMemoryNetwork.
+type MemoryNetwork struct {
+  nodes map[string]*Node
+  // Maps each partitioned node to its partition; nodes only reach others in
+  // the same partition. Unlisted nodes form a partition of their own.
+  partitions map[string]int
+  mutex *sync.Mutex
+}
+
+func MakeMemoryNetwork() *MemoryNetwork {
+  m := &MemoryNetwork{}
+  m.nodes = make(map[string]*Node)
+  m.partitions = make(map[string]int)
+  m.mutex = &sync.Mutex{}
+  return m
+}
+
+// Connect a node to the network.
+func (m *MemoryNetwork) Register(node *Node) {
+  defer m.mutex.Unlock()
+  m.mutex.Lock()
+
+  m.nodes[node.id] = node
+}
+
+/**
+ * Split the network, so that nodes only reach nodes in the same group. Nodes
+ * not in any group are connected to one another.
+ */
+func (m *MemoryNetwork) Partition(groups ...[]string) {
+  defer m.mutex.Unlock()
+  m.mutex.Lock()
+
+  m.partitions = make(map[string]int)
+  for i, group := range groups {
+    for _, id := range group {
+      m.partitions[id] = i + 1
+    }
+  }
+}
+
+// Reconnect every node.
+func (m *MemoryNetwork) Heal() {
+  m.Partition()
+}
+
+func (m *MemoryNetwork) Send(msg *Message) {
+  m.mutex.Lock()
+  node, ok := m.nodes[msg.To]
+  connected := m.partitions[msg.From] == m.partitions[msg.To]
+  m.mutex.Unlock()
+
+  if ok && connected {
+    node.Receive(msg)
+  }
+}
+
+// Configures an HttpTransport.
+type HttpTransportOptions struct {
+  // Signs each message as sent by its sender, for peers which only accept
+  // messages from other nodes; may be nil.
+  PeerKey *auth.PeerKey
+  // If set, peers are reached over TLS with this client config.
+  Tls *tls.Config
+  // Logs messages which cannot be sent; may be nil.
+  Logger *logging.Logger
+}
+
+// Sends messages to peers' RAFT_MESSAGE_PATH over HTTP. Peers are named by
+// their address, e.g. `localhost:8081`.
+type HttpTransport struct {
+  httpClient *http.Client
+  // The scheme of peers' URLs, `https://` over TLS.
+  scheme string
+  // Signs messages; may be nil.
+  peerKey *auth.PeerKey
+  // Logs messages which cannot be sent; may be nil.
+  logger *logging.Logger
+}
+
+// Make a transport whose messages time out after `timeout`. `options` may be
+// nil.
+func MakeHttpTransport(timeout time.Duration, options *HttpTransportOptions) *HttpTransport {
+  t := &HttpTransport{}
+  t.httpClient = &http.Client{ Timeout: timeout }
+  t.scheme = "http://"
+  if options != nil {
+    t.peerKey = options.PeerKey
+    t.logger = options.Logger
+  }
+  if options != nil && options.Tls != nil {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = options.Tls
+    t.httpClient.Transport = transport
+    t.scheme = "https://"
+  }
+  return t
+}
+
+func (t *HttpTransport) Send(msg *Message) {
+  body, err := json.Marshal(msg)
+  if err != nil {
+    t.logger.Error("Error encoding Raft message", "to", msg.To, "err", err)
+    return
+  }
+
+  baseUrl := msg.To
+  if !strings.Contains(baseUrl, "://") {
+    baseUrl = t.scheme + baseUrl
+  }
+
+  // Send asynchronously, so a slow peer never stalls the node.
+  go func() {
+    req, err := http.NewRequest("POST", baseUrl + RAFT_MESSAGE_PATH, bytes.NewReader(body))
+    if err != nil {
+      t.logger.Error("Error making Raft request", "to", msg.To, "err", err)
+      return
+    }
+    req.Header.Set("Content-Type", "application/json")
+    t.peerKey.Sign(req, msg.From)
+    resp, err := t.httpClient.Do(req)
+    if err != nil {
+      return
+    }
+    resp.Body.Close()
+  }()
+}
+
+// Return a handler which delivers messages received over HTTP to the node.
+func messageHandler(node *Node) http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc(RAFT_MESSAGE_PATH, func(w http.ResponseWriter, r *http.Request) {
+    var msg Message
+    if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+    node.Receive(&msg)
+  })
+  return mux
+}
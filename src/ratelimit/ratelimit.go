@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+  "math"
+  "sync"
+  "time"
+)
+
+const (
+  // The number of clients whose buckets are tracked before idle buckets,
+  // i.e. those which have refilled completely, are dropped.
+  MAX_TRACKED_CLIENTS = 10000
+)
+
+// A token bucket holding up to `burst` tokens, refilled at `rate` per
+// second. Each request takes one token.
+type bucket struct {
+  tokens float64
+  updated time.Time
+}
+
+// Token bucket rate limits, one bucket per client, e.g. per token or IP
+// address. Create instances via MakeRateLimiter.
+type RateLimiter struct {
+  // Tokens added to each bucket per second; 0 is unlimited.
+  rate float64
+  // The capacity of each bucket, i.e. the requests a client may make at once
+  // after being idle.
+  burst int
+  buckets map[string]*bucket
+  // Returns the current time; replaced by tests.
+  now func() time.Time
+  // Guards every field.
+  mutex *sync.Mutex
+}
+
+/**
+ * Make a RateLimiter allowing each client `rate` requests per second, in
+ * bursts of up to `burst`. A `rate` of 0 is unlimited; a `burst` below 1
+ * selects 1.
+ */
+func MakeRateLimiter(rate float64, burst int) *RateLimiter {
+  l := &RateLimiter{}
+  l.now = time.Now
+  l.mutex = &sync.Mutex{}
+  l.SetLimits(rate, burst)
+  return l
+}
+
+/**
+ * Replace the limits, taking effect immediately. Every client starts again
+ * with a full bucket, so that raised limits relieve throttled clients at once.
+ */
+func (l *RateLimiter) SetLimits(rate float64, burst int) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  if burst < 1 {
+    burst = 1
+  }
+  l.rate = rate
+  l.burst = burst
+  l.buckets = make(map[string]*bucket)
+}
+
+/**
+ * Take a token from the client's bucket. Returns whether one was available,
+ * and if not, how long until one will be.
+ */
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  if l.rate <= 0 {
+    return true, 0
+  }
+
+  now := l.now()
+  b, ok := l.buckets[client]
+  if !ok {
+    if len(l.buckets) >= MAX_TRACKED_CLIENTS {
+      l.prune(now)
+    }
+    b = &bucket{ tokens: float64(l.burst), updated: now }
+    l.buckets[client] = b
+  }
+
+  b.tokens = math.Min(float64(l.burst), b.tokens + now.Sub(b.updated).Seconds() * l.rate)
+  b.updated = now
+  if b.tokens >= 1 {
+    b.tokens--
+    return true, 0
+  }
+  wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+  return false, wait
+}
+
+/**
+ * Drop the buckets which have refilled completely, as a new bucket is
+ * equivalent.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *RateLimiter) prune(now time.Time) {
+  for client, b := range l.buckets {
+    if b.tokens + now.Sub(b.updated).Seconds() * l.rate >= float64(l.burst) {
+      delete(l.buckets, client)
+    }
+  }
+}
+
+// Limits the requests in flight at once, queueing those beyond the limit
+// until a request finishes. Create instances via MakeConcurrencyLimiter.
+type ConcurrencyLimiter struct {
+  // The maximum requests in flight; 0 is unlimited.
+  limit int
+  // The maximum requests queued; beyond it, requests are rejected at once.
+  maxQueued int
+  inFlight int
+  // The queued requests, in arrival order. Each channel is closed when the
+  // request is handed a slot.
+  waiters []chan struct{}
+  // Guards every field.
+  mutex *sync.Mutex
+}
+
+/**
+ * Make a ConcurrencyLimiter allowing `limit` requests in flight, and
+ * queueing up to `maxQueued` more. A `limit` of 0 is unlimited.
+ */
+func MakeConcurrencyLimiter(limit int, maxQueued int) *ConcurrencyLimiter {
+  l := &ConcurrencyLimiter{}
+  l.mutex = &sync.Mutex{}
+  l.SetLimits(limit, maxQueued)
+  return l
+}
+
+/**
+ * Replace the limits. Raising the limit admits queued requests at once;
+ * lowering it lets requests in flight finish.
+ */
+func (l *ConcurrencyLimiter) SetLimits(limit int, maxQueued int) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  l.limit = limit
+  l.maxQueued = maxQueued
+  for len(l.waiters) > 0 && (l.limit <= 0 || l.inFlight < l.limit) {
+    l.inFlight++
+    close(l.waiters[0])
+    l.waiters = l.waiters[1:]
+  }
+}
+
+/**
+ * Wait up to `timeout` for a slot. Returns whether one was acquired, in
+ * which case Release must be called once the request finishes.
+ */
+func (l *ConcurrencyLimiter) Acquire(timeout time.Duration) bool {
+  l.mutex.Lock()
+  if l.limit <= 0 || l.inFlight < l.limit {
+    l.inFlight++
+    l.mutex.Unlock()
+    return true
+  }
+  if len(l.waiters) >= l.maxQueued || timeout <= 0 {
+    l.mutex.Unlock()
+    return false
+  }
+  waiter := make(chan struct{})
+  l.waiters = append(l.waiters, waiter)
+  l.mutex.Unlock()
+
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  select {
+  case <-waiter:
+    return true
+  case <-timer.C:
+  }
+
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  for i, queued := range l.waiters {
+    if queued == waiter {
+      l.waiters = append(l.waiters[:i], l.waiters[i + 1:]...)
+      return false
+    }
+  }
+  // The slot was handed over as the timer fired.
+  return true
+}
+
+// Release a slot acquired by Acquire, handing it to the first queued request.
+func (l *ConcurrencyLimiter) Release() {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  if len(l.waiters) > 0 && (l.limit <= 0 || l.inFlight <= l.limit) {
+    close(l.waiters[0])
+    l.waiters = l.waiters[1:]
+    return
+  }
+  l.inFlight--
+}
+
+// Return the number of requests in flight and queued.
+func (l *ConcurrencyLimiter) Load() (int, int) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  return l.inFlight, len(l.waiters)
+}
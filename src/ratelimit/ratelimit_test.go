@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+  "testing"
+  "time"
+)
+
+func TestRateLimiterRefillsBucketsPerClient(t *testing.T) {
+  now := time.Unix(1000, 0)
+  l := MakeRateLimiter(2, 3)
+  l.now = func() time.Time { return now }
+
+  for i := 0; i < 3; i++ {
+    if ok, _ := l.Allow("a"); !ok {
+      t.Fatalf("Expected request %v of the burst to be allowed", i)
+    }
+  }
+  ok, wait := l.Allow("a")
+  if ok || wait != 500 * time.Millisecond {
+    t.Errorf("Expected to wait 500ms beyond the burst, got %v %v", ok, wait)
+  }
+  if ok, _ := l.Allow("b"); !ok {
+    t.Errorf("Expected another client to have its own bucket")
+  }
+
+  now = now.Add(500 * time.Millisecond)
+  if ok, _ := l.Allow("a"); !ok {
+    t.Errorf("Expected a token after 500ms")
+  }
+  if ok, _ := l.Allow("a"); ok {
+    t.Errorf("Expected only one token after 500ms")
+  }
+
+  l.SetLimits(0, 0)
+  if ok, _ := l.Allow("a"); !ok {
+    t.Errorf("Expected a rate of 0 to be unlimited")
+  }
+}
+
+func TestConcurrencyLimiterQueuesAndRejects(t *testing.T) {
+  l := MakeConcurrencyLimiter(1, 1)
+  if !l.Acquire(0) {
+    t.Fatalf("Expected the first request to be admitted")
+  }
+  if l.Acquire(0) {
+    t.Errorf("Expected a request not willing to wait to be rejected")
+  }
+  if l.Acquire(10 * time.Millisecond) {
+    t.Errorf("Expected a queued request to time out")
+  }
+
+  admitted := make(chan bool)
+  go func() { admitted <- l.Acquire(time.Second) }()
+  for {
+    if _, queued := l.Load(); queued == 1 {
+      break
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if l.Acquire(time.Second) {
+    t.Errorf("Expected a request beyond the queue to be rejected")
+  }
+
+  l.Release()
+  if !<-admitted {
+    t.Errorf("Expected the queued request to be handed the slot")
+  }
+  if inFlight, queued := l.Load(); inFlight != 1 || queued != 0 {
+    t.Errorf("Expected one request in flight, got %v in flight and %v queued",
+      inFlight, queued)
+  }
+  l.Release()
+  if inFlight, _ := l.Load(); inFlight != 0 {
+    t.Errorf("Expected no requests in flight, got %v", inFlight)
+  }
+}
+
+func TestConcurrencyLimiterRaisingLimitAdmitsQueued(t *testing.T) {
+  l := MakeConcurrencyLimiter(1, 1)
+  l.Acquire(0)
+
+  admitted := make(chan bool)
+  go func() { admitted <- l.Acquire(time.Second) }()
+  for {
+    if _, queued := l.Load(); queued == 1 {
+      break
+    }
+    time.Sleep(time.Millisecond)
+  }
+
+  l.SetLimits(2, 1)
+  if !<-admitted {
+    t.Errorf("Expected raising the limit to admit the queued request")
+  }
+  if inFlight, _ := l.Load(); inFlight != 2 {
+    t.Errorf("Expected two requests in flight, got %v", inFlight)
+  }
+}
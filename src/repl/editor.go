@@ -0,0 +1,337 @@
+package repl
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+)
+
+const (
+  // The most lines kept in the history, and its file.
+  MAX_HISTORY = 1000
+)
+
+var (
+  // Returned by ReadLine when the line is abandoned with Ctrl-C.
+  ErrInterrupted = errors.New("Interrupted")
+)
+
+// Configures optional LineEditor behaviour.
+type EditorOptions struct {
+  // The file the history is loaded from and appended to; optional.
+  HistoryFile string
+  // Returns the candidate completions of the last word of `line`, the text
+  // before the cursor; optional.
+  Complete func(line string) []string
+}
+
+/**
+ * Reads lines from a terminal, with editing, history and tab completion, or
+ * from any other input as is. Create instances via MakeLineEditor.
+ *
+ * <p> On a terminal, the arrow keys, Home, End, Delete and Backspace edit
+ * the line as usual; Up and Down (or Ctrl-P and Ctrl-N) recall the history;
+ * Ctrl-A, Ctrl-E, Ctrl-U and Ctrl-K are as in Emacs; Tab completes; Ctrl-C
+ * abandons the line; Ctrl-D on an empty line ends the input.
+ */
+type LineEditor struct {
+  reader *bufio.Reader
+  output io.Writer
+  // The terminal being edited on, or nil if the input is not a terminal.
+  terminal *os.File
+  history []string
+  options *EditorOptions
+}
+
+/**
+ * Make a LineEditor reading `input`. Editing is enabled if it is a terminal,
+ * in which case the history is loaded from EditorOptions.HistoryFile.
+ */
+func MakeLineEditor(input io.Reader, output io.Writer, options *EditorOptions) *LineEditor {
+  e := &LineEditor{}
+  e.reader = bufio.NewReader(input)
+  e.output = output
+  e.options = options
+  if e.options == nil {
+    e.options = &EditorOptions{}
+  }
+  if file, ok := input.(*os.File); ok && isTerminal(int(file.Fd())) {
+    e.terminal = file
+    e.loadHistory()
+  }
+  return e
+}
+
+// Return whether lines are edited on a terminal, rather than read as is.
+func (e *LineEditor) IsTerminal() bool {
+  return e.terminal != nil
+}
+
+/**
+ * Read a line, without its line ending, after printing `prompt` if the
+ * input is a terminal. Returns io.EOF at the end of the input, and
+ * ErrInterrupted if the line was abandoned.
+ */
+func (e *LineEditor) ReadLine(prompt string) (string, error) {
+  if e.terminal == nil {
+    line, err := e.reader.ReadString('\n')
+    if err == io.EOF && line != "" {
+      err = nil
+    }
+    return strings.TrimRight(line, "\r\n"), err
+  }
+
+  fd := int(e.terminal.Fd())
+  previous, err := makeRaw(fd)
+  if err != nil {
+    return "", err
+  }
+  defer restoreTerminal(fd, previous)
+  return e.edit(prompt)
+}
+
+/**
+ * Add a line to the history, and append it to the history file. Blank
+ * lines and repeats of the last line are skipped.
+ */
+func (e *LineEditor) AddHistory(line string) {
+  if strings.TrimSpace(line) == "" ||
+      (len(e.history) > 0 && e.history[len(e.history) - 1] == line) {
+    return
+  }
+  e.history = append(e.history, line)
+  if len(e.history) > MAX_HISTORY {
+    e.history = e.history[len(e.history) - MAX_HISTORY:]
+  }
+
+  if e.terminal == nil || e.options.HistoryFile == "" {
+    return
+  }
+  file, err := os.OpenFile(e.options.HistoryFile, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+  if err != nil {
+    return
+  }
+  defer file.Close()
+  fmt.Fprintln(file, line)
+}
+
+/**
+ * Load the last MAX_HISTORY lines of the history file, compacting it if it
+ * has grown beyond them. A missing file is an empty history.
+ */
+func (e *LineEditor) loadHistory() {
+  if e.options.HistoryFile == "" {
+    return
+  }
+  data, err := os.ReadFile(e.options.HistoryFile)
+  if err != nil {
+    return
+  }
+
+  lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+  if len(lines) > MAX_HISTORY {
+    lines = lines[len(lines) - MAX_HISTORY:]
+    os.WriteFile(e.options.HistoryFile, []byte(strings.Join(lines, "\n") + "\n"), 0600)
+  }
+  for _, line := range lines {
+    if line != "" {
+      e.history = append(e.history, line)
+    }
+  }
+}
+
+/**
+ * Edit a line in raw mode until Enter, Ctrl-C or Ctrl-D.
+ *
+ * <p> This method assumes the terminal is in raw mode.
+ */
+func (e *LineEditor) edit(prompt string) (string, error) {
+  var line []rune
+  cursor := 0
+  // The history entry being shown; len(history) is the line being edited,
+  // saved in `edited` while another entry is shown.
+  historyIndex := len(e.history)
+  var edited []rune
+  // Whether the last key was Tab, so that a second lists the candidates.
+  tabbed := false
+
+  redraw := func() {
+    fmt.Fprint(e.output, "\r\x1b[K", prompt, string(line))
+    if back := len(line) - cursor; back > 0 {
+      fmt.Fprintf(e.output, "\x1b[%dD", back)
+    }
+  }
+  recall := func(index int) {
+    if index < 0 || index > len(e.history) || index == historyIndex {
+      return
+    }
+    if historyIndex == len(e.history) {
+      edited = line
+    }
+    historyIndex = index
+    if index == len(e.history) {
+      line = edited
+    } else {
+      line = []rune(e.history[index])
+    }
+    cursor = len(line)
+    redraw()
+  }
+
+  redraw()
+  for {
+    r, _, err := e.reader.ReadRune()
+    if err != nil {
+      return "", err
+    }
+    wasTabbed := tabbed
+    tabbed = false
+
+    switch r {
+    case '\r', '\n':
+      fmt.Fprint(e.output, "\n")
+      return string(line), nil
+    case 3: // Ctrl-C
+      fmt.Fprint(e.output, "^C\n")
+      return "", ErrInterrupted
+    case 4: // Ctrl-D
+      if len(line) == 0 {
+        fmt.Fprint(e.output, "\n")
+        return "", io.EOF
+      }
+      if cursor < len(line) {
+        line = append(line[:cursor], line[cursor + 1:]...)
+        redraw()
+      }
+    case 127, 8: // Backspace
+      if cursor > 0 {
+        line = append(line[:cursor - 1], line[cursor:]...)
+        cursor--
+        redraw()
+      }
+    case 1: // Ctrl-A
+      cursor = 0
+      redraw()
+    case 5: // Ctrl-E
+      cursor = len(line)
+      redraw()
+    case 21: // Ctrl-U
+      line = line[cursor:]
+      cursor = 0
+      redraw()
+    case 11: // Ctrl-K
+      line = line[:cursor]
+      redraw()
+    case 16: // Ctrl-P
+      recall(historyIndex - 1)
+    case 14: // Ctrl-N
+      recall(historyIndex + 1)
+    case '\t':
+      line, cursor = e.complete(line, cursor, wasTabbed)
+      tabbed = true
+      redraw()
+    case 27: // An escape sequence, e.g. `ESC [ A` for Up.
+      switch e.readEscape() {
+      case "[A", "OA":
+        recall(historyIndex - 1)
+      case "[B", "OB":
+        recall(historyIndex + 1)
+      case "[C", "OC":
+        if cursor < len(line) {
+          cursor++
+          redraw()
+        }
+      case "[D", "OD":
+        if cursor > 0 {
+          cursor--
+          redraw()
+        }
+      case "[H", "OH", "[1~":
+        cursor = 0
+        redraw()
+      case "[F", "OF", "[4~":
+        cursor = len(line)
+        redraw()
+      case "[3~":
+        if cursor < len(line) {
+          line = append(line[:cursor], line[cursor + 1:]...)
+          redraw()
+        }
+      }
+    default:
+      if r >= ' ' {
+        line = append(line[:cursor], append([]rune{ r }, line[cursor:]...)...)
+        cursor++
+        redraw()
+      }
+    }
+  }
+}
+
+// Read the rest of an escape sequence after ESC, e.g. `[A` or `[3~`.
+func (e *LineEditor) readEscape() string {
+  var sequence strings.Builder
+  for {
+    r, _, err := e.reader.ReadRune()
+    if err != nil {
+      return sequence.String()
+    }
+    sequence.WriteRune(r)
+    // Sequences end with a letter or `~`, after a `[` or `O`.
+    if sequence.Len() > 1 && (r == '~' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')) {
+      return sequence.String()
+    }
+    if sequence.Len() == 1 && r != '[' && r != 'O' {
+      return sequence.String()
+    }
+  }
+}
+
+/**
+ * Complete the word before the cursor: to the only candidate, followed by a
+ * space, or else to the candidates' common prefix. If there is none, and
+ * `list` is set, the candidates are printed. Returns the new line and
+ * cursor.
+ */
+func (e *LineEditor) complete(line []rune, cursor int, list bool) ([]rune, int) {
+  if e.options.Complete == nil {
+    return line, cursor
+  }
+  before := string(line[:cursor])
+  candidates := e.options.Complete(before)
+  if len(candidates) == 0 {
+    return line, cursor
+  }
+
+  wordStart := strings.LastIndexAny(before, " \t") + 1
+  word := before[wordStart:]
+  completion := candidates[0]
+  if len(candidates) == 1 {
+    completion += " "
+  } else {
+    for _, candidate := range candidates[1:] {
+      completion = commonPrefix(completion, candidate)
+    }
+  }
+
+  if len(completion) <= len(word) {
+    if list {
+      fmt.Fprint(e.output, "\r\n", strings.Join(candidates, "  "), "\r\n")
+    }
+    return line, cursor
+  }
+  completed := []rune(before[:wordStart] + completion)
+  return append(completed, line[cursor:]...), len(completed)
+}
+
+// Return the longest common prefix of `a` and `b`.
+func commonPrefix(a string, b string) string {
+  i := 0
+  for i < len(a) && i < len(b) && a[i] == b[i] {
+    i++
+  }
+  return a[:i]
+}
@@ -0,0 +1,175 @@
+package repl
+
+import (
+  "errors"
+  "fmt"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+/**
+ * Split a command line into words, as a shell does:
+ *   - Words are separated by whitespace, e.g. `GET key`.
+ *   - 'Single quotes' keep their contents as is.
+ *   - "Double quotes" keep their contents, except for the escapes \\, \",
+ *     \n, \r, \t and \xHH, e.g. "line one\nline two".
+ *   - Outside quotes, a backslash keeps the next character as is, e.g.
+ *     `key\ with\ spaces`, and a backslash ending a line joins the next.
+ * Adjacent quoted and unquoted parts form one word. Returns whether the
+ * line is incomplete, i.e. a quote is open or it ends with a backslash, in
+ * which case the words are not yet known.
+ */
+func Tokenize(line string) ([]string, bool, error) {
+  var words []string
+  var word strings.Builder
+  // Whether a word is in progress; quotes start a possibly empty word.
+  inWord := false
+  runes := []rune(line)
+  for i := 0; i < len(runes); i++ {
+    r := runes[i]
+    switch {
+    case unicode.IsSpace(r):
+      if inWord {
+        words = append(words, word.String())
+        word.Reset()
+        inWord = false
+      }
+    case r == '\\':
+      if i + 1 == len(runes) {
+        return nil, true, nil
+      }
+      i++
+      // A backslash and newline join lines.
+      if runes[i] != '\n' {
+        word.WriteRune(runes[i])
+        inWord = true
+      }
+    case r == '\'':
+      end := indexRune(runes, i + 1, '\'')
+      if end < 0 {
+        return nil, true, nil
+      }
+      word.WriteString(string(runes[i + 1:end]))
+      inWord = true
+      i = end
+    case r == '"':
+      end, err := unescapeQuoted(runes, i + 1, &word)
+      if err != nil {
+        return nil, false, err
+      }
+      if end < 0 {
+        return nil, true, nil
+      }
+      inWord = true
+      i = end
+    default:
+      word.WriteRune(r)
+      inWord = true
+    }
+  }
+  if inWord {
+    words = append(words, word.String())
+  }
+  return words, false, nil
+}
+
+// Return the index of the first `target` in `runes` from `start`, or -1.
+func indexRune(runes []rune, start int, target rune) int {
+  for i := start; i < len(runes); i++ {
+    if runes[i] == target {
+      return i
+    }
+  }
+  return -1
+}
+
+/**
+ * Write the contents of a double quoted string starting at `start` to
+ * `word`, unescaped. Returns the index of the closing quote, or -1 if it is
+ * not closed.
+ */
+func unescapeQuoted(runes []rune, start int, word *strings.Builder) (int, error) {
+  for i := start; i < len(runes); i++ {
+    r := runes[i]
+    if r == '"' {
+      return i, nil
+    }
+    if r != '\\' {
+      word.WriteRune(r)
+      continue
+    }
+
+    i++
+    if i == len(runes) {
+      return -1, nil
+    }
+    switch runes[i] {
+    case '\\', '"':
+      word.WriteRune(runes[i])
+    case 'n':
+      word.WriteByte('\n')
+    case 'r':
+      word.WriteByte('\r')
+    case 't':
+      word.WriteByte('\t')
+    case '\n':
+      // A backslash and newline join lines.
+    case 'x':
+      if i + 2 >= len(runes) {
+        return -1, nil
+      }
+      value, err := strconv.ParseUint(string(runes[i + 1:i + 3]), 16, 8)
+      if err != nil {
+        return 0, errors.New(fmt.Sprintf("Invalid escape \\x%v", string(runes[i + 1:i + 3])))
+      }
+      word.WriteByte(byte(value))
+      i += 2
+    default:
+      return 0, errors.New(fmt.Sprintf("Invalid escape \\%c", runes[i]))
+    }
+  }
+  return -1, nil
+}
+
+/**
+ * Return `word` as Tokenize would read it back: as is if it has no special
+ * characters, otherwise double quoted and escaped.
+ */
+func Quote(word string) string {
+  if word != "" && !strings.ContainsAny(word, " \t\r\n\\'\"") && isPrintable(word) {
+    return word
+  }
+
+  var quoted strings.Builder
+  quoted.WriteByte('"')
+  for i := 0; i < len(word); i++ {
+    switch c := word[i]; {
+    case c == '\\' || c == '"':
+      quoted.WriteByte('\\')
+      quoted.WriteByte(c)
+    case c == '\n':
+      quoted.WriteString("\\n")
+    case c == '\r':
+      quoted.WriteString("\\r")
+    case c == '\t':
+      quoted.WriteString("\\t")
+    case c < 0x20 || c == 0x7f:
+      quoted.WriteString(fmt.Sprintf("\\x%02x", c))
+    default:
+      quoted.WriteByte(c)
+    }
+  }
+  quoted.WriteByte('"')
+  return quoted.String()
+}
+
+// Return whether every character of `word` is printable.
+func isPrintable(word string) bool {
+  for _, r := range word {
+    if !unicode.IsPrint(r) {
+      return false
+    }
+  }
+  return true
+}
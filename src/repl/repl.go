@@ -0,0 +1,431 @@
+package repl
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "sort"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+  "buildbuddy.takehome.com/src/client"
+)
+
+const (
+  // The output formats of command results.
+  OUTPUT_TABLE = "table"
+  OUTPUT_JSON = "json"
+  OUTPUT_RAW = "raw"
+
+  PROMPT = "> "
+  // The prompt continuing a command with an open quote.
+  CONTINUATION_PROMPT = "... "
+)
+
+// The commands, as completed and listed by HELP.
+var COMMANDS = []string{ "DEL", "EXIT", "GET", "HELP", "LIST", "ROTATE_KEYS", "SET", "STAT", "TTL" }
+
+// The commands whose arguments are keys, and so are completed as keys.
+var KEY_COMMANDS = map[string]bool{ "DEL": true, "GET": true, "LIST": true, "SET": true,
+  "STAT": true, "TTL": true }
+
+const HELP = `GET <key>                     Print the value of the key.
+SET <key> <value> [EX <secs>]  Set the value, optionally expiring after <secs>.
+DEL <key> [key...]            Delete the keys.
+LIST [prefix]                 List the keys with the prefix.
+STAT <key>                    Print the size, expiry and metadata of the value.
+TTL <key>                     Print the seconds until the value expires, or -1.
+ROTATE_KEYS                   Re-encrypt values with the keyfile's active key.
+EXIT                          Leave the REPL.
+Quote keys and values with spaces, e.g. SET "my key" 'my value'; within
+double quotes, \n, \t, \" and \\ are escaped. An open quote continues the
+value on the next line.`
+
+// Configures optional Repl behaviour.
+type Options struct {
+  // The format of command results: OUTPUT_TABLE (the default), OUTPUT_JSON
+  // or OUTPUT_RAW.
+  Output string
+  // The file the history is kept in; optional.
+  HistoryFile string
+  // Serves ROTATE_KEYS, if the server's keys are local; optional.
+  RotateKeys func() error
+}
+
+// The outcome of a command, in each output format.
+type result struct {
+  // The table: its column headers and rows. Commands without a table, e.g.
+  // SET, print their raw output instead.
+  columns []string
+  rows [][]string
+  // The raw output, e.g. a value as is.
+  raw string
+  // The JSON output.
+  json interface{}
+}
+
+// An interactive client of the server. Create instances via MakeRepl.
+type Repl struct {
+  client *client.Client
+  options *Options
+}
+
+// Make a Repl calling the server via `c`. Returns an error for an unknown
+// output format.
+func MakeRepl(c *client.Client, options *Options) (*Repl, error) {
+  r := &Repl{}
+  r.client = c
+  r.options = &Options{}
+  if options != nil {
+    *r.options = *options
+  }
+  if r.options.Output == "" {
+    r.options.Output = OUTPUT_TABLE
+  }
+  if err := ValidateOutput(r.options.Output); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// Return an error unless `output` is an output format, e.g. OUTPUT_JSON.
+func ValidateOutput(output string) error {
+  if output != OUTPUT_TABLE && output != OUTPUT_JSON && output != OUTPUT_RAW {
+    return errors.New(fmt.Sprintf("Unknown output format %q; expected table, json or raw",
+      output))
+  }
+  return nil
+}
+
+/**
+ * Read commands from `input` and print their results to `output` until
+ * EXIT or the end of the input. A terminal input is edited with history and
+ * completion; see LineEditor.
+ */
+func (r *Repl) Run(input io.Reader, output io.Writer) error {
+  editor := MakeLineEditor(input, output, &EditorOptions{
+    HistoryFile: r.options.HistoryFile,
+    Complete: r.complete,
+  })
+
+  for {
+    words, err := r.readCommand(editor)
+    if err == io.EOF {
+      return nil
+    } else if err == ErrInterrupted {
+      continue
+    } else if err != nil {
+      if _, ok := err.(*parseError); ok {
+        r.print(output, nil, err)
+        continue
+      }
+      return err
+    }
+    if len(words) == 0 {
+      continue
+    }
+
+    if editor.IsTerminal() {
+      quoted := make([]string, len(words))
+      for i, word := range words {
+        quoted[i] = Quote(word)
+      }
+      editor.AddHistory(strings.Join(quoted, " "))
+    }
+    if strings.EqualFold(words[0], "EXIT") || strings.EqualFold(words[0], "QUIT") {
+      return nil
+    }
+    result, err := r.Execute(words)
+    r.print(output, result, err)
+  }
+}
+
+// An invalid command line, e.g. with an unknown escape.
+type parseError struct {
+  err error
+}
+
+func (e *parseError) Error() string {
+  return e.err.Error()
+}
+
+/**
+ * Read the words of a command, reading further lines while a quote is open
+ * or a line ends with a backslash.
+ */
+func (r *Repl) readCommand(editor *LineEditor) ([]string, error) {
+  line, err := editor.ReadLine(PROMPT)
+  for err == nil {
+    words, incomplete, parseErr := Tokenize(line)
+    if parseErr != nil {
+      return nil, &parseError{ parseErr }
+    }
+    if !incomplete {
+      return words, nil
+    }
+
+    var next string
+    next, err = editor.ReadLine(CONTINUATION_PROMPT)
+    line += "\n" + next
+  }
+  return nil, err
+}
+
+/**
+ * Execute a command, e.g. `[GET key]`, returning its result. The command
+ * name is case insensitive.
+ */
+func (r *Repl) Execute(words []string) (*result, error) {
+  command := strings.ToUpper(words[0])
+  args := words[1:]
+  switch {
+  case command == "GET" && len(args) == 1:
+    value, err := r.client.Get(args[0])
+    if err != nil {
+      return nil, err
+    }
+    return &result{
+      columns: []string{ "KEY", "VALUE" },
+      rows: [][]string{ { args[0], printable(string(value)) } },
+      raw: string(value),
+      json: map[string]string{ "key": args[0], "value": string(value) },
+    }, nil
+  case command == "SET" && len(args) >= 2:
+    return r.set(args)
+  case (command == "DEL" || command == "DELETE") && len(args) >= 1:
+    for _, key := range args {
+      if err := r.client.Delete(key); err != nil {
+        return nil, err
+      }
+    }
+    return &result{ raw: "OK", json: map[string][]string{ "deleted": args } }, nil
+  case command == "LIST" && len(args) <= 1:
+    prefix := ""
+    if len(args) == 1 {
+      prefix = args[0]
+    }
+    keys, err := r.client.Keys(prefix)
+    if err != nil {
+      return nil, err
+    }
+    rows := make([][]string, len(keys))
+    for i, key := range keys {
+      rows[i] = []string{ printable(key) }
+    }
+    return &result{
+      columns: []string{ "KEY" },
+      rows: rows,
+      raw: strings.Join(keys, "\n"),
+      json: map[string][]string{ "keys": append([]string{}, keys...) },
+    }, nil
+  case command == "STAT" && len(args) == 1:
+    return r.stat(args[0])
+  case command == "TTL" && len(args) == 1:
+    _, attributes, err := r.client.GetWithAttributes(args[0])
+    if err != nil {
+      return nil, err
+    }
+    ttl := strconv.FormatInt(ttlSeconds(attributes), 10)
+    return &result{
+      columns: []string{ "KEY", "TTL" },
+      rows: [][]string{ { args[0], ttl } },
+      raw: ttl,
+      json: map[string]interface{}{ "key": args[0], "ttl_seconds": ttlSeconds(attributes) },
+    }, nil
+  case command == "ROTATE_KEYS" && len(args) == 0:
+    if r.options.RotateKeys == nil {
+      return nil, errors.New("Key rotation requires a local server; send the server SIGHUP.")
+    }
+    if err := r.options.RotateKeys(); err != nil {
+      return nil, err
+    }
+    return &result{ raw: "OK", json: map[string]string{ "result": "OK" } }, nil
+  case command == "HELP":
+    return &result{ raw: HELP, json: map[string][]string{ "commands": COMMANDS } }, nil
+  }
+  return nil, errors.New(fmt.Sprintf("Invalid command %v; type HELP for the commands",
+    strings.Join(words, " ")))
+}
+
+/**
+ * Execute `SET <key> <value> [EX <seconds>]`. Unquoted words of the value
+ * are joined by single spaces, e.g. `SET key two words`.
+ */
+func (r *Repl) set(args []string) (*result, error) {
+  key := args[0]
+  valueWords := args[1:]
+  options := &client.SetOptions{}
+  if n := len(valueWords); n >= 3 && strings.EqualFold(valueWords[n - 2], "EX") {
+    seconds, err := strconv.ParseInt(valueWords[n - 1], 10, 64)
+    if err != nil || seconds <= 0 {
+      return nil, errors.New(fmt.Sprintf("Invalid expiry %q; expected seconds",
+        valueWords[n - 1]))
+    }
+    options.Ttl = time.Duration(seconds) * time.Second
+    valueWords = valueWords[:n - 2]
+  }
+
+  if err := r.client.SetWithOptions(key, []byte(strings.Join(valueWords, " ")), options); err != nil {
+    return nil, err
+  }
+  return &result{ raw: "OK", json: map[string]string{ "key": key, "result": "OK" } }, nil
+}
+
+// Execute `STAT <key>`: the value's size, expiry and metadata.
+func (r *Repl) stat(key string) (*result, error) {
+  value, attributes, err := r.client.GetWithAttributes(key)
+  if err != nil {
+    return nil, err
+  }
+  expiresAt := ""
+  if attributes != nil && !attributes.ExpiresAt.IsZero() {
+    expiresAt = attributes.ExpiresAt.UTC().Format(time.RFC3339)
+  }
+  var metadata map[string]string
+  if attributes != nil {
+    metadata = attributes.Metadata
+  }
+
+  fields := [][]string{
+    { "key", printable(key) },
+    { "size_bytes", strconv.Itoa(len(value)) },
+    { "expires_at", expiresAt },
+    { "ttl_seconds", strconv.FormatInt(ttlSeconds(attributes), 10) },
+  }
+  var names []string
+  for name := range metadata {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    fields = append(fields, []string{ "metadata." + name, printable(metadata[name]) })
+  }
+
+  var raw []string
+  for _, field := range fields {
+    raw = append(raw, field[0] + "=" + field[1])
+  }
+  encoded := map[string]interface{}{
+    "key": key,
+    "size_bytes": len(value),
+    "ttl_seconds": ttlSeconds(attributes),
+    "metadata": metadata,
+  }
+  if expiresAt != "" {
+    encoded["expires_at"] = expiresAt
+  }
+  return &result{
+    columns: []string{ "FIELD", "VALUE" },
+    rows: fields,
+    raw: strings.Join(raw, "\n"),
+    json: encoded,
+  }, nil
+}
+
+// Return the seconds until a value expires, rounded up, or -1 if it never
+// expires.
+func ttlSeconds(attributes *client.Attributes) int64 {
+  if attributes == nil || attributes.ExpiresAt.IsZero() {
+    return -1
+  }
+  remaining := time.Until(attributes.ExpiresAt)
+  if remaining < 0 {
+    return 0
+  }
+  return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// Return `text` as is if it is printable on one line, otherwise quoted.
+func printable(text string) string {
+  if isPrintable(text) {
+    return text
+  }
+  return Quote(text)
+}
+
+// Print a command's result, or its error, in the output format.
+func (r *Repl) print(output io.Writer, result *result, err error) {
+  if err != nil {
+    if r.options.Output == OUTPUT_JSON {
+      encoded, _ := json.Marshal(map[string]string{ "error": err.Error() })
+      fmt.Fprintln(output, string(encoded))
+    } else {
+      fmt.Fprintln(output, "Error:", err)
+    }
+    return
+  }
+
+  switch {
+  case r.options.Output == OUTPUT_JSON:
+    encoded, err := json.Marshal(result.json)
+    if err != nil {
+      fmt.Fprintln(output, "Error:", err)
+      return
+    }
+    fmt.Fprintln(output, string(encoded))
+  case r.options.Output == OUTPUT_TABLE && result.columns != nil:
+    table := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(table, strings.Join(result.columns, "\t"))
+    for _, row := range result.rows {
+      fmt.Fprintln(table, strings.Join(row, "\t"))
+    }
+    table.Flush()
+  default:
+    if result.raw == "" {
+      return
+    }
+    fmt.Fprint(output, result.raw)
+    if !strings.HasSuffix(result.raw, "\n") {
+      fmt.Fprintln(output)
+    }
+  }
+}
+
+/**
+ * Return the completions of the last word of `line`: the command names for
+ * the first word, otherwise the keys on the server for commands of keys.
+ */
+func (r *Repl) complete(line string) []string {
+  words := strings.Fields(line)
+  if len(words) == 0 || (len(words) == 1 && !strings.HasSuffix(line, " ")) {
+    word := ""
+    if len(words) == 1 {
+      word = strings.ToUpper(words[0])
+    }
+    var candidates []string
+    for _, command := range COMMANDS {
+      if strings.HasPrefix(command, word) {
+        candidates = append(candidates, command)
+      }
+    }
+    return candidates
+  }
+
+  if !KEY_COMMANDS[strings.ToUpper(words[0])] {
+    return nil
+  }
+  // SET completes only its key, not its value.
+  if strings.EqualFold(words[0], "SET") &&
+      (len(words) > 2 || (len(words) == 2 && strings.HasSuffix(line, " "))) {
+    return nil
+  }
+
+  word := ""
+  if !strings.HasSuffix(line, " ") {
+    word = words[len(words) - 1]
+  }
+  prefix := strings.TrimLeft(word, `"'`)
+  keys, err := r.client.Keys(prefix)
+  if err != nil {
+    return nil
+  }
+  var candidates []string
+  for _, key := range keys {
+    if candidate := Quote(key); strings.HasPrefix(candidate, word) {
+      candidates = append(candidates, candidate)
+    }
+  }
+  return candidates
+}
@@ -0,0 +1,194 @@
+package repl
+
+import (
+  "bufio"
+  "bytes"
+  "net/http/httptest"
+  "reflect"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Make a Repl of a server with an empty filestore.
+func makeTestRepl(t *testing.T, output string) *Repl {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  testServer := httptest.NewServer(server.MakeServerWithStores(fs, nil).Handler())
+  t.Cleanup(testServer.Close)
+
+  r, err := MakeRepl(client.MakeClient(testServer.URL), &Options{ Output: output })
+  if err != nil {
+    t.Fatalf("Error making REPL: %v", err)
+  }
+  return r
+}
+
+// Run the REPL on `input`, returning its output.
+func runTestRepl(r *Repl, input string) string {
+  var output bytes.Buffer
+  r.Run(strings.NewReader(input), &output)
+  return output.String()
+}
+
+func TestTokenize(t *testing.T) {
+  for _, testCase := range []struct {
+    line string
+    expected []string
+  }{
+    { "  GET   key ", []string{ "GET", "key" } },
+    { `SET "my key" 'single \n quoted'`, []string{ "SET", "my key", `single \n quoted` } },
+    { `SET key "a\tb\n\"c\"\\\x41"`, []string{ "SET", "key", "a\tb\n\"c\"\\A" } },
+    { `GET key\ with\ spaces`, []string{ "GET", "key with spaces" } },
+    { `SET key ""`, []string{ "SET", "key", "" } },
+    { `SET pre"fix"ed`, []string{ "SET", "prefixed" } },
+    { "SET key \"line one\nline two\"", []string{ "SET", "key", "line one\nline two" } },
+    { "SET key \\\nvalue", []string{ "SET", "key", "value" } },
+  } {
+    words, incomplete, err := Tokenize(testCase.line)
+    if err != nil || incomplete || !reflect.DeepEqual(words, testCase.expected) {
+      t.Errorf("Expected %q to be %q, got %q (%v, %v)",
+        testCase.line, testCase.expected, words, incomplete, err)
+    }
+  }
+
+  for _, line := range []string{ `SET key "open`, "SET key 'open", `SET key \` } {
+    if _, incomplete, err := Tokenize(line); !incomplete || err != nil {
+      t.Errorf("Expected %q to be incomplete, got %v %v", line, incomplete, err)
+    }
+  }
+  if _, _, err := Tokenize(`GET "\q"`); err == nil {
+    t.Errorf("Expected an unknown escape to fail")
+  }
+}
+
+func TestQuoteRoundTrips(t *testing.T) {
+  for _, word := range []string{ "plain", "", "two words", "quote\"s", "back\\slash",
+      "new\nline", "tab\t", "\x01", "it's" } {
+    words, _, err := Tokenize(Quote(word))
+    if err != nil || len(words) != 1 || words[0] != word {
+      t.Errorf("Expected %q to round trip via %v, got %q (%v)", word, Quote(word), words, err)
+    }
+  }
+  if Quote("plain") != "plain" {
+    t.Errorf("Expected plain words not to be quoted, got %v", Quote("plain"))
+  }
+}
+
+func TestRunCommandsAsTables(t *testing.T) {
+  r := makeTestRepl(t, "")
+  output := runTestRepl(r, `set "my key" hello   world
+SET other "line one
+line two"
+get "my key"
+GET other
+LIST
+TTL other
+DEL other
+GET other
+BOGUS
+exit
+GET unreached
+`)
+
+  expected := `OK
+OK
+KEY     VALUE
+my key  hello world
+KEY    VALUE
+other  "line one\nline two"
+KEY
+my key
+other
+KEY    TTL
+other  -1
+OK
+Error: Key not found: other
+Error: Invalid command BOGUS; type HELP for the commands
+`
+  if output != expected {
+    t.Errorf("Expected output:\n%v\ngot:\n%v", expected, output)
+  }
+}
+
+func TestRunCommandsAsJsonAndRaw(t *testing.T) {
+  r := makeTestRepl(t, OUTPUT_JSON)
+  output := runTestRepl(r, "SET key value EX 60\nGET key\nTTL key\nLIST k\nGET missing\n")
+  expected := `{"key":"key","result":"OK"}
+{"key":"key","value":"value"}
+{"key":"key","ttl_seconds":60}
+{"keys":["key"]}
+{"error":"Key not found: missing"}
+`
+  if output != expected {
+    t.Errorf("Expected output:\n%v\ngot:\n%v", expected, output)
+  }
+
+  r.options.Output = OUTPUT_RAW
+  if output := runTestRepl(r, "GET key\nSTAT key\n"); !strings.HasPrefix(output,
+      "value\nkey=key\nsize_bytes=5\nexpires_at=") {
+    t.Errorf("Expected the raw value and stats, got %q", output)
+  }
+
+  if _, err := MakeRepl(r.client, &Options{ Output: "xml" }); err == nil {
+    t.Errorf("Expected an unknown output format to fail")
+  }
+}
+
+func TestComplete(t *testing.T) {
+  r := makeTestRepl(t, "")
+  runTestRepl(r, "SET apple 1\nSET apricot 2\nSET \"a b\" 3\nSET banana 4\n")
+
+  for _, testCase := range []struct {
+    line string
+    expected []string
+  }{
+    { "", COMMANDS },
+    { "s", []string{ "SET", "STAT" } },
+    { "GET ap", []string{ "apple", "apricot" } },
+    { `DEL banana "a`, []string{ `"a b"` } },
+    { "SET b", []string{ "banana" } },
+    { "SET banana ", nil },
+    { "EXIT ", nil },
+  } {
+    if candidates := r.complete(testCase.line); !reflect.DeepEqual(candidates, testCase.expected) {
+      t.Errorf("Expected %q to complete to %q, got %q", testCase.line, testCase.expected, candidates)
+    }
+  }
+}
+
+func TestLineEditorEditsAndRecallsHistory(t *testing.T) {
+  var output bytes.Buffer
+  e := MakeLineEditor(strings.NewReader(""), &output, &EditorOptions{
+    Complete: func(line string) []string { return []string{ "GET" } },
+  })
+  e.AddHistory("GET first")
+  e.AddHistory("GET second")
+
+  for _, testCase := range []struct {
+    keys string
+    expected string
+  }{
+    // Completion, then typing.
+    { "G\tkey\r", "GET key" },
+    // Left, insert, Home, delete, End.
+    { "SE key\x1b[D\x1b[D\x1b[D\x1b[DT\x01\x1b[3~S\x05!\r", "SET key!" },
+    // Up twice, Down once, Backspace.
+    { "\x1b[A\x1b[A\x1b[B\x7f\r", "GET secon" },
+    // Ctrl-U kills to the start, Ctrl-K to the end.
+    { "abc\x15xyz\x01\x1b[C\x0b\r", "x" },
+  } {
+    e.reader = bufio.NewReader(strings.NewReader(testCase.keys))
+    line, err := e.edit(PROMPT)
+    if err != nil || line != testCase.expected {
+      t.Errorf("Expected %q to edit %q, got %q (%v)", testCase.keys, testCase.expected, line, err)
+    }
+  }
+
+  e.reader = bufio.NewReader(strings.NewReader("abc\x03"))
+  if _, err := e.edit(PROMPT); err != ErrInterrupted {
+    t.Errorf("Expected Ctrl-C to interrupt, got %v", err)
+  }
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package repl
+
+import (
+  "syscall"
+  "unsafe"
+)
+
+// The terminal state saved by makeRaw.
+type terminalState = syscall.Termios
+
+// Return whether the file descriptor is a terminal.
+func isTerminal(fd int) bool {
+  var termios syscall.Termios
+  return ioctl(fd, syscall.TCGETS, &termios) == nil
+}
+
+/**
+ * Put the terminal into raw mode, so that keys are read as they are pressed
+ * and not echoed, returning its previous state for restoreTerminal. Output
+ * processing is kept, so that `\n` still starts a new line.
+ */
+func makeRaw(fd int) (*terminalState, error) {
+  var previous syscall.Termios
+  if err := ioctl(fd, syscall.TCGETS, &previous); err != nil {
+    return nil, err
+  }
+
+  raw := previous
+  raw.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+  raw.Cflag |= syscall.CS8
+  raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+  raw.Cc[syscall.VMIN] = 1
+  raw.Cc[syscall.VTIME] = 0
+  if err := ioctl(fd, syscall.TCSETS, &raw); err != nil {
+    return nil, err
+  }
+  return &previous, nil
+}
+
+// Restore the terminal state returned by makeRaw.
+func restoreTerminal(fd int, previous *terminalState) error {
+  return ioctl(fd, syscall.TCSETS, previous)
+}
+
+func ioctl(fd int, request uintptr, termios *syscall.Termios) error {
+  _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request,
+    uintptr(unsafe.Pointer(termios)))
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package repl
+
+import (
+  "errors"
+)
+
+// The terminal state saved by makeRaw; line editing is only supported on
+// Linux, so elsewhere input is read a line at a time.
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+  return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+  return nil, errors.New("Raw terminal mode is not supported on this platform")
+}
+
+func restoreTerminal(fd int, previous *terminalState) error {
+  return nil
+}
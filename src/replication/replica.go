@@ -0,0 +1,336 @@
+package replication
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // The routes peers serve for one another, beneath REPLICA_PATH_PREFIX.
+  REPLICA_PATH_PREFIX = "/replica/"
+  REPLICA_GET_PATH = "/replica/get"
+  REPLICA_SET_PATH = "/replica/set"
+  // The liveness probe of a peer's server.
+  PEER_HEALTH_PATH = "/healthz"
+)
+
+// A value along with the attributes which version it. Deletions and expired
+// values are tombstones, whose attributes are marked Deleted.
+type VersionedValue struct {
+  Value store.Value
+  // Never nil; holds at least the value's version.
+  Attributes *store.Attributes
+}
+
+// Return whether the value is missing as of `now`: a tombstone, or expired.
+func (v *VersionedValue) missing(now time.Time) bool {
+  return v.Attributes.Deleted || v.Attributes.Expired(now)
+}
+
+// A single copy of the data, either on this node or on a peer.
+type Replica interface {
+  /**
+   * Store the value, unless the replica already holds the same or a newer
+   * version of it.
+   */
+  Apply(ctx context.Context, key store.Key, value *VersionedValue) error
+
+  /**
+   * Return the replica's value or tombstone, or nil if it holds neither for
+   * the key. Expired values are returned as tombstones.
+   */
+  Read(ctx context.Context, key store.Key) (*VersionedValue, error)
+
+  // A human readable name for the replica, e.g. its address.
+  String() string
+}
+
+// The replica held by this node's own store.
+type LocalReplica struct {
+  kvStore store.VersionedKeyValueStore
+  // Serializes Apply calls, so that a version is compared and written
+  // atomically.
+  mutex *sync.Mutex
+  // Logs errors serving peers; may be nil.
+  logger *logging.Logger
+  // Called with every value or tombstone stored; may be nil.
+  onApply func(key store.Key, value store.Value, attributes *store.Attributes)
+}
+
+// The JSON encoding of a VersionedValue sent between peers. The value is
+// base64 encoded by encoding/json, so arbitrary bytes survive.
+type replicaValue struct {
+  Key store.Key `json:"key"`
+  Value []byte `json:"value"`
+  Version store.Version `json:"version"`
+  // Unix nanoseconds, or 0 if the value never expires.
+  ExpiresAt int64 `json:"expires_at,omitempty"`
+  Metadata map[string]string `json:"metadata,omitempty"`
+  Deleted bool `json:"deleted,omitempty"`
+}
+
+func encodeReplicaValue(key store.Key, value *VersionedValue) *replicaValue {
+  encoded := &replicaValue{
+    Key: key,
+    Value: []byte(value.Value),
+    Version: value.Attributes.Version,
+    Metadata: value.Attributes.Metadata,
+    Deleted: value.Attributes.Deleted,
+  }
+  if !value.Attributes.ExpiresAt.IsZero() {
+    encoded.ExpiresAt = value.Attributes.ExpiresAt.UnixNano()
+  }
+  return encoded
+}
+
+func (e *replicaValue) decode() *VersionedValue {
+  attributes := &store.Attributes{
+    Metadata: e.Metadata,
+    Version: e.Version,
+    Deleted: e.Deleted,
+  }
+  if e.ExpiresAt != 0 {
+    attributes.ExpiresAt = time.Unix(0, e.ExpiresAt)
+  }
+  return &VersionedValue{ Value: store.Value(e.Value), Attributes: attributes }
+}
+
+// Make the replica for a local store, which must keep versioned tombstones.
+func MakeLocalReplica(kvStore store.KeyValueStore) (*LocalReplica, error) {
+  versionedStore, ok := kvStore.(store.VersionedKeyValueStore)
+  if !ok {
+    return nil, errors.New("Replication requires a store which keeps versioned tombstones")
+  }
+
+  r := &LocalReplica{}
+  r.kvStore = versionedStore
+  r.mutex = &sync.Mutex{}
+  return r, nil
+}
+
+func (r *LocalReplica) Apply(ctx context.Context, key store.Key, value *VersionedValue) error {
+  defer r.mutex.Unlock()
+  r.mutex.Lock()
+
+  current, err := r.Read(ctx, key)
+  if err != nil {
+    return err
+  }
+  if current != nil && !value.Attributes.Version.After(current.Attributes.Version) {
+    return nil
+  }
+  if err := r.kvStore.SetWithAttributes(ctx, key, value.Value, value.Attributes); err != nil {
+    return err
+  }
+
+  // Still under the mutex, so that changes are reported in order.
+  if r.onApply != nil {
+    r.onApply(key, value.Value, value.Attributes)
+  }
+  return nil
+}
+
+func (r *LocalReplica) Read(ctx context.Context, key store.Key) (*VersionedValue, error) {
+  value, attributes, err := r.kvStore.GetVersioned(ctx, key)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  if attributes == nil {
+    // Written before replication was enabled; older than any replicated
+    // write.
+    attributes = &store.Attributes{}
+  }
+  return &VersionedValue{ Value: value, Attributes: attributes }, nil
+}
+
+func (r *LocalReplica) String() string {
+  return "local"
+}
+
+// Return the handler for the routes peers use to reach this replica.
+func (r *LocalReplica) Handler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc(REPLICA_GET_PATH, r.handleGet)
+  mux.HandleFunc(REPLICA_SET_PATH, r.handleSet)
+  return mux
+}
+
+// Handler for a /replica/get call. Returns the versioned value or tombstone
+// as JSON, or a 404 if the replica holds neither for the `key` query parameter.
+func (r *LocalReplica) handleGet(w http.ResponseWriter, req *http.Request) {
+  key := req.URL.Query().Get("key")
+  if key == "" {
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  value, err := r.Read(req.Context(), store.Key(key))
+  if err != nil {
+    r.logger.Error("Error reading replica", "key", key, "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  } else if value == nil {
+    w.WriteHeader(http.StatusNotFound)
+    return
+  }
+
+  encoded := encodeReplicaValue(store.Key(key), value)
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(encoded); err != nil {
+    r.logger.Warn("Error encoding replica value", "err", err)
+  }
+}
+
+// Handler for a /replica/set call. The body is a JSON versioned value, which
+// is applied unless the replica already holds a newer version.
+func (r *LocalReplica) handleSet(w http.ResponseWriter, req *http.Request) {
+  defer req.Body.Close()
+
+  var encoded replicaValue
+  if err := json.NewDecoder(req.Body).Decode(&encoded); err != nil ||
+      encoded.Key == "" || encoded.Version.IsZero() {
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  if err := r.Apply(req.Context(), encoded.Key, encoded.decode()); err != nil {
+    r.logger.Error("Error applying replicated write", "key", encoded.Key, "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+  }
+}
+
+// A replica held by a peer, reached over HTTP.
+type RemoteReplica struct {
+  // The peer's base URL, e.g. `http://localhost:8081`.
+  baseUrl string
+  httpClient *http.Client
+  // Signs the calls to the peer as `self`; may be nil.
+  peerKey *auth.PeerKey
+  self string
+}
+
+/**
+ * Make the replica for a peer, e.g. `localhost:8081`, called with the
+ * PeerTimeout, PeerKey and Tls of `options`, which may be nil.
+ */
+func MakeRemoteReplica(address string, options *ReplicationOptions) *RemoteReplica {
+  if options == nil {
+    options = &ReplicationOptions{}
+  }
+  timeout := options.PeerTimeout
+  if timeout <= 0 {
+    timeout = DEFAULT_PEER_TIMEOUT
+  }
+
+  r := &RemoteReplica{}
+  r.baseUrl = address
+  if !strings.Contains(address, "://") {
+    r.baseUrl = "http://" + address
+    if options.Tls != nil {
+      r.baseUrl = "https://" + address
+    }
+  }
+  r.httpClient = &http.Client{ Timeout: timeout }
+  if options.Tls != nil {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = options.Tls
+    r.httpClient.Transport = transport
+  }
+  r.peerKey = options.PeerKey
+  r.self = options.NodeId
+  return r
+}
+
+func (r *RemoteReplica) Apply(ctx context.Context, key store.Key, value *VersionedValue) error {
+  encoded := encodeReplicaValue(key, value)
+
+  body, err := json.Marshal(encoded)
+  if err != nil {
+    return err
+  }
+
+  req, err := http.NewRequestWithContext(ctx, "POST", r.baseUrl + REPLICA_SET_PATH,
+    bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  r.peerKey.Sign(req, r.self)
+  resp, err := r.httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return errors.New(fmt.Sprintf("HttpError %v from replica %v", resp.StatusCode, r))
+  }
+  return nil
+}
+
+func (r *RemoteReplica) Read(ctx context.Context, key store.Key) (*VersionedValue, error) {
+  req, err := http.NewRequestWithContext(ctx, "GET",
+    r.baseUrl + REPLICA_GET_PATH + "?key=" + url.QueryEscape(string(key)), nil)
+  if err != nil {
+    return nil, err
+  }
+  r.peerKey.Sign(req, r.self)
+  resp, err := r.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode == http.StatusNotFound {
+    return nil, nil
+  } else if resp.StatusCode != http.StatusOK {
+    return nil, errors.New(fmt.Sprintf("HttpError %v from replica %v", resp.StatusCode, r))
+  }
+
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  var encoded replicaValue
+  if err := json.Unmarshal(body, &encoded); err != nil {
+    return nil, err
+  }
+
+  return encoded.decode(), nil
+}
+
+// Return an error unless the peer's server answers its liveness probe.
+func (r *RemoteReplica) Ping() error {
+  resp, err := r.httpClient.Get(r.baseUrl + PEER_HEALTH_PATH)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return errors.New(fmt.Sprintf("HttpError %v from replica %v", resp.StatusCode, r))
+  }
+  return nil
+}
+
+func (r *RemoteReplica) String() string {
+  return r.baseUrl
+}
@@ -0,0 +1,494 @@
+package replication
+
+import (
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // The default timeout for calls to a peer.
+  DEFAULT_PEER_TIMEOUT = 2 * time.Second
+)
+
+// Configures a ReplicatedStore.
+type ReplicationOptions struct {
+  // This node's ID, which breaks ties between versions written at the same
+  // instant. Must be unique among the peers.
+  NodeId string
+  // The number of replicas, including this node's, which must acknowledge a
+  // write or answer a read before it succeeds. Default to a majority.
+  WriteQuorum int
+  ReadQuorum int
+  // The timeout for calls to a peer. Defaults to DEFAULT_PEER_TIMEOUT.
+  PeerTimeout time.Duration
+  // Signs the calls to peers, as NodeId, for peers which only serve other
+  // nodes; may be nil.
+  PeerKey *auth.PeerKey
+  // If set, peers are called over TLS with this client config.
+  Tls *tls.Config
+  // Logs failed writes and repairs; may be nil.
+  Logger *logging.Logger
+}
+
+// A KeyValueStore replicated across this node and its peers, without a
+// leader: any node coordinates the reads and writes it receives.
+//
+// Writes are versioned by the coordinator and sent to every replica,
+// succeeding once W replicas acknowledge them. Deletions are writes of a
+// tombstone, and expired values read as tombstones of their version, so that
+// replicas holding older writes never bring a key back; tombstones are kept
+// indefinitely. Reads ask every replica,
+// return the newest version among the first R answers, and repair replicas
+// which answered with an older version. With W + R greater than the number
+// of replicas, every read overlaps the latest successful write.
+// Create instances via MakeReplicatedStore.
+type ReplicatedStore struct {
+  local *LocalReplica
+  // Every replica, with the local replica first.
+  replicas []Replica
+  nodeId string
+  writeQuorum int
+  readQuorum int
+  // The last version timestamp assigned, so that versions assigned by this
+  // node strictly increase even if the clock does not.
+  lastTimestamp int64
+  // Writes beyond the quorum and read repairs run in the background; tests
+  // wait on them.
+  pending *sync.WaitGroup
+  // Counters reported by Stats.
+  repairCount int64
+  writeFailures int64
+  readFailures int64
+  mutex *sync.Mutex
+  // Logs failed writes and repairs; may be nil.
+  logger *logging.Logger
+}
+
+// The answer of a single replica to a read.
+type readResult struct {
+  replica Replica
+  value *VersionedValue
+  err error
+}
+
+/**
+ * Make a store replicated between `local` and the peers at `peerAddresses`,
+ * e.g. `localhost:8081`. The local store must support attributes; see
+ * `store.AttributeKeyValueStore`. `options` may be nil.
+ */
+func MakeReplicatedStore(
+    local store.KeyValueStore,
+    peerAddresses []string,
+    options *ReplicationOptions) (*ReplicatedStore, error) {
+  if options == nil {
+    options = &ReplicationOptions{}
+  }
+
+  localReplica, err := MakeLocalReplica(local)
+  if err != nil {
+    return nil, err
+  }
+  localReplica.logger = options.Logger
+
+  replicas := []Replica{ localReplica }
+  for _, address := range peerAddresses {
+    replicas = append(replicas, MakeRemoteReplica(address, options))
+  }
+  return makeReplicatedStore(localReplica, replicas, options)
+}
+
+func makeReplicatedStore(
+    local *LocalReplica,
+    replicas []Replica,
+    options *ReplicationOptions) (*ReplicatedStore, error) {
+  majority := len(replicas) / 2 + 1
+  r := &ReplicatedStore{}
+  r.local = local
+  r.replicas = replicas
+  r.nodeId = options.NodeId
+  r.writeQuorum = options.WriteQuorum
+  if r.writeQuorum == 0 {
+    r.writeQuorum = majority
+  }
+  r.readQuorum = options.ReadQuorum
+  if r.readQuorum == 0 {
+    r.readQuorum = majority
+  }
+  r.pending = &sync.WaitGroup{}
+  r.mutex = &sync.Mutex{}
+  r.logger = options.Logger
+
+  if r.writeQuorum < 1 || r.writeQuorum > len(replicas) ||
+      r.readQuorum < 1 || r.readQuorum > len(replicas) {
+    return nil, errors.New(fmt.Sprintf(
+      "Quorums W=%v, R=%v must be between 1 and the %v replicas",
+      r.writeQuorum, r.readQuorum, len(replicas)))
+  }
+  if r.writeQuorum + r.readQuorum <= len(replicas) {
+    r.logger.Warn("W + R does not exceed the number of replicas; reads may miss the latest writes",
+      "write_quorum", r.writeQuorum, "read_quorum", r.readQuorum, "replicas", len(replicas))
+  }
+  return r, nil
+}
+
+/**
+ * Write the value to every replica, returning once W replicas acknowledge
+ * it. Replicas which have not yet answered continue in the background.
+ */
+func (r *ReplicatedStore) Set(ctx context.Context, key store.Key, value store.Value) error {
+  return r.SetWithAttributes(ctx, key, value, nil)
+}
+
+/**
+ * Write the value and its attributes to every replica, returning once W
+ * replicas acknowledge it. Any version in `attributes` is replaced by a new
+ * version assigned by this node.
+ *
+ * <p> Once started, a write is sent to every replica whatever becomes of
+ * `ctx`, so that replicas converge; the call stops waiting for the quorum,
+ * returning the context's error, once it ends.
+ */
+func (r *ReplicatedStore) SetWithAttributes(
+    ctx context.Context,
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  versioned := &VersionedValue{ Value: value, Attributes: &store.Attributes{} }
+  if attributes != nil {
+    *versioned.Attributes = *attributes
+  }
+  versioned.Attributes.Deleted = false
+  return r.write(ctx, key, versioned)
+}
+
+/**
+ * Write a tombstone for the key to every replica, returning once W replicas
+ * acknowledge it. As with writes, the call stops waiting once `ctx` ends.
+ */
+func (r *ReplicatedStore) Delete(ctx context.Context, key store.Key) error {
+  tombstone := &VersionedValue{
+    Value: store.EMPTY_VALUE,
+    Attributes: &store.Attributes{ Deleted: true },
+  }
+  return r.write(ctx, key, tombstone)
+}
+
+/**
+ * Assign the value a new version, and write it to every replica, returning
+ * once W replicas acknowledge it.
+ */
+func (r *ReplicatedStore) write(
+    ctx context.Context,
+    key store.Key,
+    versioned *VersionedValue) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  versioned.Attributes.Version = r.nextVersion()
+
+  results := make(chan error, len(r.replicas))
+  r.pending.Add(len(r.replicas))
+  for _, replica := range r.replicas {
+    go func(replica Replica) {
+      defer r.pending.Done()
+      err := replica.Apply(context.Background(), key, versioned)
+      if err != nil {
+        atomic.AddInt64(&r.writeFailures, 1)
+        r.logger.Warn("Replicated write failed", "key", key, "replica", replica, "err", err)
+      }
+      results <- err
+    }(replica)
+  }
+
+  acks, failures := 0, 0
+  var lastErr error
+  for range r.replicas {
+    var err error
+    select {
+    case err = <-results:
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+    if err != nil {
+      failures++
+      lastErr = err
+    } else {
+      acks++
+    }
+
+    if acks >= r.writeQuorum {
+      return nil
+    } else if failures > len(r.replicas) - r.writeQuorum {
+      break
+    }
+  }
+  return fmt.Errorf("%w: Write quorum not reached for %v: %v of %v acks, last error: %v",
+    store.ErrUnavailable, key, acks, r.writeQuorum, lastErr)
+}
+
+/**
+ * Wait for writes beyond the quorum and read repairs still running in the
+ * background, then close the local replica's store.
+ */
+func (r *ReplicatedStore) Close() error {
+  r.pending.Wait()
+  return r.local.kvStore.Close()
+}
+
+// A replica which can be probed, e.g. a RemoteReplica.
+type pinger interface {
+  Ping() error
+}
+
+/**
+ * Check that the local store is healthy, and that enough replicas are
+ * reachable for both the write and read quorums, i.e. the larger of W and R.
+ */
+func (r *ReplicatedStore) CheckHealth() error {
+  if checker, ok := r.local.kvStore.(store.HealthChecker); ok {
+    if err := checker.CheckHealth(); err != nil {
+      return err
+    }
+  }
+
+  errs := make([]error, len(r.replicas))
+  wg := &sync.WaitGroup{}
+  for i, replica := range r.replicas {
+    if p, ok := replica.(pinger); ok {
+      wg.Add(1)
+      go func(i int, p pinger) {
+        defer wg.Done()
+        errs[i] = p.Ping()
+      }(i, p)
+    }
+  }
+  wg.Wait()
+
+  reachable := 0
+  var unreachable []string
+  for i, err := range errs {
+    if err == nil {
+      reachable++
+    } else {
+      unreachable = append(unreachable, fmt.Sprintf("%v (%v)", r.replicas[i], err))
+    }
+  }
+  needed := r.writeQuorum
+  if r.readQuorum > needed {
+    needed = r.readQuorum
+  }
+  if reachable < needed {
+    return errors.New(fmt.Sprintf("%v of %v replicas are reachable, below the quorum of %v: %v",
+      reachable, len(r.replicas), needed, strings.Join(unreachable, ", ")))
+  }
+  return nil
+}
+
+/**
+ * Return the newest value among the first R replicas to answer.
+ */
+func (r *ReplicatedStore) Get(ctx context.Context, key store.Key) (store.Value, error) {
+  value, _, err := r.GetWithAttributes(ctx, key)
+  return value, err
+}
+
+/**
+ * Return the newest value and its attributes among the first R replicas to
+ * answer, or an error wrapping os.ErrNotExist if none of them hold a value or
+ * the newest is a tombstone.
+ *
+ * <p> Replicas which answer with an older value, including those answering
+ * after the quorum, are repaired in the background. Reads are sent with
+ * `ctx`, so ending it also abandons those still in flight.
+ */
+func (r *ReplicatedStore) GetWithAttributes(
+    ctx context.Context,
+    key store.Key) (store.Value, *store.Attributes, error) {
+  if err := ctx.Err(); err != nil {
+    return store.EMPTY_VALUE, nil, err
+  }
+  results := make(chan readResult, len(r.replicas))
+  for _, replica := range r.replicas {
+    go func(replica Replica) {
+      value, err := replica.Read(ctx, key)
+      results <- readResult{ replica: replica, value: value, err: err }
+    }(replica)
+  }
+
+  var answered []readResult
+  failures := 0
+  var lastErr error
+  for len(answered) < r.readQuorum {
+    var result readResult
+    select {
+    case result = <-results:
+    case <-ctx.Done():
+      // Reads still in flight are cancelled too; no repair is attempted.
+      return store.EMPTY_VALUE, nil, ctx.Err()
+    }
+    if result.err != nil {
+      atomic.AddInt64(&r.readFailures, 1)
+      failures++
+      lastErr = result.err
+      if failures > len(r.replicas) - r.readQuorum {
+        r.repairInBackground(key, answered, results,
+          len(r.replicas) - len(answered) - failures)
+        if err := ctx.Err(); err != nil {
+          // The replicas failed as the call was abandoned.
+          return store.EMPTY_VALUE, nil, err
+        }
+        return store.EMPTY_VALUE, nil, fmt.Errorf(
+          "%w: Read quorum not reached for %v: %v of %v answers, last error: %v",
+          store.ErrUnavailable, key, len(answered), r.readQuorum, lastErr)
+      }
+      continue
+    }
+    answered = append(answered, result)
+  }
+
+  newest := newestValue(answered)
+  r.repairInBackground(key, answered, results,
+    len(r.replicas) - len(answered) - failures)
+  if newest == nil || newest.missing(time.Now()) {
+    return store.EMPTY_VALUE, nil, fmt.Errorf("%w: key %v", os.ErrNotExist, key)
+  }
+  return newest.Value, newest.Attributes, nil
+}
+
+/**
+ * Repair the replicas which answered with a value older than the newest
+ * answer, after also collecting the `pending` answers still to come.
+ */
+func (r *ReplicatedStore) repairInBackground(
+    key store.Key,
+    answered []readResult,
+    results <-chan readResult,
+    pending int) {
+  r.pending.Add(1)
+  go func() {
+    defer r.pending.Done()
+
+    for i := 0; i < pending; i++ {
+      if result := <-results; result.err == nil {
+        answered = append(answered, result)
+      }
+    }
+
+    newest := newestValue(answered)
+    if newest == nil {
+      return
+    }
+
+    for _, result := range answered {
+      if result.value != nil &&
+          !newest.Attributes.Version.After(result.value.Attributes.Version) {
+        continue
+      } else if result.value == nil && newest.Attributes.Deleted {
+        // Replicas which never held the key need no tombstone.
+        continue
+      }
+
+      atomic.AddInt64(&r.repairCount, 1)
+      if err := result.replica.Apply(context.Background(), key, newest); err != nil {
+        r.logger.Warn("Read repair failed", "key", key, "replica", result.replica, "err", err)
+      }
+    }
+  }()
+}
+
+/**
+ * Return the keys held by the local replica, other than tombstones. Keys
+ * which have not yet been replicated to this node are omitted.
+ */
+func (r *ReplicatedStore) Keys(ctx context.Context) ([]store.Key, error) {
+  lister, ok := r.local.kvStore.(store.KeyLister)
+  if !ok {
+    return nil, errors.New("The local store cannot list its keys")
+  }
+  keys, err := lister.Keys(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  now := time.Now()
+  live := keys[:0]
+  for _, key := range keys {
+    value, err := r.local.Read(ctx, key)
+    if err != nil {
+      return nil, err
+    } else if value != nil && !value.missing(now) {
+      live = append(live, key)
+    }
+  }
+  return live, nil
+}
+
+// Return the local store's statistics along with replication counters.
+func (r *ReplicatedStore) Stats() map[string]int64 {
+  stats := make(map[string]int64)
+  if reporter, ok := r.local.kvStore.(store.StatsReporter); ok {
+    stats = reporter.Stats()
+  }
+  stats["replicas"] = int64(len(r.replicas))
+  stats["write_quorum"] = int64(r.writeQuorum)
+  stats["read_quorum"] = int64(r.readQuorum)
+  stats["read_repairs"] = atomic.LoadInt64(&r.repairCount)
+  stats["replica_write_failures"] = atomic.LoadInt64(&r.writeFailures)
+  stats["replica_read_failures"] = atomic.LoadInt64(&r.readFailures)
+  return stats
+}
+
+/**
+ * Call `fn` with every value or tombstone the local replica stores, whether
+ * written via this node, sent by a peer, or repaired by a read, e.g. to
+ * notify watchers. Tombstones' attributes are marked Deleted. Must be called
+ * before the store is used.
+ */
+func (r *ReplicatedStore) OnApply(
+    fn func(key store.Key, value store.Value, attributes *store.Attributes)) {
+  r.local.onApply = fn
+}
+
+// Return the handler peers use to reach this node's replica; it serves the
+// routes beneath REPLICA_PATH_PREFIX.
+func (r *ReplicatedStore) ReplicaHandler() http.Handler {
+  return r.local.Handler()
+}
+
+// Assign a version greater than any previously assigned by this node.
+func (r *ReplicatedStore) nextVersion() store.Version {
+  defer r.mutex.Unlock()
+  r.mutex.Lock()
+
+  timestamp := time.Now().UnixNano()
+  if timestamp <= r.lastTimestamp {
+    timestamp = r.lastTimestamp + 1
+  }
+  r.lastTimestamp = timestamp
+  return store.Version{ Timestamp: timestamp, NodeId: r.nodeId }
+}
+
+// Return the newest value among the answers, or nil if none hold a value.
+func newestValue(answered []readResult) *VersionedValue {
+  var newest *VersionedValue
+  for _, result := range answered {
+    if result.value == nil {
+      continue
+    }
+    if newest == nil || result.value.Attributes.Version.After(newest.Attributes.Version) {
+      newest = result.value
+    }
+  }
+  return newest
+}
@@ -0,0 +1,376 @@
+package replication
+
+import (
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  KEY = store.Key("a key")
+  VALUE = store.Value("some value 123")
+  VALUE2 = store.Value("another value")
+)
+
+// Several in-process servers, each replicating to all of the others.
+type testCluster struct {
+  servers []*httptest.Server
+  locals []*store.FileStore
+  stores []*ReplicatedStore
+}
+
+func makeTestCluster(t *testing.T, n int, options *ReplicationOptions) *testCluster {
+  cluster := &testCluster{}
+  handlers := make([]http.Handler, n)
+  for i := 0; i < n; i++ {
+    i := i
+    cluster.servers = append(cluster.servers, httptest.NewServer(
+      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        handlers[i].ServeHTTP(w, r)
+      })))
+  }
+  t.Cleanup(cluster.close)
+
+  for i := 0; i < n; i++ {
+    local, err := store.MakeFileStore(t.TempDir(), nil)
+    if err != nil {
+      t.Fatalf("Error making filestore: %v", err)
+    }
+
+    var peers []string
+    for j, peer := range cluster.servers {
+      if j != i {
+        peers = append(peers, peer.URL)
+      }
+    }
+
+    nodeOptions := &ReplicationOptions{ NodeId: cluster.servers[i].URL }
+    if options != nil {
+      *nodeOptions = *options
+      nodeOptions.NodeId = cluster.servers[i].URL
+    }
+    replicated, err := MakeReplicatedStore(local, peers, nodeOptions)
+    if err != nil {
+      t.Fatalf("Error making replicated store: %v", err)
+    }
+
+    cluster.locals = append(cluster.locals, local)
+    cluster.stores = append(cluster.stores, replicated)
+    // Servers accept the replicas' calls signed with the same key.
+    s, err := server.MakeServerWithOptions(replicated, nil,
+      &server.ServerOptions{ PeerKey: nodeOptions.PeerKey })
+    if err != nil {
+      t.Fatalf("Error making server: %v", err)
+    }
+    handlers[i] = s.Handler()
+  }
+  return cluster
+}
+
+func (c *testCluster) close() {
+  for _, s := range c.servers {
+    s.Close()
+  }
+}
+
+func TestReplicatedWriteReachesEveryReplica(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, nil)
+
+  c := client.MakeClient(cluster.servers[0].URL)
+  if err := c.Set(string(KEY), []byte(VALUE)); err != nil {
+    t.Fatalf("Error setting %v: %v", KEY, err)
+  }
+
+  // Writes finish in the background once the quorum acknowledges them.
+  for _, replicated := range cluster.stores {
+    replicated.pending.Wait()
+  }
+
+  for i, local := range cluster.locals {
+    if value, attributes, err := local.GetWithAttributes(ctx, KEY); err != nil ||
+        value != VALUE || attributes.Version.IsZero() {
+      t.Errorf("Expected replica %v to hold a versioned %v, got %v (%v)",
+        i, VALUE, value, err)
+    }
+  }
+
+  if value, err := client.MakeClient(cluster.servers[2].URL).Get(string(KEY));
+      err != nil || store.Value(value) != VALUE {
+    t.Errorf("Expected to read %v via another node, got %v (%v)", VALUE, value, err)
+  }
+}
+
+func TestReplicatedWriteRequiresQuorum(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, nil)
+  cluster.servers[1].Close()
+  cluster.servers[2].Close()
+
+  if err := cluster.stores[0].Set(ctx, KEY, VALUE); err == nil {
+    t.Errorf("Expected a write with 1 of 3 replicas to miss the quorum")
+  }
+
+  cluster = makeTestCluster(t, 3, &ReplicationOptions{ WriteQuorum: 1, ReadQuorum: 1 })
+  cluster.servers[1].Close()
+  cluster.servers[2].Close()
+
+  if err := cluster.stores[0].Set(ctx, KEY, VALUE); err != nil {
+    t.Errorf("Expected a write with W=1 to succeed, got %v", err)
+  }
+  if value, err := cluster.stores[0].Get(ctx, KEY); err != nil || value != VALUE {
+    t.Errorf("Expected a read with R=1 to succeed, got %v (%v)", value, err)
+  }
+}
+
+func TestReplicatedReadRepairsStaleReplicas(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, nil)
+  older := &VersionedValue{
+    Value: VALUE,
+    Attributes: &store.Attributes{ Version: cluster.stores[0].nextVersion() },
+  }
+  newer := &VersionedValue{
+    Value: VALUE2,
+    Attributes: &store.Attributes{ Version: cluster.stores[0].nextVersion() },
+  }
+
+  // Replica 1 misses the newer write, and replica 2 misses both.
+  cluster.stores[0].local.Apply(ctx, KEY, newer)
+  cluster.stores[1].local.Apply(ctx, KEY, older)
+
+  value, err := cluster.stores[0].Get(ctx, KEY)
+  if err != nil || value != VALUE2 {
+    t.Fatalf("Expected the newest value %v, got %v (%v)", VALUE2, value, err)
+  }
+  cluster.stores[0].pending.Wait()
+
+  for i := 1; i < 3; i++ {
+    remote := MakeRemoteReplica(cluster.servers[i].URL, nil)
+    if repaired, err := remote.Read(ctx, KEY); err != nil || repaired == nil ||
+        repaired.Value != VALUE2 {
+      t.Errorf("Expected replica %v to be repaired to %v, got %v (%v)",
+        i, VALUE2, repaired, err)
+    }
+  }
+
+  if stats := cluster.stores[0].Stats(); stats["read_repairs"] != 2 {
+    t.Errorf("Expected 2 read repairs, got %v", stats)
+  }
+}
+
+func TestRemoteReplicasAreCalledOverTls(t *testing.T) {
+  ctx := context.Background()
+  local, _ := store.MakeFileStore(t.TempDir(), nil)
+  replica, _ := MakeLocalReplica(local)
+  peer := httptest.NewTLSServer(replica.Handler())
+  t.Cleanup(peer.Close)
+
+  // The peer is listed without a scheme, as in the config.
+  rootCas := x509.NewCertPool()
+  rootCas.AddCert(peer.Certificate())
+  remote := MakeRemoteReplica(strings.TrimPrefix(peer.URL, "https://"),
+    &ReplicationOptions{ Tls: &tls.Config{ RootCAs: rootCas } })
+
+  value := &VersionedValue{
+    Value: VALUE,
+    Attributes: &store.Attributes{ Version: store.Version{ Timestamp: 1, NodeId: "a" } },
+  }
+  if err := remote.Apply(ctx, KEY, value); err != nil {
+    t.Fatalf("Error applying over TLS: %v", err)
+  }
+  if read, err := remote.Read(ctx, KEY); err != nil || read == nil || read.Value != VALUE {
+    t.Errorf("Expected to read %v over TLS, got %v (%v)", VALUE, read, err)
+  }
+}
+
+func TestReplicaKeepsNewestVersion(t *testing.T) {
+  ctx := context.Background()
+  local, _ := store.MakeFileStore(t.TempDir(), nil)
+  replica, _ := MakeLocalReplica(local)
+
+  older := &VersionedValue{
+    Value: VALUE,
+    Attributes: &store.Attributes{ Version: store.Version{ Timestamp: 1, NodeId: "b" } },
+  }
+  newer := &VersionedValue{
+    Value: VALUE2,
+    Attributes: &store.Attributes{ Version: store.Version{ Timestamp: 1, NodeId: "c" } },
+  }
+  replica.Apply(ctx, KEY, newer)
+  replica.Apply(ctx, KEY, older)
+
+  if current, err := replica.Read(ctx, KEY); err != nil || current.Value != VALUE2 {
+    t.Errorf("Expected the newest version to win, got %v (%v)", current, err)
+  }
+}
+
+func TestReplicatedDeleteWritesATombstone(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, nil)
+  if err := cluster.stores[0].Set(ctx, KEY, VALUE); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+  if err := cluster.stores[1].Delete(ctx, KEY); err != nil {
+    t.Fatalf("Error deleting key: %v", err)
+  }
+  cluster.stores[1].pending.Wait()
+
+  if _, err := cluster.stores[2].Get(ctx, KEY); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("Expected a deleted key to wrap os.ErrNotExist, got %v", err)
+  }
+  if keys, err := cluster.stores[0].Keys(ctx); err != nil || len(keys) != 0 {
+    t.Errorf("Expected no keys after the delete, got %v (%v)", keys, err)
+  }
+  for i, local := range cluster.stores {
+    if tombstone, err := local.local.Read(ctx, KEY); err != nil || tombstone == nil ||
+        !tombstone.Attributes.Deleted {
+      t.Errorf("Expected replica %v to hold a tombstone, got %v (%v)", i, tombstone, err)
+    }
+  }
+}
+
+func TestStaleReplicasDoNotResurrectDeletedOrExpiredKeys(t *testing.T) {
+  ctx := context.Background()
+  for _, newer := range []*store.Attributes{
+    { Deleted: true },
+    { ExpiresAt: time.Now().Add(-time.Second) },
+  } {
+    cluster := makeTestCluster(t, 3, nil)
+    older := &VersionedValue{
+      Value: VALUE,
+      Attributes: &store.Attributes{ Version: cluster.stores[0].nextVersion() },
+    }
+    newer.Version = cluster.stores[0].nextVersion()
+
+    // Replica 2 missed the delete or expiring write.
+    cluster.stores[0].local.Apply(ctx, KEY, &VersionedValue{ Value: VALUE2, Attributes: newer })
+    cluster.stores[1].local.Apply(ctx, KEY, &VersionedValue{ Value: VALUE2, Attributes: newer })
+    cluster.stores[2].local.Apply(ctx, KEY, older)
+
+    if _, err := cluster.stores[2].Get(ctx, KEY); !errors.Is(err, os.ErrNotExist) {
+      t.Errorf("Expected the stale value to be superseded by %+v, got %v", newer, err)
+    }
+    cluster.stores[2].pending.Wait()
+
+    if repaired, err := cluster.stores[2].local.Read(ctx, KEY); err != nil ||
+        repaired == nil || !repaired.Attributes.Deleted ||
+        repaired.Attributes.Version != newer.Version {
+      t.Errorf("Expected the stale replica to be repaired with a tombstone, got %v (%v)",
+        repaired, err)
+    }
+  }
+}
+
+func TestWatchersSeeWritesCoordinatedByPeers(t *testing.T) {
+  cluster := makeTestCluster(t, 3, nil)
+  var watchers []*client.Watcher
+  for _, s := range cluster.servers {
+    watcher, err := client.MakeClient(s.URL).Watch("", nil)
+    if err != nil {
+      t.Fatalf("Error watching: %v", err)
+    }
+    defer watcher.Close()
+    watchers = append(watchers, watcher)
+  }
+
+  c := client.MakeClient(cluster.servers[0].URL)
+  if err := c.Set(string(KEY), []byte(VALUE)); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+  if err := c.Delete(string(KEY)); err != nil {
+    t.Fatalf("Error deleting key: %v", err)
+  }
+
+  // Every node, including the coordinator, reports each change once.
+  for i, watcher := range watchers {
+    for _, expected := range []string{ "set", "delete" } {
+      select {
+      case event := <-watcher.Events():
+        if event.Type != expected || event.Key != string(KEY) {
+          t.Errorf("Expected a %v event on node %v, got %+v", expected, i, event)
+        }
+      case <-time.After(5 * time.Second):
+        t.Fatalf("Timed out waiting for a %v event on node %v", expected, i)
+      }
+    }
+  }
+}
+
+func TestReplicasOnlyAcceptSignedCalls(t *testing.T) {
+  ctx := context.Background()
+  peerKey, _ := auth.MakePeerKey([]byte("test-peer-secret"))
+  cluster := makeTestCluster(t, 3, &ReplicationOptions{ PeerKey: peerKey })
+
+  if err := cluster.stores[0].Set(ctx, KEY, VALUE); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+  cluster.stores[0].pending.Wait()
+  for i, local := range cluster.locals {
+    if value, err := local.Get(ctx, KEY); err != nil || value != VALUE {
+      t.Errorf("Expected replica %v to hold the value, got %q (%v)", i, value, err)
+    }
+  }
+
+  // A client cannot write to a replica directly.
+  resp, err := http.Post(cluster.servers[1].URL + REPLICA_SET_PATH, "application/json",
+    strings.NewReader(`{"key":"a key","value":"Zm9yZ2Vk","version":{"timestamp":1}}`))
+  if err != nil {
+    t.Fatalf("Error calling the replica: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusUnauthorized {
+    t.Errorf("Expected an unsigned replica call to be unauthorized, got %v", resp.StatusCode)
+  }
+}
+
+func TestReplicatedReadOfMissingKey(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, nil)
+
+  if _, err := cluster.stores[1].Get(ctx, KEY); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("Expected a missing key to wrap os.ErrNotExist, got %v", err)
+  }
+
+  _, err := client.MakeClient(cluster.servers[1].URL).Get(string(KEY))
+  if !errors.Is(err, client.ErrNotFound) {
+    t.Errorf("Expected a 404 for a missing key, got %v", err)
+  }
+}
+
+func TestReplicatedStoreValidatesQuorums(t *testing.T) {
+  local, _ := store.MakeFileStore(t.TempDir(), nil)
+  _, err := MakeReplicatedStore(local, []string{ "localhost:1" },
+    &ReplicationOptions{ WriteQuorum: 3 })
+  if err == nil || !strings.Contains(err.Error(), "Quorums") {
+    t.Errorf("Expected an error for a quorum larger than the replicas, got %v", err)
+  }
+
+  if _, err := MakeReplicatedStore(&store.FakeKeyValueStore{}, nil, nil); err == nil {
+    t.Errorf("Expected an error replicating a store without attributes")
+  }
+}
+
+func TestReplicatedCallsStopWaitingOnceCancelled(t *testing.T) {
+  cluster := makeTestCluster(t, 3, nil)
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  if err := cluster.stores[0].Set(ctx, KEY, VALUE); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled write to fail with its context's error, got %v", err)
+  }
+  if _, err := cluster.stores[0].Get(ctx, KEY); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled read to fail with its context's error, got %v", err)
+  }
+}
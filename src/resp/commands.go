@@ -0,0 +1,698 @@
+package resp
+
+import (
+  "errors"
+  "fmt"
+  "hash/fnv"
+  "math"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  // Reported by INFO. Clients use it to detect features; this frontend
+  // implements a subset of the RESP2 commands of this version.
+  REDIS_VERSION = "6.0.0"
+  // The number of keys SCAN returns per call without a COUNT.
+  DEFAULT_SCAN_COUNT = 10
+)
+
+// Handles a command, whose name is args[0], writing exactly one reply.
+type commandHandler func(c *conn, args []string)
+
+type command struct {
+  handler commandHandler
+  // The number of arguments including the name, as in Redis: exactly
+  // `arity` if positive, at least -`arity` if negative.
+  arity int
+  // With an auth policy, the permissions the connection's token must hold
+  // on every key (or prefix) returned by `keysOf`. Commands without any are
+  // allowed before AUTH.
+  permissions []auth.Permission
+  keysOf func(args []string) []string
+}
+
+var (
+  readOnly = []auth.Permission{ auth.PERMISSION_READ }
+  writeOnly = []auth.Permission{ auth.PERMISSION_WRITE }
+  readWrite = []auth.Permission{ auth.PERMISSION_READ, auth.PERMISSION_WRITE }
+  adminOnly = []auth.Permission{ auth.PERMISSION_ADMIN }
+)
+
+// The supported commands, by lowercase name.
+var commands = map[string]*command{
+  "auth": { handleAuth, -2, nil, nil },
+  "ping": { handlePing, -1, nil, nil },
+  "quit": { handleQuit, 1, nil, nil },
+  "get": { handleGet, 2, readOnly, firstKey },
+  "set": { handleSet, -3, writeOnly, firstKey },
+  "del": { handleDel, -2, writeOnly, everyKey },
+  "exists": { handleExists, -2, readOnly, everyKey },
+  "mget": { handleMget, -2, readOnly, everyKey },
+  "mset": { handleMset, -3, writeOnly, msetKeys },
+  "incr": { handleIncr, 2, readWrite, firstKey },
+  "keys": { handleKeys, 2, readOnly, keysPrefix },
+  "scan": { handleScan, -2, readOnly, scanPrefix },
+  "info": { handleInfo, -1, adminOnly, everyPrefix },
+}
+
+// Execute a command, writing its reply.
+func (c *conn) execute(args []string) {
+  name := strings.ToLower(args[0])
+  cmd, ok := commands[name]
+  if !ok {
+    c.reply.error(fmt.Sprintf("ERR unknown command '%v'", args[0]))
+    return
+  }
+
+  if (cmd.arity > 0 && len(args) != cmd.arity) ||
+      (cmd.arity < 0 && len(args) < -cmd.arity) {
+    c.reply.error(fmt.Sprintf("ERR wrong number of arguments for '%v' command", name))
+    return
+  }
+  if !c.authorize(cmd, args) {
+    return
+  }
+  cmd.handler(c, args)
+}
+
+/**
+ * Return whether the connection may run the command, replying with an error
+ * as Redis does if not: before AUTH, or if its token lacks a permission on
+ * one of the keys.
+ */
+func (c *conn) authorize(cmd *command, args []string) bool {
+  if c.server.policy == nil || len(cmd.permissions) == 0 {
+    return true
+  }
+  if c.principal == nil {
+    c.reply.error("NOAUTH Authentication required.")
+    return false
+  }
+
+  for _, key := range cmd.keysOf(args) {
+    for _, permission := range cmd.permissions {
+      if !c.principal.Allowed(permission, key) {
+        c.server.logger.Warn("Denied RESP command", "principal", c.principal.Name,
+          "command", strings.ToLower(args[0]), "permission", permission, "key", key)
+        c.reply.error("NOPERM this user has no permissions to access one of the keys " +
+          "used as arguments")
+        return false
+      }
+    }
+  }
+  return true
+}
+
+// The key of commands taking a single key.
+func firstKey(args []string) []string {
+  return args[1:2]
+}
+
+// The keys of commands taking only keys.
+func everyKey(args []string) []string {
+  return args[1:]
+}
+
+// The keys of MSET key value [key value ...].
+func msetKeys(args []string) []string {
+  var keys []string
+  for i := 1; i < len(args); i += 2 {
+    keys = append(keys, args[i])
+  }
+  return keys
+}
+
+// The prefix every key matching KEYS' pattern begins with.
+func keysPrefix(args []string) []string {
+  return []string{ globPrefix(args[1]) }
+}
+
+// The prefix every key matching SCAN's MATCH pattern, if any, begins with.
+func scanPrefix(args []string) []string {
+  pattern := "*"
+  for i := 2; i + 1 < len(args); i += 2 {
+    if strings.ToUpper(args[i]) == "MATCH" {
+      pattern = args[i + 1]
+    }
+  }
+  return []string{ globPrefix(pattern) }
+}
+
+// Commands covering every key, i.e. the empty prefix.
+func everyPrefix(args []string) []string {
+  return []string{ "" }
+}
+
+// Reply with a store error, other than a missing key.
+func (c *conn) storeError(err error) {
+  c.server.logger.Error("RESP store error", "err", err)
+  c.reply.error("ERR " + strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// Read a key within a transaction, reporting whether it exists.
+func lookup(tx server.Transaction, key string) (store.Value, *store.Attributes, bool, error) {
+  value, attributes, err := tx.Get(store.Key(key))
+  if errors.Is(err, os.ErrNotExist) {
+    return store.EMPTY_VALUE, nil, false, nil
+  } else if err != nil {
+    return store.EMPTY_VALUE, nil, false, err
+  }
+  return value, attributes, true, nil
+}
+
+// PING [message]
+func handlePing(c *conn, args []string) {
+  if len(args) > 2 {
+    c.reply.error("ERR wrong number of arguments for 'ping' command")
+  } else if len(args) == 2 {
+    c.reply.bulk(args[1])
+  } else {
+    c.reply.simple("PONG")
+  }
+}
+
+/**
+ * AUTH [username] token: authenticates the connection with an API token, as
+ * with the HTTP API's Authorization header. Any username is ignored, so
+ * that clients which send one, e.g. for Redis 6 ACLs, can authenticate.
+ */
+func handleAuth(c *conn, args []string) {
+  if len(args) > 3 {
+    c.reply.error("ERR syntax error")
+    return
+  }
+  if c.server.policy == nil {
+    c.reply.error("ERR AUTH <password> called without any password configured for the " +
+      "default user. Are you sure your configuration is correct?")
+    return
+  }
+
+  principal, ok := c.server.policy.Authenticate(args[len(args) - 1])
+  if !ok {
+    c.principal = nil
+    c.reply.error("WRONGPASS invalid username-password pair or user is disabled.")
+    return
+  }
+  c.principal = principal
+  c.reply.simple("OK")
+}
+
+// QUIT: the connection closes after the reply.
+func handleQuit(c *conn, args []string) {
+  c.quit = true
+  c.reply.simple("OK")
+}
+
+// GET key
+func handleGet(c *conn, args []string) {
+  var value store.Value
+  var exists bool
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    var err error
+    value, _, exists, err = lookup(tx, args[1])
+    return err
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else if !exists {
+    c.reply.null()
+  } else {
+    c.reply.bulk(string(value))
+  }
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func handleSet(c *conn, args []string) {
+  var ttl time.Duration
+  var nx, xx bool
+  for i := 3; i < len(args); i++ {
+    option := strings.ToUpper(args[i])
+    switch {
+    case option == "NX" && !xx:
+      nx = true
+    case option == "XX" && !nx:
+      xx = true
+    case (option == "EX" || option == "PX") && ttl == 0 && i + 1 < len(args):
+      i++
+      n, err := strconv.ParseInt(args[i], 10, 64)
+      if err != nil {
+        c.reply.error("ERR value is not an integer or out of range")
+        return
+      }
+      unit := time.Second
+      if option == "PX" {
+        unit = time.Millisecond
+      }
+      if n <= 0 || n > math.MaxInt64 / int64(unit) {
+        c.reply.error("ERR invalid expire time in 'set' command")
+        return
+      }
+      ttl = time.Duration(n) * unit
+    default:
+      c.reply.error("ERR syntax error")
+      return
+    }
+  }
+
+  var attributes *store.Attributes
+  if ttl > 0 {
+    attributes = &store.Attributes{ ExpiresAt: time.Now().Add(ttl) }
+  }
+
+  written := false
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    if nx || xx {
+      _, _, exists, err := lookup(tx, args[1])
+      if err != nil {
+        return err
+      }
+      if (nx && exists) || (xx && !exists) {
+        return nil
+      }
+    }
+
+    written = true
+    return tx.Set(store.Key(args[1]), store.Value(args[2]), attributes)
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else if !written {
+    c.reply.null()
+  } else {
+    c.reply.simple("OK")
+  }
+}
+
+// DEL key [key ...]: replies with the number of keys removed.
+func handleDel(c *conn, args []string) {
+  var removed int64
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    for _, key := range args[1:] {
+      _, _, exists, err := lookup(tx, key)
+      if err != nil {
+        return err
+      }
+      if !exists {
+        continue
+      }
+
+      if err := tx.Delete(store.Key(key)); err != nil {
+        return err
+      }
+      removed++
+    }
+    return nil
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply.integer(removed)
+  }
+}
+
+// EXISTS key [key ...]: replies with the number of keys which exist,
+// counting repeated keys each time.
+func handleExists(c *conn, args []string) {
+  var count int64
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    for _, key := range args[1:] {
+      _, _, exists, err := lookup(tx, key)
+      if err != nil {
+        return err
+      }
+      if exists {
+        count++
+      }
+    }
+    return nil
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply.integer(count)
+  }
+}
+
+// MGET key [key ...]: replies with each value, or null for missing keys.
+func handleMget(c *conn, args []string) {
+  values := make([]*store.Value, len(args) - 1)
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    for i, key := range args[1:] {
+      value, _, exists, err := lookup(tx, key)
+      if err != nil {
+        return err
+      }
+      if exists {
+        values[i] = &value
+      }
+    }
+    return nil
+  })
+
+  if err != nil {
+    c.storeError(err)
+    return
+  }
+
+  c.reply.array(len(values))
+  for _, value := range values {
+    if value == nil {
+      c.reply.null()
+    } else {
+      c.reply.bulk(string(*value))
+    }
+  }
+}
+
+// MSET key value [key value ...]: sets every pair atomically.
+func handleMset(c *conn, args []string) {
+  if len(args) % 2 != 1 {
+    c.reply.error("ERR wrong number of arguments for 'mset' command")
+    return
+  }
+
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    for i := 1; i < len(args); i += 2 {
+      if err := tx.Set(store.Key(args[i]), store.Value(args[i + 1]), nil); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else {
+    c.reply.simple("OK")
+  }
+}
+
+// INCR key: increments the integer value, treating a missing key as 0, and
+// keeping any TTL.
+func handleIncr(c *conn, args []string) {
+  var result int64
+  var replyError string
+  err := c.server.backend.Atomically(c.ctx, func(tx server.Transaction) error {
+    value, attributes, exists, err := lookup(tx, args[1])
+    if err != nil {
+      return err
+    }
+
+    var n int64
+    if exists {
+      if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+        replyError = "ERR value is not an integer or out of range"
+        return nil
+      }
+    }
+    if n == math.MaxInt64 {
+      replyError = "ERR increment or decrement would overflow"
+      return nil
+    }
+
+    result = n + 1
+    return tx.Set(store.Key(args[1]), store.Value(strconv.FormatInt(result, 10)), attributes)
+  })
+
+  if err != nil {
+    c.storeError(err)
+  } else if replyError != "" {
+    c.reply.error(replyError)
+  } else {
+    c.reply.integer(result)
+  }
+}
+
+// KEYS pattern: replies with every key matching the glob-style pattern.
+func handleKeys(c *conn, args []string) {
+  pattern := args[1]
+  // Narrow the listing by the pattern's literal prefix.
+  keys, err := c.server.backend.Keys(c.ctx, globPrefix(pattern))
+  if err != nil {
+    c.storeError(err)
+    return
+  }
+
+  var matching []string
+  for _, key := range keys {
+    if matchGlob(pattern, string(key)) {
+      matching = append(matching, string(key))
+    }
+  }
+
+  c.reply.array(len(matching))
+  for _, key := range matching {
+    c.reply.bulk(key)
+  }
+}
+
+/**
+ * SCAN cursor [MATCH pattern] [COUNT count]: replies with the next cursor
+ * and a batch of keys. Keys are visited in order of their hash, and the
+ * cursor is the hash to resume from, so every key present for the whole
+ * iteration is returned, even as other keys are added and removed. A cursor
+ * of 0 starts and ends the iteration.
+ */
+func handleScan(c *conn, args []string) {
+  cursor, err := strconv.ParseUint(args[1], 10, 64)
+  if err != nil {
+    c.reply.error("ERR invalid cursor")
+    return
+  }
+
+  pattern := "*"
+  count := DEFAULT_SCAN_COUNT
+  for i := 2; i < len(args); i += 2 {
+    if i + 1 >= len(args) {
+      c.reply.error("ERR syntax error")
+      return
+    }
+    switch strings.ToUpper(args[i]) {
+    case "MATCH":
+      pattern = args[i + 1]
+    case "COUNT":
+      if count, err = strconv.Atoi(args[i + 1]); err != nil || count < 1 {
+        c.reply.error("ERR syntax error")
+        return
+      }
+    default:
+      c.reply.error("ERR syntax error")
+      return
+    }
+  }
+
+  keys, err := c.server.backend.Keys(c.ctx, "")
+  if err != nil {
+    c.storeError(err)
+    return
+  }
+
+  type hashedKey struct {
+    hash uint64
+    key string
+  }
+  var remaining []hashedKey
+  for _, key := range keys {
+    if hash := keyHash(string(key)); hash >= cursor {
+      remaining = append(remaining, hashedKey{ hash, string(key) })
+    }
+  }
+  sort.Slice(remaining, func(i, j int) bool {
+    return remaining[i].hash < remaining[j].hash ||
+      (remaining[i].hash == remaining[j].hash && remaining[i].key < remaining[j].key)
+  })
+
+  // Take `count` keys, plus any sharing the last key's hash, so that the
+  // next cursor skips none.
+  end := count
+  if end > len(remaining) {
+    end = len(remaining)
+  }
+  for end > 0 && end < len(remaining) && remaining[end].hash == remaining[end - 1].hash {
+    end++
+  }
+
+  var next uint64
+  if end < len(remaining) {
+    next = remaining[end].hash
+  }
+
+  var batch []string
+  for _, hashed := range remaining[:end] {
+    if matchGlob(pattern, hashed.key) {
+      batch = append(batch, hashed.key)
+    }
+  }
+
+  c.reply.array(2)
+  c.reply.bulk(strconv.FormatUint(next, 10))
+  c.reply.array(len(batch))
+  for _, key := range batch {
+    c.reply.bulk(key)
+  }
+}
+
+// The position of a key in SCAN's iteration order.
+func keyHash(key string) uint64 {
+  hash := fnv.New64a()
+  hash.Write([]byte(key))
+  return hash.Sum64()
+}
+
+// INFO [section]: replies with server, client and store statistics.
+func handleInfo(c *conn, args []string) {
+  section := "all"
+  if len(args) > 2 {
+    c.reply.error("ERR syntax error")
+    return
+  } else if len(args) == 2 {
+    section = strings.ToLower(args[1])
+  }
+
+  stats := c.server.stats()
+  sections := []struct {
+    name string
+    fields map[string]int64
+  }{
+    { "server", map[string]int64{ "uptime_in_seconds": stats.uptimeSeconds } },
+    { "clients", map[string]int64{
+      "connected_clients": stats.connectedClients,
+      "maxclients": stats.maxClients,
+    }},
+    { "stats", map[string]int64{
+      "total_connections_received": stats.totalConnections,
+      "total_commands_processed": stats.totalCommands,
+      "rejected_connections": stats.rejectedConnections,
+    }},
+  }
+  for name, fields := range c.server.backend.Stats() {
+    sections = append(sections, struct {
+      name string
+      fields map[string]int64
+    }{ name, fields })
+  }
+
+  var info strings.Builder
+  for _, s := range sections {
+    if section != "all" && section != "everything" && section != "default" &&
+        section != s.name {
+      continue
+    }
+
+    fmt.Fprintf(&info, "# %v\r\n", strings.ToUpper(s.name[:1]) + s.name[1:])
+    if s.name == "server" {
+      fmt.Fprintf(&info, "redis_version:%v\r\nredis_mode:standalone\r\n", REDIS_VERSION)
+    }
+    names := make([]string, 0, len(s.fields))
+    for name := range s.fields {
+      names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+      fmt.Fprintf(&info, "%v:%v\r\n", name, s.fields[name])
+    }
+    info.WriteString("\r\n")
+  }
+  c.reply.bulk(info.String())
+}
+
+// Return the literal prefix of a glob-style pattern, which every key
+// matching it begins with.
+func globPrefix(pattern string) string {
+  if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+    return pattern[:i]
+  }
+  return pattern
+}
+
+/**
+ * Match a key against a Redis glob-style pattern: `*` matches any sequence,
+ * `?` any single byte, `[abc]`, `[^abc]` and `[a-z]` a class of bytes, and
+ * `\` escapes the next byte.
+ */
+func matchGlob(pattern string, s string) bool {
+  for len(pattern) > 0 {
+    switch pattern[0] {
+    case '*':
+      for len(pattern) > 1 && pattern[1] == '*' {
+        pattern = pattern[1:]
+      }
+      if len(pattern) == 1 {
+        return true
+      }
+      for i := 0; i <= len(s); i++ {
+        if matchGlob(pattern[1:], s[i:]) {
+          return true
+        }
+      }
+      return false
+    case '?':
+      if len(s) == 0 {
+        return false
+      }
+      pattern, s = pattern[1:], s[1:]
+    case '[':
+      if len(s) == 0 {
+        return false
+      }
+      consumed, matched := matchClass(pattern, s[0])
+      if !matched {
+        return false
+      }
+      pattern, s = pattern[consumed:], s[1:]
+    default:
+      if pattern[0] == '\\' && len(pattern) > 1 {
+        pattern = pattern[1:]
+      }
+      if len(s) == 0 || s[0] != pattern[0] {
+        return false
+      }
+      pattern, s = pattern[1:], s[1:]
+    }
+  }
+  return len(s) == 0
+}
+
+// Match a byte against the class opening `pattern`, returning the length of
+// the class and whether the byte matched.
+func matchClass(pattern string, b byte) (int, bool) {
+  i := 1
+  negate := i < len(pattern) && pattern[i] == '^'
+  if negate {
+    i++
+  }
+
+  matched := false
+  for i < len(pattern) && pattern[i] != ']' {
+    if pattern[i] == '\\' && i + 1 < len(pattern) {
+      matched = matched || pattern[i + 1] == b
+      i += 2
+    } else if i + 2 < len(pattern) && pattern[i + 1] == '-' && pattern[i + 2] != ']' {
+      low, high := pattern[i], pattern[i + 2]
+      if low > high {
+        low, high = high, low
+      }
+      matched = matched || (b >= low && b <= high)
+      i += 3
+    } else {
+      matched = matched || pattern[i] == b
+      i++
+    }
+  }
+  if i < len(pattern) {
+    // Skip the closing bracket.
+    i++
+  }
+  return i, matched != negate
+}
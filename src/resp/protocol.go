@@ -0,0 +1,126 @@
+package resp
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+)
+
+const (
+  // The largest bulk string accepted in a command.
+  MAX_BULK_BYTES = 64 * 1024 * 1024
+  // The most arguments accepted in a command.
+  MAX_ARGUMENTS = 1024 * 1024
+  // The longest inline command or length line accepted.
+  MAX_LINE_BYTES = 64 * 1024
+)
+
+var (
+  // Returned for input which is not valid RESP. The connection is closed
+  // after replying, as the stream can no longer be parsed.
+  ErrProtocol = errors.New("Protocol error")
+)
+
+/**
+ * Read a single command: either an array of bulk strings, as sent by client
+ * libraries, or an inline command of space separated words, as typed into a
+ * telnet session. Returns nil for an empty inline command.
+ */
+func readCommand(reader *bufio.Reader) ([]string, error) {
+  line, err := readLine(reader)
+  if err != nil {
+    return nil, err
+  }
+
+  if !strings.HasPrefix(line, "*") {
+    return strings.Fields(line), nil
+  }
+
+  count, err := strconv.Atoi(line[1:])
+  if err != nil || count > MAX_ARGUMENTS {
+    return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+  }
+
+  args := make([]string, 0, count)
+  for i := 0; i < count; i++ {
+    line, err := readLine(reader)
+    if err != nil {
+      return nil, err
+    }
+    if !strings.HasPrefix(line, "$") {
+      return nil, fmt.Errorf("%w: expected '$', got '%v'", ErrProtocol, line)
+    }
+
+    length, err := strconv.Atoi(line[1:])
+    if err != nil || length < 0 || length > MAX_BULK_BYTES {
+      return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+    }
+
+    bulk := make([]byte, length + 2)
+    if _, err := io.ReadFull(reader, bulk); err != nil {
+      return nil, err
+    }
+    if bulk[length] != '\r' || bulk[length + 1] != '\n' {
+      return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+    }
+    args = append(args, string(bulk[:length]))
+  }
+  return args, nil
+}
+
+// Read a line terminated by CRLF (or, for inline commands, LF alone).
+func readLine(reader *bufio.Reader) (string, error) {
+  var line []byte
+  for {
+    fragment, isPrefix, err := reader.ReadLine()
+    if err != nil {
+      return "", err
+    }
+    line = append(line, fragment...)
+    if len(line) > MAX_LINE_BYTES {
+      return "", fmt.Errorf("%w: line too long", ErrProtocol)
+    }
+    if !isPrefix {
+      return string(line), nil
+    }
+  }
+}
+
+// Writes RESP2 replies. Errors are sticky, and reported by Flush.
+type replyWriter struct {
+  writer *bufio.Writer
+}
+
+func (w *replyWriter) simple(s string) {
+  fmt.Fprintf(w.writer, "+%s\r\n", s)
+}
+
+// Write an error reply, e.g. "ERR syntax error".
+func (w *replyWriter) error(s string) {
+  fmt.Fprintf(w.writer, "-%s\r\n", s)
+}
+
+func (w *replyWriter) integer(n int64) {
+  fmt.Fprintf(w.writer, ":%d\r\n", n)
+}
+
+func (w *replyWriter) bulk(s string) {
+  fmt.Fprintf(w.writer, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// Write the null bulk string, e.g. for a missing key.
+func (w *replyWriter) null() {
+  w.writer.WriteString("$-1\r\n")
+}
+
+// Write an array header; the caller then writes `n` elements.
+func (w *replyWriter) array(n int) {
+  fmt.Fprintf(w.writer, "*%d\r\n", n)
+}
+
+func (w *replyWriter) Flush() error {
+  return w.writer.Flush()
+}
@@ -0,0 +1,369 @@
+package resp
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "fmt"
+  "net"
+  "strings"
+  "testing"
+  "time"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// A RESP server over a filestore-backed server.Server, listening on a free
+// port.
+func startTestServer(t *testing.T, options *Options) (string, *server.Server) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  backend := server.MakeServerWithStores(fs, nil)
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  s := MakeServer(backend, options)
+  go s.Serve(listener)
+  t.Cleanup(func() { s.Close() })
+  return listener.Addr().String(), backend
+}
+
+// A raw client connection.
+type testConn struct {
+  t *testing.T
+  conn net.Conn
+  reader *bufio.Reader
+}
+
+func dial(t *testing.T, address string) *testConn {
+  conn, err := net.Dial("tcp", address)
+  if err != nil {
+    t.Fatalf("Error connecting: %v", err)
+  }
+  t.Cleanup(func() { conn.Close() })
+  conn.SetDeadline(time.Now().Add(5 * time.Second))
+  return &testConn{ t: t, conn: conn, reader: bufio.NewReader(conn) }
+}
+
+// Encode a command as an array of bulk strings.
+func encode(args ...string) string {
+  encoded := fmt.Sprintf("*%d\r\n", len(args))
+  for _, arg := range args {
+    encoded += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+  }
+  return encoded
+}
+
+// Send a command and return its raw reply.
+func (c *testConn) do(args ...string) string {
+  if _, err := c.conn.Write([]byte(encode(args...))); err != nil {
+    c.t.Fatalf("Error writing: %v", err)
+  }
+  return c.readReply()
+}
+
+// Read a single raw reply, including any nested elements.
+func (c *testConn) readReply() string {
+  line, err := c.reader.ReadString('\n')
+  if err != nil {
+    c.t.Fatalf("Error reading reply: %v", err)
+  }
+
+  var n int
+  switch line[0] {
+  case '$':
+    fmt.Sscanf(line, "$%d", &n)
+    if n < 0 {
+      return line
+    }
+    bulk := make([]byte, n + 2)
+    if _, err := c.reader.Read(bulk); err != nil {
+      c.t.Fatalf("Error reading bulk: %v", err)
+    }
+    return line + string(bulk)
+  case '*':
+    fmt.Sscanf(line, "*%d", &n)
+    for i := 0; i < n; i++ {
+      line += c.readReply()
+    }
+  }
+  return line
+}
+
+func (c *testConn) expect(want string, args ...string) {
+  if got := c.do(args...); got != want {
+    c.t.Errorf("Expected %q for %v, got %q", want, args, got)
+  }
+}
+
+func TestRespGetSetDelAndExists(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("+PONG\r\n", "PING")
+  c.expect("$-1\r\n", "GET", "key")
+  c.expect("+OK\r\n", "SET", "key", "a value")
+  c.expect("$7\r\na value\r\n", "get", "key")
+  c.expect(":2\r\n", "EXISTS", "key", "key", "missing")
+  c.expect(":1\r\n", "DEL", "key", "missing")
+  c.expect("$-1\r\n", "GET", "key")
+  c.expect("-ERR wrong number of arguments for 'get' command\r\n", "GET")
+  c.expect("-ERR unknown command 'FLUSHALL'\r\n", "FLUSHALL")
+}
+
+func TestRespSetOptions(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("$-1\r\n", "SET", "key", "value", "XX")
+  c.expect("+OK\r\n", "SET", "key", "value", "NX")
+  c.expect("$-1\r\n", "SET", "key", "other", "NX")
+  c.expect("+OK\r\n", "SET", "key", "other", "XX", "PX", "100")
+  c.expect("$5\r\nother\r\n", "GET", "key")
+  c.expect("-ERR syntax error\r\n", "SET", "key", "value", "NX", "XX")
+  c.expect("-ERR invalid expire time in 'set' command\r\n", "SET", "key", "value", "EX", "0")
+
+  time.Sleep(150 * time.Millisecond)
+  c.expect("$-1\r\n", "GET", "key")
+}
+
+func TestRespMultiKeyCommandsAndIncr(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("+OK\r\n", "MSET", "a", "1", "b", "2")
+  c.expect("*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n", "MGET", "a", "missing", "b")
+  c.expect(":2\r\n", "INCR", "a")
+  c.expect(":1\r\n", "INCR", "counter")
+  c.expect("-ERR wrong number of arguments for 'mset' command\r\n", "MSET", "a", "1", "b")
+
+  c.do("SET", "text", "abc")
+  c.expect("-ERR value is not an integer or out of range\r\n", "INCR", "text")
+}
+
+func TestRespPipelinesCommands(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  // Send every command in one write, before reading any reply.
+  var pipeline strings.Builder
+  for i := 0; i < 100; i++ {
+    pipeline.WriteString(encode("SET", fmt.Sprintf("key%v", i), fmt.Sprintf("%v", i)))
+    pipeline.WriteString(encode("GET", fmt.Sprintf("key%v", i)))
+  }
+  c.conn.Write([]byte(pipeline.String()))
+
+  for i := 0; i < 100; i++ {
+    if reply := c.readReply(); reply != "+OK\r\n" {
+      t.Fatalf("Expected OK for SET %v, got %q", i, reply)
+    }
+    value := fmt.Sprintf("%v", i)
+    if reply := c.readReply(); reply != fmt.Sprintf("$%d\r\n%s\r\n", len(value), value) {
+      t.Fatalf("Expected %v for GET %v, got %q", value, i, reply)
+    }
+  }
+}
+
+func TestRespKeysAndScan(t *testing.T) {
+  address, backend := startTestServer(t, nil)
+  c := dial(t, address)
+  for i := 0; i < 25; i++ {
+    backend.Set(context.Background(), store.Key(fmt.Sprintf("user-%v", i)), store.Value("value"), nil)
+  }
+  backend.Set(context.Background(), store.Key("other"), store.Value("value"), nil)
+
+  c.expect("*2\r\n$7\r\nuser-10\r\n$7\r\nuser-11\r\n", "KEYS", "user-1[01]*")
+
+  seen := make(map[string]bool)
+  cursor := "0"
+  for calls := 0; calls == 0 || cursor != "0"; calls++ {
+    if calls > 30 {
+      t.Fatalf("Expected SCAN to finish")
+    }
+    c.conn.Write([]byte(encode("SCAN", cursor, "MATCH", "user-*", "COUNT", "4")))
+    c.reader.ReadString('\n')
+    c.reader.ReadString('\n')
+    cursor, _ = c.reader.ReadString('\n')
+    cursor = strings.TrimSpace(cursor)
+
+    var n int
+    line, _ := c.reader.ReadString('\n')
+    fmt.Sscanf(line, "*%d", &n)
+    for i := 0; i < n; i++ {
+      c.reader.ReadString('\n')
+      key, _ := c.reader.ReadString('\n')
+      seen[strings.TrimSpace(key)] = true
+    }
+  }
+
+  if len(seen) != 25 || seen["other"] {
+    t.Errorf("Expected SCAN to return the 25 user keys, got %v", seen)
+  }
+}
+
+func TestRespSharesTheServerStore(t *testing.T) {
+  address, backend := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.expect("+OK\r\n", "SET", "key", "value")
+  if value, _, err := backend.Get(context.Background(), store.Key("key")); err != nil || value != "value" {
+    t.Errorf("Expected the server to read the RESP write, got %v (%v)", value, err)
+  }
+
+  if info := c.do("INFO"); !strings.Contains(info, "# Server") ||
+      !strings.Contains(info, "connected_clients:1") {
+    t.Errorf("Expected INFO to report the server and its clients, got %q", info)
+  }
+}
+
+func TestRespRejectsConnectionsOverTheLimit(t *testing.T) {
+  address, _ := startTestServer(t, &Options{ MaxConnections: 1 })
+  first := dial(t, address)
+  first.expect("+PONG\r\n", "PING")
+
+  second := dial(t, address)
+  if reply := second.readReply(); reply != "-ERR max number of clients reached\r\n" {
+    t.Errorf("Expected the second connection to be refused, got %q", reply)
+  }
+}
+
+func TestRespClosesConnectionOnProtocolError(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.conn.Write([]byte("*1\r\n+PING\r\n"))
+  if reply := c.readReply(); !strings.HasPrefix(reply, "-ERR Protocol error") {
+    t.Errorf("Expected a protocol error, got %q", reply)
+  }
+  if _, err := c.reader.ReadString('\n'); err == nil {
+    t.Errorf("Expected the connection to close")
+  }
+}
+
+func TestRespInlineCommands(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  c.conn.Write([]byte("SET key value\r\nGET key\r\n"))
+  if reply := c.readReply() + c.readReply(); reply != "+OK\r\n$5\r\nvalue\r\n" {
+    t.Errorf("Expected inline commands to be executed, got %q", reply)
+  }
+}
+
+func TestRespRequiresAuthWithAPolicy(t *testing.T) {
+  policy, err := auth.ParsePolicy([]byte(`{
+    "roles": {
+      "builds": [ { "prefix": "builds-", "permissions": [ "read", "write" ] } ]
+    },
+    "tokens": [ { "name": "ci", "token": "ci-token", "roles": [ "builds" ] } ]
+  }`))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+  address, _ := startTestServer(t, &Options{ Auth: policy })
+  c := dial(t, address)
+
+  c.expect("+PONG\r\n", "PING")
+  c.expect("-NOAUTH Authentication required.\r\n", "GET", "builds-1")
+  c.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+    "AUTH", "wrong-token")
+  c.expect("-NOAUTH Authentication required.\r\n", "SET", "builds-1", "value")
+
+  c.expect("+OK\r\n", "AUTH", "default", "ci-token")
+  c.expect("+OK\r\n", "SET", "builds-1", "value")
+  c.expect("$5\r\nvalue\r\n", "GET", "builds-1")
+  c.expect("*1\r\n$8\r\nbuilds-1\r\n", "KEYS", "builds-*")
+
+  noPerm := "-NOPERM this user has no permissions to access one of the keys used as " +
+    "arguments\r\n"
+  c.expect(noPerm, "GET", "other")
+  c.expect(noPerm, "MSET", "builds-2", "value", "other", "value")
+  c.expect(noPerm, "KEYS", "*")
+  c.expect(noPerm, "SCAN", "0", "MATCH", "b*")
+  c.expect(noPerm, "INFO")
+  c.expect("$-1\r\n", "GET", "builds-2")
+}
+
+func TestRespRejectsAuthWithoutAPolicy(t *testing.T) {
+  address, _ := startTestServer(t, nil)
+  c := dial(t, address)
+
+  if reply := c.do("AUTH", "token"); !strings.HasPrefix(reply, "-ERR AUTH") {
+    t.Errorf("Expected AUTH to fail without a policy, got %q", reply)
+  }
+}
+
+func TestMatchGlob(t *testing.T) {
+  cases := []struct {
+    pattern string
+    key string
+    matches bool
+  }{
+    { "*", "anything", true },
+    { "h?llo", "hello", true },
+    { "h?llo", "hllo", false },
+    { "h*llo", "heeeello", true },
+    { "h[ae]llo", "hallo", true },
+    { "h[ae]llo", "hillo", false },
+    { "h[^e]llo", "hallo", true },
+    { "h[^e]llo", "hello", false },
+    { "h[a-b]llo", "hbllo", true },
+    { "h\\*llo", "h*llo", true },
+    { "h\\*llo", "hello", false },
+  }
+  for _, c := range cases {
+    if matchGlob(c.pattern, c.key) != c.matches {
+      t.Errorf("Expected matchGlob(%q, %q) to be %v", c.pattern, c.key, c.matches)
+    }
+  }
+}
+
+// A Backend whose transactions wait until their context ends.
+type blockingBackend struct {
+  started chan struct{}
+  ended chan error
+}
+
+func (b *blockingBackend) Atomically(
+    ctx context.Context,
+    fn func(tx server.Transaction) error) error {
+  b.started <- struct{}{}
+  <-ctx.Done()
+  b.ended <- ctx.Err()
+  return ctx.Err()
+}
+
+func (b *blockingBackend) Keys(ctx context.Context, prefix string) ([]store.Key, error) {
+  return nil, nil
+}
+
+func (b *blockingBackend) Stats() map[string]map[string]int64 {
+  return nil
+}
+
+func TestCloseCancelsCommandsInProgress(t *testing.T) {
+  backend := &blockingBackend{ started: make(chan struct{}, 1), ended: make(chan error, 1) }
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  s := MakeServer(backend, nil)
+  go s.Serve(listener)
+
+  c := dial(t, listener.Addr().String())
+  c.conn.Write([]byte(encode("GET", "key")))
+  <-backend.started
+  s.Close()
+
+  select {
+  case err := <-backend.ended:
+    if !errors.Is(err, context.Canceled) {
+      t.Errorf("Expected the command's context to be cancelled, got %v", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Errorf("Expected closing the server to cancel the command")
+  }
+}
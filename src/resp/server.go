@@ -0,0 +1,240 @@
+package resp
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "net"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/server"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  DEFAULT_MAX_CONNECTIONS = 1024
+)
+
+// The store stack commands run against; implemented by server.Server, so
+// RESP and HTTP clients share its store, cache and /watch streams.
+type Backend interface {
+  Atomically(ctx context.Context, fn func(tx server.Transaction) error) error
+  Keys(ctx context.Context, prefix string) ([]store.Key, error)
+  Stats() map[string]map[string]int64
+}
+
+// Configures a RESP Server. Zero fields select defaults.
+type Options struct {
+  // Connections beyond this limit are refused with an error reply.
+  MaxConnections int
+  // If set, connections must AUTH with a token, which the policy authorizes
+  // for the keys of each command, as over HTTP.
+  Auth *auth.Policy
+  // Logs store and connection errors; may be nil.
+  Logger *logging.Logger
+}
+
+// Counters reported by INFO.
+type serverStats struct {
+  uptimeSeconds int64
+  connectedClients int64
+  maxClients int64
+  totalConnections int64
+  totalCommands int64
+  rejectedConnections int64
+}
+
+// A TCP listener speaking the Redis RESP2 protocol, so that redis-cli and
+// Redis client libraries can use the store. Commands from a connection are
+// executed in order, and pipelined commands are answered in a single write.
+// Create instances via MakeServer.
+type Server struct {
+  backend Backend
+  maxConnections int
+  // Authenticates AUTH commands; nil if connections need not authenticate.
+  policy *auth.Policy
+  started time.Time
+
+  listener net.Listener
+  // Every open connection, and the cancellation of its context.
+  connections map[net.Conn]context.CancelFunc
+  closed bool
+  totalConnections int64
+  totalCommands int64
+  rejectedConnections int64
+  // Guards the listener, connections and counters.
+  mutex *sync.Mutex
+  logger *logging.Logger
+}
+
+// A single client connection.
+type conn struct {
+  server *Server
+  // Cancelled once the connection is closed, e.g. as the server shuts down,
+  // abandoning its store calls.
+  ctx context.Context
+  reader *bufio.Reader
+  reply *replyWriter
+  // Set by QUIT; the connection closes once the reply is sent.
+  quit bool
+  // The holder of the token presented by AUTH, if any.
+  principal *auth.Principal
+}
+
+// Make a Server over the backend. `options` may be nil.
+func MakeServer(backend Backend, options *Options) *Server {
+  s := &Server{}
+  s.backend = backend
+  s.maxConnections = DEFAULT_MAX_CONNECTIONS
+  if options != nil && options.MaxConnections > 0 {
+    s.maxConnections = options.MaxConnections
+  }
+  s.started = time.Now()
+  s.connections = make(map[net.Conn]context.CancelFunc)
+  s.mutex = &sync.Mutex{}
+  if options != nil {
+    s.policy = options.Auth
+    s.logger = options.Logger
+  }
+  return s
+}
+
+// Listen on `address`, e.g. `:6379`, and serve connections until Close.
+func (s *Server) ListenAndServe(address string) error {
+  listener, err := net.Listen("tcp", address)
+  if err != nil {
+    return err
+  }
+  return s.Serve(listener)
+}
+
+// Serve connections from the listener until Close.
+func (s *Server) Serve(listener net.Listener) error {
+  s.mutex.Lock()
+  if s.closed {
+    s.mutex.Unlock()
+    listener.Close()
+    return errors.New("RESP server closed")
+  }
+  s.listener = listener
+  s.mutex.Unlock()
+
+  for {
+    netConn, err := listener.Accept()
+    if err != nil {
+      s.mutex.Lock()
+      closed := s.closed
+      s.mutex.Unlock()
+      if closed {
+        return nil
+      }
+      return err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    if !s.admit(netConn, cancel) {
+      cancel()
+      // Reply as Redis does when over its client limit.
+      netConn.Write([]byte("-ERR max number of clients reached\r\n"))
+      netConn.Close()
+      continue
+    }
+    go s.serveConn(ctx, netConn)
+  }
+}
+
+// Track a new connection and the cancellation of its context, unless the
+// limit is reached.
+func (s *Server) admit(netConn net.Conn, cancel context.CancelFunc) bool {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  s.totalConnections++
+  if s.closed || len(s.connections) >= s.maxConnections {
+    s.rejectedConnections++
+    return false
+  }
+  s.connections[netConn] = cancel
+  return true
+}
+
+// Stop listening and close every connection.
+func (s *Server) Close() error {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  s.closed = true
+  for netConn, cancel := range s.connections {
+    cancel()
+    netConn.Close()
+  }
+
+  if s.listener != nil {
+    return s.listener.Close()
+  }
+  return nil
+}
+
+func (s *Server) stats() *serverStats {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  return &serverStats{
+    uptimeSeconds: int64(time.Since(s.started) / time.Second),
+    connectedClients: int64(len(s.connections)),
+    maxClients: int64(s.maxConnections),
+    totalConnections: s.totalConnections,
+    totalCommands: s.totalCommands,
+    rejectedConnections: s.rejectedConnections,
+  }
+}
+
+/**
+ * Execute the connection's commands in order, within `ctx`. Replies are buffered while
+ * more pipelined commands are already waiting, and flushed once the input
+ * is drained.
+ */
+func (s *Server) serveConn(ctx context.Context, netConn net.Conn) {
+  defer func() {
+    s.mutex.Lock()
+    cancel := s.connections[netConn]
+    delete(s.connections, netConn)
+    s.mutex.Unlock()
+    cancel()
+    netConn.Close()
+  }()
+
+  c := &conn{}
+  c.server = s
+  c.ctx = ctx
+  c.reader = bufio.NewReader(netConn)
+  c.reply = &replyWriter{ writer: bufio.NewWriter(netConn) }
+
+  for !c.quit {
+    args, err := readCommand(c.reader)
+    if errors.Is(err, ErrProtocol) {
+      c.reply.error("ERR " + err.Error())
+      c.reply.Flush()
+      return
+    } else if err != nil {
+      return
+    }
+    if len(args) == 0 {
+      continue
+    }
+
+    s.mutex.Lock()
+    s.totalCommands++
+    s.mutex.Unlock()
+    c.execute(args)
+
+    if c.reader.Buffered() == 0 || c.quit {
+      if err := c.reply.Flush(); err != nil {
+        s.logger.Debug("Error writing RESP reply", "err", err)
+        return
+      }
+    }
+  }
+}
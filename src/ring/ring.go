@@ -0,0 +1,97 @@
+package ring
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "sort"
+)
+
+const (
+  // The default number of points each node occupies on the ring. More points
+  // spread keys more evenly, at the cost of a larger ring.
+  DEFAULT_VIRTUAL_NODES = 128
+)
+
+// A consistent hash ring, partitioning keys between nodes. Each node occupies
+// many points (virtual nodes) on the ring, and owns the keys hashing to just
+// before each of its points, so adding or removing a node only moves the keys
+// it gains or loses.
+// Create instances via MakeRing.
+type Ring struct {
+  // The sorted hashes of every virtual node.
+  points []uint64
+  // The node occupying each point.
+  owners map[uint64]string
+  // The nodes, in the order they were given.
+  nodes []string
+}
+
+/**
+ * Make a ring of `nodes`, e.g. `localhost:8081`, each occupying
+ * `virtualNodes` points. A `virtualNodes` of 0 selects DEFAULT_VIRTUAL_NODES.
+ */
+func MakeRing(nodes []string, virtualNodes int) (*Ring, error) {
+  if len(nodes) == 0 {
+    return nil, errors.New("A ring requires at least one node")
+  }
+  if virtualNodes <= 0 {
+    virtualNodes = DEFAULT_VIRTUAL_NODES
+  }
+
+  r := &Ring{}
+  r.owners = make(map[uint64]string)
+  for _, node := range nodes {
+    if r.Contains(node) {
+      return nil, errors.New(fmt.Sprintf("Duplicate ring node %v", node))
+    }
+    r.nodes = append(r.nodes, node)
+
+    for i := 0; i < virtualNodes; i++ {
+      point := hash(fmt.Sprintf("%s#%d", node, i))
+      // Collisions are vanishingly rare; the first node keeps the point.
+      if _, ok := r.owners[point]; ok {
+        continue
+      }
+      r.owners[point] = node
+      r.points = append(r.points, point)
+    }
+  }
+
+  sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+  return r, nil
+}
+
+/**
+ * Return the node which owns `key`: the node at the first point at or after
+ * the key's hash, wrapping around the ring.
+ */
+func (r *Ring) Owner(key string) string {
+  keyHash := hash(key)
+  i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= keyHash })
+  if i == len(r.points) {
+    i = 0
+  }
+  return r.owners[r.points[i]]
+}
+
+// Return every node, in the order they were given.
+func (r *Ring) Nodes() []string {
+  return append([]string{}, r.nodes...)
+}
+
+// Return whether `node` is a member of the ring.
+func (r *Ring) Contains(node string) bool {
+  for _, member := range r.nodes {
+    if member == node {
+      return true
+    }
+  }
+  return false
+}
+
+func hash(s string) uint64 {
+  digest := sha256.Sum256([]byte(s))
+  return binary.BigEndian.Uint64(digest[:8])
+}
@@ -0,0 +1,57 @@
+package ring
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestRingPartitionsKeysEvenly(t *testing.T) {
+  nodes := []string{ "localhost:8081", "localhost:8082", "localhost:8083" }
+  r, err := MakeRing(nodes, 0)
+  if err != nil {
+    t.Fatalf("Error making ring: %v", err)
+  }
+
+  counts := make(map[string]int)
+  for i := 0; i < 30000; i++ {
+    counts[r.Owner(fmt.Sprintf("key%v", i))]++
+  }
+
+  for _, node := range nodes {
+    // Each node should own roughly a third of the keys.
+    if counts[node] < 7000 || counts[node] > 13000 {
+      t.Errorf("Expected %v to own roughly 10000 keys, got %v", node, counts)
+    }
+  }
+}
+
+func TestRingOnlyMovesKeysOfChangedNode(t *testing.T) {
+  before, _ := MakeRing([]string{ "a", "b", "c" }, 0)
+  after, _ := MakeRing([]string{ "a", "b", "c", "d" }, 0)
+
+  moved := 0
+  for i := 0; i < 10000; i++ {
+    key := fmt.Sprintf("key%v", i)
+    if before.Owner(key) != after.Owner(key) {
+      moved++
+      if after.Owner(key) != "d" {
+        t.Fatalf("Expected %v to move only to the new node, moved to %v",
+          key, after.Owner(key))
+      }
+    }
+  }
+
+  if moved == 0 || moved > 4000 {
+    t.Errorf("Expected roughly a quarter of the keys to move, moved %v", moved)
+  }
+}
+
+func TestRingRejectsInvalidMembership(t *testing.T) {
+  if _, err := MakeRing(nil, 0); err == nil {
+    t.Errorf("Expected an error for an empty ring")
+  }
+
+  if _, err := MakeRing([]string{ "a", "a" }, 0); err == nil {
+    t.Errorf("Expected an error for a duplicate node")
+  }
+}
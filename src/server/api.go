@@ -0,0 +1,213 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/store"
+)
+
+var (
+  errDeleteUnsupported = errors.New("Store cannot delete keys")
+  errKeysUnsupported = errors.New("Store cannot list its keys")
+)
+
+// Exclusive access to the server's stores, e.g. for a read-modify-write of
+// a key; see `Server.Atomically`. Reads consult the cache, and writes keep
+// the cache and /watch streams in sync, exactly as the HTTP API does.
+type Transaction interface {
+  Get(key store.Key) (store.Value, *store.Attributes, error)
+  Set(key store.Key, value store.Value, attributes *store.Attributes) error
+  // Deleting a missing key succeeds.
+  Delete(key store.Key) error
+}
+
+// A Transaction over a Server whose mutex is held. Store operations are
+// traced as children of the span in `ctx`.
+type transaction struct {
+  s *Server
+  ctx context.Context
+}
+
+/**
+ * Run `fn` with exclusive access to the server's stores, serialized with
+ * every other API call. Other frontends, e.g. the RESP listener, use this
+ * to share the HTTP API's store, cache and /watch streams. The
+ * transaction's store calls are abandoned once `ctx` ends, e.g. as the
+ * frontend's connection closes.
+ */
+func (s *Server) Atomically(ctx context.Context, fn func(tx Transaction) error) error {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  return fn(&transaction{ s: s, ctx: ctx })
+}
+
+// Return the value and attributes of `key`, as a /get call would.
+func (s *Server) Get(
+    ctx context.Context,
+    key store.Key) (store.Value, *store.Attributes, error) {
+  var value store.Value
+  var attributes *store.Attributes
+  err := s.Atomically(ctx, func(tx Transaction) error {
+    var err error
+    value, attributes, err = tx.Get(key)
+    return err
+  })
+  return value, attributes, err
+}
+
+// Store a value and its attributes, which may be nil, as a /set call would.
+func (s *Server) Set(
+    ctx context.Context,
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  return s.Atomically(ctx, func(tx Transaction) error {
+    return tx.Set(key, value, attributes)
+  })
+}
+
+// Remove a key, as a /delete call would.
+func (s *Server) Delete(ctx context.Context, key store.Key) error {
+  return s.Atomically(ctx, func(tx Transaction) error {
+    return tx.Delete(key)
+  })
+}
+
+// Return every key beginning with `prefix`, in sorted order, listed with `ctx`.
+func (s *Server) Keys(ctx context.Context, prefix string) ([]store.Key, error) {
+  lister, ok := s.filestore.(store.KeyLister)
+  if !ok {
+    return nil, errKeysUnsupported
+  }
+
+  keys, err := lister.Keys(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  matching := []store.Key{}
+  for _, key := range keys {
+    if strings.HasPrefix(string(key), prefix) {
+      matching = append(matching, key)
+    }
+  }
+  sort.Slice(matching, func(i, j int) bool { return matching[i] < matching[j] })
+  return matching, nil
+}
+
+// Return the statistics of the store and cache, as /metrics reports them.
+func (s *Server) Stats() map[string]map[string]int64 {
+  metrics := make(map[string]map[string]int64)
+  if reporter, ok := s.filestore.(store.StatsReporter); ok {
+    metrics["filestore"] = reporter.Stats()
+  }
+  if reporter, ok := s.cache.(store.StatsReporter); ok {
+    metrics["cache"] = reporter.Stats()
+  }
+  return metrics
+}
+
+// Return the server's store if it is a FileStore, e.g. to rotate its keys, or
+// nil otherwise.
+func (s *Server) FileStore() *store.FileStore {
+  fs, _ := s.filestore.(*store.FileStore)
+  return fs
+}
+
+func (tx *transaction) Get(key store.Key) (store.Value, *store.Attributes, error) {
+  s := tx.s
+  if s.cache != nil {
+    ctx, span := s.startStoreSpan(tx.ctx, s.cache, "Get", key)
+    value, attributes, err := getWithAttributes(ctx, s.cache, key)
+    span.SetAttribute("cache.hit", err == nil)
+    // Cache lookups only fail by missing, which cache.hit records.
+    span.End()
+    if err == nil {
+      return value, attributes, nil
+    }
+  }
+
+  ctx, span := s.startStoreSpan(tx.ctx, s.filestore, "Get", key)
+  value, attributes, err := getWithAttributes(ctx, s.filestore, key)
+  span.SetAttribute("found", err == nil)
+  span.SetAttribute("value.bytes", value.SizeOfBytes())
+  endStoreSpan(span, err)
+  if err != nil {
+    return store.EMPTY_VALUE, nil, err
+  }
+
+  if s.cache != nil {
+    if err := tx.setTraced(s.cache, key, value, attributes); err != nil {
+      s.logger.Warn("Error writing to the cache", "key", key, "err", err)
+    }
+  }
+  return value, attributes, nil
+}
+
+func (tx *transaction) Set(
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  s := tx.s
+  if err := tx.setTraced(s.filestore, key, value, attributes); err != nil {
+    return err
+  }
+
+  // Maintain consistency between the cache and the filestore.
+  // Any errors thrown here are non-fatal; they should be logged to telemetry.
+  if s.cache != nil {
+    if err := tx.setTraced(s.cache, key, value, attributes); err != nil {
+      s.logger.Warn("Error writing to the cache", "key", key, "err", err)
+    }
+  }
+
+  // Servers built without a hub, e.g. in tests, have no watchers to notify.
+  if s.watchHub != nil && !s.storeNotifies {
+    var expiresAt time.Time
+    if attributes != nil {
+      expiresAt = attributes.ExpiresAt
+    }
+    s.watchHub.publishSet(key, value, expiresAt)
+  }
+  return nil
+}
+
+func (tx *transaction) Delete(key store.Key) error {
+  s := tx.s
+  deleter, ok := s.filestore.(store.Deleter)
+  if !ok {
+    return errDeleteUnsupported
+  }
+
+  ctx, span := s.startStoreSpan(tx.ctx, s.filestore, "Delete", key)
+  err := deleter.Delete(ctx, key)
+  endStoreSpan(span, err)
+  if err != nil {
+    return err
+  }
+
+  if cacheDeleter, ok := s.cache.(store.Deleter); ok {
+    cacheDeleter.Delete(tx.ctx, key)
+  }
+  if s.watchHub != nil && !s.storeNotifies {
+    s.watchHub.publishDelete(key)
+  }
+  return nil
+}
+
+// Write a value and its attributes to `kvStore` within a span.
+func (tx *transaction) setTraced(
+    kvStore store.KeyValueStore,
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  ctx, span := tx.s.startStoreSpan(tx.ctx, kvStore, "Set", key)
+  err := setWithAttributes(ctx, kvStore, key, value, attributes)
+  span.SetAttribute("value.bytes", value.SizeOfBytes())
+  endStoreSpan(span, err)
+  return err
+}
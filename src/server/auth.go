@@ -0,0 +1,97 @@
+package server
+
+import (
+  "net/http"
+  "strings"
+  "buildbuddy.takehome.com/src/auth"
+)
+
+const (
+  // Carries an API key, as an alternative to an `Authorization: Bearer`
+  // header.
+  HEADER_API_KEY = "X-Api-Key"
+)
+
+// Return the token presented by the request, or "" if none.
+func requestToken(r *http.Request) string {
+  if authorization := r.Header.Get("Authorization"); authorization != "" {
+    if len(authorization) > len("Bearer ") &&
+        strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+      return authorization[len("Bearer "):]
+    }
+    return ""
+  }
+  return r.Header.Get(HEADER_API_KEY)
+}
+
+// Return the prefix of a /keys or /watch request.
+func prefixRequestKey(r *http.Request) string {
+  return r.URL.Query().Get("prefix")
+}
+
+// Admin requests cover every key, i.e. the empty prefix.
+func adminRequestKey(r *http.Request) string {
+  return ""
+}
+
+// Return the server's auth policy, e.g. for other frontends to authorize
+// their clients with, or nil if it has none.
+func (s *Server) Policy() *auth.Policy {
+  return s.policy
+}
+
+/**
+ * Wrap a handler so that, if the server has an auth policy, requests must
+ * present a known token holding `permission` on the key (or prefix) returned
+ * by `keyOf`. Returns a StatusUnauthorized for a missing or unknown token,
+ * and a StatusForbidden if the token lacks the permission.
+ */
+func (s *Server) authorize(
+    permission auth.Permission,
+    keyOf func(r *http.Request) string,
+    next http.HandlerFunc) http.HandlerFunc {
+  if s.policy == nil {
+    return next
+  }
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    principal, ok := s.policy.Authenticate(requestToken(r))
+    if !ok {
+      // Return a StatusUnauthorized; the caller is not identified.
+      w.Header().Set("WWW-Authenticate", "Bearer")
+      w.WriteHeader(http.StatusUnauthorized)
+      return
+    }
+
+    key := keyOf(r)
+    if !principal.Allowed(permission, key) {
+      s.log(r).Warn("Denied request", "principal", principal.Name, "permission", permission,
+        "path", r.URL.Path, "key", key)
+      // Return a StatusForbidden; the caller may not perform this request.
+      w.WriteHeader(http.StatusForbidden)
+      return
+    }
+    next(w, r)
+  }
+}
+
+/**
+ * Wrap a handler of the routes nodes serve one another, e.g. /replica/. With
+ * a PeerKey, requests must be signed with it, and a StatusUnauthorized is
+ * returned otherwise; without one, they are authorized as admin calls.
+ */
+func (s *Server) authorizePeer(next http.HandlerFunc) http.HandlerFunc {
+  if s.peerKey == nil {
+    return s.authorize(auth.PERMISSION_ADMIN, adminRequestKey, next)
+  }
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    if _, ok := s.peerKey.Verify(r); !ok {
+      s.log(r).Warn("Denied unsigned peer request", "path", r.URL.Path)
+      // Return a StatusUnauthorized; the caller is not a node.
+      w.WriteHeader(http.StatusUnauthorized)
+      return
+    }
+    next(w, r)
+  }
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  TEST_AUTH_CONFIG = `{
+    "roles": {
+      "builds": [ { "prefix": "builds-", "permissions": [ "read", "write" ] } ],
+      "reader": [ { "prefix": "", "permissions": [ "read" ] } ],
+      "admin": [ { "prefix": "", "permissions": [ "read", "write", "admin" ] } ]
+    },
+    "tokens": [
+      { "name": "ci", "token": "ci-token", "roles": [ "builds" ] },
+      { "name": "dashboard", "token": "reader-token", "roles": [ "reader" ] },
+      { "name": "operator", "token": "admin-token", "roles": [ "admin" ] }
+    ]
+  }`
+)
+
+// Serve a filestore, requiring the test tokens, returning the server's URL.
+func startAuthServer(t *testing.T) string {
+  policy, err := auth.ParsePolicy([]byte(TEST_AUTH_CONFIG))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, _ := MakeServerWithOptions(fs, nil, &ServerOptions{ Auth: policy })
+
+  testServer := httptest.NewServer(s.Handler())
+  t.Cleanup(testServer.Close)
+  return testServer.URL
+}
+
+func makeAuthClient(t *testing.T, serverUrl string, token string) *client.Client {
+  c, err := client.MakeClientWithOptions(serverUrl, &client.ClientOptions{ Token: token })
+  if err != nil {
+    t.Fatalf("Error making client: %v", err)
+  }
+  return c
+}
+
+func TestAuthRejectsRequestsWithoutAKnownToken(t *testing.T) {
+  serverUrl := startAuthServer(t)
+  requests := []struct {
+    method string
+    path string
+    body string
+  }{
+    { "GET", "/get?key=builds-1", "" },
+    { "POST", "/set", `{ "key": "builds-1", "value": "v" }` },
+    { "POST", "/delete", `{ "key": "builds-1" }` },
+    { "GET", "/keys", "" },
+    { "GET", "/watch", "" },
+    { "GET", "/metrics", "" },
+    { "GET", "/admin/snapshot", "" },
+    { "POST", "/admin/rebalance", `{ "nodes": [] }` },
+  }
+
+  for _, token := range []string{ "", "wrong-token" } {
+    for _, request := range requests {
+      req, _ := http.NewRequest(request.method, serverUrl + request.path,
+        strings.NewReader(request.body))
+      if token != "" {
+        req.Header.Set("Authorization", "Bearer " + token)
+      }
+      resp, err := http.DefaultClient.Do(req)
+      if err != nil {
+        t.Fatalf("Error requesting %v: %v", request.path, err)
+      }
+      resp.Body.Close()
+      if resp.StatusCode != http.StatusUnauthorized ||
+          resp.Header.Get("WWW-Authenticate") == "" {
+        t.Errorf("Expected a 401 for %v with token %q, got %v",
+          request.path, token, resp.StatusCode)
+      }
+    }
+  }
+}
+
+func TestAuthEnforcesPermissionsOnKeyPrefixes(t *testing.T) {
+  serverUrl := startAuthServer(t)
+  ci := makeAuthClient(t, serverUrl, "ci-token")
+  reader := makeAuthClient(t, serverUrl, "reader-token")
+
+  if err := ci.Set("builds-1", []byte("value")); err != nil {
+    t.Errorf("Expected a write within the token's prefix to succeed: %v", err)
+  }
+  if value, err := reader.Get("builds-1"); err != nil || string(value) != "value" {
+    t.Errorf("Expected a reader to read the value, got %v (%v)", string(value), err)
+  }
+  if keys, err := ci.Keys("builds-"); err != nil || len(keys) != 1 {
+    t.Errorf("Expected to list keys within the token's prefix, got %v (%v)", keys, err)
+  }
+
+  if err := ci.Set("releases-1", []byte("value")); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected a write outside the token's prefix to be forbidden, got %v", err)
+  }
+  if _, err := ci.Get("releases-1"); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected a read outside the token's prefix to be forbidden, got %v", err)
+  }
+  if _, err := ci.Keys(""); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected listing beyond the token's prefix to be forbidden, got %v", err)
+  }
+  if err := reader.Delete("builds-1"); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected a reader's delete to be forbidden, got %v", err)
+  }
+  if err := reader.Snapshot(&strings.Builder{}); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected a reader's snapshot to be forbidden, got %v", err)
+  }
+
+  admin := makeAuthClient(t, serverUrl, "admin-token")
+  if err := admin.Snapshot(&strings.Builder{}); err != nil {
+    t.Errorf("Expected an admin's snapshot to succeed: %v", err)
+  }
+
+  anonymous := client.MakeClient(serverUrl)
+  if _, err := anonymous.Get("builds-1"); !errors.Is(err, client.ErrUnauthorized) {
+    t.Errorf("Expected an anonymous read to be unauthorized, got %v", err)
+  }
+}
+
+func TestAuthAcceptsApiKeyHeader(t *testing.T) {
+  serverUrl := startAuthServer(t)
+  req, _ := http.NewRequest("GET", serverUrl + "/metrics", nil)
+  req.Header.Set(HEADER_API_KEY, "admin-token")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatalf("Error requesting metrics: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    t.Errorf("Expected an API key to authenticate, got %v", resp.StatusCode)
+  }
+}
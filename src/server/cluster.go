@@ -0,0 +1,418 @@
+package server
+
+import (
+  "bytes"
+  "context"
+  "crypto/tls"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httputil"
+  "net/url"
+  "os"
+  "reflect"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/ring"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+const (
+  // Marks a request proxied from another node of the cluster. Forwarded
+  // requests are always served locally, so that nodes which disagree on the
+  // membership never proxy a request in a loop. The marker is only trusted
+  // on requests signed with the PeerKey; see forwardedByPeer.
+  HEADER_CLUSTER_FORWARDED = "X-Cluster-Forwarded"
+)
+
+// Configures optional Server behaviour.
+type ServerOptions struct {
+  // The address Start serves on; defaults to config.DEFAULT_ADDRESS.
+  Address string
+  // If set, the admin routes, e.g. /metrics and /admin/status, are served
+  // from this address by ServeAdmin rather than by Handler, e.g.
+  // `localhost:9090`. If AdminLocalOnly is also set, only loopback clients
+  // are served.
+  AdminAddress string
+  AdminLocalOnly bool
+  // The config the server was made from, reported by /admin/status;
+  // optional.
+  Config *config.Config
+  // Logs errors, and if AccessLog is set, every request served with its
+  // status, latency and sizes. If nil, nothing is logged.
+  Logger *logging.Logger
+  AccessLog bool
+  // Traces each request, and the store operations it causes; may be nil.
+  Tracer *tracing.Tracer
+  // This server's entry in ClusterNodes, e.g. `localhost:8081`.
+  ClusterSelf string
+  // The nodes of the cluster, e.g. `localhost:8081`. If set, keys are
+  // partitioned between the nodes on a consistent hash ring, and requests
+  // for keys owned by another node are proxied to it.
+  ClusterNodes []string
+  // The secret shared by the nodes, which sign the requests they forward to
+  // each other with it. Without it, every request is routed as if it came
+  // from a client.
+  PeerKey *auth.PeerKey
+  // If set, other nodes are reached over TLS with this client config, e.g.
+  // when forwarding requests; see PeerTlsConfig.
+  PeerTls *tls.Config
+  // If set, API calls are only served over TLS.
+  Tls *TlsOptions
+  // If set, API calls must present a token, which the policy authorizes for
+  // the keys involved.
+  Auth *auth.Policy
+  // If set, requests may select a namespace, each with its own store,
+  // cache and quotas. Keys are never visible outside their namespace.
+  Namespaces *NamespaceOptions
+  // If set, requests are limited per client and in flight; the limits can
+  // be adjusted through /admin/limits.
+  RateLimits *RateLimits
+}
+
+// The body of an /admin/rebalance call, e.g.
+// { "nodes": [ "localhost:8081", "localhost:8082" ] }
+type rebalanceRequest struct {
+  Nodes []string `json:"nodes"`
+}
+
+// The outcome of an /admin/rebalance call.
+type RebalanceReport struct {
+  // The number of keys streamed to their new owners.
+  Moved int `json:"moved"`
+  // The number of keys which could not be moved, and remain on this node.
+  Failed int `json:"failed"`
+}
+
+// Return the URL of a cluster node, e.g. `http://localhost:8081` for
+// `localhost:8081`, or `https://localhost:8081` if nodes are reached over
+// TLS.
+func (s *Server) nodeUrl(node string) string {
+  if strings.Contains(node, "://") {
+    return node
+  }
+  if s.peerTls != nil {
+    return "https://" + node
+  }
+  return "http://" + node
+}
+
+// Return the current ring, or nil if the server is not in cluster mode.
+func (s *Server) currentRing() *ring.Ring {
+  defer s.ringMutex.Unlock()
+  s.ringMutex.Lock()
+
+  return s.ring
+}
+
+/**
+ * Wrap a handler so that requests for keys owned by another node are proxied
+ * to that node. Requests the handler would reject, e.g. without a key, are
+ * passed through.
+ */
+func (s *Server) routeToOwner(
+    next http.HandlerFunc,
+    keyOf func(r *http.Request) string) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    keyRing := s.currentRing()
+    if keyRing == nil || s.forwardedByPeer(r) {
+      next(w, r)
+      return
+    }
+
+    key := keyOf(r)
+    if key == "" {
+      next(w, r)
+      return
+    }
+
+    owner := keyRing.Owner(key)
+    if owner == s.clusterSelf {
+      next(w, r)
+      return
+    }
+    s.proxy(w, r, owner)
+  }
+}
+
+/**
+ * Wrap a handler so that, if the store has a leader and this node is not it,
+ * requests are proxied to the leader. Returns a StatusServiceUnavailable
+ * while no leader is known, e.g. during an election.
+ */
+func (s *Server) routeToLeader(next http.HandlerFunc) http.HandlerFunc {
+  provider, ok := s.filestore.(leaderProvider)
+  if !ok {
+    return next
+  }
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    if provider.IsLeader() || s.forwardedByPeer(r) {
+      next(w, r)
+      return
+    }
+
+    leader := provider.Leader()
+    if leader == "" {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    s.proxy(w, r, leader)
+  }
+}
+
+// Return whether the request was forwarded by another node, rather than by a
+// client setting HEADER_CLUSTER_FORWARDED itself.
+func (s *Server) forwardedByPeer(r *http.Request) bool {
+  if r.Header.Get(HEADER_CLUSTER_FORWARDED) == "" {
+    return false
+  }
+  _, ok := s.peerKey.Verify(r)
+  return ok
+}
+
+// Return the key of a /get request.
+func getRequestKey(r *http.Request) string {
+  return r.URL.Query().Get("key")
+}
+
+// Return the key of a /set or /delete request, leaving the body intact for the
+// handler.
+func setRequestKey(r *http.Request) string {
+  body, err := ioutil.ReadAll(r.Body)
+  r.Body.Close()
+  r.Body = ioutil.NopCloser(bytes.NewReader(body))
+  if err != nil {
+    return ""
+  }
+
+  var kv setRequest
+  if err := json.Unmarshal(body, &kv); err != nil {
+    return ""
+  }
+  return string(kv.Key)
+}
+
+// Proxy the request to the node which owns its key, or to the leader.
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, owner string) {
+  target, err := url.Parse(s.nodeUrl(owner))
+  if err != nil {
+    s.log(r).Error("Invalid cluster node", "node", owner, "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  proxy := httputil.NewSingleHostReverseProxy(target)
+  proxy.Transport = s.peerTransport
+  director := proxy.Director
+  proxy.Director = func(req *http.Request) {
+    director(req)
+    forwardedBy := s.clusterSelf
+    if forwardedBy == "" {
+      // Outside cluster mode, e.g. when forwarding to a Raft leader.
+      forwardedBy = "true"
+    }
+    req.Header.Set(HEADER_CLUSTER_FORWARDED, forwardedBy)
+    s.peerKey.Sign(req, forwardedBy)
+    propagateRequestId(req)
+    tracing.Inject(req.Context(), req.Header)
+  }
+  proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+    s.log(req).Warn("Error proxying", "node", owner, "err", err)
+    // Return a StatusBadGateway; the owning node is unreachable.
+    w.WriteHeader(http.StatusBadGateway)
+  }
+  proxy.ServeHTTP(w, r)
+}
+
+// Handler for an /admin/rebalance call. Adopts the membership in the body,
+// then streams every local key owned by another node to its new owner, and
+// returns a RebalanceReport.
+//
+// To add or remove nodes, start any new nodes with the new membership, then
+// call /admin/rebalance with it on every old and new node. Until a node has
+// been rebalanced, reads of the keys it is handing over may miss.
+func (s *Server) handleRebalance(w http.ResponseWriter, r *http.Request) {
+  if s.clusterSelf == "" {
+    // Return a StatusNotImplemented; the server is not in cluster mode.
+    w.WriteHeader(http.StatusNotImplemented)
+    return
+  }
+
+  var request rebalanceRequest
+  if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  newRing, err := ring.MakeRing(request.Nodes, 0)
+  if err != nil {
+    s.log(r).Warn("Invalid rebalance membership", "err", err)
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  s.ringMutex.Lock()
+  s.ring = newRing
+  s.ringMutex.Unlock()
+
+  // Keys are moved with the caller's credentials, which the new owners
+  // authorize as they would the caller's own writes.
+  report, err := s.rebalance(r.Context(), newRing, r.Header.Get("Authorization"),
+    r.Header.Get(HEADER_API_KEY))
+  if err != nil {
+    s.log(r).Error("Error rebalancing", "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(report); err != nil {
+    s.log(r).Warn("Error encoding rebalance report", "err", err)
+  }
+}
+
+/**
+ * Stream every local key owned by another node on `newRing` to its owner,
+ * then remove the local copy. Writes to the owners carry the `authorization`
+ * and `apiKey` headers, if set. Stops moving keys once `ctx` ends.
+ */
+func (s *Server) rebalance(
+    ctx context.Context,
+    newRing *ring.Ring,
+    authorization string,
+    apiKey string) (*RebalanceReport, error) {
+  lister, ok := s.filestore.(store.KeyLister)
+  if !ok {
+    return nil, errors.New("The store cannot list its keys")
+  }
+
+  keys, err := lister.Keys(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  report := &RebalanceReport{}
+  httpClient := &http.Client{ Timeout: 10 * time.Second, Transport: s.peerTransport }
+  for _, key := range keys {
+    owner := newRing.Owner(string(key))
+    if owner == s.clusterSelf {
+      continue
+    }
+    if err := ctx.Err(); err != nil {
+      return report, err
+    }
+
+    if err := s.moveKey(ctx, httpClient, key, owner, authorization, apiKey); err != nil {
+      s.logger.Warn("Error moving key", "key", key, "node", owner, "err", err)
+      report.Failed++
+    } else {
+      report.Moved++
+    }
+  }
+  return report, nil
+}
+
+/**
+ * Send the key to its new owner, unless the owner already holds a newer value
+ * for it, then remove it locally. The mutex is not held during the transfer,
+ * so a local copy which changes meanwhile is kept and the move fails.
+ */
+func (s *Server) moveKey(
+    ctx context.Context,
+    httpClient *http.Client,
+    key store.Key,
+    owner string,
+    authorization string,
+    apiKey string) error {
+  s.mutex.Lock()
+  value, attributes, err := getWithAttributes(ctx, s.filestore, key)
+  s.mutex.Unlock()
+  if errors.Is(err, os.ErrNotExist) {
+    // Expired or removed since the keys were listed.
+    return nil
+  } else if err != nil {
+    return err
+  }
+
+  // Only set the key if the owner has none; any value it holds was written
+  // after it adopted the new membership.
+  kv := &setRequest{ Key: key, Value: value, IfAbsent: true }
+  if attributes != nil {
+    kv.Metadata = attributes.Metadata
+    if !attributes.ExpiresAt.IsZero() {
+      remaining := time.Until(attributes.ExpiresAt)
+      if remaining <= 0 {
+        return nil
+      }
+      kv.Ttl = int64((remaining + time.Second - 1) / time.Second)
+    }
+  }
+
+  body, err := json.Marshal(kv)
+  if err != nil {
+    return err
+  }
+
+  // Mark the request as forwarded, so the owner stores it even if it has not
+  // yet adopted the new membership.
+  req, err := http.NewRequestWithContext(ctx, "POST", s.nodeUrl(owner) + "/set",
+    bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set(HEADER_CLUSTER_FORWARDED, s.clusterSelf)
+  s.peerKey.Sign(req, s.clusterSelf)
+  if authorization != "" {
+    req.Header.Set("Authorization", authorization)
+  }
+  if apiKey != "" {
+    req.Header.Set(HEADER_API_KEY, apiKey)
+  }
+
+  resp, err := httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode == http.StatusPreconditionFailed {
+    s.logger.Debug("The owner holds a newer value; dropping the local copy",
+      "key", key, "node", owner)
+  } else if resp.StatusCode != http.StatusOK {
+    return errors.New(fmt.Sprintf("HttpError %v from %v", resp.StatusCode, owner))
+  }
+
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+  current, currentAttributes, err := getWithAttributes(ctx, s.filestore, key)
+  if err != nil && !errors.Is(err, os.ErrNotExist) {
+    return err
+  } else if err == nil && (current != value || !sameAttributes(attributes, currentAttributes)) {
+    return errors.New(fmt.Sprintf("Key %v changed while moving it to %v; keeping the local copy",
+      key, owner))
+  }
+
+  if deleter, ok := s.cache.(store.Deleter); ok {
+    deleter.Delete(ctx, key)
+  }
+  if deleter, ok := s.filestore.(store.Deleter); ok {
+    return deleter.Delete(ctx, key)
+  }
+  s.logger.Warn("The store cannot delete keys; leaving a stale copy", "key", key)
+  return nil
+}
+
+// Whether two reads of a key returned the same attributes.
+func sameAttributes(a *store.Attributes, b *store.Attributes) bool {
+  if a == nil || b == nil {
+    return a == b
+  }
+  return a.ExpiresAt.Equal(b.ExpiresAt) && reflect.DeepEqual(a.Metadata, b.Metadata)
+}
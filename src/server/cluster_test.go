@@ -0,0 +1,335 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/ring"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// In-process cluster nodes, each serving its own filestore.
+type testCluster struct {
+  nodes []string
+  servers []*httptest.Server
+  filestores []*store.FileStore
+  // The secret the nodes sign forwarded requests with.
+  peerKey *auth.PeerKey
+}
+
+// Start `n` nodes, of which the first `members` form the initial membership.
+// With no members, the nodes are standalone servers which never proxy.
+func makeTestCluster(t *testing.T, n int, members int) *testCluster {
+  return makeTestClusterWithPolicy(t, n, members, nil)
+}
+
+// Start a cluster as makeTestCluster does, whose nodes require tokens which
+// `policy` authorizes, unless it is nil.
+func makeTestClusterWithPolicy(
+    t *testing.T,
+    n int,
+    members int,
+    policy *auth.Policy) *testCluster {
+  peerKey, _ := auth.MakePeerKey([]byte("test-peer-secret"))
+  cluster := &testCluster{ peerKey: peerKey }
+  handlers := make([]http.Handler, n)
+  for i := 0; i < n; i++ {
+    i := i
+    testServer := httptest.NewServer(
+      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        handlers[i].ServeHTTP(w, r)
+      }))
+    t.Cleanup(testServer.Close)
+    cluster.servers = append(cluster.servers, testServer)
+    cluster.nodes = append(cluster.nodes, testServer.URL)
+  }
+
+  for i := 0; i < n; i++ {
+    fs, _ := store.MakeFileStore(t.TempDir(), nil)
+    cache, _ := store.MakeCache(1024)
+
+    // New nodes start with the membership they will join.
+    membership := cluster.nodes[:members]
+    if i >= members {
+      membership = cluster.nodes
+    }
+    options := &ServerOptions{
+      ClusterSelf: cluster.nodes[i],
+      ClusterNodes: membership,
+      PeerKey: peerKey,
+      Auth: policy,
+    }
+    if members == 0 {
+      options = nil
+    }
+    s, err := MakeServerWithOptions(fs, cache, options)
+    if err != nil {
+      t.Fatalf("Error making cluster server: %v", err)
+    }
+
+    cluster.filestores = append(cluster.filestores, fs)
+    handlers[i] = s.Handler()
+  }
+  return cluster
+}
+
+// Return the index of the node holding `key` on disk, or -1.
+func (c *testCluster) holder(t *testing.T, key string) int {
+  ctx := context.Background()
+  holder := -1
+  for i, fs := range c.filestores {
+    if _, err := fs.Get(ctx, store.Key(key)); err == nil {
+      if holder != -1 {
+        t.Errorf("Expected %v on one node, found on %v and %v", key, holder, i)
+      }
+      holder = i
+    }
+  }
+  return holder
+}
+
+func TestClusterProxiesKeysToTheirOwner(t *testing.T) {
+  cluster := makeTestCluster(t, 3, 3)
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+
+  // Send every request to the first node, which proxies keys it doesn't own.
+  c := client.MakeClient(cluster.nodes[0])
+  for i := 0; i < 20; i++ {
+    key := fmt.Sprintf("key%v", i)
+    if err := c.Set(key, []byte("value")); err != nil {
+      t.Fatalf("Error setting %v: %v", key, err)
+    }
+
+    if owner := keyRing.Owner(key); cluster.holder(t, key) == -1 ||
+        cluster.nodes[cluster.holder(t, key)] != owner {
+      t.Errorf("Expected %v to be stored on its owner %v", key, owner)
+    }
+
+    if value, err := c.Get(key); err != nil || string(value) != "value" {
+      t.Errorf("Expected to read %v via a proxy, got %v (%v)", key, value, err)
+    }
+  }
+}
+
+func TestClusterClientRoutesToOwner(t *testing.T) {
+  // Standalone servers store a misrouted request locally.
+  cluster := makeTestCluster(t, 3, 0)
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+
+  c, err := client.MakeClusterClient(cluster.nodes, nil)
+  if err != nil {
+    t.Fatalf("Error making cluster client: %v", err)
+  }
+  for i := 0; i < 20; i++ {
+    key := fmt.Sprintf("key%v", i)
+    c.Set(key, []byte("value"))
+    if holder := cluster.holder(t, key); holder == -1 ||
+        cluster.nodes[holder] != keyRing.Owner(key) {
+      t.Errorf("Expected %v to be sent to its owner", key)
+    }
+  }
+
+  if keys, err := c.Keys("key1"); err != nil || len(keys) != 11 {
+    t.Errorf("Expected the 11 keys with prefix key1 across nodes, got %v (%v)",
+      keys, err)
+  }
+}
+
+func TestClusterRebalancesOntoNewNode(t *testing.T) {
+  ctx := context.Background()
+  cluster := makeTestCluster(t, 3, 2)
+  c, _ := client.MakeClusterClient(cluster.nodes[:2], nil)
+  for i := 0; i < 50; i++ {
+    c.Set(fmt.Sprintf("key%v", i), []byte(fmt.Sprintf("value%v", i)))
+  }
+
+  reports, err := c.Rebalance(cluster.nodes)
+  if err != nil {
+    t.Fatalf("Error rebalancing: %v", err)
+  }
+
+  moved := 0
+  for _, report := range reports {
+    moved += report.Moved
+    if report.Failed != 0 {
+      t.Errorf("Expected no failed moves, got %v", report)
+    }
+  }
+
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+  for i := 0; i < 50; i++ {
+    key := fmt.Sprintf("key%v", i)
+    if holder := cluster.holder(t, key); holder == -1 ||
+        cluster.nodes[holder] != keyRing.Owner(key) {
+      t.Errorf("Expected %v to be moved to its new owner", key)
+    }
+
+    if value, err := c.Get(key); err != nil || string(value) != fmt.Sprintf("value%v", i) {
+      t.Errorf("Expected to read %v after rebalancing, got %v (%v)", key, value, err)
+    }
+  }
+
+  if keys, _ := cluster.filestores[2].Keys(ctx); moved == 0 || len(keys) != moved {
+    t.Errorf("Expected the new node to receive the %v moved keys, got %v", moved, keys)
+  }
+}
+
+func TestClusterClientSendsItsTokenToEveryNode(t *testing.T) {
+  policy, err := auth.ParsePolicy([]byte(TEST_AUTH_CONFIG))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+  cluster := makeTestClusterWithPolicy(t, 3, 2, policy)
+
+  anonymous, _ := client.MakeClusterClient(cluster.nodes[:2], nil)
+  if err := anonymous.Set("key", []byte("value")); !errors.Is(err, client.ErrUnauthorized) {
+    t.Errorf("Expected a set without a token to be unauthorized, got %v", err)
+  }
+  if _, err := anonymous.Rebalance(cluster.nodes); !errors.Is(err, client.ErrUnauthorized) {
+    t.Errorf("Expected a rebalance without a token to be unauthorized, got %v", err)
+  }
+
+  c, err := client.MakeClusterClient(cluster.nodes[:2],
+    &client.ClientOptions{ Token: "admin-token" })
+  if err != nil {
+    t.Fatalf("Error making cluster client: %v", err)
+  }
+  for i := 0; i < 20; i++ {
+    if err := c.Set(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+      t.Fatalf("Error setting key%v: %v", i, err)
+    }
+  }
+
+  reports, err := c.Rebalance(cluster.nodes)
+  if err != nil {
+    t.Fatalf("Error rebalancing: %v", err)
+  }
+  for _, report := range reports {
+    if report.Failed != 0 {
+      t.Errorf("Expected no failed moves, got %v", report)
+    }
+  }
+
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+  for i := 0; i < 20; i++ {
+    key := fmt.Sprintf("key%v", i)
+    if holder := cluster.holder(t, key); holder == -1 ||
+        cluster.nodes[holder] != keyRing.Owner(key) {
+      t.Errorf("Expected %v to be moved to its new owner", key)
+    }
+    if value, err := c.Get(key); err != nil || string(value) != "value" {
+      t.Errorf("Expected to read %v after rebalancing, got %v (%v)", key, value, err)
+    }
+  }
+  if keys, err := c.Keys(""); err != nil || len(keys) != 20 {
+    t.Errorf("Expected to list the 20 keys, got %v (%v)", keys, err)
+  }
+}
+
+func TestClusterRebalanceKeepsNewerValuesOnTheOwner(t *testing.T) {
+  cluster := makeTestCluster(t, 3, 2)
+  newRing, _ := ring.MakeRing(cluster.nodes, 0)
+
+  // Find a key which moves to the new node.
+  key := "key"
+  for i := 0; newRing.Owner(key) != cluster.nodes[2]; i++ {
+    key = fmt.Sprintf("key%v", i)
+  }
+  c, _ := client.MakeClusterClient(cluster.nodes[:2], nil)
+  if err := c.Set(key, []byte("old")); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+  // The new node already holds a newer value, e.g. written after it joined.
+  if err := cluster.filestores[2].Set(context.Background(), store.Key(key), "new"); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+
+  reports, err := c.Rebalance(cluster.nodes)
+  if err != nil {
+    t.Fatalf("Error rebalancing: %v", err)
+  }
+  for _, report := range reports {
+    if report.Failed != 0 {
+      t.Errorf("Expected no failed moves, got %v", report)
+    }
+  }
+
+  if holder := cluster.holder(t, key); holder != 2 {
+    t.Errorf("Expected only the new owner to hold %v, found it on %v", key, holder)
+  }
+  if value, _ := cluster.filestores[2].Get(context.Background(), store.Key(key)); value != "new" {
+    t.Errorf("Expected the newer value to be kept, got %q", value)
+  }
+}
+
+func TestClusterServesForwardedRequestsLocally(t *testing.T) {
+  cluster := makeTestCluster(t, 2, 2)
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+
+  // Find a key the second node owns, and force it onto the first.
+  key := "key"
+  for i := 0; keyRing.Owner(key) != cluster.nodes[1]; i++ {
+    key = fmt.Sprintf("key%v", i)
+  }
+
+  req, _ := http.NewRequest("POST", cluster.nodes[0] + "/set",
+    strings.NewReader(fmt.Sprintf(`{"key":%q,"value":"value"}`, key)))
+  req.Header.Set(HEADER_CLUSTER_FORWARDED, cluster.nodes[1])
+  cluster.peerKey.Sign(req, cluster.nodes[1])
+  if resp, err := http.DefaultClient.Do(req); err != nil ||
+      resp.StatusCode != http.StatusOK {
+    t.Fatalf("Error sending a forwarded set: %v", err)
+  }
+
+  if cluster.holder(t, key) != 0 {
+    t.Errorf("Expected the forwarded set to be stored locally")
+  }
+}
+
+func TestClusterProxiesRequestsClaimingToBeForwarded(t *testing.T) {
+  cluster := makeTestCluster(t, 2, 2)
+  keyRing, _ := ring.MakeRing(cluster.nodes, 0)
+
+  key := "key"
+  for i := 0; keyRing.Owner(key) != cluster.nodes[1]; i++ {
+    key = fmt.Sprintf("key%v", i)
+  }
+
+  // Neither a bare marker nor one with a forged signature makes the first
+  // node store a key it does not own.
+  forged, _ := auth.MakePeerKey([]byte("forged-peer-secret"))
+  for _, signer := range []*auth.PeerKey{ nil, forged } {
+    req, _ := http.NewRequest("POST", cluster.nodes[0] + "/set",
+      strings.NewReader(fmt.Sprintf(`{"key":%q,"value":"value"}`, key)))
+    req.Header.Set(HEADER_CLUSTER_FORWARDED, cluster.nodes[1])
+    signer.Sign(req, cluster.nodes[1])
+    if resp, err := http.DefaultClient.Do(req); err != nil ||
+        resp.StatusCode != http.StatusOK {
+      t.Fatalf("Error sending a set claiming to be forwarded: %v", err)
+    }
+
+    if holder := cluster.holder(t, key); holder != 1 {
+      t.Errorf("Expected the set to be proxied to the owner, got node %v", holder)
+    }
+  }
+  if value, _ := cluster.filestores[0].Get(context.Background(), store.Key(key)); value != "" {
+    t.Errorf("Expected nothing stored on the first node, got %q", value)
+  }
+}
+
+func TestClusterRejectsServerOutsideMembership(t *testing.T) {
+  _, err := MakeServerWithOptions(&store.FakeKeyValueStore{}, nil, &ServerOptions{
+    ClusterSelf: "localhost:9999",
+    ClusterNodes: []string{ "localhost:8081" },
+  })
+  if err == nil {
+    t.Errorf("Expected an error for a server outside the membership")
+  }
+}
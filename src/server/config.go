@@ -0,0 +1,295 @@
+package server
+
+import (
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "io"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/certs"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+// Make the configured logger, writing to `out`, e.g. os.Stderr.
+func MakeLogger(c *config.Config, out io.Writer) (*logging.Logger, error) {
+  level, err := logging.ParseLevel(c.LogLevel)
+  if err != nil {
+    return nil, err
+  }
+  return logging.MakeLogger(out, &logging.Options{ Level: level, Format: c.LogFormat })
+}
+
+// The service name recorded on the server's spans.
+const TRACE_SERVICE_NAME = "buildbuddy-server"
+
+/**
+ * Make the configured Tracer, exporting spans to `--trace_file`, or nil if
+ * tracing is off. Spans which cannot be exported are logged to `logger`,
+ * which may be nil.
+ */
+func MakeTracer(c *config.Config, logger *logging.Logger) (*tracing.Tracer, error) {
+  if c.TraceFile == "" {
+    return nil, nil
+  }
+  exporter, err := tracing.MakeJsonFileExporter(c.TraceFile)
+  if err != nil {
+    return nil, fmt.Errorf("Error opening trace file: %w", err)
+  }
+  return tracing.MakeTracer(exporter, &tracing.TracerOptions{
+    ServiceName: TRACE_SERVICE_NAME,
+    Logger: logger,
+  }), nil
+}
+
+/**
+ * Storage engines which MakeServer cannot make itself, as they reach their
+ * peers via Servers of their own. Each is passed the options the Server is
+ * made with, e.g. for its peer key, peer TLS config and logger.
+ */
+type StoreFactories struct {
+  // Make the Raft store of the config's `raft_nodes`, keeping its state
+  // machine in a FileStore with `fsOptions`. Required with `raft_nodes`.
+  Raft func(
+    c *config.Config,
+    fsOptions *store.FileStoreOptions,
+    options *ServerOptions) (store.KeyValueStore, error)
+  // Replicate `kvStore` to the config's `replica_peers`. Required with
+  // `replica_peers`.
+  Replicate func(
+    c *config.Config,
+    kvStore store.KeyValueStore,
+    options *ServerOptions) (store.KeyValueStore, error)
+}
+
+/**
+ * Make a Server as configured: its storage engine, cache and optional
+ * behaviour, logging to `logger` and tracing to `tracer`, which may be nil. The
+ * config is assumed valid, e.g. as returned by config.Load. `factories` may
+ * be nil unless the config enables Raft or replication.
+ */
+func MakeServer(
+    c *config.Config,
+    logger *logging.Logger,
+    tracer *tracing.Tracer,
+    factories *StoreFactories) (*Server, error) {
+  var cache *store.Cache
+  var err error
+  if c.EnableCaching {
+    cache, err = store.MakeCacheWithOptions(c.CacheBytes, &store.CacheOptions{ Logger: logger })
+    if err != nil {
+      return nil, fmt.Errorf("Error making cache: %w", err)
+    }
+  }
+
+  options, err := serverOptions(c, logger)
+  if err != nil {
+    return nil, err
+  }
+  options.Tracer = tracer
+
+  kvStore, err := makeStore(c, options, factories)
+  if err != nil {
+    return nil, err
+  }
+  s, err := MakeServerWithOptions(kvStore, cache, options)
+  if err != nil {
+    kvStore.Close()
+    return nil, err
+  }
+  return s, nil
+}
+
+// Make the configured storage engine, replicated if configured.
+func makeStore(
+    c *config.Config,
+    options *ServerOptions,
+    factories *StoreFactories) (store.KeyValueStore, error) {
+  if factories == nil {
+    factories = &StoreFactories{}
+  }
+  fsOptions, err := FileStoreOptions(c, options.Logger)
+  if err != nil {
+    return nil, err
+  }
+
+  var kvStore store.KeyValueStore
+  directory := c.StoreDirectory()
+  if c.LogStructuredStorage {
+    kvStore, err = store.MakeLogStore(directory, &store.LogStoreOptions{ Logger: options.Logger })
+    if err != nil {
+      return nil, fmt.Errorf("Error making log store: %w", err)
+    }
+  } else if len(c.RaftNodes) > 0 {
+    if factories.Raft == nil {
+      return nil, errors.New("Raft requires a Raft store factory")
+    }
+    if kvStore, err = factories.Raft(c, fsOptions, options); err != nil {
+      return nil, fmt.Errorf("Error making Raft store: %w", err)
+    }
+  } else {
+    if kvStore, err = store.MakeFileStore(directory, fsOptions); err != nil {
+      return nil, fmt.Errorf("Error making filestore: %w", err)
+    }
+  }
+
+  if len(c.ReplicaPeers) > 0 {
+    var replicated store.KeyValueStore
+    err := errors.New("Replication requires a replication factory")
+    if factories.Replicate != nil {
+      replicated, err = factories.Replicate(c, kvStore, options)
+    }
+    if err != nil {
+      kvStore.Close()
+      return nil, fmt.Errorf("Error configuring replication: %w", err)
+    }
+    kvStore = replicated
+  }
+  return kvStore, nil
+}
+
+/**
+ * Return the TLS config nodes reach one another with, or nil unless the API
+ * is served over TLS. Nodes trust the CAs in `tls_ca_file`, or the system's,
+ * and present the `tls_client_cert_file` certificate, or else their own, to
+ * nodes which require mutual TLS. `logger` may be nil.
+ */
+func PeerTlsConfig(c *config.Config, logger *logging.Logger) (*tls.Config, error) {
+  if c.TlsCertFile == "" {
+    return nil, nil
+  }
+
+  certFile, keyFile := c.TlsClientCertFile, c.TlsClientKeyFile
+  if certFile == "" {
+    certFile, keyFile = c.TlsCertFile, c.TlsKeyFile
+  }
+  keyPair, err := certs.LoadKeyPair(certFile, keyFile, logger)
+  if err != nil {
+    return nil, err
+  }
+
+  var rootCas *certs.CertPool
+  if c.TlsCaFile != "" {
+    if rootCas, err = certs.LoadCertPool(c.TlsCaFile, logger); err != nil {
+      return nil, err
+    }
+  }
+  return certs.ClientConfig(keyPair, rootCas), nil
+}
+
+// Return the options of the configured FileStores, loading any keyfile.
+// `logger` may be nil.
+func FileStoreOptions(
+    c *config.Config,
+    logger *logging.Logger) (*store.FileStoreOptions, error) {
+  fsOptions := &store.FileStoreOptions{
+    EnableCompression: c.EnableCompression,
+    EnableDeduplication: c.EnableDeduplication,
+    MaxBytes: c.MaxStoreBytes,
+    MaxFiles: c.MaxStoreFiles,
+    Logger: logger,
+  }
+  if c.EncryptionKeyfile != "" {
+    keyring, err := store.LoadKeyring(c.EncryptionKeyfile)
+    if err != nil {
+      return nil, fmt.Errorf("Error loading keyfile: %w", err)
+    }
+    fsOptions.Keyring = keyring
+  }
+  return fsOptions, nil
+}
+
+// Return the ServerOptions of the config, loading the files it names.
+func serverOptions(c *config.Config, logger *logging.Logger) (*ServerOptions, error) {
+  options := &ServerOptions{
+    Address: c.Address,
+    AdminAddress: c.AdminAddress,
+    AdminLocalOnly: c.AdminLocalOnly,
+    Config: c,
+    Logger: logger,
+    AccessLog: c.AccessLog,
+  }
+  if len(c.ClusterNodes) > 0 {
+    options.ClusterNodes = c.ClusterNodes
+    options.ClusterSelf = c.NodeName()
+  }
+
+  if c.PeerSecretFile != "" {
+    peerKey, err := auth.LoadPeerKey(c.PeerSecretFile)
+    if err != nil {
+      return nil, err
+    }
+    options.PeerKey = peerKey
+  }
+
+  if c.TlsCertFile != "" {
+    options.Tls = &TlsOptions{
+      CertFile: c.TlsCertFile,
+      KeyFile: c.TlsKeyFile,
+      ClientCaFile: c.TlsClientCaFile,
+    }
+    peerTls, err := PeerTlsConfig(c, logger)
+    if err != nil {
+      return nil, err
+    }
+    options.PeerTls = peerTls
+  }
+
+  if c.AuthConfig != "" {
+    policy, err := auth.LoadPolicy(c.AuthConfig)
+    if err != nil {
+      return nil, err
+    }
+    options.Auth = policy
+  }
+
+  if c.NamespacesConfig != "" {
+    namespaces, err := LoadNamespaceConfig(c.NamespacesConfig)
+    if err != nil {
+      return nil, err
+    }
+    fsOptions, err := FileStoreOptions(c, logger)
+    if err != nil {
+      return nil, err
+    }
+    directory := c.NamespacesDirectory
+    if directory == "" {
+      directory = c.StoreDirectory() + "-namespaces"
+    }
+    options.Namespaces = &NamespaceOptions{
+      Directory: directory,
+      Namespaces: namespaces,
+      FileStore: fsOptions,
+    }
+  }
+
+  // Flags override the rate limits config file.
+  var limits *RateLimits
+  if c.RateLimitConfig != "" {
+    var err error
+    if limits, err = LoadRateLimits(c.RateLimitConfig); err != nil {
+      return nil, err
+    }
+  }
+  if c.RateLimitRps > 0 || c.RateLimitBurst > 0 || c.MaxInFlight > 0 || c.MaxQueued > 0 {
+    if limits == nil {
+      limits = &RateLimits{}
+    }
+    if c.RateLimitRps > 0 {
+      limits.RequestsPerSecond = c.RateLimitRps
+    }
+    if c.RateLimitBurst > 0 {
+      limits.Burst = c.RateLimitBurst
+    }
+    if c.MaxInFlight > 0 {
+      limits.MaxInFlight = c.MaxInFlight
+    }
+    if c.MaxQueued > 0 {
+      limits.MaxQueued = c.MaxQueued
+    }
+  }
+  options.RateLimits = limits
+  return options, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+  "errors"
+  "testing"
+
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/store"
+)
+
+func TestMakeServerFromConfig(t *testing.T) {
+  c, err := config.Load([]string{
+    "--address=:8081", "--enable_caching", "--cache_bytes=1024", "--max_in_flight=4",
+    "--directory=" + t.TempDir(),
+  }, func(string) string { return "" })
+  if err != nil {
+    t.Fatalf("Error loading config: %v", err)
+  }
+
+  s, err := MakeServer(c, nil, nil, nil)
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+  if s.address != ":8081" {
+    t.Errorf("Expected to serve on :8081, got %v", s.address)
+  }
+  if capacity := s.Stats()["cache"]["capacity_bytes"]; capacity != 1024 {
+    t.Errorf("Expected a 1024 byte cache, got %v", capacity)
+  }
+  if s.admission.status().Limits.MaxInFlight != 4 {
+    t.Errorf("Expected the in-flight limit of the flag")
+  }
+  if fs := s.FileStore(); fs == nil || fs.Stats()["file_count"] != 0 {
+    t.Errorf("Expected an empty filestore in the directory of the flag")
+  }
+}
+
+func TestMakeServerUsesStoreFactories(t *testing.T) {
+  c := config.Default()
+  c.Directory = t.TempDir()
+  c.RaftNodes = []string{ "localhost:8080" }
+  c.ReplicaPeers = []string{ "localhost:8081" }
+  raftStore := &store.FakeKeyValueStore{}
+  replicated := &store.FakeKeyValueStore{}
+
+  s, err := MakeServer(c, nil, nil, &StoreFactories{
+    Raft: func(
+        c *config.Config,
+        fsOptions *store.FileStoreOptions,
+        options *ServerOptions) (store.KeyValueStore, error) {
+      return raftStore, nil
+    },
+    Replicate: func(
+        c *config.Config,
+        kvStore store.KeyValueStore,
+        options *ServerOptions) (store.KeyValueStore, error) {
+      if kvStore != raftStore {
+        t.Errorf("Expected the Raft store to be replicated")
+      }
+      return replicated, nil
+    },
+  })
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+  if s.filestore != replicated {
+    t.Errorf("Expected the server to serve the replicated store")
+  }
+
+  if _, err := MakeServer(c, nil, nil, nil); err == nil {
+    t.Errorf("Expected Raft without a factory to fail")
+  }
+}
+
+func TestMakeServerClosesStoreOnError(t *testing.T) {
+  c := config.Default()
+  c.Directory = t.TempDir()
+  c.RaftNodes = []string{ "localhost:8080" }
+  c.ClusterNodes = []string{ "localhost:8081", "localhost:8082" }
+  fs := &store.FakeKeyValueStore{}
+  factories := &StoreFactories{
+    Raft: func(
+        c *config.Config,
+        fsOptions *store.FileStoreOptions,
+        options *ServerOptions) (store.KeyValueStore, error) {
+      return fs, nil
+    },
+    Replicate: func(
+        c *config.Config,
+        kvStore store.KeyValueStore,
+        options *ServerOptions) (store.KeyValueStore, error) {
+      return nil, errors.New("unreachable peers")
+    },
+  }
+
+  // This server is not one of the cluster's nodes.
+  if _, err := MakeServer(c, nil, nil, factories); err == nil {
+    t.Errorf("Expected a server outside its cluster to fail")
+  }
+  if !fs.Closed {
+    t.Errorf("Expected the store to be closed")
+  }
+
+  fs.Closed = false
+  c.ClusterNodes = nil
+  c.ReplicaPeers = []string{ "localhost:8081" }
+  if _, err := MakeServer(c, nil, nil, factories); err == nil {
+    t.Errorf("Expected failing to replicate to fail")
+  }
+  if !fs.Closed {
+    t.Errorf("Expected the store to be closed once replication failed")
+  }
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net"
+  "net/http"
+  "runtime"
+  "runtime/debug"
+  "strings"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  // The outcome of a passing readiness check.
+  CHECK_OK = "ok"
+)
+
+// The JSON body of a /readyz response, e.g.
+// { "ready": false, "checks": { "store": "Directory ... is not writable" } }
+type readiness struct {
+  Ready bool `json:"ready"`
+  // Each check's outcome: CHECK_OK, or why it failed.
+  Checks map[string]string `json:"checks"`
+}
+
+// The build of the running binary, as reported by /admin/status.
+type buildInfo struct {
+  GoVersion string `json:"go_version"`
+  Path string `json:"path,omitempty"`
+  Version string `json:"version,omitempty"`
+  // The platform and VCS settings stamped by `go build`, e.g. `GOOS` and
+  // `vcs.revision`.
+  Settings map[string]string `json:"settings,omitempty"`
+}
+
+// The JSON body of an /admin/status response.
+type status struct {
+  StartedAt time.Time `json:"started_at"`
+  UptimeSeconds float64 `json:"uptime_seconds"`
+  // The config the server was made from, with secrets redacted; omitted if
+  // it was made from stores directly.
+  Config *config.Config `json:"config,omitempty"`
+  Readiness *readiness `json:"readiness"`
+  // The statistics of the store and cache of each namespace, as /metrics
+  // reports them, e.g. the store's `size_bytes` and the cache's
+  // `size_bytes` against its `capacity_bytes`.
+  Stats map[string]map[string]map[string]int64 `json:"stats"`
+  Goroutines int `json:"goroutines"`
+  Build *buildInfo `json:"build"`
+}
+
+// Register the liveness and readiness probes, which are neither
+// authenticated nor limited, so that they answer under load.
+func (s *Server) addProbeRoutes(mux *http.ServeMux) {
+  mux.HandleFunc("/healthz", s.handleHealthz)
+  mux.HandleFunc("/readyz", s.handleReadyz)
+}
+
+// Register the admin routes of a single namespace.
+func (s *Server) addAdminRoutes(mux *http.ServeMux) {
+  mux.HandleFunc("/metrics", s.admit("/metrics", true,
+    s.authorize(auth.PERMISSION_ADMIN, adminRequestKey, s.handleMetrics)))
+  mux.HandleFunc("/admin/snapshot", s.admit("/admin/snapshot", true,
+    s.authorize(auth.PERMISSION_ADMIN, adminRequestKey, s.handleSnapshot)))
+}
+
+// Register the admin routes which cover every namespace, and so are served
+// from the default one.
+func (s *Server) addServerAdminRoutes(mux *http.ServeMux) {
+  if s.namespaces != nil {
+    mux.HandleFunc("/admin/namespaces", s.authorize(auth.PERMISSION_ADMIN, adminRequestKey,
+      s.handleNamespaces))
+  }
+  if s.admission != nil {
+    // Not itself limited, so that limits can be adjusted under load.
+    mux.HandleFunc("/admin/limits", s.authorize(auth.PERMISSION_ADMIN, adminRequestKey,
+      s.handleLimits))
+  }
+  mux.HandleFunc("/admin/status", s.authorize(auth.PERMISSION_ADMIN, adminRequestKey,
+    s.handleStatus))
+}
+
+/**
+ * Return the handler of the admin listener: the probes and every admin
+ * route, e.g. /metrics and /admin/status. Only admin routes configured to
+ * be served separately, via ServerOptions.AdminAddress, are removed from
+ * Handler.
+ */
+func (s *Server) AdminHandler() http.Handler {
+  mux := http.NewServeMux()
+  s.addAdminRoutes(mux)
+  s.addProbeRoutes(mux)
+  s.addServerAdminRoutes(mux)
+  return s.withRequestLogging(s.withTracing(s.withNamespaces(mux,
+    func(namespace *Server) http.Handler {
+      namespaceMux := http.NewServeMux()
+      namespace.addAdminRoutes(namespaceMux)
+      return namespaceMux
+    })))
+}
+
+/**
+ * Serve the admin routes from the listener, over TLS if the API is, and
+ * only to loopback clients if ServerOptions.AdminLocalOnly is set. Returns
+ * http.ErrServerClosed once the server is shut down.
+ */
+func (s *Server) ServeAdmin(listener net.Listener) error {
+  handler := s.AdminHandler()
+  if s.adminLocalOnly {
+    handler = localOnly(handler)
+  }
+  return s.serve(listener, handler)
+}
+
+// Reject requests from other machines with a StatusForbidden.
+func localOnly(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+      // Return a StatusForbidden; the admin routes are local only.
+      http.Error(w, "Admin routes are only served locally", http.StatusForbidden)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// Handler for a /healthz call: the server is alive, as it answered.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain")
+  fmt.Fprintln(w, CHECK_OK)
+}
+
+// Handler for a /readyz call. Reports each readiness check, with a
+// StatusServiceUnavailable if any failed.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+  result := s.checkReadiness()
+  w.Header().Set("Content-Type", "application/json")
+  if !result.Ready {
+    // Return a StatusServiceUnavailable; the orchestrator should not route
+    // calls here yet.
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  if err := json.NewEncoder(w).Encode(result); err != nil {
+    s.log(r).Warn("Error encoding readiness", "err", err)
+  }
+}
+
+/**
+ * Check that the server is not shutting down, and that the store of each
+ * namespace is healthy, e.g. that its disk is writable and its replicas
+ * reachable; see store.HealthChecker. A store having been made means it
+ * was opened, and for a FileStore, that its temporary directory was
+ * emptied.
+ */
+func (s *Server) checkReadiness() *readiness {
+  result := &readiness{ Ready: true, Checks: make(map[string]string) }
+  check := func(name string, err error) {
+    result.Checks[name] = CHECK_OK
+    if err != nil {
+      result.Checks[name] = err.Error()
+      result.Ready = false
+    }
+  }
+
+  s.serveMutex.Lock()
+  shuttingDown := s.shutdown
+  s.serveMutex.Unlock()
+  if shuttingDown {
+    check("shutdown", errors.New("Shutting down"))
+  } else {
+    check("shutdown", nil)
+  }
+
+  check("store", checkStore(s.filestore))
+  for name, namespace := range s.namespaces {
+    check("namespace/" + name, checkStore(namespace.filestore))
+  }
+  return result
+}
+
+// Return the health of a store which reports it, otherwise nil.
+func checkStore(kvStore store.KeyValueStore) error {
+  if checker, ok := kvStore.(store.HealthChecker); ok {
+    return checker.CheckHealth()
+  }
+  return nil
+}
+
+// Handler for an /admin/status call. Returns the config, uptime, readiness,
+// store and cache statistics, goroutine count and build as JSON.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+  result := &status{
+    StartedAt: s.startedAt.UTC(),
+    UptimeSeconds: time.Since(s.startedAt).Seconds(),
+    Readiness: s.checkReadiness(),
+    Stats: map[string]map[string]map[string]int64{ DEFAULT_NAMESPACE: s.Stats() },
+    Goroutines: runtime.NumGoroutine(),
+    Build: &buildInfo{ GoVersion: runtime.Version() },
+  }
+  if s.config != nil {
+    result.Config = s.config.Redacted()
+  }
+  for name, namespace := range s.namespaces {
+    result.Stats[name] = namespace.Stats()
+  }
+  if info, ok := debug.ReadBuildInfo(); ok {
+    result.Build.Path = info.Main.Path
+    result.Build.Version = info.Main.Version
+    for _, setting := range info.Settings {
+      if !strings.HasPrefix(setting.Key, "vcs.") && setting.Key != "GOOS" &&
+          setting.Key != "GOARCH" {
+        continue
+      }
+      if result.Build.Settings == nil {
+        result.Build.Settings = make(map[string]string)
+      }
+      result.Build.Settings[setting.Key] = setting.Value
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(result); err != nil {
+    s.log(r).Warn("Error encoding status", "err", err)
+  }
+}
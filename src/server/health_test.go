@@ -0,0 +1,114 @@
+package server
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/store"
+)
+
+func TestHealthzAnswers(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, _ := MakeServerWithOptions(fs, nil, nil)
+
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+  if w.Code != http.StatusOK {
+    t.Errorf("Expected http %v, received %v", http.StatusOK, w.Code)
+  }
+}
+
+func TestReadyzReportsUnwritableDisk(t *testing.T) {
+  directory := t.TempDir()
+  fs, _ := store.MakeFileStore(directory, nil)
+  s, _ := MakeServerWithOptions(fs, nil, nil)
+
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+  if w.Code != http.StatusOK {
+    t.Errorf("Expected http %v, received %v: %v", http.StatusOK, w.Code, w.Body)
+  }
+
+  // Removing the store's directory makes it unwritable.
+  os.RemoveAll(directory)
+  w = httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+  if w.Code != http.StatusServiceUnavailable {
+    t.Errorf("Expected http %v, received %v", http.StatusServiceUnavailable, w.Code)
+  }
+  result := &readiness{}
+  if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+    t.Fatalf("Error decoding readiness: %v", err)
+  }
+  if result.Ready || result.Checks["store"] == CHECK_OK {
+    t.Errorf("Expected the store check to fail, got %+v", result)
+  }
+}
+
+func TestAdminStatusReportsConfigAndStats(t *testing.T) {
+  conf := config.Default()
+  conf.Directory = filepath.Join(t.TempDir(), "store")
+  conf.AuthToken = "secret"
+  fs, _ := store.MakeFileStore(conf.Directory, nil)
+  s, _ := MakeServerWithOptions(fs, nil, &ServerOptions{ Config: conf })
+
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+  if w.Code != http.StatusOK {
+    t.Fatalf("Expected http %v, received %v", http.StatusOK, w.Code)
+  }
+  // Decoded loosely, as config.Config is written but not read as JSON.
+  result := &struct {
+    Config map[string]interface{} `json:"config"`
+    Stats map[string]interface{} `json:"stats"`
+    Goroutines int `json:"goroutines"`
+    Build *buildInfo `json:"build"`
+  }{}
+  if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+    t.Fatalf("Error decoding status: %v", err)
+  }
+  if result.Config == nil || result.Config["auth_token"] != "<redacted>" {
+    t.Errorf("Expected the config with its token redacted, got %v", result.Config)
+  }
+  if _, ok := result.Stats[DEFAULT_NAMESPACE]; !ok {
+    t.Errorf("Expected stats of the default namespace, got %v", result.Stats)
+  }
+  if result.Goroutines <= 0 || result.Build == nil || result.Build.GoVersion == "" {
+    t.Errorf("Expected goroutines and build info, got %+v", result)
+  }
+}
+
+func TestAdminAddressSeparatesAdminRoutes(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, _ := MakeServerWithOptions(fs, nil, &ServerOptions{
+    AdminAddress: "127.0.0.1:0",
+    AdminLocalOnly: true,
+  })
+
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+  if w.Code != http.StatusNotFound {
+    t.Errorf("Expected the API handler not to serve admin routes, received %v", w.Code)
+  }
+
+  local := httptest.NewRequest("GET", "/admin/status", nil)
+  local.RemoteAddr = "127.0.0.1:1234"
+  w = httptest.NewRecorder()
+  localOnly(s.AdminHandler()).ServeHTTP(w, local)
+  if w.Code != http.StatusOK {
+    t.Errorf("Expected a local admin call to succeed, received %v", w.Code)
+  }
+
+  remote := httptest.NewRequest("GET", "/admin/status", nil)
+  remote.RemoteAddr = "10.0.0.1:1234"
+  w = httptest.NewRecorder()
+  localOnly(s.AdminHandler()).ServeHTTP(w, remote)
+  if w.Code != http.StatusForbidden {
+    t.Errorf("Expected a remote admin call to be forbidden, received %v", w.Code)
+  }
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+  "bufio"
+  "errors"
+  "net"
+  "net/http"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+// Records the status and size of a response, for the access log and traces.
+type recordingResponseWriter struct {
+  http.ResponseWriter
+  status int
+  bytesWritten int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+  if w.status == 0 {
+    w.status = status
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  written, err := w.ResponseWriter.Write(data)
+  w.bytesWritten += int64(written)
+  return written, err
+}
+
+// Flush the response, e.g. for /watch streams.
+func (w *recordingResponseWriter) Flush() {
+  if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+    return hijacker.Hijack()
+  }
+  return nil, nil, errors.New("Response cannot be hijacked")
+}
+
+/**
+ * Assign each request an ID, taken from its X-Request-ID header if valid
+ * and otherwise generated, which is echoed in the response and attached to
+ * every entry logged for it; see Server.log. If enabled, also write an
+ * access log entry once the request is served.
+ */
+func (s *Server) withRequestLogging(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    requestId := r.Header.Get(logging.HEADER_REQUEST_ID)
+    if !logging.ValidRequestId(requestId) {
+      requestId = logging.NewRequestId()
+    }
+    w.Header().Set(logging.HEADER_REQUEST_ID, requestId)
+    r = r.WithContext(logging.WithRequestId(r.Context(), requestId))
+    if !s.accessLog || !s.logger.Enabled(logging.LEVEL_INFO) {
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    start := time.Now()
+    recorder := &recordingResponseWriter{ ResponseWriter: w }
+    next.ServeHTTP(recorder, r)
+    if recorder.status == 0 {
+      recorder.status = http.StatusOK
+    }
+    s.logger.Info("Served request",
+      "request_id", requestId,
+      "method", r.Method,
+      "path", r.URL.Path,
+      "status", recorder.status,
+      "duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+      "bytes_in", r.ContentLength,
+      "bytes_out", recorder.bytesWritten,
+      "remote", r.RemoteAddr)
+  })
+}
+
+// Return the server's logger, attaching the request's ID if it has one.
+func (s *Server) log(r *http.Request) *logging.Logger {
+  if requestId := logging.RequestId(r.Context()); requestId != "" {
+    return s.logger.With("request_id", requestId)
+  }
+  return s.logger
+}
+
+// Send the ID carried by an outgoing request's context, e.g. one proxied to
+// another node, so that the node logs it too.
+func propagateRequestId(req *http.Request) {
+  if requestId := logging.RequestId(req.Context()); requestId != "" {
+    req.Header.Set(logging.HEADER_REQUEST_ID, requestId)
+  }
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+  "bytes"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Make a server logging every level to a buffer.
+func makeLoggingServer(t *testing.T) (*Server, *bytes.Buffer) {
+  output := &bytes.Buffer{}
+  logger, _ := logging.MakeLogger(output, &logging.Options{ Level: logging.LEVEL_DEBUG })
+  fs, _ := store.MakeFileStore(t.TempDir(), &store.FileStoreOptions{ Logger: logger })
+  s, err := MakeServerWithOptions(fs, nil, &ServerOptions{ Logger: logger, AccessLog: true })
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+  return s, output
+}
+
+func TestRequestIdsAreEchoedAndLogged(t *testing.T) {
+  s, output := makeLoggingServer(t)
+
+  req := httptest.NewRequest("GET", "/get?key=missing", nil)
+  req.Header.Set(logging.HEADER_REQUEST_ID, "build-123")
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, req)
+
+  if w.Header().Get(logging.HEADER_REQUEST_ID) != "build-123" {
+    t.Errorf("Expected the request ID to be echoed, got %q",
+      w.Header().Get(logging.HEADER_REQUEST_ID))
+  }
+  for _, expected := range []string{
+      `msg="Key not found" request_id=build-123 key=missing`,
+      `msg="Served request" request_id=build-123 method=GET path=/get status=404`,
+  } {
+    if !strings.Contains(output.String(), expected) {
+      t.Errorf("Expected the log to contain %q, got %q", expected, output.String())
+    }
+  }
+
+  // Malformed IDs are replaced, so they cannot forge entries.
+  req = httptest.NewRequest("GET", "/get?key=missing", nil)
+  req.Header.Set(logging.HEADER_REQUEST_ID, "a b")
+  w = httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, req)
+  if requestId := w.Header().Get(logging.HEADER_REQUEST_ID);
+      requestId == "a b" || !logging.ValidRequestId(requestId) {
+    t.Errorf("Expected a generated request ID, got %q", requestId)
+  }
+}
+
+func TestLogsDoNotContainValues(t *testing.T) {
+  s, output := makeLoggingServer(t)
+
+  body := `{"key": "a key", "value": "a secret value"`
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/set", strings.NewReader(body)))
+  if w.Code != http.StatusInternalServerError {
+    t.Errorf("Expected http %v, received %v", http.StatusInternalServerError, w.Code)
+  }
+  if strings.Contains(output.String(), "secret") {
+    t.Errorf("Expected the body to be redacted, got %q", output.String())
+  }
+  if !strings.Contains(output.String(), "bytes_in=") {
+    t.Errorf("Expected an access log entry, got %q", output.String())
+  }
+}
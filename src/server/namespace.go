@@ -0,0 +1,224 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+const (
+  // Selects the namespace of a request, as an alternative to a path prefix.
+  HEADER_NAMESPACE = "X-Namespace"
+  // Selects the namespace of a request, e.g. `/ns/team-a/get?key=a`.
+  NAMESPACE_PATH_PREFIX = "/ns/"
+  // The namespace of requests which select none, i.e. the server's own
+  // store and cache.
+  DEFAULT_NAMESPACE = "default"
+)
+
+var (
+  namespaceNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9_-]*$")
+)
+
+// The limits of a namespace. 0 is unlimited, or for CacheBytes, no cache.
+type NamespaceConfig struct {
+  QuotaBytes int64 `json:"quota_bytes"`
+  QuotaKeys int `json:"quota_keys"`
+  CacheBytes int `json:"cache_bytes"`
+}
+
+// The JSON config file, e.g.
+// {
+//   "namespaces": {
+//     "team-a": { "quota_bytes": 1048576, "quota_keys": 1000, "cache_bytes": 65536 }
+//   }
+// }
+type namespacesConfig struct {
+  Namespaces map[string]*NamespaceConfig `json:"namespaces"`
+}
+
+// Namespaces served alongside the default one, each with its own store,
+// cache and quotas.
+type NamespaceOptions struct {
+  // The directory holding each namespace's FileStore, in a subdirectory
+  // named after the namespace.
+  Directory string
+  Namespaces map[string]*NamespaceConfig
+  // Options shared by every namespace's FileStore, e.g. compression; its
+  // quotas are replaced by each namespace's. May be nil.
+  FileStore *store.FileStoreOptions
+}
+
+// Load the namespaces of a JSON config file.
+func LoadNamespaceConfig(path string) (map[string]*NamespaceConfig, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var parsed namespacesConfig
+  if err := json.Unmarshal(data, &parsed); err != nil {
+    return nil, fmt.Errorf("Invalid namespaces config %v: %w", path, err)
+  }
+  for name, config := range parsed.Namespaces {
+    if err := validateNamespace(name, config); err != nil {
+      return nil, fmt.Errorf("Invalid namespaces config %v: %w", path, err)
+    }
+  }
+  return parsed.Namespaces, nil
+}
+
+func validateNamespace(name string, config *NamespaceConfig) error {
+  if !namespaceNamePattern.MatchString(name) {
+    return errors.New(fmt.Sprintf(
+      "Namespace %q must be lowercase letters, digits, '-' and '_'", name))
+  }
+  if name == DEFAULT_NAMESPACE {
+    return errors.New(fmt.Sprintf("Namespace %q is reserved", name))
+  }
+  if config == nil || config.QuotaBytes < 0 || config.QuotaKeys < 0 || config.CacheBytes < 0 {
+    return errors.New(fmt.Sprintf("Namespace %q has negative limits", name))
+  }
+  return nil
+}
+
+/**
+ * Make a Server for each namespace, each with its own FileStore and cache.
+ * Each enforces `policy`, logs to `logger` with its name attached, and
+ * traces to `tracer`; all may be nil.
+ */
+func makeNamespaces(
+    options *NamespaceOptions,
+    policy *auth.Policy,
+    logger *logging.Logger,
+    tracer *tracing.Tracer) (map[string]*Server, error) {
+  if err := os.MkdirAll(options.Directory, 0755); err != nil {
+    return nil, err
+  }
+
+  namespaces := make(map[string]*Server)
+  for name, config := range options.Namespaces {
+    if err := validateNamespace(name, config); err != nil {
+      return nil, err
+    }
+
+    fsOptions := store.FileStoreOptions{}
+    if options.FileStore != nil {
+      fsOptions = *options.FileStore
+    }
+    fsOptions.QuotaBytes = config.QuotaBytes
+    fsOptions.QuotaKeys = config.QuotaKeys
+    namespaceLogger := logger.With("namespace", name)
+    fsOptions.Logger = namespaceLogger
+    fs, err := store.MakeFileStore(filepath.Join(options.Directory, name), &fsOptions)
+    if err != nil {
+      return nil, fmt.Errorf("Error creating namespace %v: %w", name, err)
+    }
+
+    var cache *store.Cache
+    if config.CacheBytes > 0 {
+      cache, err = store.MakeCacheWithOptions(config.CacheBytes,
+        &store.CacheOptions{ Logger: namespaceLogger })
+      if err != nil {
+        return nil, fmt.Errorf("Error creating namespace %v: %w", name, err)
+      }
+    }
+
+    namespace, err := MakeServerWithOptions(fs, cache, &ServerOptions{
+      Auth: policy,
+      Logger: namespaceLogger,
+      Tracer: tracer,
+    })
+    if err != nil {
+      return nil, err
+    }
+    namespaces[name] = namespace
+  }
+  return namespaces, nil
+}
+
+/**
+ * Return a handler dispatching each request to its namespace's handler. The
+ * namespace is selected by the path prefix, e.g. `/ns/team-a/get`, else the
+ * X-Namespace header, else the namespace the request's token is bound to,
+ * else DEFAULT_NAMESPACE.
+ */
+func (s *Server) routeToNamespace(handlers map[string]http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    name := r.Header.Get(HEADER_NAMESPACE)
+
+    if strings.HasPrefix(r.URL.Path, NAMESPACE_PATH_PREFIX) {
+      rest := strings.TrimPrefix(r.URL.Path, NAMESPACE_PATH_PREFIX)
+      slash := strings.Index(rest, "/")
+      if slash <= 0 {
+        // Return a StatusNotFound; the path names no namespace and route.
+        w.WriteHeader(http.StatusNotFound)
+        return
+      }
+      if name != "" && name != rest[:slash] {
+        // Return a StatusBadRequest; the path and header disagree.
+        http.Error(w, "Conflicting namespaces selected", http.StatusBadRequest)
+        return
+      }
+      name = rest[:slash]
+
+      stripped := new(http.Request)
+      *stripped = *r
+      stripped.URL = new(url.URL)
+      *stripped.URL = *r.URL
+      stripped.URL.Path = rest[slash:]
+      stripped.URL.RawPath = ""
+      r = stripped
+    }
+
+    if s.policy != nil {
+      principal, ok := s.policy.Authenticate(requestToken(r))
+      if ok && principal.Namespace != "" {
+        if name == "" {
+          name = principal.Namespace
+        } else if name != principal.Namespace {
+          s.log(r).Warn("Denied namespace", "principal", principal.Name, "namespace", name)
+          // Return a StatusForbidden; the token is bound to another namespace.
+          w.WriteHeader(http.StatusForbidden)
+          return
+        }
+      }
+    }
+
+    if name == "" {
+      name = DEFAULT_NAMESPACE
+    }
+    handler, ok := handlers[name]
+    if !ok {
+      // Return a StatusNotFound; the namespace does not exist.
+      http.Error(w, fmt.Sprintf("Unknown namespace %q", name), http.StatusNotFound)
+      return
+    }
+    handler.ServeHTTP(w, r)
+  })
+}
+
+// Handler for an /admin/namespaces call. Returns the usage of each
+// namespace, as /metrics reports it, e.g.
+// { "default": { "filestore": { ... } }, "team-a": { "filestore": { ... } } }
+func (s *Server) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+  report := make(map[string]map[string]map[string]int64)
+  report[DEFAULT_NAMESPACE] = s.Stats()
+  for name, namespace := range s.namespaces {
+    report[name] = namespace.Stats()
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(report); err != nil {
+    s.log(r).Warn("Error writing namespace usage", "err", err)
+  }
+}
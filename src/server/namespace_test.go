@@ -0,0 +1,197 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  TEST_NAMESPACE_AUTH_CONFIG = `{
+    "roles": {
+      "writer": [ { "prefix": "", "permissions": [ "read", "write" ] } ],
+      "admin": [ { "prefix": "", "permissions": [ "read", "write", "admin" ] } ]
+    },
+    "tokens": [
+      { "name": "team-a", "token": "team-a-token", "roles": [ "writer" ], "namespace": "team-a" },
+      { "name": "operator", "token": "admin-token", "roles": [ "admin" ] }
+    ]
+  }`
+)
+
+// Serve a filestore with the namespaces `team-a`, limited to two keys, and
+// `team-b`, returning the server's URL.
+func startNamespaceServer(t *testing.T, policy *auth.Policy) string {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, err := MakeServerWithOptions(fs, nil, &ServerOptions{
+    Auth: policy,
+    Namespaces: &NamespaceOptions{
+      Directory: filepath.Join(t.TempDir(), "namespaces"),
+      Namespaces: map[string]*NamespaceConfig{
+        "team-a": &NamespaceConfig{ QuotaKeys: 2, CacheBytes: 1024 },
+        "team-b": &NamespaceConfig{},
+      },
+    },
+  })
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+
+  testServer := httptest.NewServer(s.Handler())
+  t.Cleanup(testServer.Close)
+  return testServer.URL
+}
+
+func makeNamespaceClient(
+    t *testing.T, serverUrl string, options *client.ClientOptions) *client.Client {
+  c, err := client.MakeClientWithOptions(serverUrl, options)
+  if err != nil {
+    t.Fatalf("Error making client: %v", err)
+  }
+  return c
+}
+
+func TestNamespacesIsolateKeys(t *testing.T) {
+  serverUrl := startNamespaceServer(t, nil)
+  teamA := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Namespace: "team-a" })
+  teamB := makeNamespaceClient(t, serverUrl + "/ns/team-b", nil)
+  defaultNamespace := client.MakeClient(serverUrl)
+
+  if err := teamA.Set("key", []byte("a")); err != nil {
+    t.Fatalf("Error setting in team-a: %v", err)
+  }
+  if err := teamB.Set("key", []byte("b")); err != nil {
+    t.Fatalf("Error setting in team-b: %v", err)
+  }
+
+  if value, err := teamA.Get("key"); err != nil || string(value) != "a" {
+    t.Errorf("Expected team-a's value, got %v (%v)", string(value), err)
+  }
+  if value, err := teamB.Get("key"); err != nil || string(value) != "b" {
+    t.Errorf("Expected team-b's value, got %v (%v)", string(value), err)
+  }
+  if _, err := defaultNamespace.Get("key"); !errors.Is(err, client.ErrNotFound) {
+    t.Errorf("Expected the key to be absent from the default namespace, got %v", err)
+  }
+  if keys, err := defaultNamespace.Keys(""); err != nil || len(keys) != 0 {
+    t.Errorf("Expected no keys in the default namespace, got %v (%v)", keys, err)
+  }
+
+  if err := teamA.Delete("key"); err != nil {
+    t.Fatalf("Error deleting from team-a: %v", err)
+  }
+  if value, err := teamB.Get("key"); err != nil || string(value) != "b" {
+    t.Errorf("Expected team-b's value to survive, got %v (%v)", string(value), err)
+  }
+
+  unknown := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Namespace: "team-c" })
+  if _, err := unknown.Get("key"); err == nil {
+    t.Errorf("Expected an unknown namespace to fail")
+  }
+}
+
+func TestNamespacesEnforceKeyQuota(t *testing.T) {
+  serverUrl := startNamespaceServer(t, nil)
+  teamA := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Namespace: "team-a" })
+
+  for _, key := range []string{ "1", "2" } {
+    if err := teamA.Set(key, []byte("value")); err != nil {
+      t.Fatalf("Error setting %v: %v", key, err)
+    }
+  }
+  if err := teamA.Set("3", []byte("value")); !errors.Is(err, client.ErrQuotaExceeded) {
+    t.Errorf("Expected the third key to exceed the quota, got %v", err)
+  }
+  if err := teamA.Set("1", []byte("new value")); err != nil {
+    t.Errorf("Expected overwriting a key to stay within the quota: %v", err)
+  }
+
+  // Other namespaces have their own quotas.
+  teamB := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Namespace: "team-b" })
+  if err := teamB.Set("3", []byte("value")); err != nil {
+    t.Errorf("Expected team-b to be unaffected by team-a's quota: %v", err)
+  }
+}
+
+func TestNamespacesBindTokens(t *testing.T) {
+  policy, err := auth.ParsePolicy([]byte(TEST_NAMESPACE_AUTH_CONFIG))
+  if err != nil {
+    t.Fatalf("Error parsing policy: %v", err)
+  }
+  serverUrl := startNamespaceServer(t, policy)
+
+  bound := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Token: "team-a-token" })
+  if err := bound.Set("key", []byte("value")); err != nil {
+    t.Fatalf("Error setting with a bound token: %v", err)
+  }
+  explicit := makeNamespaceClient(t, serverUrl, &client.ClientOptions{
+    Token: "team-a-token", Namespace: "team-a",
+  })
+  if value, err := explicit.Get("key"); err != nil || string(value) != "value" {
+    t.Errorf("Expected the bound token to write to team-a, got %v (%v)", string(value), err)
+  }
+
+  escaping := makeNamespaceClient(t, serverUrl + "/ns/team-b", &client.ClientOptions{
+    Token: "team-a-token",
+  })
+  if _, err := escaping.Get("key"); !errors.Is(err, client.ErrForbidden) {
+    t.Errorf("Expected leaving the bound namespace to be forbidden, got %v", err)
+  }
+
+  operator := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Token: "admin-token" })
+  if _, err := operator.Get("key"); !errors.Is(err, client.ErrNotFound) {
+    t.Errorf("Expected an unbound token to use the default namespace, got %v", err)
+  }
+}
+
+func TestNamespacesReportUsage(t *testing.T) {
+  serverUrl := startNamespaceServer(t, nil)
+  teamA := makeNamespaceClient(t, serverUrl, &client.ClientOptions{ Namespace: "team-a" })
+  if err := teamA.Set("key", []byte("value")); err != nil {
+    t.Fatalf("Error setting: %v", err)
+  }
+
+  resp, err := http.Get(serverUrl + "/admin/namespaces")
+  if err != nil {
+    t.Fatalf("Error requesting usage: %v", err)
+  }
+  defer resp.Body.Close()
+  var report map[string]map[string]map[string]int64
+  if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+    t.Fatalf("Error decoding usage: %v", err)
+  }
+
+  if len(report) != 3 {
+    t.Errorf("Expected usage of three namespaces, got %v", report)
+  }
+  if report["team-a"]["filestore"]["quota_keys"] != 2 {
+    t.Errorf("Expected team-a's quota to be reported, got %v", report["team-a"])
+  }
+  if report["team-a"]["cache"] == nil || report["team-b"]["cache"] != nil {
+    t.Errorf("Expected only team-a to have a cache, got %v", report)
+  }
+  if report["team-b"]["filestore"]["quota_keys"] != 0 {
+    t.Errorf("Expected team-b to be unlimited, got %v", report["team-b"])
+  }
+}
+
+func TestLoadNamespaceConfigRejectsInvalidNames(t *testing.T) {
+  for _, name := range []string{ "default", "Team", "../escape", "" } {
+    path := filepath.Join(t.TempDir(), "namespaces.json")
+    config := `{ "namespaces": { "` + name + `": { "quota_keys": 1 } } }`
+    if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+      t.Fatalf("Error writing config: %v", err)
+    }
+    if _, err := LoadNamespaceConfig(path); err == nil {
+      t.Errorf("Expected namespace %q to be rejected", name)
+    }
+  }
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math"
+  "net"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+  "buildbuddy.takehome.com/src/ratelimit"
+)
+
+const (
+  // How long requests beyond an in-flight limit are queued by default.
+  DEFAULT_QUEUE_TIMEOUT_MS = 1000
+)
+
+var (
+  // The routes which may have their own in-flight limits.
+  LIMITED_ROUTES = []string{
+    "/get", "/set", "/delete", "/keys", "/metrics", "/admin/snapshot", "/admin/rebalance",
+  }
+)
+
+// The request limits of the server, e.g.
+// {
+//   "requests_per_second": 50, "burst": 100,
+//   "max_in_flight": 64, "route_max_in_flight": { "/set": 16 },
+//   "max_queued": 128, "queue_timeout_ms": 1000
+// }
+type RateLimits struct {
+  // Requests per second allowed to each client, identified by its token if
+  // it presents a known one, or else its IP address; 0 is unlimited.
+  RequestsPerSecond float64 `json:"requests_per_second"`
+  // The requests each client may make at once after being idle.
+  Burst int `json:"burst"`
+  // The requests in flight at once, across every route; 0 is unlimited.
+  MaxInFlight int `json:"max_in_flight"`
+  // The requests in flight at once on each route in LIMITED_ROUTES.
+  RouteMaxInFlight map[string]int `json:"route_max_in_flight"`
+  // The requests queued beyond each in-flight limit; beyond it, requests
+  // are rejected at once.
+  MaxQueued int `json:"max_queued"`
+  // How long requests are queued before being rejected; 0 selects
+  // DEFAULT_QUEUE_TIMEOUT_MS.
+  QueueTimeoutMs int64 `json:"queue_timeout_ms"`
+}
+
+// Load RateLimits from a JSON config file.
+func LoadRateLimits(path string) (*RateLimits, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  limits := &RateLimits{}
+  if err := json.Unmarshal(data, limits); err != nil {
+    return nil, fmt.Errorf("Invalid rate limits config %v: %w", path, err)
+  }
+  if err := limits.validate(); err != nil {
+    return nil, fmt.Errorf("Invalid rate limits config %v: %w", path, err)
+  }
+  return limits, nil
+}
+
+func (l *RateLimits) validate() error {
+  if l.RequestsPerSecond < 0 || l.Burst < 0 || l.MaxInFlight < 0 || l.MaxQueued < 0 ||
+      l.QueueTimeoutMs < 0 {
+    return errors.New("Rate limits must not be negative")
+  }
+  for route, limit := range l.RouteMaxInFlight {
+    known := false
+    for _, limited := range LIMITED_ROUTES {
+      known = known || limited == route
+    }
+    if !known {
+      return errors.New(fmt.Sprintf("Route %v cannot be limited", route))
+    }
+    if limit < 0 {
+      return errors.New(fmt.Sprintf("Route %v has a negative limit", route))
+    }
+  }
+  return nil
+}
+
+// Admits requests within the server's RateLimits.
+type admission struct {
+  limits RateLimits
+  clients *ratelimit.RateLimiter
+  global *ratelimit.ConcurrencyLimiter
+  // Keyed by route, for every route in LIMITED_ROUTES.
+  routes map[string]*ratelimit.ConcurrencyLimiter
+  // The requests rejected for exceeding a client's rate, and an in-flight
+  // limit, respectively.
+  rateLimited int64
+  overloaded int64
+  // Guards `limits`.
+  mutex *sync.Mutex
+}
+
+func makeAdmission(limits *RateLimits) (*admission, error) {
+  a := &admission{}
+  a.clients = ratelimit.MakeRateLimiter(0, 0)
+  a.global = ratelimit.MakeConcurrencyLimiter(0, 0)
+  a.routes = make(map[string]*ratelimit.ConcurrencyLimiter)
+  for _, route := range LIMITED_ROUTES {
+    a.routes[route] = ratelimit.MakeConcurrencyLimiter(0, 0)
+  }
+  a.mutex = &sync.Mutex{}
+  if err := a.setLimits(limits); err != nil {
+    return nil, err
+  }
+  return a, nil
+}
+
+// Replace the limits, taking effect for new requests.
+func (a *admission) setLimits(limits *RateLimits) error {
+  if err := limits.validate(); err != nil {
+    return err
+  }
+  defer a.mutex.Unlock()
+  a.mutex.Lock()
+
+  a.limits = *limits
+  a.clients.SetLimits(limits.RequestsPerSecond, limits.Burst)
+  a.global.SetLimits(limits.MaxInFlight, limits.MaxQueued)
+  for route, limiter := range a.routes {
+    limiter.SetLimits(limits.RouteMaxInFlight[route], limits.MaxQueued)
+  }
+  return nil
+}
+
+func (a *admission) queueTimeout() time.Duration {
+  defer a.mutex.Unlock()
+  a.mutex.Lock()
+  if a.limits.QueueTimeoutMs == 0 {
+    return DEFAULT_QUEUE_TIMEOUT_MS * time.Millisecond
+  }
+  return time.Duration(a.limits.QueueTimeoutMs) * time.Millisecond
+}
+
+// The body of an /admin/limits response.
+type limitsStatus struct {
+  Limits RateLimits `json:"limits"`
+  InFlight int `json:"in_flight"`
+  Queued int `json:"queued"`
+  RateLimited int64 `json:"rate_limited"`
+  Overloaded int64 `json:"overloaded"`
+}
+
+func (a *admission) status() *limitsStatus {
+  defer a.mutex.Unlock()
+  a.mutex.Lock()
+
+  status := &limitsStatus{ Limits: a.limits }
+  status.InFlight, status.Queued = a.global.Load()
+  status.RateLimited = atomic.LoadInt64(&a.rateLimited)
+  status.Overloaded = atomic.LoadInt64(&a.overloaded)
+  return status
+}
+
+// Return the identity a request is rate limited by: its token's name if it
+// presents a known token, or else its IP address.
+func (s *Server) clientIdentity(r *http.Request) string {
+  if s.policy != nil {
+    if principal, ok := s.policy.Authenticate(requestToken(r)); ok {
+      return "token:" + principal.Name
+    }
+  }
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  return "ip:" + host
+}
+
+/**
+ * Wrap a route's handler so that, if the server has rate limits, requests
+ * beyond the client's rate get a StatusTooManyRequests. If `inFlight` is
+ * set, requests beyond the route's or the server's in-flight limit are
+ * queued, and get a StatusServiceUnavailable if no slot frees up in time.
+ * Both responses carry a Retry-After header.
+ */
+func (s *Server) admit(route string, inFlight bool, next http.HandlerFunc) http.HandlerFunc {
+  if s.admission == nil {
+    return next
+  }
+  a := s.admission
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    if ok, wait := a.clients.Allow(s.clientIdentity(r)); !ok {
+      atomic.AddInt64(&a.rateLimited, 1)
+      // Return a StatusTooManyRequests; the client exceeded its rate.
+      w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+      http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+      return
+    }
+    if !inFlight {
+      next(w, r)
+      return
+    }
+
+    timeout := a.queueTimeout()
+    limiters := []*ratelimit.ConcurrencyLimiter{ a.routes[route], a.global }
+    for _, limiter := range limiters {
+      if limiter == nil {
+        continue
+      }
+      if !limiter.Acquire(timeout) {
+        atomic.AddInt64(&a.overloaded, 1)
+        // Return a StatusServiceUnavailable; too many requests are in flight.
+        w.Header().Set("Retry-After", "1")
+        http.Error(w, "Too many requests in flight", http.StatusServiceUnavailable)
+        return
+      }
+      defer limiter.Release()
+    }
+    next(w, r)
+  }
+}
+
+// Handler for an /admin/limits call. A GET returns the current limits and
+// load, e.g. { "limits": { ... }, "in_flight": 3, "queued": 0, ... }; a POST
+// replaces the limits with the RateLimits in its body.
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+  if r.Method == http.MethodPost || r.Method == http.MethodPut {
+    limits := &RateLimits{}
+    if err := json.NewDecoder(r.Body).Decode(limits); err != nil {
+      // Return a StatusBadRequest; the body is not RateLimits.
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    if err := s.admission.setLimits(limits); err != nil {
+      // Return a StatusBadRequest; the limits are invalid.
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    s.log(r).Info("Updated rate limits", "limits", fmt.Sprintf("%+v", *limits))
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(s.admission.status()); err != nil {
+    s.log(r).Warn("Error writing rate limits", "err", err)
+  }
+}
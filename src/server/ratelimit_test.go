@@ -0,0 +1,113 @@
+package server
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Serve a filestore with the rate limits, returning the server.
+func startRateLimitedServer(t *testing.T, limits *RateLimits) (*Server, string) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, err := MakeServerWithOptions(fs, nil, &ServerOptions{ RateLimits: limits })
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+
+  testServer := httptest.NewServer(s.Handler())
+  t.Cleanup(testServer.Close)
+  return s, testServer.URL
+}
+
+func TestRateLimitsReturnTooManyRequests(t *testing.T) {
+  _, serverUrl := startRateLimitedServer(t, &RateLimits{ RequestsPerSecond: 0.1, Burst: 2 })
+  c := client.MakeClient(serverUrl)
+  for i := 0; i < 2; i++ {
+    if err := c.Set("key", []byte("value")); err != nil {
+      t.Fatalf("Expected request %v of the burst to succeed: %v", i, err)
+    }
+  }
+
+  resp, err := http.Get(serverUrl + "/get?key=key")
+  if err != nil {
+    t.Fatalf("Error getting: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusTooManyRequests {
+    t.Errorf("Expected a 429 beyond the burst, got %v", resp.StatusCode)
+  }
+  if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "10" {
+    t.Errorf("Expected to retry after 10 seconds, got %q", retryAfter)
+  }
+
+  // Limits can be adjusted at runtime, and their endpoint is not limited.
+  resp, err = http.Post(serverUrl + "/admin/limits", "application/json",
+    strings.NewReader(`{ "requests_per_second": 1000, "burst": 1000 }`))
+  if err != nil {
+    t.Fatalf("Error setting limits: %v", err)
+  }
+  var status limitsStatus
+  json.NewDecoder(resp.Body).Decode(&status)
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusOK || status.Limits.Burst != 1000 ||
+      status.RateLimited != 1 {
+    t.Errorf("Expected the new limits and one rate limited request, got %v %+v",
+      resp.StatusCode, status)
+  }
+  if _, err := c.Get("key"); err != nil {
+    t.Errorf("Expected a request within the raised limits to succeed: %v", err)
+  }
+}
+
+func TestInFlightLimitsReturnServiceUnavailable(t *testing.T) {
+  s, serverUrl := startRateLimitedServer(t, &RateLimits{
+    MaxInFlight: 2,
+    RouteMaxInFlight: map[string]int{ "/set": 1 },
+    QueueTimeoutMs: 10,
+  })
+  c := client.MakeClient(serverUrl)
+
+  // Occupy the only /set slot, as a slow request would.
+  s.admission.routes["/set"].Acquire(0)
+  resp, err := http.Post(serverUrl + "/set", "application/json",
+    strings.NewReader(`{ "key": "key", "value": "value" }`))
+  if err != nil {
+    t.Fatalf("Error setting: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusServiceUnavailable ||
+      resp.Header.Get("Retry-After") == "" {
+    t.Errorf("Expected a 503 with Retry-After beyond the route's limit, got %v",
+      resp.StatusCode)
+  }
+  if _, err := c.Keys(""); err != nil {
+    t.Errorf("Expected other routes to be admitted: %v", err)
+  }
+  s.admission.routes["/set"].Release()
+
+  // Occupy every slot.
+  s.admission.global.Acquire(0)
+  s.admission.global.Acquire(0)
+  if _, err := c.Keys(""); err == nil {
+    t.Errorf("Expected requests beyond the global limit to fail")
+  }
+  s.admission.global.Release()
+  if err := c.Set("key", []byte("value")); err != nil {
+    t.Errorf("Expected a request within the limits to succeed: %v", err)
+  }
+}
+
+func TestRateLimitsRejectUnknownRoutes(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  _, err := MakeServerWithOptions(fs, nil, &ServerOptions{
+    RateLimits: &RateLimits{ RouteMaxInFlight: map[string]int{ "/unknown": 1 } },
+  })
+  if err == nil {
+    t.Errorf("Expected a limit on an unknown route to be rejected")
+  }
+}
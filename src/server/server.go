@@ -1,32 +1,132 @@
 package server 
 
 import(
+  "context"
+  "crypto/tls"
   "encoding/json"
+  "errors"
   "fmt"
   "io/ioutil"
-  "log"
+  "net"
   "net/http"
+  "os"
+  "strings"
   "sync"
+  "time"
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/ring"
   "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
 )
 
+const (
+  // /get response headers describing the value's attributes, if any.
+  // The expiry is formatted as RFC 3339, and the metadata as a JSON object.
+  HEADER_EXPIRES_AT = "X-Expires-At"
+  HEADER_METADATA = "X-Metadata"
+)
+
+var (
+  errAttributesUnsupported = errors.New("Store does not support attributes")
+)
+
+// The JSON body of a /set call, e.g.
+// { "key": "a key", "value": "a value", "ttl": 60, "metadata": { "a": "b" } }
+type setRequest struct {
+  Key store.Key
+  Value store.Value
+  // Optional; the number of seconds until the value expires.
+  Ttl int64
+  // Optional; arbitrary metadata stored alongside the value.
+  Metadata map[string]string
+  // Optional; only store the value if the key holds none, e.g. when a key is
+  // handed to its new owner. Returns a StatusPreconditionFailed otherwise.
+  IfAbsent bool
+}
+
+// The JSON body of a /delete call, e.g. { "key": "a key" }
+type deleteRequest struct {
+  Key store.Key
+}
+
+// A store which drops keys by itself, e.g. the FileStore evicting keys to
+// stay within its budget, and reports them so the cache can drop them too.
+type evictionNotifier interface {
+  OnEvict(fn func(key store.Key))
+}
+
 // An HTTP Server that supports GET and SET operations.
 // Create instances via the MakeServer method.
 type Server struct {
-  // The file store.
+  // The persistent store, e.g. a FileStore or a LogStore.
   filestore store.KeyValueStore 
   // An optionally enabled cache.
   cache store.KeyValueStore
   // A mutex used for serializing /set and /get calls.
   mutex *sync.Mutex
+  // In cluster mode, this server's node and the ring partitioning keys
+  // between the nodes; otherwise empty and nil.
+  clusterSelf string
+  ring *ring.Ring
+  // Signs and verifies requests forwarded between nodes; may be nil.
+  peerKey *auth.PeerKey
+  // Guards `ring`, which is replaced when the cluster is rebalanced.
+  ringMutex *sync.Mutex
+  // Streams changes made through this server to /watch calls.
+  watchHub *watchHub
+  // Whether the store reports its changes to the hub itself, including those
+  // made via other servers; see applyNotifier.
+  storeNotifies bool
+  // If set, API calls are only served over TLS.
+  tlsConfig *tls.Config
+  // If set, other nodes are reached over TLS with this config, via
+  // `peerTransport`.
+  peerTls *tls.Config
+  peerTransport http.RoundTripper
+  // If set, API calls must present a token authorized by the policy.
+  policy *auth.Policy
+  // The servers of any namespaces besides the default one, i.e. this
+  // server's; nil if there are none.
+  namespaces map[string]*Server
+  // If set, requests are admitted within its rate and in-flight limits,
+  // which are shared by every namespace.
+  admission *admission
+  // The HTTP servers serving API calls, stopped by Shutdown, and whether it
+  // was called.
+  httpServers []*http.Server
+  shutdown bool
+  // Guards `httpServers` and `shutdown`.
+  serveMutex *sync.Mutex
+  // The address Start serves on, e.g. `:8080`.
+  address string
+  // If set, the admin routes are served from this address by ServeAdmin,
+  // rather than by Handler, and optionally only to local clients.
+  adminAddress string
+  adminLocalOnly bool
+  // The config the server was made from, if any, and when it was made.
+  config *config.Config
+  startedAt time.Time
+  // Logs errors, and each request served if `accessLog` is set; may be nil.
+  logger *logging.Logger
+  accessLog bool
+  // Traces requests and store operations; may be nil.
+  tracer *tracing.Tracer
 }
 
 // Handler for a /get call. Reads a key/value pair from the underlying
 // store, and returns the value.
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+  ctx, span := s.tracer.Start(r.Context(), "Server.handleGet", tracing.KIND_INTERNAL)
+  defer span.End()
   defer s.mutex.Unlock()
   s.mutex.Lock()
 
+  // Whether the value is sent compressed depends on Accept-Encoding, so
+  // caches must key every response on it, errors included.
+  w.Header().Set("Vary", "Accept-Encoding")
+
   // Extract the query parameter `key`.
   query := r.URL.Query()
   keyQuery, ok := query["key"]
@@ -37,42 +137,195 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
   }
 
   key := keyQuery[0]
+  span.SetAttribute("key", key)
 
   // Check the cache to see if the value is present.
   if s.cache != nil {
-    if value, err := s.cache.Get(store.Key(key)); err == nil {
+    cacheCtx, cacheSpan := s.startStoreSpan(ctx, s.cache, "Get", store.Key(key))
+    value, attributes, err := getWithAttributes(cacheCtx, s.cache, store.Key(key))
+    cacheSpan.SetAttribute("cache.hit", err == nil)
+    cacheSpan.SetAttribute("value.bytes", value.SizeOfBytes())
+    // Cache lookups only fail by missing, which cache.hit records.
+    cacheSpan.End()
+    span.SetAttribute("cache.hit", err == nil)
+    if err == nil {
+      writeAttributeHeaders(w, attributes)
       fmt.Fprint(w, value)
       return
     }
   }
 
-  // Retrieve the value from the filestore.
-  value, err := s.filestore.Get(store.Key(key))
-  if err != nil {
-    fmt.Println("GET 404:", store.Key(key), "error:", err)
-    // Return a StatusNotFoundError; failure retrieving the value.
+  // Retrieve the value from the filestore, in its stored encoding if possible.
+  encoded, err := s.getEncoded(ctx, store.Key(key))
+  if s.writeAbandoned(w, r, err) {
+    return
+  } else if errors.Is(err, store.ErrReservedKey) {
+    // Return a StatusBadRequest; the key names one of the store's own files.
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  } else if errors.Is(err, store.ErrIntegrity) {
+    s.log(r).Error("Stored value failed its integrity check", "key", key, "err", err)
+    // Return a StatusInternalServerError; the stored value failed its
+    // integrity check.
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  } else if errors.Is(err, os.ErrNotExist) {
+    s.log(r).Debug("Key not found", "key", key, "err", err)
+    // Return a StatusNotFoundError; no value is stored for the key.
     w.WriteHeader(http.StatusNotFound)
     return 
+  } else if errors.Is(err, store.ErrUnavailable) {
+    s.log(r).Warn("Store unavailable", "key", key, "err", err)
+    // Return a StatusServiceUnavailable; e.g. no leader or quorum, which
+    // the client may retry.
+    w.WriteHeader(http.StatusServiceUnavailable)
+    return
+  } else if err != nil {
+    s.log(r).Error("Error retrieving value", "key", key, "err", err)
+    // Return a StatusNotFoundError; failure retrieving the value.
+    w.WriteHeader(http.StatusNotFound)
+    return
+  }
+
+  // Send the stored bytes as-is if the client accepts their encoding. The
+  // value is still decoded if it needs to be written into the cache.
+  sendEncoded := encoded.ContentEncoding() != "" &&
+    acceptsEncoding(r, encoded.ContentEncoding())
+  var value store.Value
+  if !sendEncoded || s.cache != nil {
+    if value, err = encoded.Decode(); err != nil {
+      s.log(r).Error("Error decoding stored value", "key", key, "err", err)
+      // Return a StatusInternalServerError; the stored value is corrupted.
+      w.WriteHeader(http.StatusInternalServerError)
+      return
+    }
   }
 
   // Write the value into the cache. Any errors here are non-fatal; they should
   // be logged to Telemetry. TODO: Migrate this logic off the critical path of
   // GET.
   if s.cache != nil {
-    if cacheSetErr := s.cache.Set(store.Key(key), store.Value(value)); 
+    tx := &transaction{ s: s, ctx: ctx }
+    if cacheSetErr := tx.setTraced(s.cache, store.Key(key), value, encoded.Attributes);
         cacheSetErr != nil {
-        // Log this error to telemetry.
-        fmt.Println("\tCache error:", cacheSetErr) 
+        s.log(r).Warn("Error writing to the cache", "key", key, "err", cacheSetErr)
     }
   }
 
   // Output the value back to the caller.
+  span.SetAttribute("value.bytes", len(encoded.Bytes))
+  writeAttributeHeaders(w, encoded.Attributes)
+  if sendEncoded {
+    w.Header().Set("Content-Encoding", encoded.ContentEncoding())
+    w.Write(encoded.Bytes)
+    return
+  }
   fmt.Fprint(w, value)
 }
 
+// Retrieve a value from the filestore in its stored encoding, traced as a
+// child of the span in `ctx`. Stores which do not support encodings return
+// the plain value.
+func (s *Server) getEncoded(ctx context.Context, key store.Key) (*store.EncodedValue, error) {
+  ctx, span := s.startStoreSpan(ctx, s.filestore, "Get", key)
+  encoded, err := s.getEncodedFromStore(ctx, key)
+  span.SetAttribute("found", err == nil)
+  if err == nil {
+    span.SetAttribute("value.bytes", len(encoded.Bytes))
+    span.SetAttribute("codec", encoded.ContentEncoding())
+  }
+  endStoreSpan(span, err)
+  return encoded, err
+}
+
+func (s *Server) getEncodedFromStore(
+    ctx context.Context,
+    key store.Key) (*store.EncodedValue, error) {
+  if encodedStore, ok := s.filestore.(store.EncodedKeyValueStore); ok {
+    return encodedStore.GetEncoded(ctx, key)
+  }
+
+  value, attributes, err := getWithAttributes(ctx, s.filestore, key)
+  if err != nil {
+    return nil, err
+  }
+  return &store.EncodedValue{
+    Codec: store.CODEC_NONE,
+    Bytes: []byte(value),
+    Attributes: attributes,
+  }, nil
+}
+
+// Retrieve a value and its attributes from a store. Stores which do not
+// support attributes return nil attributes.
+func getWithAttributes(
+    ctx context.Context,
+    kvStore store.KeyValueStore,
+    key store.Key) (store.Value, *store.Attributes, error) {
+  if attributeStore, ok := kvStore.(store.AttributeKeyValueStore); ok {
+    return attributeStore.GetWithAttributes(ctx, key)
+  }
+
+  value, err := kvStore.Get(ctx, key)
+  return value, nil, err
+}
+
+// Store a value and its attributes. Return an error if there are attributes
+// to store, but the store does not support them.
+func setWithAttributes(
+    ctx context.Context,
+    kvStore store.KeyValueStore,
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) error {
+  if attributes.IsEmpty() {
+    return kvStore.Set(ctx, key, value)
+  }
+
+  if attributeStore, ok := kvStore.(store.AttributeKeyValueStore); ok {
+    return attributeStore.SetWithAttributes(ctx, key, value, attributes)
+  }
+  return errAttributesUnsupported
+}
+
+/**
+ * Respond to a request whose store call was abandoned as the request's
+ * context ended, e.g. as the client disconnected or its deadline passed.
+ * Return whether it was.
+ */
+func (s *Server) writeAbandoned(w http.ResponseWriter, r *http.Request, err error) bool {
+  if err == nil || r.Context().Err() == nil ||
+      !(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+    return false
+  }
+  s.log(r).Debug("Abandoned request", "err", err)
+  // Return a StatusServiceUnavailable; the caller is most likely gone.
+  w.WriteHeader(http.StatusServiceUnavailable)
+  return true
+}
+
+// Describe the value's attributes, if any, in the response headers.
+func writeAttributeHeaders(w http.ResponseWriter, attributes *store.Attributes) {
+  if attributes.IsEmpty() {
+    return
+  }
+
+  if !attributes.ExpiresAt.IsZero() {
+    w.Header().Set(HEADER_EXPIRES_AT, attributes.ExpiresAt.UTC().Format(time.RFC3339Nano))
+  }
+
+  if len(attributes.Metadata) > 0 {
+    if metadata, err := json.Marshal(attributes.Metadata); err == nil {
+      w.Header().Set(HEADER_METADATA, string(metadata))
+    }
+  }
+}
+
 // Handler for a /set call. The HTTP Body is a JSON containing a 
 // Key/Value Pair (e.g. { "key" : "a key", "value": "an arbitrary value" })
 func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+  ctx, span := s.tracer.Start(r.Context(), "Server.handleSet", tracing.KIND_INTERNAL)
+  defer span.End()
   defer s.mutex.Unlock()
   defer r.Body.Close()
 
@@ -80,56 +333,382 @@ func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
   body, err := ioutil.ReadAll(r.Body)
   if err != nil {
     // Return a StatusInternalServerError; error reading the POST body.
-    fmt.Println("Error reading POST body:", err)
+    s.log(r).Error("Error reading POST body", "err", err)
     w.WriteHeader(http.StatusInternalServerError)
     return
   }
 
   // Unmarshal the POST Body into the key/value pair.
-  var kv store.KeyValuePair
+  var kv setRequest
   if err := json.Unmarshal(body, &kv); err != nil {
     // Return a StatusInternalServerError; error unmarshaling the POST body.
-    fmt.Printf("Error unmarshaling JSON %s, error: %v", body, err)
+    s.log(r).Warn("Error unmarshaling POST body", "body", body, "err", err)
     w.WriteHeader(http.StatusInternalServerError)
     return
   }
 
-  // Attempt to write the value to the filestore.
-  if err := s.filestore.Set(kv.Key, kv.Value); err != nil {
-    fmt.Println("Error setting in the filestore:", err)
+  span.SetAttribute("key", string(kv.Key))
+  span.SetAttribute("value.bytes", kv.Value.SizeOfBytes())
+  if kv.Ttl < 0 {
+    // Return a StatusBadRequest; the TTL is malformed.
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  attributes := &store.Attributes{ Metadata: kv.Metadata }
+  if kv.Ttl > 0 {
+    attributes.ExpiresAt = time.Now().Add(time.Duration(kv.Ttl) * time.Second)
+  }
+
+  tx := &transaction{ s: s, ctx: ctx }
+  if kv.IfAbsent {
+    if _, _, err := tx.Get(kv.Key); err == nil {
+      // Return a StatusPreconditionFailed; the key already holds a value.
+      w.WriteHeader(http.StatusPreconditionFailed)
+      return
+    } else if s.writeAbandoned(w, r, err) {
+      return
+    } else if !errors.Is(err, os.ErrNotExist) {
+      s.log(r).Error("Error checking for an existing value", "key", kv.Key, "err", err)
+      w.WriteHeader(http.StatusInternalServerError)
+      return
+    }
+  }
+
+  // Attempt to write the value to the filestore, and then the cache.
+  if err := tx.Set(kv.Key, kv.Value, attributes); s.writeAbandoned(w, r, err) {
+    return
+  } else if errors.Is(err, errAttributesUnsupported) {
+    // Return a StatusNotImplemented; the store cannot hold a TTL or metadata.
+    w.WriteHeader(http.StatusNotImplemented)
+    return
+  } else if errors.Is(err, store.ErrReservedKey) {
+    // Return a StatusBadRequest; the key names one of the store's own files.
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  } else if errors.Is(err, store.ErrQuotaExceeded) {
+    // Return a StatusInsufficientStorage; the namespace is at its quota.
+    s.log(r).Warn("Refused set", "key", kv.Key, "err", err)
+    w.WriteHeader(http.StatusInsufficientStorage)
+    return
+  } else if err != nil {
+    s.log(r).Error("Error setting in the filestore", "key", kv.Key, "err", err)
     // Failure writing to fliestore; return a 500.
     w.WriteHeader(http.StatusInternalServerError)
     return
   } 
-  
-  // Maintain consistency between the cache and the filestore.
-  // Any errors thrown here are non-fatal; they should be logged to telemetry.
-  if s.cache != nil {  
-    if err := s.cache.Set(kv.Key, kv.Value); err != nil {
-      // Log a caching failure to telemetry.
-      fmt.Println("\tCache Set error:", err)
+}
+
+// Handler for a /delete call. Removes the key from the store and the cache.
+// Deleting a missing key succeeds.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+  defer s.mutex.Unlock()
+  defer r.Body.Close()
+
+  s.mutex.Lock()
+  var request deleteRequest
+  if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Key == "" {
+    // Return a StatusBadRequest; the POST body is malformed.
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  }
+
+  if err := (&transaction{ s: s, ctx: r.Context() }).Delete(request.Key);
+      s.writeAbandoned(w, r, err) {
+    return
+  } else if errors.Is(err, errDeleteUnsupported) {
+    // Return a StatusNotImplemented; the store cannot delete keys.
+    w.WriteHeader(http.StatusNotImplemented)
+    return
+  } else if errors.Is(err, store.ErrReservedKey) {
+    // Return a StatusBadRequest; the key names one of the store's own files.
+    w.WriteHeader(http.StatusBadRequest)
+    return
+  } else if err != nil {
+    s.log(r).Error("Error deleting from the filestore", "key", request.Key, "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+}
+
+// Handler for a /keys call. Returns a JSON object listing every key which
+// begins with the optional `prefix` query parameter, in sorted order, e.g.
+// { "keys": [ "a key", "another key" ] }
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+  keys, err := s.Keys(r.Context(), r.URL.Query().Get("prefix"))
+  if s.writeAbandoned(w, r, err) {
+    return
+  } else if errors.Is(err, errKeysUnsupported) {
+    // Return a StatusNotImplemented; the store cannot list its keys.
+    w.WriteHeader(http.StatusNotImplemented)
+    return
+  } else if err != nil {
+    s.log(r).Error("Error listing keys", "err", err)
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  response := struct {
+    Keys []store.Key `json:"keys"`
+  }{ Keys: keys }
+
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(response); err != nil {
+    s.log(r).Warn("Error encoding keys", "err", err)
+  }
+}
+
+// Handler for a /metrics call. Returns a JSON object holding the statistics
+// of each store, e.g. { "filestore": { "size_bytes": 1024, ... }, ... }
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+  metrics := s.Stats()
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(metrics); err != nil {
+    s.log(r).Warn("Error encoding metrics", "err", err)
+  }
+}
+
+// Handler for an /admin/snapshot call. Streams a tar archive holding a
+// point-in-time snapshot of the filestore; see `store.FileStore.Snapshot`.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+  snapshotter, ok := s.filestore.(store.Snapshotter)
+  if !ok {
+    // Return a StatusNotImplemented; the store cannot be snapshotted.
+    w.WriteHeader(http.StatusNotImplemented)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/x-tar")
+  if err := snapshotter.Snapshot(w); err != nil {
+    // The status has already been sent; the truncated archive fails
+    // verification on restore.
+    s.log(r).Error("Error writing snapshot", "err", err)
+  }
+}
+
+// Return whether the request's Accept-Encoding header lists `encoding`,
+// e.g. `Accept-Encoding: gzip, deflate`.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+  for _, header := range r.Header.Values("Accept-Encoding") {
+    for _, accepted := range strings.Split(header, ",") {
+      // Ignore any quality value, e.g. `gzip;q=0.5`.
+      name := strings.TrimSpace(strings.Split(accepted, ";")[0])
+      if strings.EqualFold(name, encoding) {
+        return true
+      }
     }
   }
+  return false
+}
+
+// A store which serves routes to its peers, e.g. a replicated store.
+type replicaHandlerProvider interface {
+  /**
+   * Return the handler for the routes beneath `/replica/`.
+   */
+  ReplicaHandler() http.Handler
 }
 
-// Start the server. Initializes any in-memory state, then begins
-// accepting API calls.
-func (s *Server) Start() {
-  http.HandleFunc("/get", s.handleGet)
-  http.HandleFunc("/set", s.handleSet)
+// A store with a single leader which must serve every request, e.g. a Raft
+// store. Requests reaching another node are forwarded to the leader.
+type leaderProvider interface {
+  IsLeader() bool
+  // Return the leader's address, e.g. `localhost:8081`, or "" if unknown.
+  Leader() string
+}
 
-  if err := http.ListenAndServe(":8080", nil); err != nil {
-    log.Fatal(err)
+// Return the handler serving every API route, in every namespace.
+func (s *Server) Handler() http.Handler {
+  withAdmin := s.adminAddress == ""
+  mux := s.apiHandler(withAdmin)
+  s.addProbeRoutes(mux)
+  if withAdmin {
+    s.addServerAdminRoutes(mux)
+  }
+  return s.withRequestLogging(s.withTracing(s.withNamespaces(mux,
+    func(namespace *Server) http.Handler {
+      return namespace.apiHandler(withAdmin)
+    })))
+}
+
+/**
+ * Route requests to the default namespace's handler, i.e. `mux`, or to
+ * another namespace's, made by `handler`; see routeToNamespace.
+ */
+func (s *Server) withNamespaces(
+    mux *http.ServeMux,
+    handler func(namespace *Server) http.Handler) http.Handler {
+  if s.namespaces == nil {
+    return mux
+  }
+  handlers := map[string]http.Handler{ DEFAULT_NAMESPACE: mux }
+  for name, namespace := range s.namespaces {
+    handlers[name] = handler(namespace)
   }
+  return s.routeToNamespace(handlers)
 }
 
-// Make a Server, providing some configuration parameters.
-func MakeServer(fs *store.FileStore, cache *store.Cache) *Server {
+// Return the handler serving every API route of this server's namespace.
+func (s *Server) apiHandler(withAdmin bool) *http.ServeMux {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/get", s.admit("/get", true,
+    s.authorize(auth.PERMISSION_READ, getRequestKey,
+      s.routeToLeader(s.routeToOwner(s.handleGet, getRequestKey)))))
+  mux.HandleFunc("/set", s.admit("/set", true,
+    s.authorize(auth.PERMISSION_WRITE, setRequestKey,
+      s.routeToLeader(s.routeToOwner(s.handleSet, setRequestKey)))))
+  mux.HandleFunc("/delete", s.admit("/delete", true,
+    s.authorize(auth.PERMISSION_WRITE, setRequestKey,
+      s.routeToLeader(s.routeToOwner(s.handleDelete, setRequestKey)))))
+  mux.HandleFunc("/keys", s.admit("/keys", true,
+    s.authorize(auth.PERMISSION_READ, prefixRequestKey,
+      s.routeToLeader(s.handleKeys))))
+  // Streams last as long as their clients, so hold no in-flight slot.
+  mux.HandleFunc("/watch", s.admit("/watch", false,
+    s.authorize(auth.PERMISSION_READ, prefixRequestKey,
+      s.routeToLeader(s.handleWatch))))
+  if withAdmin {
+    s.addAdminRoutes(mux)
+  }
+  // Part of the cluster protocol, so served beside the API calls.
+  mux.HandleFunc("/admin/rebalance", s.admit("/admin/rebalance", true,
+    s.authorize(auth.PERMISSION_ADMIN, adminRequestKey, s.handleRebalance)))
+  if provider, ok := s.filestore.(replicaHandlerProvider); ok {
+    mux.HandleFunc("/replica/", s.authorizePeer(provider.ReplicaHandler().ServeHTTP))
+  }
+  return mux
+}
+
+// Start the server on its configured address, by default `:8080`, and any
+// admin address. Initializes any in-memory state, then begins accepting API
+// calls. Returns nil once the server is shut down, or the error which stopped
+// it.
+func (s *Server) Start() error {
+  if s.adminAddress != "" {
+    listener, err := net.Listen("tcp", s.adminAddress)
+    if err != nil {
+      return err
+    }
+    go func() {
+      if err := s.ServeAdmin(listener); err != nil && err != http.ErrServerClosed {
+        s.logger.Error("Admin listener failed", "address", s.adminAddress, "err", err)
+      }
+    }()
+  }
+  return s.ListenAndServe(s.address)
+}
+
+// Start the server on `address`, e.g. `:8081`. Returns nil once the server is
+// shut down, or the error which stopped it.
+func (s *Server) ListenAndServe(address string) error {
+  listener, err := net.Listen("tcp", address)
+  if err != nil {
+    return err
+  }
+  if err := s.Serve(listener); err != http.ErrServerClosed {
+    return err
+  }
+  return nil
+}
+
+// Make a Server of the given store and optional cache, e.g. in tests. Use
+// MakeServer to make one from a config.
+func MakeServerWithStores(fs store.KeyValueStore, cache *store.Cache) *Server {
+  server, _ := MakeServerWithOptions(fs, cache, nil)
+  return server
+}
+
+// Make a Server with optional behaviour, e.g. cluster mode. `options` may be
+// nil.
+func MakeServerWithOptions(
+    fs store.KeyValueStore,
+    cache *store.Cache,
+    options *ServerOptions) (*Server, error) {
   server := &Server {}  
   server.filestore = fs
   if cache != nil {
     server.cache = cache
   }
   server.mutex = &sync.Mutex{}
-  return server
+  server.ringMutex = &sync.Mutex{}
+  server.watchHub = makeWatchHub()
+  if notifier, ok := fs.(applyNotifier); ok {
+    notifier.OnApply(server.watchHub.publishApplied)
+    server.storeNotifies = true
+  }
+  if notifier, ok := fs.(evictionNotifier); ok && cache != nil {
+    // Otherwise the cache would keep serving keys the store dropped.
+    notifier.OnEvict(func(key store.Key) {
+      cache.Delete(context.Background(), key)
+    })
+  }
+  server.serveMutex = &sync.Mutex{}
+  server.address = config.DEFAULT_ADDRESS
+  if options != nil && options.Address != "" {
+    server.address = options.Address
+  }
+  server.startedAt = time.Now()
+  if options != nil {
+    server.adminAddress = options.AdminAddress
+    server.adminLocalOnly = options.AdminLocalOnly
+    server.config = options.Config
+    server.logger = options.Logger
+    server.accessLog = options.AccessLog
+    server.tracer = options.Tracer
+  }
+
+  if options != nil && len(options.ClusterNodes) > 0 {
+    keyRing, err := ring.MakeRing(options.ClusterNodes, 0)
+    if err != nil {
+      return nil, err
+    }
+    if !keyRing.Contains(options.ClusterSelf) {
+      return nil, errors.New(fmt.Sprintf("This server, %v, is not a cluster node: %v",
+        options.ClusterSelf, options.ClusterNodes))
+    }
+    server.clusterSelf = options.ClusterSelf
+    server.ring = keyRing
+  }
+
+  if options != nil {
+    server.policy = options.Auth
+    server.peerKey = options.PeerKey
+  }
+
+  if options != nil && options.Tls != nil {
+    tlsConfig, err := loadTlsConfig(options.Tls, server.logger)
+    if err != nil {
+      return nil, err
+    }
+    server.tlsConfig = tlsConfig
+  }
+
+  server.peerTransport = http.DefaultTransport
+  if options != nil && options.PeerTls != nil {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = options.PeerTls
+    server.peerTls = options.PeerTls
+    server.peerTransport = transport
+  }
+
+  if options != nil && options.RateLimits != nil {
+    admission, err := makeAdmission(options.RateLimits)
+    if err != nil {
+      return nil, err
+    }
+    server.admission = admission
+  }
+
+  if options != nil && options.Namespaces != nil {
+    namespaces, err := makeNamespaces(options.Namespaces, server.policy, server.logger,
+      server.tracer)
+    if err != nil {
+      return nil, err
+    }
+    for _, namespace := range namespaces {
+      namespace.admission = server.admission
+    }
+    server.namespaces = namespaces
+  }
+  return server, nil
 }
@@ -2,14 +2,22 @@ package server
 
 import (
   "bytes"
+  "compress/gzip"
+  "context"
   "errors"
   "encoding/json"
   "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
   "sync"
   "testing"
+  "time"
   "net/http"
   "net/http/httptest"
   
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/raft"
   "buildbuddy.takehome.com/src/store"
 )
 
@@ -130,6 +138,32 @@ func TestGetReportsFilestoreFailure(t *testing.T) {
   }
 }
 
+func TestGetMapsStoreErrorsToStatuses(t *testing.T) {
+  cases := []struct {
+    err error
+    status int
+  }{
+    { fmt.Errorf("%w: key key not found", os.ErrNotExist), http.StatusNotFound },
+    { &raft.NotLeaderError{ Leader: "localhost:8081" }, http.StatusServiceUnavailable },
+    { raft.ErrTimeout, http.StatusServiceUnavailable },
+    { raft.ErrStopped, http.StatusServiceUnavailable },
+    { fmt.Errorf("%w: Read quorum not reached", store.ErrUnavailable), http.StatusServiceUnavailable },
+    // Other read failures are reported as misses, as they always were.
+    { errors.New("Disk on fire"), http.StatusNotFound },
+  }
+  for _, c := range cases {
+    fs := &store.FakeKeyValueStore{}
+    s := MakeServerWithStores(fs, nil)
+    fs.SetNextGet("", c.err)
+    req := httptest.NewRequest("GET", "/get?key=key", nil)
+    w := httptest.NewRecorder()
+    s.handleGet(w, req)
+    if w.Code != c.status {
+      t.Errorf("Expected http %v for %q, received %v", c.status, c.err, w.Code)
+    }
+  }
+}
+
 func TestGetSynchronizesFilestoreAndCache(t *testing.T) {
   fs := &store.FakeKeyValueStore{}
   c := &store.FakeKeyValueStore{}
@@ -243,3 +277,424 @@ cache.SetCalls[0].Value != store.Value("a value") {
 w.Result().StatusCode)
   }
 }
+
+func TestGetSendsCompressedBytesWhenAccepted(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(),
+    &store.FileStoreOptions{ EnableCompression: true })
+  s := &Server {
+    filestore: fs,
+    cache: nil,
+    mutex: &sync.Mutex{},
+  }
+
+  value := strings.Repeat("compressible ", 100)
+  fs.Set(ctx, store.Key("key"), store.Value(value))
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/get?key=key", nil)
+  req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+  w := httptest.NewRecorder()
+  s.handleGet(w, req)
+
+  if w.Result().Header.Get("Content-Encoding") != "gzip" {
+    t.Errorf("Expected a gzip Content-Encoding")
+  }
+  if w.Result().Header.Get("Vary") != "Accept-Encoding" {
+    t.Errorf("Expected a Vary: Accept-Encoding header")
+  }
+
+  reader, err := gzip.NewReader(w.Body)
+  if err != nil {
+    t.Fatalf("Expected a gzip body: %v", err)
+  }
+  if body, _ := ioutil.ReadAll(reader); string(body) != value {
+    t.Errorf("Expected the gzip body to decompress to %v", value)
+  }
+}
+
+func TestReservedKeysReturn400(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  key := store.TEMP_DIRECTORY_NAME
+
+  for name, handle := range map[string]func() *httptest.ResponseRecorder{
+    "set": func() *httptest.ResponseRecorder {
+      req := httptest.NewRequest("POST", "http://localhost:8080/set",
+        strings.NewReader(`{ "key": "` + key + `", "value": "value" }`))
+      w := httptest.NewRecorder()
+      s.handleSet(w, req)
+      return w
+    },
+    "get": func() *httptest.ResponseRecorder {
+      req := httptest.NewRequest("GET", "http://localhost:8080/get?key=" + key, nil)
+      w := httptest.NewRecorder()
+      s.handleGet(w, req)
+      return w
+    },
+    "delete": func() *httptest.ResponseRecorder {
+      req := httptest.NewRequest("POST", "http://localhost:8080/delete",
+        strings.NewReader(`{ "key": "` + key + `" }`))
+      w := httptest.NewRecorder()
+      s.handleDelete(w, req)
+      return w
+    },
+  } {
+    if w := handle(); w.Result().StatusCode != http.StatusBadRequest {
+      t.Errorf("Expected %v to return http %v, received %v", name,
+        http.StatusBadRequest, w.Result().StatusCode)
+    }
+  }
+}
+
+func TestEveryGetResponseVariesOnAcceptEncoding(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  cache, _ := store.MakeCache(50)
+  s := MakeServerWithStores(fs, cache)
+  cache.Set(ctx, store.Key("cached"), store.Value("value"))
+
+  for _, url := range []string{ "/get?key=cached", "/get?key=missing", "/get" } {
+    req := httptest.NewRequest("GET", "http://localhost:8080" + url, nil)
+    w := httptest.NewRecorder()
+    s.handleGet(w, req)
+    if w.Result().Header.Get("Vary") != "Accept-Encoding" {
+      t.Errorf("Expected %v (http %v) to vary on Accept-Encoding", url, w.Result().StatusCode)
+    }
+  }
+}
+
+func TestGetDecompressesWhenEncodingNotAccepted(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(),
+    &store.FileStoreOptions{ EnableCompression: true })
+  s := &Server {
+    filestore: fs,
+    cache: nil,
+    mutex: &sync.Mutex{},
+  }
+
+  value := strings.Repeat("compressible ", 100)
+  fs.Set(ctx, store.Key("key"), store.Value(value))
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/get?key=key", nil)
+  w := httptest.NewRecorder()
+  s.handleGet(w, req)
+
+  if w.Result().Header.Get("Content-Encoding") != "" {
+    t.Errorf("Expected no Content-Encoding")
+  }
+  if w.Result().Header.Get("Vary") != "Accept-Encoding" {
+    t.Errorf("Expected a Vary: Accept-Encoding header")
+  }
+
+  if string(w.Body.Bytes()) != value {
+    t.Errorf("Expected %v, received %v", value, string(w.Body.Bytes()))
+  }
+}
+
+func TestMetricsReportsStoreStats(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  cache, _ := store.MakeCache(50)
+  s := MakeServerWithStores(fs, cache)
+
+  fs.Set(ctx, store.Key("key"), store.Value("value"))
+  cache.Get(ctx, store.Key("key"))
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/metrics", nil)
+  w := httptest.NewRecorder()
+  s.handleMetrics(w, req)
+
+  var metrics map[string]map[string]int64
+  if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+    t.Fatalf("Error unmarshaling metrics: %v", err)
+  }
+
+  if metrics["filestore"]["file_count"] != 1 {
+    t.Errorf("Expected 1 file in the filestore metrics, got %v", metrics)
+  }
+
+  if metrics["cache"]["misses"] != 1 {
+    t.Errorf("Expected 1 cache miss in the metrics, got %v", metrics)
+  }
+}
+
+func TestSnapshotStreamsFilestoreArchive(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  fs.Set(ctx, store.Key("key"), store.Value("value"))
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/admin/snapshot", nil)
+  w := httptest.NewRecorder()
+  s.handleSnapshot(w, req)
+
+  if w.Result().StatusCode != http.StatusOK {
+    t.Fatalf("Expected http %v, received %v", http.StatusOK, w.Result().StatusCode)
+  }
+
+  if _, err := store.RestoreSnapshot(w.Body, t.TempDir()); err != nil {
+    t.Errorf("Error restoring the streamed snapshot: %v", err)
+  }
+}
+
+func TestSnapshotUnsupportedStoreReturns501(t *testing.T) {
+  s := MakeServerWithStores(&store.FakeKeyValueStore{}, nil)
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/admin/snapshot", nil)
+  w := httptest.NewRecorder()
+  s.handleSnapshot(w, req)
+
+  if w.Result().StatusCode != http.StatusNotImplemented {
+    t.Errorf("Expected http %v, received %v", http.StatusNotImplemented,
+w.Result().StatusCode)
+  }
+}
+
+func TestSetStoresTtlAndMetadata(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  cache, _ := store.MakeCache(50)
+  s := MakeServerWithStores(fs, cache)
+
+  body := `{"key":"key","value":"value","ttl":60,"metadata":{"tool":"bazel"}}`
+  req := httptest.NewRequest("POST", "http://localhost:8080/set",
+    strings.NewReader(body))
+  w := httptest.NewRecorder()
+  s.handleSet(w, req)
+  if w.Result().StatusCode != http.StatusOK {
+    t.Fatalf("Expected http %v, received %v", http.StatusOK, w.Result().StatusCode)
+  }
+
+  _, attributes, err := fs.GetWithAttributes(ctx, store.Key("key"))
+  if err != nil || attributes.Metadata["tool"] != "bazel" ||
+      time.Until(attributes.ExpiresAt) > time.Minute ||
+      time.Until(attributes.ExpiresAt) < 50 * time.Second {
+    t.Errorf("Expected a 60s TTL and metadata, got %v (%v)", attributes, err)
+  }
+
+  // Both the cache hit and, with an emptied cache, the filestore read
+  // describe the attributes.
+  for i := 0; i < 2; i++ {
+    req = httptest.NewRequest("GET", "http://localhost:8080/get?key=key", nil)
+    w = httptest.NewRecorder()
+    s.handleGet(w, req)
+
+    if w.Result().Header.Get(HEADER_METADATA) != `{"tool":"bazel"}` {
+      t.Errorf("Expected a metadata header, got %v", w.Result().Header)
+    }
+    expiresAt, err := time.Parse(time.RFC3339Nano,
+      w.Result().Header.Get(HEADER_EXPIRES_AT))
+    if err != nil || !expiresAt.Equal(attributes.ExpiresAt) {
+      t.Errorf("Expected expiry %v, got %v", attributes.ExpiresAt, expiresAt)
+    }
+    cache, _ = store.MakeCache(50)
+    s.cache = cache
+  }
+}
+
+func TestSetRejectsNegativeTtl(t *testing.T) {
+  fs := &store.FakeKeyValueStore{}
+  s := MakeServerWithStores(fs, nil)
+
+  req := httptest.NewRequest("POST", "http://localhost:8080/set",
+    strings.NewReader(`{"key":"key","value":"value","ttl":-1}`))
+  w := httptest.NewRecorder()
+  s.handleSet(w, req)
+
+  if w.Result().StatusCode != http.StatusBadRequest || len(fs.SetCalls) != 0 {
+    t.Errorf("Expected http %v, received %v", http.StatusBadRequest,
+w.Result().StatusCode)
+  }
+}
+
+func TestSetAttributesUnsupportedStoreReturns501(t *testing.T) {
+  fs := &store.FakeKeyValueStore{}
+  s := MakeServerWithStores(fs, nil)
+
+  req := httptest.NewRequest("POST", "http://localhost:8080/set",
+    strings.NewReader(`{"key":"key","value":"value","ttl":60}`))
+  w := httptest.NewRecorder()
+  s.handleSet(w, req)
+
+  if w.Result().StatusCode != http.StatusNotImplemented {
+    t.Errorf("Expected http %v, received %v", http.StatusNotImplemented,
+w.Result().StatusCode)
+  }
+}
+
+func TestKeysListsKeysWithPrefix(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  fs.Set(ctx, store.Key("b-2"), store.Value("value"))
+  fs.Set(ctx, store.Key("a"), store.Value("value"))
+  fs.Set(ctx, store.Key("b-1"), store.Value("value"))
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/keys?prefix=b-", nil)
+  w := httptest.NewRecorder()
+  s.handleKeys(w, req)
+
+  if body := strings.TrimSpace(w.Body.String()); body != `{"keys":["b-1","b-2"]}` {
+    t.Errorf("Expected the keys with prefix b-, received %v", body)
+  }
+}
+
+func TestKeysUnsupportedStoreReturns501(t *testing.T) {
+  s := MakeServerWithStores(&store.FakeKeyValueStore{}, nil)
+
+  req := httptest.NewRequest("GET", "http://localhost:8080/keys", nil)
+  w := httptest.NewRecorder()
+  s.handleKeys(w, req)
+
+  if w.Result().StatusCode != http.StatusNotImplemented {
+    t.Errorf("Expected http %v, received %v", http.StatusNotImplemented,
+w.Result().StatusCode)
+  }
+}
+
+func TestDeleteRemovesKeyFromStoreAndCache(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  cache, _ := store.MakeCache(50)
+  s := MakeServerWithStores(fs, cache)
+  fs.Set(ctx, store.Key("key"), store.Value("value"))
+  cache.Set(ctx, store.Key("key"), store.Value("value"))
+
+  req := httptest.NewRequest("POST", "http://localhost:8080/delete",
+    strings.NewReader(`{"key":"key"}`))
+  w := httptest.NewRecorder()
+  s.handleDelete(w, req)
+
+  if w.Result().StatusCode != http.StatusOK {
+    t.Fatalf("Expected http %v, received %v", http.StatusOK, w.Result().StatusCode)
+  }
+  if _, err := fs.Get(ctx, store.Key("key")); err == nil {
+    t.Errorf("Expected the key to be deleted from the filestore")
+  }
+  if _, err := cache.Get(ctx, store.Key("key")); err == nil {
+    t.Errorf("Expected the key to be deleted from the cache")
+  }
+}
+
+func TestEvictedKeysAreDroppedFromTheCache(t *testing.T) {
+  ctx := context.Background()
+  fs, _ := store.MakeFileStore(t.TempDir(), &store.FileStoreOptions{ MaxFiles: 1 })
+  cache, _ := store.MakeCache(50)
+  s := MakeServerWithStores(fs, cache)
+
+  for _, body := range []string{ `{"key":"key","value":"value"}`, `{"key":"key2","value":"value"}` } {
+    req := httptest.NewRequest("POST", "http://localhost:8080/set", strings.NewReader(body))
+    w := httptest.NewRecorder()
+    s.handleSet(w, req)
+    if w.Result().StatusCode != http.StatusOK {
+      t.Fatalf("Expected http %v, received %v", http.StatusOK, w.Result().StatusCode)
+    }
+  }
+
+  if _, err := cache.Get(ctx, store.Key("key")); err == nil {
+    t.Errorf("Expected the evicted key to be deleted from the cache")
+  }
+  req := httptest.NewRequest("GET", "http://localhost:8080/get?key=key", nil)
+  w := httptest.NewRecorder()
+  s.handleGet(w, req)
+  if w.Result().StatusCode != http.StatusNotFound {
+    t.Errorf("Expected http %v, received %v", http.StatusNotFound, w.Result().StatusCode)
+  }
+}
+
+func TestDeleteUnsupportedStoreReturns501(t *testing.T) {
+  s := MakeServerWithStores(&store.FakeKeyValueStore{}, nil)
+
+  req := httptest.NewRequest("POST", "http://localhost:8080/delete",
+    strings.NewReader(`{"key":"key"}`))
+  w := httptest.NewRecorder()
+  s.handleDelete(w, req)
+
+  if w.Result().StatusCode != http.StatusNotImplemented {
+    t.Errorf("Expected http %v, received %v", http.StatusNotImplemented,
+w.Result().StatusCode)
+  }
+}
+
+func TestCancelledRequestsAbandonStoreCalls(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  req := httptest.NewRequest("POST", "http://localhost:8080/set",
+    strings.NewReader(`{"key":"key","value":"value"}`)).WithContext(ctx)
+  w := httptest.NewRecorder()
+  s.handleSet(w, req)
+
+  if w.Result().StatusCode != http.StatusServiceUnavailable {
+    t.Errorf("Expected http %v, received %v", http.StatusServiceUnavailable,
+      w.Result().StatusCode)
+  }
+  if _, err := fs.Get(context.Background(), store.Key("key")); err == nil {
+    t.Errorf("Expected the cancelled set not to be stored")
+  }
+
+  fs.Set(context.Background(), store.Key("key"), store.Value("value"))
+  for _, req := range []*http.Request{
+    httptest.NewRequest("POST", "/delete", strings.NewReader(`{"key":"key"}`)),
+    httptest.NewRequest("GET", "/keys", nil),
+  } {
+    w := httptest.NewRecorder()
+    s.Handler().ServeHTTP(w, req.WithContext(ctx))
+    if w.Code != http.StatusServiceUnavailable {
+      t.Errorf("Expected http %v for %v, received %v", http.StatusServiceUnavailable,
+        req.URL.Path, w.Code)
+    }
+  }
+  if _, err := fs.Get(context.Background(), store.Key("key")); err != nil {
+    t.Errorf("Expected the cancelled delete to leave the key, got %v", err)
+  }
+}
+
+func TestClientCallsFailPastTheirDeadline(t *testing.T) {
+  // A server which answers only once the client gives up.
+  release := make(chan struct{})
+  testServer := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      select {
+      case <-r.Context().Done():
+      case <-release:
+      }
+    }))
+  defer testServer.Close()
+  defer close(release)
+
+  c, _ := client.MakeClientWithOptions(testServer.URL,
+    &client.ClientOptions{ Timeout: 50 * time.Millisecond })
+  if err := c.Set("key", []byte("value")); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Expected the set to time out, got %v", err)
+  }
+
+  // A per-call deadline applies even without a client timeout.
+  ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+  defer cancel()
+  if _, err := client.MakeClient(testServer.URL).GetContext(ctx, "key");
+      !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Expected the get to time out, got %v", err)
+  }
+
+  // As do listings, snapshots and rebalances.
+  cancelled, cancel := context.WithCancel(context.Background())
+  cancel()
+  if _, err := client.MakeClient(testServer.URL).KeysContext(cancelled, "");
+      !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected the listing to be abandoned, got %v", err)
+  }
+  if err := client.MakeClient(testServer.URL).SnapshotContext(cancelled, ioutil.Discard);
+      !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected the snapshot to be abandoned, got %v", err)
+  }
+  node := strings.TrimPrefix(testServer.URL, "http://")
+  cluster, _ := client.MakeClusterClient([]string{ node }, nil)
+  if _, err := cluster.RebalanceContext(cancelled, []string{ node });
+      !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected the rebalance to be abandoned, got %v", err)
+  }
+}
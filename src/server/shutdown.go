@@ -0,0 +1,85 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+)
+
+/**
+ * Register an HTTP server, so that Shutdown stops it. Returns false if the
+ * server is already shut down, in which case it must not serve.
+ */
+func (s *Server) track(httpServer *http.Server) bool {
+  defer s.serveMutex.Unlock()
+  s.serveMutex.Lock()
+
+  if s.shutdown {
+    return false
+  }
+  s.httpServers = append(s.httpServers, httpServer)
+  return true
+}
+
+// Disconnect every /watch stream, in every namespace, so that they do not
+// hold a shutdown open until its deadline.
+func (s *Server) closeWatches() {
+  s.watchHub.close()
+  for _, namespace := range s.namespaces {
+    namespace.watchHub.close()
+  }
+}
+
+/**
+ * Shut the server down gracefully: stop accepting connections, wait for API
+ * calls in flight to finish, then flush and close the store and cache of
+ * every namespace. If `ctx` expires first, the remaining calls are cut off,
+ * the stores are still closed, and the context's error is returned.
+ *
+ * <p> Frontends sharing the server's stores, e.g. RESP, must be closed first.
+ */
+func (s *Server) Shutdown(ctx context.Context) error {
+  s.serveMutex.Lock()
+  s.shutdown = true
+  httpServers := s.httpServers
+  s.serveMutex.Unlock()
+
+  var firstErr error
+  for _, httpServer := range httpServers {
+    if err := httpServer.Shutdown(ctx); err != nil {
+      s.logger.Warn("Cutting off API calls still in flight", "err", err)
+      httpServer.Close()
+      if firstErr == nil {
+        firstErr = err
+      }
+    }
+  }
+  // Streams served by other means, e.g. Handler() in a test server.
+  s.closeWatches()
+
+  if err := s.closeStores(); err != nil && firstErr == nil {
+    firstErr = err
+  }
+  return firstErr
+}
+
+// Close the cache and store of this server and its namespaces, once no API
+// call holds the mutex.
+func (s *Server) closeStores() error {
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+
+  var firstErr error
+  if s.cache != nil {
+    firstErr = s.cache.Close()
+  }
+  if err := s.filestore.Close(); err != nil && firstErr == nil {
+    firstErr = err
+  }
+  for name, namespace := range s.namespaces {
+    if err := namespace.closeStores(); err != nil && firstErr == nil {
+      firstErr = fmt.Errorf("Error closing namespace %v: %w", name, err)
+    }
+  }
+  return firstErr
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "testing"
+  "time"
+
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Serve the store on a local port, returning the server's URL and a channel
+// receiving Serve's result.
+func serveForShutdown(t *testing.T, s *Server) (string, <-chan error) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  served := make(chan error, 1)
+  go func() { served <- s.Serve(listener) }()
+  return "http://" + listener.Addr().String(), served
+}
+
+// Wait until `count` API calls are in flight.
+func waitForInFlight(s *Server, count int) {
+  for {
+    if inFlight, _ := s.admission.global.Load(); inFlight == count {
+      return
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestShutdownDrainsCallsInFlight(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  fs, _ := store.MakeFileStore(directory, nil)
+  s, _ := MakeServerWithOptions(fs, nil, &ServerOptions{
+    RateLimits: &RateLimits{ MaxInFlight: 10 },
+  })
+  serverUrl, served := serveForShutdown(t, s)
+  c := client.MakeClient(serverUrl)
+
+  // Hold the mutex, so that a /set stays in flight.
+  s.mutex.Lock()
+  setResult := make(chan error, 1)
+  go func() { setResult <- c.Set("key", []byte("value")) }()
+  waitForInFlight(s, 1)
+
+  shutdownResult := make(chan error, 1)
+  go func() { shutdownResult <- s.Shutdown(context.Background()) }()
+  select {
+  case err := <-shutdownResult:
+    t.Fatalf("Expected shutdown to wait for the /set, got %v", err)
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  s.mutex.Unlock()
+  if err := <-setResult; err != nil {
+    t.Errorf("Expected the /set in flight to finish: %v", err)
+  }
+  if err := <-shutdownResult; err != nil {
+    t.Errorf("Expected a clean shutdown: %v", err)
+  }
+  if err := <-served; err != http.ErrServerClosed {
+    t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+  }
+
+  if _, err := c.Get("key"); err == nil {
+    t.Errorf("Expected no further calls to be accepted")
+  }
+  reopened, _ := store.MakeFileStore(directory, nil)
+  if value, err := reopened.Get(ctx, "key"); err != nil || value != "value" {
+    t.Errorf("Expected the drained /set to be stored, got %v (%v)", value, err)
+  }
+}
+
+func TestShutdownCutsOffCallsAtDeadline(t *testing.T) {
+  fs := &store.FakeKeyValueStore{}
+  s, _ := MakeServerWithOptions(fs, nil, &ServerOptions{
+    RateLimits: &RateLimits{ MaxInFlight: 10 },
+  })
+  serverUrl, _ := serveForShutdown(t, s)
+
+  s.mutex.Lock()
+  go client.MakeClient(serverUrl).Get("key")
+  waitForInFlight(s, 1)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  shutdownResult := make(chan error, 1)
+  go func() { shutdownResult <- s.Shutdown(ctx) }()
+  <-ctx.Done()
+  s.mutex.Unlock()
+
+  if err := <-shutdownResult; !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Expected the deadline to be exceeded, got %v", err)
+  }
+  if !fs.Closed {
+    t.Errorf("Expected the store to be closed regardless")
+  }
+}
+
+func TestShutdownDisconnectsWatches(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  serverUrl, _ := serveForShutdown(t, s)
+
+  resp, err := http.Get(serverUrl + "/watch")
+  if err != nil {
+    t.Fatalf("Error watching: %v", err)
+  }
+  defer resp.Body.Close()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+  defer cancel()
+  if err := s.Shutdown(ctx); err != nil {
+    t.Errorf("Expected the watch not to hold shutdown open: %v", err)
+  }
+
+  reader := bufio.NewReader(resp.Body)
+  for {
+    if _, err := reader.ReadString('\n'); err != nil {
+      break
+    }
+  }
+
+  listener, _ := net.Listen("tcp", "127.0.0.1:0")
+  if err := s.Serve(listener); err != http.ErrServerClosed {
+    t.Errorf("Expected serving after shutdown to fail, got %v", err)
+  }
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+  "crypto/tls"
+  "net"
+  "net/http"
+  "buildbuddy.takehome.com/src/certs"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+// Configures TLS for the HTTP API. The files are PEM encoded, and reloaded
+// when they change, e.g. when the certificate is renewed.
+type TlsOptions struct {
+  // The server's certificate, and any intermediates, and its private key.
+  CertFile string
+  KeyFile string
+  // Optional; a bundle of CAs. If set, clients must present a certificate
+  // signed by one of them (mutual TLS).
+  ClientCaFile string
+}
+
+// Build the server's TLS config from the options, logging reloads to `logger`.
+func loadTlsConfig(options *TlsOptions, logger *logging.Logger) (*tls.Config, error) {
+  keyPair, err := certs.LoadKeyPair(options.CertFile, options.KeyFile, logger)
+  if err != nil {
+    return nil, err
+  }
+
+  var clientCas *certs.CertPool
+  if options.ClientCaFile != "" {
+    if clientCas, err = certs.LoadCertPool(options.ClientCaFile, logger); err != nil {
+      return nil, err
+    }
+  }
+  return certs.ServerConfig(keyPair, clientCas), nil
+}
+
+// Serve API calls from the listener, over TLS if the server was configured
+// with TlsOptions. Returns http.ErrServerClosed once the server is shut down.
+func (s *Server) Serve(listener net.Listener) error {
+  return s.serve(listener, s.Handler())
+}
+
+// Serve the handler from the listener, over TLS if configured, until the
+// server is shut down.
+func (s *Server) serve(listener net.Listener, handler http.Handler) error {
+  if s.tlsConfig != nil {
+    listener = tls.NewListener(listener, s.tlsConfig)
+  }
+
+  httpServer := &http.Server{ Handler: handler }
+  httpServer.RegisterOnShutdown(s.closeWatches)
+  if !s.track(httpServer) {
+    listener.Close()
+    return http.ErrServerClosed
+  }
+  return httpServer.Serve(listener)
+}
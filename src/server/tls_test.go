@@ -0,0 +1,179 @@
+package server
+
+import (
+  "context"
+  "fmt"
+  "net"
+  "testing"
+
+  "buildbuddy.takehome.com/src/auth"
+  "buildbuddy.takehome.com/src/certs"
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/config"
+  "buildbuddy.takehome.com/src/store"
+)
+
+// Serve a filestore over TLS on a free port, returning its URL.
+func startTlsServer(t *testing.T, options *TlsOptions) string {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s, err := MakeServerWithOptions(fs, nil, &ServerOptions{ Tls: options })
+  if err != nil {
+    t.Fatalf("Error making TLS server: %v", err)
+  }
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  t.Cleanup(func() { listener.Close() })
+  go s.Serve(listener)
+  return "https://" + listener.Addr().String()
+}
+
+func makeTlsClient(t *testing.T, serverUrl string, options *client.TlsOptions) *client.Client {
+  c, err := client.MakeClientWithOptions(serverUrl, &client.ClientOptions{ Tls: options })
+  if err != nil {
+    t.Fatalf("Error making TLS client: %v", err)
+  }
+  return c
+}
+
+func TestTlsServesClientsTrustingTheCa(t *testing.T) {
+  testCerts, _ := certs.WriteTestCertificates(t.TempDir())
+  serverUrl := startTlsServer(t, &TlsOptions{
+    CertFile: testCerts.ServerCertFile,
+    KeyFile: testCerts.ServerKeyFile,
+  })
+
+  c := makeTlsClient(t, serverUrl, &client.TlsOptions{ CaFile: testCerts.CaFile })
+  if err := c.Set("key", []byte("value")); err != nil {
+    t.Fatalf("Error setting over TLS: %v", err)
+  }
+  if value, err := c.Get("key"); err != nil || string(value) != "value" {
+    t.Errorf("Expected value over TLS, got %v (%v)", string(value), err)
+  }
+
+  // The system's CAs do not trust the test CA.
+  if _, err := client.MakeClient(serverUrl).Get("key"); err == nil {
+    t.Errorf("Expected an untrusted certificate to be rejected")
+  }
+  // Plaintext is not served.
+  if _, err := client.MakeClient("http" + serverUrl[len("https"):]).Get("key"); err == nil {
+    t.Errorf("Expected a plaintext request to fail")
+  }
+}
+
+func TestMutualTlsRequiresClientCertificateFromTheCa(t *testing.T) {
+  testCerts, _ := certs.WriteTestCertificates(t.TempDir())
+  serverUrl := startTlsServer(t, &TlsOptions{
+    CertFile: testCerts.ServerCertFile,
+    KeyFile: testCerts.ServerKeyFile,
+    ClientCaFile: testCerts.CaFile,
+  })
+
+  c := makeTlsClient(t, serverUrl, &client.TlsOptions{
+    CaFile: testCerts.CaFile,
+    CertFile: testCerts.ClientCertFile,
+    KeyFile: testCerts.ClientKeyFile,
+  })
+  if err := c.Set("key", []byte("value")); err != nil {
+    t.Errorf("Expected a client certificate from the CA to be accepted: %v", err)
+  }
+
+  anonymous := makeTlsClient(t, serverUrl, &client.TlsOptions{ CaFile: testCerts.CaFile })
+  if _, err := anonymous.Get("key"); err == nil {
+    t.Errorf("Expected a client without a certificate to be rejected")
+  }
+
+  otherCerts, _ := certs.WriteTestCertificates(t.TempDir())
+  impostor := makeTlsClient(t, serverUrl, &client.TlsOptions{
+    CaFile: testCerts.CaFile,
+    CertFile: otherCerts.ClientCertFile,
+    KeyFile: otherCerts.ClientKeyFile,
+  })
+  if _, err := impostor.Get("key"); err == nil {
+    t.Errorf("Expected a client certificate from another CA to be rejected")
+  }
+}
+
+func TestTlsRejectsMissingCertificate(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  _, err := MakeServerWithOptions(fs, nil, &ServerOptions{
+    Tls: &TlsOptions{ CertFile: t.TempDir() + "/missing.pem", KeyFile: "missing-key.pem" },
+  })
+  if err == nil {
+    t.Errorf("Expected an error for a missing certificate")
+  }
+}
+
+func TestClusterNodesReachEachOtherOverMutualTls(t *testing.T) {
+  testCerts, _ := certs.WriteTestCertificates(t.TempDir())
+  peerKey, _ := auth.MakePeerKey([]byte("test-peer-secret"))
+  peerTls, err := PeerTlsConfig(&config.Config{
+    TlsCertFile: testCerts.ServerCertFile,
+    TlsKeyFile: testCerts.ServerKeyFile,
+    TlsCaFile: testCerts.CaFile,
+  }, nil)
+  if err != nil {
+    t.Fatalf("Error loading the peer TLS config: %v", err)
+  }
+
+  // Nodes are named without a scheme, so they reach each other over TLS.
+  var listeners []net.Listener
+  var nodes []string
+  for i := 0; i < 2; i++ {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+      t.Fatalf("Error listening: %v", err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    listeners = append(listeners, listener)
+    nodes = append(nodes, listener.Addr().String())
+  }
+  var filestores []*store.FileStore
+  for i, listener := range listeners {
+    fs, _ := store.MakeFileStore(t.TempDir(), nil)
+    s, err := MakeServerWithOptions(fs, nil, &ServerOptions{
+      ClusterSelf: nodes[i],
+      ClusterNodes: nodes,
+      PeerKey: peerKey,
+      PeerTls: peerTls,
+      Tls: &TlsOptions{
+        CertFile: testCerts.ServerCertFile,
+        KeyFile: testCerts.ServerKeyFile,
+        ClientCaFile: testCerts.CaFile,
+      },
+    })
+    if err != nil {
+      t.Fatalf("Error making TLS cluster server: %v", err)
+    }
+    filestores = append(filestores, fs)
+    go s.Serve(listener)
+  }
+
+  tlsOptions := &client.TlsOptions{
+    CaFile: testCerts.CaFile,
+    CertFile: testCerts.ClientCertFile,
+    KeyFile: testCerts.ClientKeyFile,
+  }
+  // Every request to the first node for a key the second owns is proxied.
+  first := makeTlsClient(t, "https://" + nodes[0], tlsOptions)
+  for i := 0; i < 10; i++ {
+    if err := first.Set(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+      t.Fatalf("Error setting key%v via the first node: %v", i, err)
+    }
+  }
+  if keys, _ := filestores[1].Keys(context.Background()); len(keys) == 0 {
+    t.Errorf("Expected keys to be proxied to the second node over TLS")
+  }
+
+  c, err := client.MakeClusterClient(nodes, &client.ClientOptions{ Tls: tlsOptions })
+  if err != nil {
+    t.Fatalf("Error making cluster client: %v", err)
+  }
+  for i := 0; i < 10; i++ {
+    if value, err := c.Get(fmt.Sprintf("key%v", i)); err != nil || string(value) != "value" {
+      t.Errorf("Expected to read key%v over TLS, got %v (%v)", i, string(value), err)
+    }
+  }
+}
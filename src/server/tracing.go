@@ -0,0 +1,80 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "strings"
+  "buildbuddy.takehome.com/src/logging"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+/**
+ * Serve each request within a server span, continuing the trace of its
+ * traceparent header if it has one. Handlers start their spans as its
+ * children via the request's context.
+ */
+func (s *Server) withTracing(next http.Handler) http.Handler {
+  if s.tracer == nil {
+    return next
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    ctx, span := s.tracer.Start(tracing.Extract(r.Context(), r.Header),
+      r.Method + " " + r.URL.Path, tracing.KIND_SERVER)
+    defer span.End()
+    span.SetAttribute("http.method", r.Method)
+    span.SetAttribute("http.target", r.URL.Path)
+    if requestId := logging.RequestId(ctx); requestId != "" {
+      span.SetAttribute("request_id", requestId)
+    }
+
+    recorder := &recordingResponseWriter{ ResponseWriter: w }
+    next.ServeHTTP(recorder, r.WithContext(ctx))
+    if recorder.status == 0 {
+      recorder.status = http.StatusOK
+    }
+    span.SetAttribute("http.status_code", recorder.status)
+    span.SetAttribute("http.request_content_length", r.ContentLength)
+    span.SetAttribute("http.response_content_length", recorder.bytesWritten)
+    if recorder.status >= http.StatusInternalServerError {
+      span.SetError(errors.New(http.StatusText(recorder.status)))
+    }
+  })
+}
+
+/**
+ * Start a span of an operation on one of the server's stores, named after
+ * the store's type, e.g. `FileStore.Get` or `Cache.Set`, returning the
+ * context to call the store with. End it via endStoreSpan.
+ */
+func (s *Server) startStoreSpan(
+    ctx context.Context,
+    kvStore store.KeyValueStore,
+    operation string,
+    key store.Key) (context.Context, *tracing.Span) {
+  if s.tracer == nil {
+    return ctx, nil
+  }
+  ctx, span := s.tracer.Start(ctx, storeName(kvStore) + "." + operation, tracing.KIND_INTERNAL)
+  span.SetAttribute("key", string(key))
+  return ctx, span
+}
+
+// End a store span, failing it if `err` is set. A missing key is not a
+// failure.
+func endStoreSpan(span *tracing.Span, err error) {
+  if err != nil && !errors.Is(err, os.ErrNotExist) {
+    span.SetError(err)
+  }
+  span.End()
+}
+
+// Return the name of the store's type, e.g. `FileStore` for a
+// *store.FileStore.
+func storeName(kvStore store.KeyValueStore) string {
+  name := fmt.Sprintf("%T", kvStore)
+  return name[strings.LastIndex(name, ".") + 1:]
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+  "context"
+  "net/http/httptest"
+  "testing"
+
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+  "buildbuddy.takehome.com/src/tracing"
+)
+
+// Return the exported spans by name; each name is expected at most once.
+func spansByName(exporter *tracing.MemoryExporter) map[string]*tracing.SpanData {
+  spans := make(map[string]*tracing.SpanData)
+  for _, span := range exporter.Spans() {
+    spans[span.Name] = span
+  }
+  return spans
+}
+
+func TestClientCallsAreTracedThroughTheStores(t *testing.T) {
+  ctx := context.Background()
+  exporter := tracing.MakeMemoryExporter()
+  tracer := tracing.MakeTracer(exporter, nil)
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  cache, _ := store.MakeCache(1024)
+  s, err := MakeServerWithOptions(fs, cache, &ServerOptions{ Tracer: tracer })
+  if err != nil {
+    t.Fatalf("Error making server: %v", err)
+  }
+  testServer := httptest.NewServer(s.Handler())
+  defer testServer.Close()
+  c, _ := client.MakeClientWithOptions(testServer.URL, &client.ClientOptions{ Tracer: tracer })
+
+  if err := c.Set("key", []byte("value")); err != nil {
+    t.Fatalf("Error setting key: %v", err)
+  }
+  // Evict the key from the cache, so the first get misses it.
+  cache.Delete(ctx, "key")
+  for _, hit := range []bool{ false, true } {
+    exporter.Reset()
+    if _, err := c.Get("key"); err != nil {
+      t.Fatalf("Error getting key: %v", err)
+    }
+
+    spans := spansByName(exporter)
+    root := spans["Client.Get"]
+    if root == nil || root.ParentSpanId != "" || root.Kind != tracing.KIND_CLIENT {
+      t.Fatalf("Expected a root client span, got %+v", root)
+    }
+    serverSpan := spans["GET /get"]
+    handler := spans["Server.handleGet"]
+    cacheGet := spans["Cache.Get"]
+    if serverSpan == nil || handler == nil || cacheGet == nil {
+      t.Fatalf("Expected server, handler and cache spans, got %v", spans)
+    }
+    if serverSpan.ParentSpanId != root.SpanId || handler.ParentSpanId != serverSpan.SpanId ||
+        cacheGet.ParentSpanId != handler.SpanId {
+      t.Errorf("Expected the spans to form a single trace from the client")
+    }
+    for _, span := range exporter.Spans() {
+      if span.TraceId != root.TraceId || span.Status != tracing.STATUS_OK {
+        t.Errorf("Unexpected span %+v", span)
+      }
+    }
+    if cacheGet.Attributes["cache.hit"] != hit {
+      t.Errorf("Expected cache.hit %v, got %v", hit, cacheGet.Attributes["cache.hit"])
+    }
+
+    fileGet := spans["FileStore.Get"]
+    if hit && fileGet != nil {
+      t.Errorf("Expected cache hits not to read the filestore")
+    } else if !hit && (fileGet == nil || fileGet.Attributes["value.bytes"] != 5 ||
+        spans["Cache.Set"] == nil) {
+      t.Errorf("Expected a cache miss to read the filestore and fill the cache, got %v", spans)
+    }
+  }
+
+  // Missing keys are not errors.
+  exporter.Reset()
+  if _, err := c.Get("missing"); err == nil {
+    t.Fatalf("Expected the key to be missing")
+  }
+  for _, span := range exporter.Spans() {
+    if span.Status != tracing.STATUS_OK {
+      t.Errorf("Expected a miss not to fail %v", span.Name)
+    }
+  }
+  if spans := spansByName(exporter); spans["GET /get"].Attributes["http.status_code"] != 404 {
+    t.Errorf("Expected the server span to record the status")
+  }
+}
+
+func TestUntracedServersIgnoreTraceparents(t *testing.T) {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  s := MakeServerWithStores(fs, nil)
+  req := httptest.NewRequest("GET", "/get?key=missing", nil)
+  req.Header.Set(tracing.HEADER_TRACEPARENT,
+    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+  w := httptest.NewRecorder()
+  s.Handler().ServeHTTP(w, req)
+  if w.Code != 404 {
+    t.Errorf("Expected http 404, received %v", w.Code)
+  }
+}
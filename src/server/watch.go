@@ -0,0 +1,387 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/store"
+)
+
+const (
+  // The latest revision when a /watch stream starts, e.g. to resume from after
+  // disconnecting before any event arrives, as a cursor; see formatCursor.
+  HEADER_WATCH_REVISION = "X-Watch-Revision"
+
+  EVENT_SET = "set"
+  EVENT_DELETE = "delete"
+  EVENT_EXPIRE = "expire"
+
+  // The number of recent events kept for watchers resuming from a revision.
+  WATCH_HISTORY_EVENTS = 4096
+  // The number of events buffered per watcher. A watcher which falls this
+  // far behind is disconnected, and may resume from its last revision.
+  WATCH_BUFFER_EVENTS = 256
+  // How often idle streams send a comment, so proxies keep them open.
+  WATCH_KEEPALIVE_INTERVAL = 15 * time.Second
+)
+
+var (
+  // Returned when resuming from a revision which is no longer retained, or
+  // which this server never issued, e.g. before it restarted.
+  errRevisionUnavailable = errors.New("Revision unavailable")
+  // Returned when subscribing after the server began shutting down.
+  errWatchClosed = errors.New("Server is shutting down")
+)
+
+// A change to a key, streamed to watchers as a server-sent event.
+type Event struct {
+  // Identifies the process which assigned the revision; revisions restart
+  // whenever the server does, and those of different epochs are unrelated.
+  Epoch uint64 `json:"epoch"`
+  // Increases by one with every event the server publishes.
+  Revision uint64 `json:"revision"`
+  // One of EVENT_SET, EVENT_DELETE or EVENT_EXPIRE.
+  Type string `json:"type"`
+  Key store.Key `json:"key"`
+  // The new value of a set event.
+  Value []byte `json:"value,omitempty"`
+}
+
+// A single /watch stream.
+type watcher struct {
+  prefix string
+  // Closed by the hub if the watcher falls too far behind.
+  events chan *Event
+}
+
+// A value set with a TTL, awaiting its expire event.
+type pendingExpiry struct {
+  // The revision of the set event; a later set or delete supersedes it.
+  revision uint64
+  timer *time.Timer
+}
+
+// Assigns revisions to changes, and fans them out to watchers without ever
+// blocking the writer. Create instances via makeWatchHub.
+type watchHub struct {
+  // The creation time of the hub in nanoseconds, which differs after every
+  // restart, so that revisions issued before it are not mistaken for its own.
+  epoch uint64
+  revision uint64
+  // The most recent events, oldest first.
+  history []*Event
+  watchers map[*watcher]bool
+  expiries map[store.Key]*pendingExpiry
+  // Set once the server shuts down; no further watchers are accepted.
+  closed bool
+  mutex *sync.Mutex
+}
+
+func makeWatchHub() *watchHub {
+  h := &watchHub{}
+  h.epoch = uint64(time.Now().UnixNano())
+  h.watchers = make(map[*watcher]bool)
+  h.expiries = make(map[store.Key]*pendingExpiry)
+  h.mutex = &sync.Mutex{}
+  return h
+}
+
+/**
+ * Publish a set event. If the value expires, an expire event follows at its
+ * expiry unless the key changes first.
+ */
+func (h *watchHub) publishSet(key store.Key, value store.Value, expiresAt time.Time) {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  event := h.publish(EVENT_SET, key, []byte(value))
+  if expiresAt.IsZero() {
+    return
+  }
+
+  revision := event.Revision
+  h.expiries[key] = &pendingExpiry{
+    revision: revision,
+    timer: time.AfterFunc(time.Until(expiresAt), func() {
+      h.publishExpire(key, revision)
+    }),
+  }
+}
+
+/**
+ * A store which reports every change to its data, including those made
+ * elsewhere, e.g. a replicated store receiving its peers' writes. The server
+ * publishes its changes to watchers rather than its own writes.
+ */
+type applyNotifier interface {
+  /**
+   * Call `fn` with every value stored, or with attributes marked Deleted for
+   * every key removed. Must be called before the store is used.
+   */
+  OnApply(fn func(key store.Key, value store.Value, attributes *store.Attributes))
+}
+
+// Publish a set or, for a tombstone, delete event for a change a store applied.
+func (h *watchHub) publishApplied(
+    key store.Key,
+    value store.Value,
+    attributes *store.Attributes) {
+  if attributes != nil && attributes.Deleted {
+    h.publishDelete(key)
+    return
+  }
+  var expiresAt time.Time
+  if attributes != nil {
+    expiresAt = attributes.ExpiresAt
+  }
+  h.publishSet(key, value, expiresAt)
+}
+
+func (h *watchHub) publishDelete(key store.Key) {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  h.publish(EVENT_DELETE, key, nil)
+}
+
+// Publish an expire event, unless the key changed since the expiring set.
+func (h *watchHub) publishExpire(key store.Key, revision uint64) {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  if expiry, ok := h.expiries[key]; !ok || expiry.revision != revision {
+    return
+  }
+  h.publish(EVENT_EXPIRE, key, nil)
+}
+
+/**
+ * Record an event and offer it to every matching watcher, disconnecting
+ * watchers whose buffers are full.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (h *watchHub) publish(eventType string, key store.Key, value []byte) *Event {
+  // Any pending expiry is superseded by this change.
+  if expiry, ok := h.expiries[key]; ok {
+    expiry.timer.Stop()
+    delete(h.expiries, key)
+  }
+
+  h.revision++
+  event := &Event{
+    Epoch: h.epoch,
+    Revision: h.revision,
+    Type: eventType,
+    Key: key,
+    Value: value,
+  }
+  h.history = append(h.history, event)
+  if len(h.history) > WATCH_HISTORY_EVENTS {
+    h.history = h.history[len(h.history) - WATCH_HISTORY_EVENTS:]
+  }
+
+  for w := range h.watchers {
+    if !strings.HasPrefix(string(key), w.prefix) {
+      continue
+    }
+
+    select {
+    case w.events <- event:
+    default:
+      close(w.events)
+      delete(h.watchers, w)
+    }
+  }
+  return event
+}
+
+/**
+ * Register a watcher for keys beginning with `prefix`, returning it with the
+ * latest revision. If `resume` is set, also return the retained events after
+ * revision `since` of `epoch`, or errRevisionUnavailable if some have been
+ * discarded or the revision is of another epoch.
+ */
+func (h *watchHub) subscribe(
+    prefix string,
+    epoch uint64,
+    since uint64,
+    resume bool) (*watcher, uint64, []*Event, error) {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  if h.closed {
+    return nil, 0, nil, errWatchClosed
+  }
+
+  var backlog []*Event
+  if resume {
+    if epoch != h.epoch || since > h.revision {
+      return nil, 0, nil, errRevisionUnavailable
+    }
+    if since < h.revision && since + 1 < h.history[0].Revision {
+      return nil, 0, nil, errRevisionUnavailable
+    }
+
+    for _, event := range h.history {
+      if event.Revision > since && strings.HasPrefix(string(event.Key), prefix) {
+        backlog = append(backlog, event)
+      }
+    }
+  }
+
+  w := &watcher{ prefix: prefix, events: make(chan *Event, WATCH_BUFFER_EVENTS) }
+  h.watchers[w] = true
+  return w, h.revision, backlog, nil
+}
+
+/**
+ * Disconnect every watcher, which may resume from its last revision on
+ * another server, and stop publishing pending expiries.
+ */
+func (h *watchHub) close() {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  h.closed = true
+  for w := range h.watchers {
+    close(w.events)
+    delete(h.watchers, w)
+  }
+  for key, expiry := range h.expiries {
+    expiry.timer.Stop()
+    delete(h.expiries, key)
+  }
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+  defer h.mutex.Unlock()
+  h.mutex.Lock()
+
+  if h.watchers[w] {
+    close(w.events)
+    delete(h.watchers, w)
+  }
+}
+
+// Handler for a /watch call. Streams the changes to keys beginning with the
+// optional `prefix` query parameter as server-sent events, e.g.
+//
+//   id: 1700000000000000000-42
+//   event: set
+//   data: {"epoch":1700000000000000000,"revision":42,"type":"set",...}
+//
+// Passing an event's id as the `since` query parameter, or the standard
+// Last-Event-ID header, first replays the events after it. Returns a
+// StatusGone if those events are no longer retained, or were published
+// before the server restarted.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  since := r.URL.Query().Get("since")
+  if since == "" {
+    since = r.Header.Get("Last-Event-ID")
+  }
+  var epoch, revision uint64
+  if since != "" {
+    var err error
+    if epoch, revision, err = parseCursor(since); err != nil {
+      // Return a StatusBadRequest; the revision is malformed.
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+  }
+
+  watcher, latest, backlog, err := s.watchHub.subscribe(
+    r.URL.Query().Get("prefix"), epoch, revision, since != "")
+  if err == errWatchClosed {
+    // Return a StatusServiceUnavailable; the server is shutting down.
+    w.WriteHeader(http.StatusServiceUnavailable)
+    return
+  } else if err != nil {
+    // Return a StatusGone; the client must re-read the keys it watches.
+    w.WriteHeader(http.StatusGone)
+    return
+  }
+  defer s.watchHub.unsubscribe(watcher)
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set(HEADER_WATCH_REVISION, formatCursor(s.watchHub.epoch, latest))
+  w.WriteHeader(http.StatusOK)
+  for _, event := range backlog {
+    if err := writeEvent(w, event); err != nil {
+      return
+    }
+  }
+  flusher.Flush()
+
+  keepalive := time.NewTicker(WATCH_KEEPALIVE_INTERVAL)
+  defer keepalive.Stop()
+  for {
+    select {
+    case event, ok := <-watcher.events:
+      if !ok {
+        // The watcher fell behind; it may resume from its last revision.
+        return
+      }
+      if err := writeEvent(w, event); err != nil {
+        return
+      }
+    case <-keepalive.C:
+      if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+        return
+      }
+    case <-r.Context().Done():
+      return
+    }
+    flusher.Flush()
+  }
+}
+
+func writeEvent(w http.ResponseWriter, event *Event) error {
+  data, err := json.Marshal(event)
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n",
+    formatCursor(event.Epoch, event.Revision), event.Type, data)
+  return err
+}
+
+// Return the cursor a watcher resumes from, e.g. `1700000000000000000-42`
+// for revision 42 of that epoch.
+func formatCursor(epoch uint64, revision uint64) string {
+  return fmt.Sprintf("%v-%v", epoch, revision)
+}
+
+/**
+ * Parse a cursor returned by formatCursor. A bare revision, without an
+ * epoch, is of epoch 0, which no server issues, as it cannot be told apart
+ * from one issued before a restart.
+ */
+func parseCursor(cursor string) (uint64, uint64, error) {
+  epochField, revisionField := "0", cursor
+  if i := strings.IndexByte(cursor, '-'); i >= 0 {
+    epochField, revisionField = cursor[:i], cursor[i + 1:]
+  }
+
+  epoch, err := strconv.ParseUint(epochField, 10, 64)
+  if err != nil {
+    return 0, 0, err
+  }
+  revision, err := strconv.ParseUint(revisionField, 10, 64)
+  if err != nil {
+    return 0, 0, err
+  }
+  return epoch, revision, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "buildbuddy.takehome.com/src/client"
+  "buildbuddy.takehome.com/src/store"
+)
+
+func makeTestWatchServer(t *testing.T) *client.Client {
+  fs, _ := store.MakeFileStore(t.TempDir(), nil)
+  testServer := httptest.NewServer(MakeServerWithStores(fs, nil).Handler())
+  t.Cleanup(testServer.Close)
+  return client.MakeClient(testServer.URL)
+}
+
+// Return the next event, or fail if none arrives in time.
+func nextEvent(t *testing.T, watcher *client.Watcher) *client.WatchEvent {
+  select {
+  case event, ok := <-watcher.Events():
+    if !ok {
+      t.Fatalf("Expected an event, but the watch ended: %v", watcher.Err())
+    }
+    return event
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Timed out waiting for an event")
+  }
+  return nil
+}
+
+func TestWatchStreamsSetDeleteAndExpireEvents(t *testing.T) {
+  c := makeTestWatchServer(t)
+  watcher, err := c.Watch("a", nil)
+  if err != nil {
+    t.Fatalf("Error watching: %v", err)
+  }
+  defer watcher.Close()
+
+  c.Set("a1", []byte("value"))
+  c.Set("b1", []byte("value"))
+  c.Delete("a1")
+  c.SetWithOptions("a2", []byte("value"), &client.SetOptions{ Ttl: time.Second })
+
+  expected := []string{ "set a1", "delete a1", "set a2", "expire a2" }
+  var revision uint64
+  for _, want := range expected {
+    event := nextEvent(t, watcher)
+    if got := event.Type + " " + event.Key; got != want {
+      t.Errorf("Expected event %v, got %v", want, got)
+    }
+    if event.Revision <= revision {
+      t.Errorf("Expected increasing revisions, got %v after %v", event.Revision, revision)
+    }
+    revision = event.Revision
+
+    if event.Type == "set" && string(event.Value) != "value" {
+      t.Errorf("Expected set events to carry the value, got %v", event.Value)
+    }
+  }
+}
+
+// Return the epoch of the server's watch events.
+func watchEpoch(t *testing.T, c *client.Client) uint64 {
+  watcher, err := c.Watch("epoch", nil)
+  if err != nil {
+    t.Fatalf("Error watching: %v", err)
+  }
+  defer watcher.Close()
+  c.Set("epoch", []byte("value"))
+  return nextEvent(t, watcher).Epoch
+}
+
+func TestWatchResumesFromRevision(t *testing.T) {
+  c := makeTestWatchServer(t)
+  epoch := watchEpoch(t, c)
+  for i := 2; i <= 4; i++ {
+    c.Set(fmt.Sprintf("key%v", i), []byte("value"))
+  }
+
+  watcher, err := c.Watch("", &client.WatchOptions{ Since: 2, Epoch: epoch })
+  if err != nil {
+    t.Fatalf("Error watching: %v", err)
+  }
+  defer watcher.Close()
+
+  for _, want := range []string{ "key3", "key4" } {
+    if event := nextEvent(t, watcher); event.Key != want {
+      t.Errorf("Expected to replay %v, got %v", want, event.Key)
+    }
+  }
+
+  c.Set("key5", []byte("value"))
+  if event := nextEvent(t, watcher); event.Key != "key5" || event.Revision != 5 ||
+      event.Epoch != epoch {
+    t.Errorf("Expected key5 at revision 5, got %+v", event)
+  }
+}
+
+func TestWatchRejectsUnavailableRevision(t *testing.T) {
+  c := makeTestWatchServer(t)
+  epoch := watchEpoch(t, c)
+
+  if _, err := c.Watch("", &client.WatchOptions{ Since: 100, Epoch: epoch }); !errors.Is(err,
+      client.ErrRevisionUnavailable) {
+    t.Errorf("Expected ErrRevisionUnavailable, got %v", err)
+  }
+  if _, err := c.Watch("", &client.WatchOptions{ Since: 1 }); !errors.Is(err,
+      client.ErrRevisionUnavailable) {
+    t.Errorf("Expected a revision without an epoch to be unavailable, got %v", err)
+  }
+}
+
+func TestWatchRejectsRevisionsFromBeforeARestart(t *testing.T) {
+  directory := t.TempDir()
+  fs, _ := store.MakeFileStore(directory, nil)
+  hub := MakeServerWithStores(fs, nil).watchHub
+  watcher, _, _, _ := hub.subscribe("", 0, 0, false)
+  hub.publishSet("key1", "value", time.Time{})
+  before := <-watcher.events
+  hub.close()
+
+  // The restarted server reaches the same revision with different changes.
+  fs, _ = store.MakeFileStore(directory, nil)
+  restarted := MakeServerWithStores(fs, nil)
+  testServer := httptest.NewServer(restarted.Handler())
+  defer testServer.Close()
+  c := client.MakeClient(testServer.URL)
+  c.Set("key2", []byte("value"))
+  c.Set("key3", []byte("value"))
+
+  if before.Epoch == restarted.watchHub.epoch {
+    t.Fatalf("Expected the restarted server to have a new epoch")
+  }
+  resumed, err := c.Watch("", &client.WatchOptions{ Since: before.Revision, Epoch: before.Epoch })
+  if !errors.Is(err, client.ErrRevisionUnavailable) {
+    t.Errorf("Expected a revision from before the restart to be unavailable, got %v", err)
+    resumed.Close()
+  }
+
+  // Bound the stream, were it to be served.
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+  req := httptest.NewRequest("GET", "/watch", nil).WithContext(ctx)
+  req.Header.Set("Last-Event-ID", formatCursor(before.Epoch, before.Revision))
+  w := httptest.NewRecorder()
+  restarted.handleWatch(w, req)
+  if w.Result().StatusCode != http.StatusGone {
+    t.Errorf("Expected http %v, received %v", http.StatusGone, w.Result().StatusCode)
+  }
+}
+
+func TestWatchDisconnectsSlowWatchersWithoutBlocking(t *testing.T) {
+  hub := makeWatchHub()
+  slow, _, _, _ := hub.subscribe("", 0, 0, false)
+
+  done := make(chan struct{})
+  go func() {
+    for i := 0; i < WATCH_BUFFER_EVENTS * 2; i++ {
+      hub.publishSet(store.Key(fmt.Sprintf("key%v", i)), store.Value("value"), time.Time{})
+    }
+    close(done)
+  }()
+
+  select {
+  case <-done:
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Expected publishing to never block on a slow watcher")
+  }
+
+  received := 0
+  for range slow.events {
+    received++
+  }
+  if received != WATCH_BUFFER_EVENTS {
+    t.Errorf("Expected the buffered %v events before disconnecting, got %v",
+      WATCH_BUFFER_EVENTS, received)
+  }
+}
@@ -0,0 +1,212 @@
+package store
+
+import (
+  "bytes"
+  "context"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "time"
+)
+
+var (
+  // Values stored with attributes are prefixed by this magic, a uvarint
+  // length, and the JSON encoded attributes.
+  ATTRIBUTES_MAGIC = []byte("BBKA")
+)
+
+// Optional attributes stored alongside a value.
+type Attributes struct {
+  // When the value expires, or the zero time if it never expires.
+  ExpiresAt time.Time
+  // Arbitrary caller supplied metadata, e.g. the tool which wrote the value.
+  Metadata map[string]string
+  // The version of a replicated value, or the zero version if unversioned.
+  Version Version
+  // Marks a tombstone: a replicated value which was deleted or expired, kept
+  // so that its version supersedes older writes. Only GetVersioned returns
+  // tombstones; other reads report the key as missing.
+  Deleted bool
+}
+
+// Orders the writes of a replicated value; the greatest version wins.
+// Versions are hybrid timestamps: the coordinating node's clock, with ties
+// broken by its ID.
+type Version struct {
+  // Unix nanoseconds, as assigned by the coordinating node.
+  Timestamp int64 `json:"timestamp"`
+  // The ID of the coordinating node.
+  NodeId string `json:"node_id"`
+}
+
+// Return whether this is the zero version, i.e. the value is unversioned.
+func (v Version) IsZero() bool {
+  return v.Timestamp == 0 && v.NodeId == ""
+}
+
+// Return whether this version supersedes `other`.
+func (v Version) After(other Version) bool {
+  if v.Timestamp != other.Timestamp {
+    return v.Timestamp > other.Timestamp
+  }
+  return v.NodeId > other.NodeId
+}
+
+func (v Version) String() string {
+  return fmt.Sprintf("%v@%v", v.Timestamp, v.NodeId)
+}
+
+// The JSON encoding of Attributes. Expiry is stored as Unix nanoseconds so
+// that it can be omitted when unset.
+type storedAttributes struct {
+  ExpiresAt int64 `json:"expires_at,omitempty"`
+  Metadata map[string]string `json:"metadata,omitempty"`
+  Version *Version `json:"version,omitempty"`
+  Deleted bool `json:"deleted,omitempty"`
+}
+
+// Return whether there are no attributes to store.
+func (a *Attributes) IsEmpty() bool {
+  return a == nil ||
+    (a.ExpiresAt.IsZero() && len(a.Metadata) == 0 && a.Version.IsZero() && !a.Deleted)
+}
+
+// Return whether the value has expired as of `now`.
+func (a *Attributes) Expired(now time.Time) bool {
+  return a != nil && !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
+// A KeyValueStore which can store attributes, such as an expiry, alongside
+// each value.
+type AttributeKeyValueStore interface {
+  KeyValueStore
+
+  /**
+   * Associate the {@code key} with the {@code value} and its attributes,
+   * which may be nil. Expired values are no longer returned by Get.
+   */
+  SetWithAttributes(ctx context.Context, key Key, value Value, attributes *Attributes) error
+
+  /**
+   * Retrieve the value and attributes associated with this key, or an error
+   * if no unexpired value is stored for this key. Attributes may be nil.
+   */
+  GetWithAttributes(ctx context.Context, key Key) (Value, *Attributes, error)
+}
+
+/**
+ * An AttributeKeyValueStore which keeps tombstones for versioned values, so
+ * that replication can order deletions and expiries against older writes.
+ * Versioned values read as tombstones once they expire.
+ */
+type VersionedKeyValueStore interface {
+  AttributeKeyValueStore
+
+  /**
+   * Retrieve the value and attributes associated with this key, as
+   * GetWithAttributes does, except that tombstones are returned rather than
+   * reported as missing.
+   */
+  GetVersioned(ctx context.Context, key Key) (Value, *Attributes, error)
+}
+
+// A store which can enumerate its keys.
+type KeyLister interface {
+  /**
+   * Return every key in the store, in sorted order. Keys whose values have
+   * expired but have not yet been removed, and keys holding tombstones, may
+   * be included.
+   */
+  Keys(ctx context.Context) ([]Key, error)
+}
+
+/**
+ * Return the error reported when reading an expired key. It wraps
+ * os.ErrNotExist, as the key is treated as missing.
+ */
+func expiredError(key Key) error {
+  return fmt.Errorf("%w: key %v expired", os.ErrNotExist, key)
+}
+
+/**
+ * Return the error reported when reading a tombstone other than via
+ * GetVersioned. It wraps os.ErrNotExist, as the key is treated as missing.
+ */
+func tombstoneError(key Key) error {
+  return fmt.Errorf("%w: key %v deleted", os.ErrNotExist, key)
+}
+
+/**
+ * Return the tombstone an expired value reads as, keeping its version, or
+ * nil if the value is unversioned and so simply removed once expired.
+ */
+func expiredTombstone(attributes *Attributes) *Attributes {
+  if attributes.Version.IsZero() {
+    return nil
+  }
+  return &Attributes{ Version: attributes.Version, Deleted: true }
+}
+
+/**
+ * Encode the attributes into the section which prefixes a stored value, or
+ * return nil if there are no attributes.
+ */
+func encodeAttributes(attributes *Attributes) ([]byte, error) {
+  if attributes.IsEmpty() {
+    return nil, nil
+  }
+
+  stored := storedAttributes{ Metadata: attributes.Metadata }
+  if !attributes.ExpiresAt.IsZero() {
+    stored.ExpiresAt = attributes.ExpiresAt.UnixNano()
+  }
+  if !attributes.Version.IsZero() {
+    version := attributes.Version
+    stored.Version = &version
+  }
+  stored.Deleted = attributes.Deleted
+
+  attributesJson, err := json.Marshal(stored)
+  if err != nil {
+    return nil, err
+  }
+
+  length := make([]byte, binary.MaxVarintLen64)
+  length = length[:binary.PutUvarint(length, uint64(len(attributesJson)))]
+
+  section := append([]byte{}, ATTRIBUTES_MAGIC...)
+  section = append(section, length...)
+  return append(section, attributesJson...), nil
+}
+
+/**
+ * Split a stored value into its attributes and the remaining bytes. Values
+ * stored without attributes are returned unchanged, with nil attributes.
+ */
+func splitAttributes(stored []byte) (*Attributes, []byte, error) {
+  if !bytes.HasPrefix(stored, ATTRIBUTES_MAGIC) {
+    return nil, stored, nil
+  }
+
+  rest := stored[len(ATTRIBUTES_MAGIC):]
+  length, n := binary.Uvarint(rest)
+  if n <= 0 || uint64(len(rest) - n) < length {
+    return nil, nil, errors.New("Malformed value attributes")
+  }
+
+  var parsed storedAttributes
+  if err := json.Unmarshal(rest[n:n + int(length)], &parsed); err != nil {
+    return nil, nil, err
+  }
+
+  attributes := &Attributes{ Metadata: parsed.Metadata, Deleted: parsed.Deleted }
+  if parsed.ExpiresAt != 0 {
+    attributes.ExpiresAt = time.Unix(0, parsed.ExpiresAt)
+  }
+  if parsed.Version != nil {
+    attributes.Version = *parsed.Version
+  }
+  return attributes, rest[n + int(length):], nil
+}
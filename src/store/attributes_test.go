@@ -0,0 +1,147 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "os"
+  "testing"
+  "time"
+)
+
+func TestFileStoreStoresAttributes(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableCompression: true })
+  expiresAt := time.Now().Add(time.Hour)
+  attributes := &Attributes{
+    ExpiresAt: expiresAt,
+    Metadata: map[string]string{ "tool": "bazel" },
+  }
+  if err := fs.SetWithAttributes(ctx, KEY, VALUE, attributes); err != nil {
+    t.Fatalf("Error setting %v with attributes: %v", KEY, err)
+  }
+
+  value, stored, err := fs.GetWithAttributes(ctx, KEY)
+  if err != nil || value != VALUE {
+    t.Fatalf("Error retrieving %v: %v", KEY, err)
+  }
+  if !stored.ExpiresAt.Equal(expiresAt) || stored.Metadata["tool"] != "bazel" {
+    t.Errorf("Expected attributes %v, got %v", attributes, stored)
+  }
+
+  // Values stored without attributes have none.
+  fs.Set(ctx, KEY2, VALUE)
+  if _, stored, _ := fs.GetWithAttributes(ctx, KEY2); stored != nil {
+    t.Errorf("Expected no attributes for %v, got %v", KEY2, stored)
+  }
+}
+
+func TestFileStoreRemovesExpiredValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  fs.SetWithAttributes(ctx, KEY, VALUE,
+    &Attributes{ ExpiresAt: time.Now().Add(-time.Second) })
+
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("Expected expired %v to be missing, got %v", KEY, err)
+  }
+
+  if keys, _ := fs.Keys(ctx); len(keys) != 0 {
+    t.Errorf("Expected the expired key to be removed, got %v", keys)
+  }
+}
+
+func TestFileStoreListsKeysInOrder(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  fs.Set(ctx, KEY3, VALUE)
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  keys, err := fs.Keys(ctx)
+  if err != nil || len(keys) != 3 || keys[0] != KEY || keys[1] != KEY2 ||
+      keys[2] != KEY3 {
+    t.Errorf("Expected sorted keys, got %v (%v)", keys, err)
+  }
+}
+
+func TestLogStoreRemovesExpiredValues(t *testing.T) {
+  ctx := context.Background()
+  l := makeTestLogStore(t, t.TempDir(), nil)
+  defer l.Close()
+
+  l.SetWithAttributes(ctx, KEY, VALUE,
+    &Attributes{ ExpiresAt: time.Now().Add(-time.Second) })
+  l.SetWithAttributes(ctx, KEY2, VALUE,
+    &Attributes{ Metadata: map[string]string{ "tool": "bazel" } })
+
+  if _, err := l.Get(ctx, KEY); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("Expected expired %v to be missing, got %v", KEY, err)
+  }
+
+  if _, stored, err := l.GetWithAttributes(ctx, KEY2); err != nil ||
+      stored.Metadata["tool"] != "bazel" {
+    t.Errorf("Expected metadata for %v, got %v (%v)", KEY2, stored, err)
+  }
+}
+
+func TestVersionedStoresKeepTombstones(t *testing.T) {
+  ctx := context.Background()
+  l := makeTestLogStore(t, t.TempDir(), nil)
+  defer l.Close()
+  version := Version{ Timestamp: 1, NodeId: "a" }
+
+  for _, versioned := range []VersionedKeyValueStore{ makeTestFileStore(t, nil), l } {
+    versioned.SetWithAttributes(ctx, KEY, VALUE,
+      &Attributes{ ExpiresAt: time.Now().Add(-time.Second), Version: version })
+    versioned.SetWithAttributes(ctx, KEY2, EMPTY_VALUE,
+      &Attributes{ Version: version, Deleted: true })
+
+    for _, key := range []Key{ KEY, KEY2 } {
+      if _, err := versioned.Get(ctx, key); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("Expected %v to be missing, got %v", key, err)
+      }
+      if _, _, err := versioned.GetWithAttributes(ctx, key); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("Expected %v to be missing, got %v", key, err)
+      }
+      _, tombstone, err := versioned.GetVersioned(ctx, key)
+      if err != nil || tombstone == nil || !tombstone.Deleted || tombstone.Version != version {
+        t.Errorf("Expected a tombstone for %v, got %v (%v)", key, tombstone, err)
+      }
+    }
+  }
+}
+
+func TestCacheRemovesExpiredValues(t *testing.T) {
+  ctx := context.Background()
+  c, _ := MakeCache(50)
+  c.SetWithAttributes(ctx, KEY, VALUE,
+    &Attributes{ ExpiresAt: time.Now().Add(-time.Second) })
+
+  if _, err := c.Get(ctx, KEY); err == nil {
+    t.Errorf("Expected expired %v to be missing", KEY)
+  }
+  if len(c.cache) != 0 || c.evictionList.Len() != 0 || c.sizeBytes != 0 {
+    t.Errorf("Expected the expired entry to be removed from the cache")
+  }
+}
+
+func TestAttributesRoundTrip(t *testing.T) {
+  encoded, err := encodeValue(VALUE, &Attributes{
+    Metadata: map[string]string{ "a": "b" },
+  }, false)
+  if err != nil {
+    t.Fatalf("Error encoding %v: %v", VALUE, err)
+  }
+
+  parsed, err := parseEncodedValue(encoded)
+  if err != nil || parsed.Attributes.Metadata["a"] != "b" {
+    t.Fatalf("Error parsing attributes: %v", err)
+  }
+  if value, _ := parsed.Decode(); value != VALUE {
+    t.Errorf("Expected %v, got %v", VALUE, value)
+  }
+
+  if _, _, err := splitAttributes(encoded[:len(ATTRIBUTES_MAGIC) + 2]); err == nil {
+    t.Errorf("Expected an error for truncated attributes")
+  }
+}
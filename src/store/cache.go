@@ -2,14 +2,19 @@ package store
 
 import (
   "container/list"
+  "context"
   "errors"
   "fmt"
   "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
 )
 
 // A value and cache-relevant metadata, e.g. its eviction order priority.
 type cacheEntry struct {
   value Value
+  // The value's attributes, e.g. its expiry. May be nil.
+  attributes *Attributes
   evictionListElement *list.Element
   sizeBytes int 
 }
@@ -26,27 +31,44 @@ type Cache struct {
   // The first element should be evicted first, and the last element should be
   // evicted last. 
   evictionList *list.List
+  // The number of Get calls which were hits and misses, respectively.
+  hits int64
+  misses int64
+  // The number of entries evicted to make room for new entries.
+  evictions int64
   // A mutex to allow multiple GoRoutines to utilize the cache.
   // Note that we cannot use a RW lock; there may be contention if multiple
   // GET threads are modifying the eviction list.
   mutex *sync.Mutex
+  // Logs hits and misses at the debug level; may be nil.
+  logger *logging.Logger
 }
 
 /** 
  * Set the key/value pair in memory, possibly performing eviction if need be. 
  */
-func (c *Cache) Set(key Key, value Value) error {
+func (c *Cache) Set(ctx context.Context, key Key, value Value) error {
+  return c.SetWithAttributes(ctx, key, value, nil)
+}
+
+/**
+ * Set the key/value pair and its attributes in memory. Expired entries are
+ * treated as misses. Calls never block on IO, so `ctx` is not consulted.
+ */
+func (c *Cache) SetWithAttributes(
+    ctx context.Context,
+    key Key,
+    value Value,
+    attributes *Attributes) error {
   defer c.mutex.Unlock()
   c.mutex.Lock()
-  if cachedEntry, ok := c.cache[key]; ok {
-    // Delete any pre-existing entry in the cache.
-    c.sizeBytes = c.sizeBytes - cachedEntry.sizeBytes
-    delete(c.cache, key)
-  }
+  // Delete any pre-existing entry in the cache.
+  c.remove(key)
 
   // Do not store the value if it is too large.
   if value.SizeOfBytes() >= c.capacityBytes {
-    return errors.New(fmt.Sprintf("Value too large; cannot store %v->%v in cache of size %v", key, value, c.capacityBytes))
+    return errors.New(fmt.Sprintf("Value too large; cannot store %v bytes for %v in cache of size %v",
+      value.SizeOfBytes(), key, c.capacityBytes))
   }
 
   // Continually evict LRU elements until we have sufficient space.
@@ -58,6 +80,7 @@ func (c *Cache) Set(key Key, value Value) error {
 
   entry := &cacheEntry{}
   entry.value = value
+  entry.attributes = attributes
   entry.sizeBytes = value.SizeOfBytes()
   // This entry is the most recently used, and should be evicted last.
   entry.evictionListElement = c.evictionList.PushBack(key)
@@ -71,17 +94,57 @@ func (c *Cache) Set(key Key, value Value) error {
  * Retrieve the key/value from memory, or return an error if the value is
  * missing. 
  */
-func (c *Cache) Get(key Key) (Value, error) {
+func (c *Cache) Get(ctx context.Context, key Key) (Value, error) {
+  value, _, err := c.GetWithAttributes(ctx, key)
+  return value, err
+}
+
+/**
+ * Retrieve the key/value and its attributes from memory, or return an error
+ * if the value is missing or expired.
+ */
+func (c *Cache) GetWithAttributes(ctx context.Context, key Key) (Value, *Attributes, error) {
   defer c.mutex.Unlock()
   c.mutex.Lock()
-  if entry, ok := c.cache[key]; ok {
-    fmt.Println("\tCache hit!")
+  if entry, ok := c.cache[key]; ok && !entry.attributes.Expired(time.Now()) {
+    c.logger.Debug("Cache hit", "key", key)
+    c.hits++
     c.onKeyTouched(key); 
-    return entry.value, nil
+    return entry.value, entry.attributes, nil
   }
  
-  fmt.Println("\tCache miss!")
-  return "", errors.New(fmt.Sprintf("Cache miss for %v", key))
+  // Drop the entry if it expired.
+  c.remove(key)
+  c.logger.Debug("Cache miss", "key", key)
+  c.misses++
+  return "", nil, errors.New(fmt.Sprintf("Cache miss for %v", key))
+}
+
+/**
+ * Remove the key from the cache, if present.
+ */
+func (c *Cache) Delete(ctx context.Context, key Key) error {
+  defer c.mutex.Unlock()
+  c.mutex.Lock()
+
+  c.remove(key)
+  return nil
+}
+
+/**
+ * Remove the key from the cache, if present.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (c *Cache) remove(key Key) {
+  entry, ok := c.cache[key]
+  if !ok {
+    return
+  }
+
+  c.evictionList.Remove(entry.evictionListElement)
+  c.sizeBytes = c.sizeBytes - entry.sizeBytes
+  delete(c.cache, key)
 }
 
 /**
@@ -104,9 +167,40 @@ func (c *Cache) evictLru() error {
 
   c.sizeBytes = c.sizeBytes - cacheEntry.sizeBytes
   delete(c.cache, key)
+  c.evictions++
+  return nil
+}
+
+/**
+ * Release the cache's entries. Nothing is buffered, as the cache is not
+ * persistent.
+ */
+func (c *Cache) Close() error {
+  defer c.mutex.Unlock()
+  c.mutex.Lock()
+
+  c.cache = make(map[Key]*cacheEntry)
+  c.evictionList.Init()
+  c.sizeBytes = 0
   return nil
 }
 
+/**
+ * Report the cache's occupancy, hits, misses and evictions.
+ */
+func (c *Cache) Stats() map[string]int64 {
+  defer c.mutex.Unlock()
+  c.mutex.Lock()
+  return map[string]int64{
+    "size_bytes": int64(c.sizeBytes),
+    "capacity_bytes": int64(c.capacityBytes),
+    "entries": int64(len(c.cache)),
+    "hits": c.hits,
+    "misses": c.misses,
+    "evictions": c.evictions,
+  }
+}
+
 /**
  * Indicate a key/value pair was just touched, e.g. to adjust it's eviction
  * priority.
@@ -130,8 +224,21 @@ func (c *Cache) onKeyTouched(key Key) error {
   return nil
 }
 
+type CacheOptions struct {
+  // Logs hits and misses at the debug level; may be nil.
+  Logger *logging.Logger
+}
+
 // Construct a new Cache instance.
 func MakeCache(capacityBytes int) (*Cache, error) {
+  return MakeCacheWithOptions(capacityBytes, nil)
+}
+
+// Construct a new Cache instance. `options` may be nil.
+func MakeCacheWithOptions(capacityBytes int, options *CacheOptions) (*Cache, error) {
+  if options == nil {
+    options = &CacheOptions{}
+  }
   if capacityBytes <= 0 {
     return nil, errors.New(fmt.Sprintf("Cannot create a cache of capacity %v",
 capacityBytes))
@@ -144,6 +251,7 @@ capacityBytes))
   c.cache = make(map[Key]*cacheEntry) 
   c.evictionList = list.New()
   c.mutex = &sync.Mutex{}
+  c.logger = options.Logger
 
   return c, nil
 }
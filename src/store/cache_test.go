@@ -1,6 +1,7 @@
 package store 
 
 import (
+  "context"
   "testing"
 )
 
@@ -14,9 +15,10 @@ const (
 )
 
 func TestCacheUpdatesLruOrder(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(50)
-  cache.Set(KEY, VALUE)
-  cache.Set(KEY2, VALUE)
+  cache.Set(ctx, KEY, VALUE)
+  cache.Set(ctx, KEY2, VALUE)
   
   // Current LRU order is KEY->KEY2
   if cache.evictionList.Front().Value.(Key) != KEY {
@@ -29,39 +31,42 @@ func TestCacheUpdatesLruOrder(t *testing.T) {
 }
 
 func TestCacheSetsEntry(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(50)
-  if err := cache.Set(KEY, VALUE); err != nil {
+  if err := cache.Set(ctx, KEY, VALUE); err != nil {
     t.Errorf("Error when setting %v->%v in cache", KEY, VALUE)
   }
 
-  if val, err := cache.Get(KEY); err != nil || val != VALUE {
+  if val, err := cache.Get(ctx, KEY); err != nil || val != VALUE {
     t.Errorf("Error retrieving %v from cache", KEY)
   }
 }
 
 func TestCacheDeletesOldKey(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(50)
-  cache.Set(KEY, VALUE)
+  cache.Set(ctx, KEY, VALUE)
 
-  if val, _ := cache.Get(KEY); val != VALUE {
+  if val, _ := cache.Get(ctx, KEY); val != VALUE {
     t.Errorf("Expected a %v->%v store", KEY, VALUE)
   }
 
-  cache.Set(KEY, VALUE_THAT_FITS)
-  if val, _ := cache.Get(KEY); val != VALUE_THAT_FITS {
+  cache.Set(ctx, KEY, VALUE_THAT_FITS)
+  if val, _ := cache.Get(ctx, KEY); val != VALUE_THAT_FITS {
     t.Errorf("Expected a %v->%v store", KEY, VALUE_THAT_FITS)
   }  
 }
 
 func TestCacheAddsEntryThrowsValueTooLarge(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(15)
 
-  cache.Set(KEY, VALUE)
-  if val, err := cache.Get(KEY); err != nil || val != VALUE {
+  cache.Set(ctx, KEY, VALUE)
+  if val, err := cache.Get(ctx, KEY); err != nil || val != VALUE {
     t.Errorf("Error inserting %v->%v", KEY, VALUE)
   }  
 
-  if err := cache.Set(KEY, VALUE_LARGE); err == nil {
+  if err := cache.Set(ctx, KEY, VALUE_LARGE); err == nil {
     t.Errorf("Expected error when setting %v->%v",  KEY, VALUE_LARGE)
   } 
 
@@ -72,38 +77,40 @@ func TestCacheAddsEntryThrowsValueTooLarge(t *testing.T) {
 }
 
 func TestCacheEvictsIfNeeded(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(len(VALUE) + len(VALUE_THAT_FITS) - 1)
 
-  cache.Set(KEY, VALUE)
-  cache.Set(KEY2, VALUE_THAT_FITS) // Evicts KEY->VALUE
+  cache.Set(ctx, KEY, VALUE)
+  cache.Set(ctx, KEY2, VALUE_THAT_FITS) // Evicts KEY->VALUE
 
   if _, ok := cache.cache[KEY]; ok {
     t.Errorf("Expected eviction of %v", KEY)
   }
 
-  if val, _ := cache.Get(KEY2); val != VALUE_THAT_FITS {
+  if val, _ := cache.Get(ctx, KEY2); val != VALUE_THAT_FITS {
     t.Errorf("Expected %v-%v", KEY2, VALUE_THAT_FITS)
   }
 }
 
 func TestCacheEvictsLRU(t *testing.T) {
+  ctx := context.Background()
   // The cache can fit three key/value pairs.
   cache, _ := MakeCache(25)
   value1 := Value("aaaaa") // 5 bytes
   
-  cache.Set("key1", value1)
-  cache.Set("key2", value1)
-  cache.Set("key3", value1)
-  cache.Set("key4", value1)
-  cache.Set("key5", value1)
+  cache.Set(ctx, "key1", value1)
+  cache.Set(ctx, "key2", value1)
+  cache.Set(ctx, "key3", value1)
+  cache.Set(ctx, "key4", value1)
+  cache.Set(ctx, "key5", value1)
 
   // LRU ordering is 1->2->3->4->5.
-  cache.Get("key3")
-  cache.Get("key2")
+  cache.Get(ctx, "key3")
+  cache.Get(ctx, "key2")
   
   // LRU ordering is 1->4->5->3->2.
   value2 := Value("aaaaabbbbbcccccddddd") // 20 bytes.
-  cache.Set("key6", value2)
+  cache.Set(ctx, "key6", value2)
 
   // Values 1, 4, 5, 3 should all be evicted. 2 and 6 should be present.
   errorIfCacheContains(cache, "key1", t)
@@ -111,20 +118,21 @@ func TestCacheEvictsLRU(t *testing.T) {
   errorIfCacheContains(cache, "key5", t)
   errorIfCacheContains(cache, "key3", t)
 
-  if val, err := cache.Get("key2"); err != nil || val != value1 {
+  if val, err := cache.Get(ctx, "key2"); err != nil || val != value1 {
     t.Errorf("Expected %v->%v in cache.", "key2", value1)
   }   
 
-  if val, err := cache.Get("key6"); err != nil || val != value2 {
+  if val, err := cache.Get(ctx, "key6"); err != nil || val != value2 {
     t.Errorf("Expected %v->%v in cache.", "key6", value2)
   } 
 }
 
 func TestCacheGetUpdatesTimestamp(t *testing.T) {
+  ctx := context.Background()
   cache, _ := MakeCache(50)
 
-  cache.Set(KEY, VALUE)
-  cache.Set(KEY2, VALUE_THAT_FITS) 
+  cache.Set(ctx, KEY, VALUE)
+  cache.Set(ctx, KEY2, VALUE_THAT_FITS) 
 
   // LRU Ordering is KEY->KEY2.
   if cache.evictionList.Front().Value.(Key) != KEY {
@@ -135,7 +143,7 @@ func TestCacheGetUpdatesTimestamp(t *testing.T) {
     t.Errorf("Invalid LRU ordering; expected %v at back.", KEY2)
   }
 
-  cache.Get(KEY)
+  cache.Get(ctx, KEY)
 
   // LRU Ordering is KEY2->KEY.  
   if cache.evictionList.Front().Value.(Key) != KEY2 {
@@ -148,7 +156,40 @@ func TestCacheGetUpdatesTimestamp(t *testing.T) {
 }
 
 func errorIfCacheContains(c *Cache, key Key, t *testing.T) {
-  if _, err := c.Get(key); err == nil {
+  ctx := context.Background()
+  if _, err := c.Get(ctx, key); err == nil {
     t.Errorf("Expected %v to be missing from cache.", key)
   }
 }
+
+func TestCacheStatsCountHitsMissesAndEvictions(t *testing.T) {
+  ctx := context.Background()
+  cache, _ := MakeCache(len(VALUE) + len(VALUE_THAT_FITS) - 1)
+  cache.Set(ctx, KEY, VALUE)
+  cache.Get(ctx, KEY)
+  cache.Set(ctx, KEY2, VALUE_THAT_FITS) // Evicts KEY->VALUE
+  cache.Get(ctx, KEY)
+
+  stats := cache.Stats()
+  if stats["hits"] != 1 || stats["misses"] != 1 || stats["evictions"] != 1 {
+    t.Errorf("Unexpected stats %v", stats)
+  }
+
+  if stats["entries"] != 1 || stats["size_bytes"] != int64(len(VALUE_THAT_FITS)) {
+    t.Errorf("Unexpected occupancy %v", stats)
+  }
+}
+
+func TestCacheDeletesEntry(t *testing.T) {
+  ctx := context.Background()
+  cache, _ := MakeCache(50)
+  cache.Set(ctx, KEY, VALUE)
+
+  if err := cache.Delete(ctx, KEY); err != nil {
+    t.Errorf("Error deleting %v: %v", KEY, err)
+  }
+  errorIfCacheContains(cache, KEY, t)
+  if cache.sizeBytes != 0 || cache.evictionList.Len() != 0 {
+    t.Errorf("Expected the deleted entry to release its space")
+  }
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "os"
+)
+
+const (
+  BLOB_DIRECTORY_NAME = "blobs"
+)
+
+var (
+  // A key file which references a blob holds this magic, followed by the
+  // hex encoded SHA-256 of the value and its attributes.
+  REFERENCE_MAGIC = []byte("BBKR")
+  REFERENCE_SIZE_BYTES = len(REFERENCE_MAGIC) + hex.EncodedLen(sha256.Size)
+)
+
+// A deduplicated value body, shared by every key whose value hashes to it.
+type blobEntry struct {
+  // The number of key files which reference this blob.
+  references int
+  // The on-disk size of the blob, in bytes.
+  sizeBytes int64
+}
+
+/**
+ * Write the value's blob unless an identical value is already stored, and
+ * return the bytes of a key file which references it. The blob is not
+ * retained until the key file has been written; see `retainBlob`.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) storeBlob(
+    key Key, value Value, attributes *Attributes) ([]byte, string, error) {
+  // Attributes are stored in the blob, so only keys with identical values
+  // and attributes share a blob.
+  attributesSection, err := encodeAttributes(attributes)
+  if err != nil {
+    return nil, "", err
+  }
+
+  digest := sha256.New()
+  digest.Write(attributesSection)
+  digest.Write([]byte(value))
+  hash := hex.EncodeToString(digest.Sum(nil))
+  reference := append(append([]byte{}, REFERENCE_MAGIC...), hash...)
+
+  if _, ok := f.blobs[hash]; ok {
+    return reference, hash, nil
+  }
+
+  stored, err := f.encodeForDisk(value, attributes)
+  if err != nil {
+    return nil, "", err
+  }
+
+  if err := f.checkBudget(key, int64(len(stored))); err != nil {
+    return nil, "", err
+  }
+
+  if err := f.writeFile(f.getBlobPath(hash), stored); err != nil {
+    return nil, "", err
+  }
+
+  f.blobs[hash] = &blobEntry{ references: 0, sizeBytes: int64(len(stored)) }
+  f.blobSizeBytes += int64(len(stored))
+  return reference, hash, nil
+}
+
+/**
+ * Record a new key file referencing the blob.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) retainBlob(hash string) {
+  if blob, ok := f.blobs[hash]; ok {
+    blob.references++
+  }
+}
+
+/**
+ * Record that a key file no longer references the blob, deleting the blob
+ * once it is unreferenced.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) releaseBlob(hash string) {
+  if blob, ok := f.blobs[hash]; ok {
+    blob.references--
+  }
+  f.collectBlob(hash)
+}
+
+/**
+ * Delete the blob if no key file references it. A failed delete leaves an
+ * orphaned blob, which is collected on the next startup.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) collectBlob(hash string) {
+  blob, ok := f.blobs[hash]
+  if !ok || blob.references > 0 {
+    return
+  }
+
+  if err := os.Remove(f.getBlobPath(hash)); err != nil && !os.IsNotExist(err) {
+    f.logger.Warn("Error collecting blob", "hash", hash, "err", err)
+    return
+  }
+  f.blobSizeBytes -= blob.sizeBytes
+  delete(f.blobs, hash)
+}
+
+/**
+ * Return the hash of the blob the key's file references, or false if the
+ * key is missing or its file holds a value.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) referencedBlob(key Key) (string, bool) {
+  if len(f.blobs) == 0 {
+    return "", false
+  }
+
+  file, err := os.Open(f.getFilePath(key, f.directory))
+  if err != nil {
+    return "", false
+  }
+  defer file.Close()
+
+  // A reference is small; avoid reading large values in full.
+  prefix := make([]byte, REFERENCE_SIZE_BYTES + 1)
+  n, err := io.ReadFull(file, prefix)
+  if err != nil && err != io.ErrUnexpectedEOF {
+    return "", false
+  }
+  return parseReference(prefix[:n])
+}
+
+/**
+ * Rebuild the blob reference counts from the key files on disk, and delete
+ * any unreferenced blobs.
+ *
+ * <p> Reference counts are never persisted. Blobs are always written before
+ * the key files referencing them, and released only after those key files
+ * are overwritten or removed, so a crash can orphan a blob but never leave
+ * a dangling reference. Orphans are collected here.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) loadBlobs() error {
+  if err := os.Mkdir(f.blobDirectory, 0755); err != nil && !os.IsExist(err) {
+    return err
+  }
+
+  blobEntries, err := os.ReadDir(f.blobDirectory)
+  if err != nil {
+    return err
+  }
+  if len(blobEntries) == 0 {
+    return nil
+  }
+
+  for _, dirEntry := range blobEntries {
+    info, err := dirEntry.Info()
+    if err != nil {
+      return err
+    }
+    f.blobs[dirEntry.Name()] = &blobEntry{ sizeBytes: info.Size() }
+    f.blobSizeBytes += info.Size()
+  }
+
+  for key := range f.usage.entries {
+    if hash, ok := f.referencedBlob(key); ok {
+      f.retainBlob(hash)
+    }
+  }
+
+  for hash := range f.blobs {
+    f.collectBlob(hash)
+  }
+  return nil
+}
+
+func (f *FileStore) getBlobPath(hash string) string {
+  return fmt.Sprintf(f.blobDirectory + "/%s", hash)
+}
+
+// Return the blob hash held by a reference, or false if the stored bytes are
+// not a reference.
+func parseReference(stored []byte) (string, bool) {
+  if len(stored) != REFERENCE_SIZE_BYTES ||
+      !bytes.HasPrefix(stored, REFERENCE_MAGIC) {
+    return "", false
+  }
+  return string(stored[len(REFERENCE_MAGIC):]), true
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "testing"
+)
+
+func TestDeduplicationSharesIdenticalValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+  fs.Set(ctx, KEY3, VALUE_THAT_FITS)
+
+  if len(fs.blobs) != 2 {
+    t.Errorf("Expected 2 blobs, got %v", len(fs.blobs))
+  }
+
+  for key, value := range map[Key]Value{ KEY: VALUE, KEY2: VALUE, KEY3: VALUE_THAT_FITS } {
+    if val, err := fs.Get(ctx, key); err != nil || val != value {
+      t.Errorf("Expected %v->%v, got %v, %v", key, value, val, err)
+    }
+  }
+}
+
+func TestDeduplicationCollectsOverwrittenBlobs(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  // The blob is still referenced by KEY2.
+  fs.Set(ctx, KEY, VALUE_THAT_FITS)
+  if len(fs.blobs) != 2 {
+    t.Errorf("Expected 2 blobs, got %v", len(fs.blobs))
+  }
+
+  // The blob for VALUE is now unreferenced.
+  fs.Set(ctx, KEY2, VALUE_THAT_FITS)
+  if len(fs.blobs) != 1 {
+    t.Errorf("Expected 1 blob, got %v", len(fs.blobs))
+  }
+
+  if blobs, _ := listFiles(fs.blobDirectory); len(blobs) != 1 {
+    t.Errorf("Expected 1 blob on disk, got %v", len(blobs))
+  }
+}
+
+func TestDeduplicationCollectsEvictedBlobs(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t,
+    &FileStoreOptions{ EnableDeduplication: true, MaxFiles: 1 })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE_THAT_FITS) // Evicts KEY.
+
+  if len(fs.blobs) != 1 || fs.Stats()["blob_count"] != 1 {
+    t.Errorf("Expected the evicted key's blob to be collected")
+  }
+}
+
+func TestDeduplicationRejectsTheBlobDirectoryAsAKey(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  fs.Set(ctx, KEY, VALUE)
+
+  if err := fs.Set(ctx, BLOB_DIRECTORY_NAME, VALUE); !errors.Is(err, ErrReservedKey) {
+    t.Errorf("Expected setting %v to be refused, got %v", BLOB_DIRECTORY_NAME, err)
+  }
+  if _, err := fs.Get(ctx, BLOB_DIRECTORY_NAME); !errors.Is(err, ErrReservedKey) {
+    t.Errorf("Expected getting %v to be refused, got %v", BLOB_DIRECTORY_NAME, err)
+  }
+  if err := fs.Delete(ctx, BLOB_DIRECTORY_NAME); !errors.Is(err, ErrReservedKey) {
+    t.Errorf("Expected deleting %v to be refused, got %v", BLOB_DIRECTORY_NAME, err)
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Expected the blobs to be untouched, got %v, %v", val, err)
+  }
+}
+
+func TestDeduplicationRebuildsReferencesOnRestart(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  options := &FileStoreOptions{ EnableDeduplication: true }
+  fs, _ := MakeFileStore(directory, options)
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  // Simulate a crash after writing a blob, but before its key file.
+  orphan := fmt.Sprintf("%064d", 0)
+  os.WriteFile(fs.getBlobPath(orphan), []byte(VALUE_LARGE), 0644)
+
+  fs, _ = MakeFileStore(directory, options)
+  if _, ok := fs.blobs[orphan]; ok {
+    t.Errorf("Expected the orphaned blob to be collected")
+  }
+
+  if len(fs.blobs) != 1 {
+    t.Fatalf("Expected 1 blob, got %v", len(fs.blobs))
+  }
+  for _, blob := range fs.blobs {
+    if blob.references != 2 {
+      t.Errorf("Expected 2 references, got %v", blob.references)
+    }
+  }
+
+  // Values written with deduplication remain readable without it.
+  fs, _ = MakeFileStore(directory, nil)
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v, got %v, %v", KEY, VALUE, val, err)
+  }
+
+  fs.Set(ctx, KEY, VALUE_THAT_FITS)
+  fs.Set(ctx, KEY2, VALUE_THAT_FITS)
+  if len(fs.blobs) != 0 {
+    t.Errorf("Expected the blob to be collected once unreferenced")
+  }
+}
+
+func TestDeduplicationRotatesEncryptedBlobs(t *testing.T) {
+  ctx := context.Background()
+  oldKey := fmt.Sprintf("old %s", KEY_HEX)
+  fs := makeTestFileStore(t, &FileStoreOptions{
+    EnableDeduplication: true,
+    Keyring: loadTestKeyring(t, oldKey),
+  })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  rotated := loadTestKeyring(t, oldKey, fmt.Sprintf("new %s", KEY_HEX2))
+  if err := <-fs.RotateKeys(rotated); err != nil {
+    t.Errorf("Error rotating keys: %v", err)
+  }
+
+  for hash := range fs.blobs {
+    stored, _ := os.ReadFile(fs.getBlobPath(hash))
+    if keyId, _ := envelopeKeyId(stored); keyId != "new" {
+      t.Errorf("Expected blob to be encrypted with `new`, got %v", keyId)
+    }
+  }
+
+  for _, key := range []Key{ KEY, KEY2 } {
+    if val, err := fs.Get(ctx, key); err != nil || val != VALUE {
+      t.Errorf("Expected %v->%v, got %v, %v", key, VALUE, val, err)
+    }
+  }
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+  "bytes"
+  "compress/gzip"
+  "context"
+  "errors"
+  "fmt"
+  "io/ioutil"
+)
+
+// The codec used to encode a value on disk.
+type Codec byte
+
+const (
+  // The value is stored verbatim after the header.
+  CODEC_NONE Codec = 0
+  // The value is gzip compressed after the header.
+  CODEC_GZIP Codec = 1
+
+  // Values smaller than this are not worth compressing; the gzip framing
+  // alone is ~20 bytes.
+  MIN_COMPRESSION_SIZE_BYTES = 256
+)
+
+var (
+  // Every encoded value begins with this magic, followed by a single codec
+  // byte. Files written before encoding was introduced lack the magic; the
+  // FileStore gives them a header when it is opened.
+  ENCODING_MAGIC = []byte("BBKV")
+  ENCODING_HEADER_SIZE_BYTES = len(ENCODING_MAGIC) + 1
+)
+
+// A value in its stored encoding, e.g. the gzip compressed bytes of a value.
+type EncodedValue struct {
+  Codec Codec
+  // The value bytes, encoded with `Codec`. Does not include the header.
+  Bytes []byte
+  // The attributes stored alongside the value, or nil.
+  Attributes *Attributes
+}
+
+/**
+ * The HTTP Content-Encoding of the encoded bytes, or the empty string if the
+ * bytes are not encoded.
+ */
+func (e *EncodedValue) ContentEncoding() string {
+  if e.Codec == CODEC_GZIP {
+    return "gzip"
+  }
+  return ""
+}
+
+/**
+ * Decode the bytes back into the original value, or return an error if the
+ * bytes are corrupted or the codec is unknown.
+ */
+func (e *EncodedValue) Decode() (Value, error) {
+  switch e.Codec {
+  case CODEC_NONE:
+    return Value(e.Bytes), nil
+  case CODEC_GZIP:
+    reader, err := gzip.NewReader(bytes.NewReader(e.Bytes))
+    if err != nil {
+      return EMPTY_VALUE, err
+    }
+    defer reader.Close()
+    decompressed, err := ioutil.ReadAll(reader)
+    if err != nil {
+      return EMPTY_VALUE, err
+    }
+    return Value(decompressed), nil
+  }
+  return EMPTY_VALUE, errors.New(fmt.Sprintf("Unknown codec %v", e.Codec))
+}
+
+// A KeyValueStore which can return values in their stored encoding, e.g. to
+// send compressed bytes to a client without decompressing them first.
+type EncodedKeyValueStore interface {
+  KeyValueStore
+
+  /**
+   * Retrieve the value associated with this key in its stored encoding, or
+   * an error if no value is stored for this key.
+   */
+  GetEncoded(ctx context.Context, key Key) (*EncodedValue, error)
+}
+
+/**
+ * Encode a value, prefixed with a header recording the codec and any
+ * attributes. Values are only compressed if `compress` is set and compression
+ * actually saves space.
+ */
+func encodeValue(value Value, attributes *Attributes, compress bool) ([]byte, error) {
+  codec := CODEC_NONE
+  payload := []byte(value)
+
+  if compress && value.SizeOfBytes() >= MIN_COMPRESSION_SIZE_BYTES {
+    var buffer bytes.Buffer
+    writer := gzip.NewWriter(&buffer)
+    if _, err := writer.Write(payload); err != nil {
+      return nil, err
+    }
+    if err := writer.Close(); err != nil {
+      return nil, err
+    }
+
+    // Skip compression for incompressible values, e.g. already compressed
+    // build artifacts.
+    if buffer.Len() < len(payload) {
+      codec = CODEC_GZIP
+      payload = buffer.Bytes()
+    }
+  }
+
+  attributesSection, err := encodeAttributes(attributes)
+  if err != nil {
+    return nil, err
+  }
+
+  encoded := make([]byte, 0,
+    len(attributesSection) + ENCODING_HEADER_SIZE_BYTES + len(payload))
+  encoded = append(encoded, attributesSection...)
+  encoded = append(encoded, ENCODING_MAGIC...)
+  encoded = append(encoded, byte(codec))
+  encoded = append(encoded, payload...)
+  return encoded, nil
+}
+
+/**
+ * Parse the attributes and header of bytes read from disk. Return an error if
+ * the header is missing, as every value is written with one.
+ */
+func parseEncodedValue(stored []byte) (*EncodedValue, error) {
+  attributes, stored, err := splitAttributes(stored)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(stored) < ENCODING_HEADER_SIZE_BYTES ||
+      !bytes.Equal(stored[:len(ENCODING_MAGIC)], ENCODING_MAGIC) {
+    return nil, errors.New("Stored value is missing its encoding header")
+  }
+
+  return &EncodedValue{
+    Codec: Codec(stored[len(ENCODING_MAGIC)]),
+    Bytes: stored[ENCODING_HEADER_SIZE_BYTES:],
+    Attributes: attributes,
+  }, nil
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+)
+
+const (
+  // The longest key ID that fits in the envelope's single length byte.
+  MAX_KEY_ID_LENGTH = 255
+)
+
+var (
+  // Every encrypted value begins with this magic, followed by a length
+  // prefixed key ID, a nonce and the AES-GCM ciphertext of the encoded value.
+  ENCRYPTION_MAGIC = []byte("BBKE")
+
+  // Returned (wrapped) when a stored value cannot be decrypted, e.g. because
+  // it was tampered with or its key is missing from the keyring.
+  ErrIntegrity = errors.New("Integrity check failed")
+)
+
+// A set of AES keys, indexed by key ID. New values are encrypted with the
+// active key; older keys are retained so existing values remain readable
+// until they are rotated.
+type Keyring struct {
+  // Maps a key ID to its AES-GCM cipher.
+  ciphers map[string]cipher.AEAD
+  // The ID of the key used to encrypt new values.
+  activeKeyId string
+}
+
+/**
+ * Load a keyring from a local keyfile. Each non-empty line holds a key ID and
+ * a hex encoded 16, 24 or 32 byte AES key, e.g. `2022-06 <64 hex chars>`.
+ * Lines beginning with `#` are ignored. The last key in the file is active.
+ * Key IDs must be unique.
+ */
+func LoadKeyring(path string) (*Keyring, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  k := &Keyring{}
+  k.ciphers = make(map[string]cipher.AEAD)
+
+  seen := make(map[string]bool)
+  scanner := bufio.NewScanner(file)
+  for lineNumber := 1; scanner.Scan(); lineNumber++ {
+    line := strings.TrimSpace(scanner.Text())
+    if len(line) == 0 || strings.HasPrefix(line, "#") {
+      continue
+    }
+
+    tokens := strings.Fields(line)
+    if len(tokens) != 2 {
+      return nil, errors.New(fmt.Sprintf("Malformed keyfile line %v", lineNumber))
+    }
+
+    keyId := tokens[0]
+    if len(keyId) > MAX_KEY_ID_LENGTH {
+      return nil, errors.New(fmt.Sprintf("Key ID too long on keyfile line %v",
+lineNumber))
+    }
+    if seen[keyId] {
+      // The later key would silently shadow the earlier one.
+      return nil, errors.New(fmt.Sprintf("Duplicate key ID %v on keyfile line %v",
+keyId, lineNumber))
+    }
+    seen[keyId] = true
+
+    key, err := hex.DecodeString(tokens[1])
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Malformed key on keyfile line %v: %v",
+lineNumber, err))
+    }
+
+    if err := k.AddKey(keyId, key); err != nil {
+      return nil, err
+    }
+  }
+
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+
+  if len(k.ciphers) == 0 {
+    return nil, errors.New(fmt.Sprintf("No keys found in keyfile %v", path))
+  }
+
+  return k, nil
+}
+
+/**
+ * Add a key to the keyring and make it the active key. Return an error if
+ * the key is not a valid AES key.
+ */
+func (k *Keyring) AddKey(keyId string, key []byte) error {
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return err
+  }
+
+  gcm, err := cipher.NewGCM(block)
+  if err != nil {
+    return err
+  }
+
+  k.ciphers[keyId] = gcm
+  k.activeKeyId = keyId
+  return nil
+}
+
+// The ID of the key used to encrypt new values.
+func (k *Keyring) ActiveKeyId() string {
+  return k.activeKeyId
+}
+
+/**
+ * Encrypt the bytes with the active key, returning the envelope that should
+ * be written to disk.
+ */
+func (k *Keyring) encrypt(plaintext []byte) ([]byte, error) {
+  gcm := k.ciphers[k.activeKeyId]
+  nonce := make([]byte, gcm.NonceSize())
+  if _, err := rand.Read(nonce); err != nil {
+    return nil, err
+  }
+
+  header := make([]byte, 0, len(ENCRYPTION_MAGIC) + 1 + len(k.activeKeyId))
+  header = append(header, ENCRYPTION_MAGIC...)
+  header = append(header, byte(len(k.activeKeyId)))
+  header = append(header, k.activeKeyId...)
+
+  // The header is authenticated, so the key ID cannot be swapped.
+  envelope := append(header, nonce...)
+  return gcm.Seal(envelope, nonce, plaintext, header), nil
+}
+
+/**
+ * Decrypt an envelope written by `encrypt`. Any failure is reported as an
+ * ErrIntegrity.
+ */
+func (k *Keyring) decrypt(envelope []byte) ([]byte, error) {
+  keyId, ok := envelopeKeyId(envelope)
+  if !ok {
+    return nil, fmt.Errorf("%w: malformed envelope", ErrIntegrity)
+  }
+
+  gcm, ok := k.ciphers[keyId]
+  if !ok {
+    return nil, fmt.Errorf("%w: unknown key ID %v", ErrIntegrity, keyId)
+  }
+
+  headerSize := len(ENCRYPTION_MAGIC) + 1 + len(keyId)
+  if len(envelope) < headerSize + gcm.NonceSize() {
+    return nil, fmt.Errorf("%w: truncated envelope", ErrIntegrity)
+  }
+
+  header := envelope[:headerSize]
+  nonce := envelope[headerSize:headerSize + gcm.NonceSize()]
+  ciphertext := envelope[headerSize + gcm.NonceSize():]
+  plaintext, err := gcm.Open(nil, nonce, ciphertext, header)
+  if err != nil {
+    return nil, fmt.Errorf("%w: %v", ErrIntegrity, err)
+  }
+  return plaintext, nil
+}
+
+// Return whether the stored bytes are an encryption envelope.
+func isEncrypted(stored []byte) bool {
+  return bytes.HasPrefix(stored, ENCRYPTION_MAGIC)
+}
+
+// Return the ID of the key which encrypted the envelope, or false if the
+// envelope is malformed.
+func envelopeKeyId(envelope []byte) (string, bool) {
+  if !isEncrypted(envelope) || len(envelope) < len(ENCRYPTION_MAGIC) + 1 {
+    return "", false
+  }
+
+  keyIdLength := int(envelope[len(ENCRYPTION_MAGIC)])
+  keyIdStart := len(ENCRYPTION_MAGIC) + 1
+  if len(envelope) < keyIdStart + keyIdLength {
+    return "", false
+  }
+  return string(envelope[keyIdStart:keyIdStart + keyIdLength]), true
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+const (
+  KEY_HEX = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+  KEY_HEX2 = "0f0e0d0c0b0a090807060504030201000f0e0d0c0b0a09080706050403020100"
+)
+
+// Write a keyfile containing the lines, returning its path.
+func writeKeyfile(t *testing.T, lines ...string) string {
+  path := filepath.Join(t.TempDir(), "keyfile")
+  if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+    t.Fatalf("Error writing keyfile: %v", err)
+  }
+  return path
+}
+
+func loadTestKeyring(t *testing.T, lines ...string) *Keyring {
+  keyring, err := LoadKeyring(writeKeyfile(t, lines...))
+  if err != nil {
+    t.Fatalf("Error loading keyring: %v", err)
+  }
+  return keyring
+}
+
+func TestLoadKeyringUsesLastKey(t *testing.T) {
+  keyring := loadTestKeyring(t,
+    "# A comment.",
+    fmt.Sprintf("old %s", KEY_HEX),
+    "",
+    fmt.Sprintf("new %s", KEY_HEX2))
+
+  if keyring.ActiveKeyId() != "new" {
+    t.Errorf("Expected active key `new`, got %v", keyring.ActiveKeyId())
+  }
+}
+
+func TestLoadKeyringRejectsMalformedKeys(t *testing.T) {
+  if _, err := LoadKeyring(writeKeyfile(t, "key not-hex")); err == nil {
+    t.Errorf("Expected an error for a non-hex key")
+  }
+
+  if _, err := LoadKeyring(writeKeyfile(t, "key 0011")); err == nil {
+    t.Errorf("Expected an error for a key of invalid length")
+  }
+
+  if _, err := LoadKeyring(writeKeyfile(t, "# No keys.")); err == nil {
+    t.Errorf("Expected an error for an empty keyfile")
+  }
+
+  duplicate := writeKeyfile(t, fmt.Sprintf("key %s", KEY_HEX), fmt.Sprintf("key %s", KEY_HEX2))
+  if _, err := LoadKeyring(duplicate); err == nil || !strings.Contains(err.Error(), "Duplicate key ID") {
+    t.Errorf("Expected an error for a duplicate key ID, got %v", err)
+  }
+}
+
+func TestFileStoreEncryptsValues(t *testing.T) {
+  ctx := context.Background()
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs := makeTestFileStore(t, &FileStoreOptions{ Keyring: keyring })
+  fs.Set(ctx, KEY, VALUE)
+
+  stored, _ := os.ReadFile(fs.getFilePath(KEY, fs.directory))
+  if bytes.Contains(stored, []byte(VALUE)) {
+    t.Errorf("Expected %v to be encrypted on disk", KEY)
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Error retrieving encrypted %v: %v", KEY, err)
+  }
+}
+
+func TestFileStoreEncryptsCompressedValues(t *testing.T) {
+  ctx := context.Background()
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs := makeTestFileStore(t,
+    &FileStoreOptions{ EnableCompression: true, Keyring: keyring })
+  value := Value(strings.Repeat("compressible ", 100))
+  fs.Set(ctx, KEY, value)
+
+  if encoded, err := fs.GetEncoded(ctx, KEY); err != nil || encoded.Codec != CODEC_GZIP {
+    t.Errorf("Expected %v to be compressed beneath the encryption", KEY)
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != value {
+    t.Errorf("Error retrieving encrypted %v: %v", KEY, err)
+  }
+}
+
+func TestFileStoreReportsTamperingAsIntegrityError(t *testing.T) {
+  ctx := context.Background()
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs := makeTestFileStore(t, &FileStoreOptions{ Keyring: keyring })
+  fs.Set(ctx, KEY, VALUE)
+
+  path := fs.getFilePath(KEY, fs.directory)
+  stored, _ := os.ReadFile(path)
+  stored[len(stored) - 1] ^= 0xff
+  os.WriteFile(path, stored, 0644)
+
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error, got %v", err)
+  }
+}
+
+func TestFileStoreReportsUnknownKeyAsIntegrityError(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs, _ := MakeFileStore(directory, &FileStoreOptions{ Keyring: keyring })
+  fs.Set(ctx, KEY, VALUE)
+
+  otherKeyring := loadTestKeyring(t, fmt.Sprintf("other %s", KEY_HEX2))
+  fs, _ = MakeFileStore(directory, &FileStoreOptions{ Keyring: otherKeyring })
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error, got %v", err)
+  }
+
+  fs, _ = MakeFileStore(directory, nil)
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error without a keyring, got %v", err)
+  }
+}
+
+func TestFileStoreRotateKeysReencryptsValues(t *testing.T) {
+  ctx := context.Background()
+  oldKey := fmt.Sprintf("old %s", KEY_HEX)
+  fs := makeTestFileStore(t, nil)
+  // A plaintext value written before encryption was enabled.
+  fs.Set(ctx, KEY, VALUE)
+
+  fs.keyring = loadTestKeyring(t, oldKey)
+  fs.Set(ctx, KEY2, VALUE_THAT_FITS)
+
+  rotated := loadTestKeyring(t, oldKey, fmt.Sprintf("new %s", KEY_HEX2))
+  if err := <-fs.RotateKeys(rotated); err != nil {
+    t.Errorf("Error rotating keys: %v", err)
+  }
+
+  for _, key := range []Key{ KEY, KEY2 } {
+    stored, _ := os.ReadFile(fs.getFilePath(key, fs.directory))
+    if keyId, _ := envelopeKeyId(stored); keyId != "new" {
+      t.Errorf("Expected %v to be encrypted with `new`, got %v", key, keyId)
+    }
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Error retrieving rotated %v: %v", KEY, err)
+  }
+
+  if val, err := fs.Get(ctx, KEY2); err != nil || val != VALUE_THAT_FITS {
+    t.Errorf("Error retrieving rotated %v: %v", KEY2, err)
+  }
+}
+
+func TestFileStoreRefusesPlaintextOnceEncrypted(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  fs, _ := MakeFileStore(directory, nil)
+  // A plaintext value written before encryption was enabled.
+  fs.Set(ctx, KEY, VALUE)
+  plaintext, _ := os.ReadFile(fs.getFilePath(KEY, fs.directory))
+
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs, _ = MakeFileStore(directory, &FileStoreOptions{ Keyring: keyring })
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Expected plaintext to be served before rotation, got %v %v", val, err)
+  }
+  if err := <-fs.RotateKeys(keyring); err != nil {
+    t.Fatalf("Error rotating keys: %v", err)
+  }
+
+  // Swap the plaintext file back in, both before and after a restart.
+  path := fs.getFilePath(KEY, fs.directory)
+  os.WriteFile(path, plaintext, 0644)
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error, got %v", err)
+  }
+  fs, _ = MakeFileStore(directory, &FileStoreOptions{ Keyring: keyring })
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error after a restart, got %v", err)
+  }
+
+  // Disabling encryption allows plaintext again.
+  fs, _ = MakeFileStore(directory, nil)
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Expected plaintext to be served without a keyring, got %v %v", val, err)
+  }
+}
+
+func TestNewEncryptedFileStoreRefusesPlaintext(t *testing.T) {
+  ctx := context.Background()
+  keyring := loadTestKeyring(t, fmt.Sprintf("key %s", KEY_HEX))
+  fs := makeTestFileStore(t, &FileStoreOptions{ Keyring: keyring })
+  encoded, _ := encodeValue(VALUE, nil, false)
+  os.WriteFile(fs.getFilePath(KEY, fs.directory), encoded, 0644)
+
+  if _, err := fs.Get(ctx, KEY); !errors.Is(err, ErrIntegrity) {
+    t.Errorf("Expected an integrity error, got %v", err)
+  }
+}
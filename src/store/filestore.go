@@ -1,13 +1,36 @@
 package store
 
 import (
+  "context"
+  "errors"
   "fmt"
   "os"
+  "path/filepath"
+  "sort"
   "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
 )
 
 const (
   TEMP_DIRECTORY_NAME = "tmp"
+  // A subdirectory marking a store whose key files all begin with a header;
+  // see encodeValue. Stores without it were written before headers were
+  // introduced, and their files hold plain values.
+  FORMAT_MARKER_NAME = "format-v2"
+  // Stages headered copies of a legacy store's files while it is upgraded.
+  UPGRADE_DIRECTORY_NAME = "upgrade"
+  // A subdirectory of the format marker, marking a store whose files are
+  // all encrypted; see FileStore.requireEncryption.
+  ENCRYPTED_MARKER_NAME = "encrypted"
+)
+
+var (
+  // Returned by writes which would take a FileStore beyond its quota.
+  ErrQuotaExceeded = errors.New("Quota exceeded")
+  // Returned (wrapped) for keys which name one of the FileStore's own
+  // subdirectories, and so cannot be stored.
+  ErrReservedKey = errors.New("Reserved key")
 )
 
 /**
@@ -16,11 +39,25 @@ const (
  *
  * <p> We enforce a deterministic strategy for identifying a 
  * filename given a Key. Currently, the key is the filename. We may use
- * hashing to give some security, and compression for the value type.
+ * hashing to give some security.
+ *
+ * <p> Values are written with a small header recording their codec, and are
+ * optionally gzip compressed (see `FileStoreOptions`). Stores written before
+ * headers were introduced are upgraded when opened, rather than guessing
+ * from each file's first bytes whether it has a header. Values may
+ * additionally be encrypted at rest with AES-GCM; see `Keyring`.
  *
  * <p> Files are created in a temporary subdirectory of `FileStore.directory`.
  * On write completion, they are moved into `FileStore.directory`. This enables
  * protection against partial writes due to server failure.  
+ *
+ * <p> The store may be given a byte and file count budget. Once a write
+ * exceeds the budget, the least recently accessed keys are evicted. It may
+ * also be given a byte and key count quota, beyond which writes are refused.
+ *
+ * <p> With deduplication enabled, value bodies are stored once per content
+ * hash in a `blobs` subdirectory, and key files hold a reference to their
+ * blob. Blobs are deleted once no key references them.
  */
 type FileStore struct {
   // The absolute path where which holds permanent files.
@@ -28,10 +65,44 @@ type FileStore struct {
   // The temporary directory which holds temporary files. This directory 
   // will be cleared on FileStore instantiation. 
   tempDirectory string
+  // Whether values should be compressed before being written to disk.
+  enableCompression bool
+  // The keys used to encrypt values, or nil if values are stored in
+  // plaintext.
+  keyring *Keyring
+  // Whether plaintext files are refused as tampered with. Set once every
+  // file is known to be encrypted: when a new store is opened with a
+  // keyring, or once a key rotation completes, which encrypts any plaintext.
+  // Opening the store without a keyring clears it.
+  requireEncryption bool
+  // The maximum total size of every file, in bytes, or 0 if unlimited.
+  maxBytes int64
+  // The maximum number of files, or 0 if unlimited.
+  maxFiles int
+  // The total size and number of keys beyond which writes are refused, or 0
+  // if unlimited.
+  quotaBytes int64
+  quotaKeys int
+  // Tracks the size and access order of every file.
+  usage *usageIndex
+  // The number of files evicted to stay within budget.
+  evictions int64
+  // Whether identical values should be stored once, as a shared blob.
+  enableDeduplication bool
+  // The directory which holds deduplicated blobs, named by content hash.
+  blobDirectory string
+  // Every blob, keyed by content hash.
+  blobs map[string]*blobEntry
+  // The total size of every blob, in bytes.
+  blobSizeBytes int64
   // A mutex used to synchronize access to the underlying file directory.
   // A RW lock _may_ improve performance; I'm not sure what the concurrency
   // requirements are of a UNIX based file system.
   mutex *sync.Mutex
+  // Logs evictions and background errors; may be nil.
+  logger *logging.Logger
+  // Called with every key evicted or expired, or nil; see OnEvict.
+  onEvict func(key Key)
 }
 
 /** 
@@ -39,45 +110,740 @@ type FileStore struct {
  * conflict. If the operation was successful, return nil; otherwise, report the
  * error that occurred (e.g. an IO failure during file creation.)
  */
-func (f *FileStore) Set(key Key, value Value) error {
+func (f *FileStore) Set(ctx context.Context, key Key, value Value) error {
+  return f.SetWithAttributes(ctx, key, value, nil)
+}
+
+/**
+ * Store the key/value pair on disk along with its attributes, which may be
+ * nil. Expired values are removed when next read.
+ *
+ * <p> Calls whose context ends while waiting for other writes, or before the
+ * key's file is committed, are abandoned without changing the store.
+ */
+func (f *FileStore) SetWithAttributes(
+    ctx context.Context,
+    key Key,
+    value Value,
+    attributes *Attributes) error {
+    if err := checkKey(key); err != nil {
+      return err
+    }
     defer f.mutex.Unlock()
     f.mutex.Lock()
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    // The blob the key currently references, to release once overwritten.
+    previousHash, hadReference := f.referencedBlob(key)
+
+    var stored []byte
+    var hash string
+    var err error
+    if f.enableDeduplication {
+      stored, hash, err = f.storeBlob(key, value, attributes)
+    } else if stored, err = f.encodeForDisk(value, attributes); err == nil {
+      err = f.checkBudget(key, int64(len(stored)))
+    }
+    if err != nil {
+      return err
+    }
+
+    if err := f.checkQuota(key, int64(len(stored))); err != nil {
+      if f.enableDeduplication {
+        // Collect the blob if this key would have been its only reference.
+        f.collectBlob(hash)
+      }
+      return err
+    }
+  
+    err = ctx.Err()
+    if err == nil {
+      err = f.writeFile(f.getFilePath(key, f.directory), stored)
+    }
+    if err != nil {
+      if f.enableDeduplication {
+        // Collect the blob if this key would have been its only reference.
+        f.collectBlob(hash)
+      }
+      return err
+    }
+
+    if f.enableDeduplication {
+      f.retainBlob(hash)
+    }
+    if hadReference {
+      f.releaseBlob(previousHash)
+    }
+
+    f.usage.onWrite(key, int64(len(stored)))
+    return f.evictIfNeeded(key)
+}
+
+/**
+ * Return an error if a value of the given on-disk size alone would exceed
+ * the byte budget.
+ */
+func (f *FileStore) checkBudget(key Key, sizeBytes int64) error {
+  if f.maxBytes > 0 && sizeBytes > f.maxBytes {
+    return errors.New(fmt.Sprintf(
+      "Value too large; cannot store %v (%v bytes) in filestore of size %v",
+      key, sizeBytes, f.maxBytes))
+  }
+  return nil
+}
+
+/**
+ * Return an error wrapping ErrQuotaExceeded if writing the key's file with
+ * the given on-disk size would exceed the quota. Any blob the write stores
+ * is counted, but blobs it would release are not, so the check errs on the
+ * side of refusing.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) checkQuota(key Key, sizeBytes int64) error {
+  var currentBytes int64
+  entry, exists := f.usage.entries[key]
+  if exists {
+    currentBytes = entry.sizeBytes
+  }
+
+  if f.quotaKeys > 0 && !exists && f.usage.fileCount() >= f.quotaKeys {
+    return fmt.Errorf("%w: cannot store %v beyond %v keys", ErrQuotaExceeded, key, f.quotaKeys)
+  }
+  if f.quotaBytes > 0 && f.diskUsageBytes() - currentBytes + sizeBytes > f.quotaBytes {
+    return fmt.Errorf("%w: cannot store %v (%v bytes) beyond %v bytes",
+      ErrQuotaExceeded, key, sizeBytes, f.quotaBytes)
+  }
+  return nil
+}
+
+/**
+ * Evict the least recently accessed keys until the store is within its
+ * budget. The key that was just written is never evicted.
+ *
+ * <p> This method assumes the mutex is held, so eviction cannot race with
+ * concurrent reads.
+ */
+func (f *FileStore) evictIfNeeded(justWritten Key) error {
+  for (f.maxBytes > 0 && f.diskUsageBytes() > f.maxBytes) ||
+      (f.maxFiles > 0 && f.usage.fileCount() > f.maxFiles) {
+    key, ok := f.usage.leastRecentlyAccessed(justWritten)
+    if !ok {
+      return nil
+    }
+
+    if err := f.removeKeyFile(key); err != nil {
+      return err
+    }
+    f.evictions++
+    f.logger.Debug("Evicted key", "key", key)
+    if f.onEvict != nil {
+      f.onEvict(key)
+    }
+  }
+  return nil
+}
+
+/**
+ * Call `fn` with every key the store removes by itself, whether evicted to
+ * stay within its budget or expired, e.g. to drop it from a cache. `fn` is
+ * called with the mutex held, so must not call back into the store. Must be
+ * called before the store is used.
+ */
+func (f *FileStore) OnEvict(fn func(key Key)) {
+  f.onEvict = fn
+}
+
+/**
+ * Remove the key's file, releasing any blob it references.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) removeKeyFile(key Key) error {
+  hash, hasReference := f.referencedBlob(key)
+
+  err := os.Remove(f.getFilePath(key, f.directory))
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  f.usage.onRemove(key)
+  if hasReference {
+    f.releaseBlob(hash)
+  }
+  return nil
+}
+
+/**
+ * The total size of every key file and blob, in bytes.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) diskUsageBytes() int64 {
+  return f.usage.sizeBytes + f.blobSizeBytes
+}
+
+/**
+ * Wait for any write in progress, then sync the store's directories, so
+ * that the renames which completed writes survive a crash.
+ */
+func (f *FileStore) Close() error {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
 
-    filePath := f.getFilePath(key, f.tempDirectory)
+  directories := []string{ f.directory }
+  if f.enableDeduplication {
+    directories = append(directories, f.blobDirectory)
+  }
+  for _, directory := range directories {
+    if err := syncDirectory(directory); err != nil {
+      return fmt.Errorf("Error syncing %v: %w", directory, err)
+    }
+  }
+  return nil
+}
+
+/**
+ * Check that the temporary directory, which is emptied when the store is
+ * made, is present and that the disk is writable.
+ */
+func (f *FileStore) CheckHealth() error {
+  return probeWritable(f.tempDirectory)
+}
+
+// Return an error unless a file can be written to and removed from the
+// directory.
+func probeWritable(directory string) error {
+  probe, err := os.CreateTemp(directory, ".probe-*")
+  if err != nil {
+    return fmt.Errorf("Directory %v is not writable: %w", directory, err)
+  }
+  _, err = probe.Write([]byte("probe"))
+  if closeErr := probe.Close(); err == nil {
+    err = closeErr
+  }
+  if removeErr := os.Remove(probe.Name()); err == nil {
+    err = removeErr
+  }
+  if err != nil {
+    return fmt.Errorf("Directory %v is not writable: %w", directory, err)
+  }
+  return nil
+}
+
+func syncDirectory(directory string) error {
+  handle, err := os.Open(directory)
+  if err != nil {
+    return err
+  }
+  if err := handle.Sync(); err != nil {
+    handle.Close()
+    return err
+  }
+  return handle.Close()
+}
+
+/**
+ * Report disk usage against the budget and quota, the number of evictions,
+ * and the number of deduplicated blobs.
+ */
+func (f *FileStore) Stats() map[string]int64 {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+  return map[string]int64{
+    "size_bytes": f.diskUsageBytes(),
+    "max_bytes": f.maxBytes,
+    "file_count": int64(f.usage.fileCount()),
+    "max_files": int64(f.maxFiles),
+    "quota_bytes": f.quotaBytes,
+    "quota_keys": int64(f.quotaKeys),
+    "evictions": f.evictions,
+    "blob_count": int64(len(f.blobs)),
+    "blob_size_bytes": f.blobSizeBytes,
+  }
+}
+
+/**
+ * Write the bytes to a file, via a temporary file so that readers never
+ * observe a partial write.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) writeFile(filePath string, stored []byte) error {
+    tmpPath := f.getFilePath(Key(filepath.Base(filePath)), f.tempDirectory)
     tmpFile, err := 
-      os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+      os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
     if err != nil {
       // IO Error when opening the file; return the error.
       return err
     }
 
-    // Write the value into the opened file.
-    _, err2 := tmpFile.Write([]byte(value))
+    // Write the encoded value into the opened file.
+    _, err2 := tmpFile.Write(stored)
     if err2 != nil {
       // On failure, close the opened file handle.
       tmpFile.Close()
       return err2
     }
   
-    return f.onTmpFileComplete(key, tmpFile)
+    return f.onTmpFileComplete(tmpFile, filePath)
 }
 
 /** 
  * Read the key/value pair from disk. Return the stored value, or any errors
  * that may have occurred when reading the file.
  */
-func (f *FileStore) Get(key Key) (Value, error) {
+func (f *FileStore) Get(ctx context.Context, key Key) (Value, error) {
+  value, _, err := f.GetWithAttributes(ctx, key)
+  return value, err
+}
+
+/**
+ * Read the key/value pair and its attributes from disk. Expired values and
+ * tombstones are reported as missing.
+ */
+func (f *FileStore) GetWithAttributes(ctx context.Context, key Key) (Value, *Attributes, error) {
+  encoded, err := f.GetEncoded(ctx, key)
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+
+  value, err := encoded.Decode()
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+  return value, encoded.Attributes, nil
+}
+
+/**
+ * Read the key/value pair and its attributes from disk, returning
+ * tombstones, including those of expired versioned values.
+ */
+func (f *FileStore) GetVersioned(ctx context.Context, key Key) (Value, *Attributes, error) {
+  encoded, err := f.getEncoded(ctx, key)
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+
+  value, err := encoded.Decode()
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+  return value, encoded.Attributes, nil
+}
+
+/**
+ * Remove the key's file, releasing any blob it references. Calls whose
+ * context ends while waiting for other writes are abandoned.
+ */
+func (f *FileStore) Delete(ctx context.Context, key Key) error {
+  if err := checkKey(key); err != nil {
+    return err
+  }
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+
+  return f.removeKeyFile(key)
+}
+
+/**
+ * Return every key on disk, in sorted order.
+ */
+func (f *FileStore) Keys(ctx context.Context) ([]Key, error) {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+
+  keys := make([]Key, 0, f.usage.fileCount())
+  for key := range f.usage.entries {
+    keys = append(keys, key)
+  }
+  sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+  return keys, nil
+}
+
+/**
+ * Read the key/value pair from disk without decoding it, e.g. so that
+ * compressed bytes can be served to a client as-is. Tombstones are reported
+ * as missing.
+ */
+func (f *FileStore) GetEncoded(ctx context.Context, key Key) (*EncodedValue, error) {
+  encoded, err := f.getEncoded(ctx, key)
+  if err != nil {
+    return nil, err
+  }
+  if encoded.Attributes != nil && encoded.Attributes.Deleted {
+    return nil, tombstoneError(key)
+  }
+  return encoded, nil
+}
+
+// Read the key/value pair from disk without decoding it, or its tombstone.
+func (f *FileStore) getEncoded(ctx context.Context, key Key) (*EncodedValue, error) {
+  if err := checkKey(key); err != nil {
+    return nil, err
+  }
   defer f.mutex.Unlock()
   f.mutex.Lock()
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
   // Only search the directory of fully written files.
   filePath := f.getFilePath(key, f.directory)
-  value, err := os.ReadFile(filePath)
+  stored, err := os.ReadFile(filePath)
   if err != nil {
     // Error when reading the file (e.g. corrupted file, file missing).
-    return "", err
+    return nil, err
+  }
+
+  // Follow a reference to its deduplicated blob.
+  if hash, ok := parseReference(stored); ok {
+    if stored, err = os.ReadFile(f.getBlobPath(hash)); err != nil {
+      return nil, err
+    }
   }
  
-  return Value(value), nil
+  encoded, err := f.decodeFromDisk(stored)
+  if err != nil {
+    return nil, err
+  }
+
+  // Lazily remove expired values. Versioned values read as tombstones
+  // instead, which keep their version.
+  if encoded.Attributes.Expired(time.Now()) {
+    if tombstone := expiredTombstone(encoded.Attributes); tombstone != nil {
+      return &EncodedValue{ Codec: CODEC_NONE, Attributes: tombstone }, nil
+    }
+    if err := f.removeKeyFile(key); err != nil {
+      f.logger.Warn("Error removing expired key", "key", key, "err", err)
+    } else if f.onEvict != nil {
+      f.onEvict(key)
+    }
+    return nil, expiredError(key)
+  }
+
+  f.usage.onRead(key)
+  return encoded, nil
+}
+
+// Return an error if the key names one of the store's own subdirectories.
+func checkKey(key Key) error {
+  switch key {
+  case TEMP_DIRECTORY_NAME, FORMAT_MARKER_NAME, UPGRADE_DIRECTORY_NAME, BLOB_DIRECTORY_NAME:
+    return fmt.Errorf("%w: %v", ErrReservedKey, key)
+  }
+  return nil
+}
+
+/**
+ * Encode a value and its attributes into the bytes written to disk: the
+ * value is optionally compressed, and then optionally encrypted along with
+ * its attributes.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) encodeForDisk(value Value, attributes *Attributes) ([]byte, error) {
+  encoded, err := encodeValue(value, attributes, f.enableCompression)
+  if err != nil {
+    return nil, err
+  }
+
+  if f.keyring == nil {
+    return encoded, nil
+  }
+  return f.keyring.encrypt(encoded)
+}
+
+/**
+ * Reverse `encodeForDisk`, decrypting the bytes if need be. Values may have
+ * been written with any combination of options, so both encrypted and
+ * plaintext files are accepted, until every file is known to be encrypted.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) decodeFromDisk(stored []byte) (*EncodedValue, error) {
+  if !isEncrypted(stored) {
+    if f.requireEncryption {
+      return nil, fmt.Errorf("%w: value is not encrypted", ErrIntegrity)
+    }
+    return parseEncodedValue(stored)
+  }
+
+  if f.keyring == nil {
+    return nil, fmt.Errorf("%w: value is encrypted but no keyring is loaded",
+      ErrIntegrity)
+  }
+
+  plaintext, err := f.keyring.decrypt(stored)
+  if err != nil {
+    return nil, err
+  }
+  return parseEncodedValue(plaintext)
+}
+
+/**
+ * Replace the keyring, and re-encrypt every existing value with its active
+ * key on a background goroutine. Plaintext values are encrypted as well, and
+ * once every value has been rotated, plaintext files are refused. Reads and
+ * writes continue to be served during rotation. The returned channel
+ * receives the first error encountered, or nil once every value has been
+ * rotated.
+ */
+func (f *FileStore) RotateKeys(keyring *Keyring) <-chan error {
+  f.mutex.Lock()
+  f.keyring = keyring
+  f.mutex.Unlock()
+
+  done := make(chan error, 1)
+  go func() {
+    var firstErr error
+    // Keep rotating the remaining values on failure, e.g. if a single value
+    // is corrupted.
+    onError := func(name string, err error) {
+      f.logger.Error("Error rotating key", "file", name, "err", err)
+      if firstErr == nil {
+        firstErr = err
+      }
+    }
+
+    keys, err := listFiles(f.directory)
+    if err != nil {
+      done <- err
+      return
+    }
+    for _, key := range keys {
+      if err := f.reencryptKey(Key(key)); err != nil {
+        onError(key, err)
+      }
+    }
+
+    hashes, err := listFiles(f.blobDirectory)
+    if err != nil {
+      done <- err
+      return
+    }
+    for _, hash := range hashes {
+      if err := f.reencryptBlob(hash); err != nil {
+        onError(hash, err)
+      }
+    }
+
+    if firstErr == nil {
+      f.mutex.Lock()
+      firstErr = f.markEncrypted(true)
+      f.mutex.Unlock()
+    }
+    done <- firstErr
+  }()
+  return done
+}
+
+/**
+ * Re-encrypt a single key's value with the current keyring's active key.
+ * Keys referencing a blob are skipped; the blob is rotated instead.
+ */
+func (f *FileStore) reencryptKey(key Key) error {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+
+  sizeBytes, err := f.reencryptFile(f.getFilePath(key, f.directory))
+  if err != nil || sizeBytes < 0 {
+    return err
+  }
+  f.usage.onResize(key, sizeBytes)
+  return nil
+}
+
+/**
+ * Re-encrypt a single deduplicated blob with the current keyring's active
+ * key.
+ */
+func (f *FileStore) reencryptBlob(hash string) error {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+
+  sizeBytes, err := f.reencryptFile(f.getBlobPath(hash))
+  if err != nil || sizeBytes < 0 {
+    return err
+  }
+
+  if blob, ok := f.blobs[hash]; ok {
+    f.blobSizeBytes += sizeBytes - blob.sizeBytes
+    blob.sizeBytes = sizeBytes
+  }
+  return nil
+}
+
+/**
+ * Re-encrypt a file with the current keyring's active key, unless it is
+ * already encrypted with that key. Return the new size of the file, or -1 if
+ * the file was left untouched.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (f *FileStore) reencryptFile(filePath string) (int64, error) {
+  keyring := f.keyring
+
+  stored, err := os.ReadFile(filePath)
+  if os.IsNotExist(err) {
+    // The file was removed since rotation began.
+    return -1, nil
+  } else if err != nil {
+    return -1, err
+  }
+
+  // References hold no value.
+  if _, ok := parseReference(stored); ok {
+    return -1, nil
+  }
+
+  plaintext := stored
+  if isEncrypted(stored) {
+    if keyId, _ := envelopeKeyId(stored); keyId == keyring.ActiveKeyId() {
+      return -1, nil
+    }
+
+    if plaintext, err = keyring.decrypt(stored); err != nil {
+      return -1, err
+    }
+  }
+
+  envelope, err := keyring.encrypt(plaintext)
+  if err != nil {
+    return -1, err
+  }
+
+  if err := f.writeFile(filePath, envelope); err != nil {
+    return -1, err
+  }
+  return int64(len(envelope)), nil
+}
+
+/**
+ * Record whether every file is encrypted, so that it survives restarts.
+ *
+ * <p> This method assumes the mutex is held, if the store is in use.
+ */
+func (f *FileStore) markEncrypted(encrypted bool) error {
+  markerPath := filepath.Join(f.directory, FORMAT_MARKER_NAME, ENCRYPTED_MARKER_NAME)
+  if !encrypted {
+    f.requireEncryption = false
+    return os.RemoveAll(markerPath)
+  }
+
+  if err := os.Mkdir(markerPath, 0755); err != nil && !os.IsExist(err) {
+    return err
+  }
+  f.requireEncryption = true
+  return nil
+}
+
+// Return the names of the regular files in a directory.
+func listFiles(directory string) ([]string, error) {
+  entries, err := os.ReadDir(directory)
+  if err != nil {
+    return nil, err
+  }
+
+  var names []string
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      names = append(names, entry.Name())
+    }
+  }
+  return names, nil
+}
+
+/**
+ * Give every key file of a store written before headers were introduced a
+ * header holding its plain value, and mark the store as upgraded. Headered
+ * copies are staged in the upgrade directory, and only moved over the
+ * originals once the store is marked, so an interrupted upgrade is restarted
+ * or finished when the store is next opened.
+ *
+ * <p> This method must be called before the store is used.
+ */
+func (f *FileStore) upgradeLegacyFiles() error {
+  upgradeDirectory := filepath.Join(f.directory, UPGRADE_DIRECTORY_NAME)
+  markerPath := filepath.Join(f.directory, FORMAT_MARKER_NAME)
+  if _, err := os.Stat(markerPath); os.IsNotExist(err) {
+    // Discard the copies of an upgrade interrupted before the store was
+    // marked; the originals are untouched.
+    if err := os.RemoveAll(upgradeDirectory); err != nil {
+      return err
+    }
+    if err := os.Mkdir(upgradeDirectory, 0755); err != nil {
+      return err
+    }
+
+    names, err := listFiles(f.directory)
+    if err != nil {
+      return err
+    }
+    for _, name := range names {
+      stored, err := os.ReadFile(filepath.Join(f.directory, name))
+      if err != nil {
+        return err
+      }
+      encoded, err := encodeValue(Value(stored), nil, false)
+      if err != nil {
+        return err
+      }
+      if err := f.writeFile(filepath.Join(upgradeDirectory, name), encoded); err != nil {
+        return err
+      }
+    }
+    if len(names) > 0 {
+      f.logger.Info("Upgrading legacy files", "directory", f.directory, "files", len(names))
+    }
+
+    if err := os.Mkdir(markerPath, 0755); err != nil {
+      return err
+    }
+  } else if err != nil {
+    return err
+  }
+
+  names, err := listFiles(upgradeDirectory)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  for _, name := range names {
+    if err := os.Rename(filepath.Join(upgradeDirectory, name),
+        filepath.Join(f.directory, name)); err != nil {
+      return err
+    }
+  }
+  return os.Remove(upgradeDirectory)
+}
+
+/**
+ * Decide whether plaintext files are refused; see requireEncryption.
+ *
+ * <p> This method must be called before the store is used, once its keys and
+ * blobs are loaded.
+ */
+func (f *FileStore) loadEncryptionMarker() error {
+  if f.keyring == nil {
+    return f.markEncrypted(false)
+  }
+
+  _, err := os.Stat(filepath.Join(f.directory, FORMAT_MARKER_NAME, ENCRYPTED_MARKER_NAME))
+  if err == nil || (f.usage.fileCount() == 0 && len(f.blobs) == 0) {
+    return f.markEncrypted(true)
+  } else if !os.IsNotExist(err) {
+    return err
+  }
+  return nil
 }
 
 /** 
@@ -89,28 +855,64 @@ func (f *FileStore) getFilePath(key Key, dir string) string {
 
 /**
  * Clean up a temporary file, e.g. by closing the file handle and moving it to 
- * the parent directory. Return nil if this operation was successful, or the 
+ * its final path. Return nil if this operation was successful, or the 
  * error that occurred.
  *
  * <p> This method assumes the mutex is held.
  */
-func (f *FileStore) onTmpFileComplete(key Key, tmpFile *os.File) error {
+func (f *FileStore) onTmpFileComplete(tmpFile *os.File, newPath string) error {
   if err := tmpFile.Close(); err != nil {
     return err
   }
 
-  oldPath := f.getFilePath(key, f.tempDirectory)
-  newPath := f.getFilePath(key, f.directory)
-  if err := os.Rename(oldPath, newPath); err != nil {
+  if err := os.Rename(tmpFile.Name(), newPath); err != nil {
     return err
   }
   
   return nil
 }
 
-func MakeFileStore(directory string) (*FileStore, error) {
+// Optional FileStore behaviour. The zero value disables every option.
+type FileStoreOptions struct {
+  // Compress values which are large enough to benefit from it.
+  EnableCompression bool
+  // Encrypt values with the keyring's active key. Values encrypted with
+  // other keys in the keyring remain readable.
+  Keyring *Keyring
+  // The maximum total size of every file, in bytes. 0 is unlimited.
+  MaxBytes int64
+  // The maximum number of files. 0 is unlimited.
+  MaxFiles int
+  // The maximum total size of every file, in bytes, and number of keys.
+  // Unlike MaxBytes and MaxFiles, writes beyond them are refused with
+  // ErrQuotaExceeded rather than evicting other keys. 0 is unlimited.
+  QuotaBytes int64
+  QuotaKeys int
+  // Store byte-identical values once, shared between their keys. Note that
+  // blobs are named by the SHA-256 of their value, even when encrypted.
+  EnableDeduplication bool
+  // Logs evictions and background errors; may be nil.
+  Logger *logging.Logger
+}
+
+// Construct a FileStore rooted at `directory`. `options` may be nil.
+func MakeFileStore(directory string, options *FileStoreOptions) (*FileStore, error) {
+  if options == nil {
+    options = &FileStoreOptions{}
+  }
+
   fs := &FileStore{}
   fs.directory = directory
+  fs.enableCompression = options.EnableCompression
+  fs.keyring = options.Keyring
+  fs.maxBytes = options.MaxBytes
+  fs.maxFiles = options.MaxFiles
+  fs.quotaBytes = options.QuotaBytes
+  fs.quotaKeys = options.QuotaKeys
+  fs.enableDeduplication = options.EnableDeduplication
+  fs.logger = options.Logger
+  fs.blobDirectory = fmt.Sprintf(directory + "/%s", BLOB_DIRECTORY_NAME)
+  fs.blobs = make(map[string]*blobEntry)
   fs.tempDirectory = fmt.Sprintf(directory + "/%s", TEMP_DIRECTORY_NAME) 
   // Make the directory if it does not already exist.
   if err := os.Mkdir(directory, 0644); err != nil && !os.IsExist(err) {
@@ -127,6 +929,30 @@ func MakeFileStore(directory string) (*FileStore, error) {
     return nil, err
   }
 
+  if err := fs.upgradeLegacyFiles(); err != nil {
+    return nil, err
+  }
+
+  usage, err := makeUsageIndex(directory)
+  if err != nil {
+    return nil, err
+  }
+  fs.usage = usage
+
+  // Blobs may be present even if deduplication is now disabled.
+  if err := fs.loadBlobs(); err != nil {
+    return nil, err
+  }
+
+  if err := fs.loadEncryptionMarker(); err != nil {
+    return nil, err
+  }
+
   fs.mutex = &sync.Mutex{} 
+
+  // The budget may have shrunk since the files were written.
+  if err := fs.evictIfNeeded(""); err != nil {
+    return nil, err
+  }
   return fs, nil
 } 
@@ -0,0 +1,337 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func makeTestFileStore(t *testing.T, options *FileStoreOptions) *FileStore {
+  fs, err := MakeFileStore(t.TempDir(), options)
+  if err != nil {
+    t.Fatalf("Error making filestore: %v", err)
+  }
+  return fs
+}
+
+func TestFileStoreSetsEntry(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  if err := fs.Set(ctx, KEY, VALUE); err != nil {
+    t.Errorf("Error when setting %v->%v in filestore: %v", KEY, VALUE, err)
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Error retrieving %v from filestore", KEY)
+  }
+}
+
+func TestFileStoreCompressesLargeValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableCompression: true })
+  value := Value(strings.Repeat("compressible ", 100))
+  fs.Set(ctx, KEY, value)
+
+  encoded, err := fs.GetEncoded(ctx, KEY)
+  if err != nil || encoded.Codec != CODEC_GZIP {
+    t.Errorf("Expected %v to be gzip compressed", KEY)
+  }
+
+  if len(encoded.Bytes) >= value.SizeOfBytes() {
+    t.Errorf("Expected compression to save space, got %v bytes",
+len(encoded.Bytes))
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != value {
+    t.Errorf("Expected %v to decompress to its original value", KEY)
+  }
+}
+
+func TestFileStoreSkipsCompressingSmallValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableCompression: true })
+  fs.Set(ctx, KEY, VALUE)
+
+  if encoded, _ := fs.GetEncoded(ctx, KEY); encoded.Codec != CODEC_NONE {
+    t.Errorf("Expected %v to be stored uncompressed", KEY)
+  }
+}
+
+func TestFileStoreSkipsCompressingIncompressibleValues(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableCompression: true })
+
+  // Random bytes do not compress.
+  random := make([]byte, 1000)
+  rand.New(rand.NewSource(1)).Read(random)
+  value := Value(random)
+  fs.Set(ctx, KEY, value)
+
+  if encoded, _ := fs.GetEncoded(ctx, KEY); encoded.Codec != CODEC_NONE {
+    t.Errorf("Expected incompressible %v to be stored uncompressed", KEY)
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != value {
+    t.Errorf("Error retrieving %v from filestore", KEY)
+  }
+}
+
+func TestFileStoreUpgradesLegacyFiles(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  // Files written before values had a header, including plain values which
+  // happen to begin with a magic.
+  legacy := map[Key]Value{
+    KEY: VALUE,
+    KEY2: Value(append(append([]byte{}, ENCODING_MAGIC...), 1, 'x')),
+    KEY3: Value(append(append([]byte{}, ENCRYPTION_MAGIC...), "value"...)),
+  }
+  for key, value := range legacy {
+    os.WriteFile(filepath.Join(directory, string(key)), []byte(value), 0644)
+  }
+  // A copy left behind by an upgrade interrupted before the store was marked.
+  os.Mkdir(filepath.Join(directory, UPGRADE_DIRECTORY_NAME), 0755)
+  os.WriteFile(filepath.Join(directory, UPGRADE_DIRECTORY_NAME, string(KEY)), []byte("stale"), 0644)
+
+  for i := 0; i < 2; i++ {
+    fs, err := MakeFileStore(directory, &FileStoreOptions{ EnableCompression: true })
+    if err != nil {
+      t.Fatalf("Error opening filestore: %v", err)
+    }
+    for key, value := range legacy {
+      if val, err := fs.Get(ctx, key); err != nil || val != value {
+        t.Errorf("Expected legacy %v to read back verbatim, got %q (%v)", key, val, err)
+      }
+    }
+    if keys, _ := fs.Keys(ctx); len(keys) != len(legacy) {
+      t.Errorf("Expected %v keys, got %v", len(legacy), keys)
+    }
+  }
+}
+
+func TestFileStoreRejectsHeaderlessFiles(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  os.WriteFile(fs.getFilePath(KEY, fs.directory), []byte(VALUE), 0644)
+
+  if _, err := fs.Get(ctx, KEY); err == nil {
+    t.Errorf("Expected a headerless file in an upgraded store to be rejected")
+  }
+}
+
+func TestFileStoreEvictsLeastRecentlyAccessedOverByteBudget(t *testing.T) {
+  ctx := context.Background()
+  // Every encoded value is 10 bytes; the budget fits three of them.
+  fs := makeTestFileStore(t, &FileStoreOptions{
+    MaxBytes: int64(3 * (ENCODING_HEADER_SIZE_BYTES + 5)),
+  })
+  fs.Set(ctx, "key1", "aaaaa")
+  fs.Set(ctx, "key2", "aaaaa")
+  fs.Set(ctx, "key3", "aaaaa")
+
+  // Access order is 2->3->1.
+  fs.Get(ctx, "key1")
+  fs.Set(ctx, "key4", "aaaaa")
+
+  if _, err := fs.Get(ctx, "key2"); err == nil {
+    t.Errorf("Expected key2 to be evicted")
+  }
+
+  for _, key := range []Key{ "key1", "key3", "key4" } {
+    if _, err := fs.Get(ctx, key); err != nil {
+      t.Errorf("Expected %v to be present: %v", key, err)
+    }
+  }
+
+  if stats := fs.Stats(); stats["evictions"] != 1 || stats["file_count"] != 3 {
+    t.Errorf("Unexpected stats %v", stats)
+  }
+}
+
+func TestFileStoreEvictsOverFileBudget(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ MaxFiles: 2 })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+  fs.Set(ctx, KEY3, VALUE)
+
+  if _, err := fs.Get(ctx, KEY); err == nil {
+    t.Errorf("Expected %v to be evicted", KEY)
+  }
+
+  if stats := fs.Stats(); stats["file_count"] != 2 {
+    t.Errorf("Expected 2 files, got %v", stats["file_count"])
+  }
+}
+
+func TestFileStoreReportsEvictedAndExpiredKeys(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ MaxFiles: 2 })
+  var evicted []Key
+  fs.OnEvict(func(key Key) {
+    evicted = append(evicted, key)
+  })
+  fs.SetWithAttributes(ctx, KEY, VALUE, &Attributes{ ExpiresAt: time.Now().Add(-time.Second) })
+  fs.Get(ctx, KEY)
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+  fs.Set(ctx, KEY3, VALUE)
+
+  if len(evicted) != 2 || evicted[0] != KEY || evicted[1] != KEY {
+    t.Errorf("Expected %v to be reported expired and then evicted, got %v", KEY, evicted)
+  }
+}
+
+func TestFileStoreRejectsValueLargerThanBudget(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ MaxBytes: 10 })
+  fs.Set(ctx, KEY, "a")
+
+  if err := fs.Set(ctx, KEY2, VALUE_LARGE); err == nil {
+    t.Errorf("Expected an error setting a value larger than the budget")
+  }
+
+  if val, err := fs.Get(ctx, KEY); err != nil || val != "a" {
+    t.Errorf("Expected %v to survive a rejected write", KEY)
+  }
+}
+
+func TestFileStoreRefusesWritesBeyondKeyQuota(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ QuotaKeys: 2 })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  if err := fs.Set(ctx, KEY3, VALUE); !errors.Is(err, ErrQuotaExceeded) {
+    t.Errorf("Expected a new key beyond the quota to be refused, got %v", err)
+  }
+  if err := fs.Set(ctx, KEY, VALUE_LARGE); err != nil {
+    t.Errorf("Expected an existing key to be overwritten within the quota: %v", err)
+  }
+  if _, err := fs.Get(ctx, KEY2); err != nil {
+    t.Errorf("Expected no key to be evicted by a quota: %v", err)
+  }
+}
+
+func TestFileStoreRefusesWritesBeyondByteQuota(t *testing.T) {
+  ctx := context.Background()
+  valueSize := int64(ENCODING_HEADER_SIZE_BYTES + len(VALUE))
+  fs := makeTestFileStore(t, &FileStoreOptions{ QuotaBytes: 2 * valueSize })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  if err := fs.Set(ctx, KEY3, VALUE); !errors.Is(err, ErrQuotaExceeded) {
+    t.Errorf("Expected a write beyond the byte quota to be refused, got %v", err)
+  }
+  // Overwriting a key replaces its bytes.
+  if err := fs.Set(ctx, KEY2, VALUE); err != nil {
+    t.Errorf("Expected an overwrite of the same size to fit the quota: %v", err)
+  }
+  if stats := fs.Stats(); stats["size_bytes"] != 2 * valueSize ||
+      stats["quota_bytes"] != 2 * valueSize {
+    t.Errorf("Expected usage at the quota, got %v", stats)
+  }
+}
+
+func TestFileStoreTracksUsageAcrossRestarts(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  fs, _ := MakeFileStore(directory, nil)
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+  fs.Set(ctx, KEY3, VALUE)
+
+  // A smaller budget evicts existing files on startup.
+  fs, _ = MakeFileStore(directory, &FileStoreOptions{ MaxFiles: 1 })
+  if stats := fs.Stats(); stats["file_count"] != 1 {
+    t.Errorf("Expected 1 file after restart, got %v", stats["file_count"])
+  }
+
+  expectedSize := int64(ENCODING_HEADER_SIZE_BYTES + len(VALUE))
+  if stats := fs.Stats(); stats["size_bytes"] != expectedSize {
+    t.Errorf("Expected %v bytes, got %v", expectedSize, stats["size_bytes"])
+  }
+}
+
+func TestFileStoreDeletesEntry(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+
+  if err := fs.Delete(ctx, KEY); err != nil {
+    t.Errorf("Error deleting %v: %v", KEY, err)
+  }
+  if _, err := fs.Get(ctx, KEY); err == nil {
+    t.Errorf("Expected %v to be deleted", KEY)
+  }
+  if val, err := fs.Get(ctx, KEY2); err != nil || val != VALUE {
+    t.Errorf("Expected %v to keep its shared value, got %v (%v)", KEY2, val, err)
+  }
+
+  fs.Delete(ctx, KEY2)
+  if stats := fs.Stats(); stats["file_count"] != 0 || stats["blob_count"] != 0 {
+    t.Errorf("Expected every file and blob to be removed, got %v", stats)
+  }
+
+  if err := fs.Delete(ctx, KEY3); err != nil {
+    t.Errorf("Expected deleting a missing key to succeed, got %v", err)
+  }
+}
+
+func TestFileStoreAbandonsCancelledCalls(t *testing.T) {
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  cancelled, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  if err := fs.Set(cancelled, KEY, VALUE); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled set to fail with its context's error, got %v", err)
+  }
+  if stats := fs.Stats(); stats["file_count"] != 0 || stats["blob_count"] != 0 {
+    t.Errorf("Expected a cancelled set to leave the store unchanged, got %v", stats)
+  }
+
+  fs.Set(context.Background(), KEY, VALUE)
+  if _, err := fs.Get(cancelled, KEY); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled get to fail with its context's error, got %v", err)
+  }
+  if _, err := fs.Keys(cancelled); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled listing to fail with its context's error, got %v", err)
+  }
+  if err := fs.Delete(cancelled, KEY); !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected a cancelled delete to fail with its context's error, got %v", err)
+  }
+  if _, err := fs.Get(context.Background(), KEY); err != nil {
+    t.Errorf("Expected a cancelled delete to leave the key, got %v", err)
+  }
+}
+
+func TestFileStoreRejectsReservedKeys(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  for _, key := range []Key{ TEMP_DIRECTORY_NAME, FORMAT_MARKER_NAME, UPGRADE_DIRECTORY_NAME } {
+    if err := fs.Set(ctx, key, VALUE); !errors.Is(err, ErrReservedKey) {
+      t.Errorf("Expected setting %v to be refused, got %v", key, err)
+    }
+    if _, err := fs.Get(ctx, key); !errors.Is(err, ErrReservedKey) {
+      t.Errorf("Expected getting %v to be refused, got %v", key, err)
+    }
+    if err := fs.Delete(ctx, key); !errors.Is(err, ErrReservedKey) {
+      t.Errorf("Expected deleting %v to be refused, got %v", key, err)
+    }
+  }
+
+  // The store's directories are untouched.
+  fs, err := MakeFileStore(fs.directory, nil)
+  if err != nil {
+    t.Fatalf("Error reopening the filestore: %v", err)
+  }
+  if err := fs.Set(ctx, KEY, VALUE); err != nil {
+    t.Errorf("Error setting %v after refusing reserved keys: %v", KEY, err)
+  }
+}
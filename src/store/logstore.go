@@ -0,0 +1,874 @@
+package store
+
+import (
+  "bufio"
+  "context"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  SEGMENT_FILE_EXTENSION = ".log"
+  HINT_FILE_EXTENSION = ".hint"
+
+  // A record is laid out as crc32 | kind | key size | value size | key | value.
+  // The crc32 covers every byte following it.
+  RECORD_HEADER_SIZE_BYTES = 4 + 1 + 4 + 4
+  // A hint is laid out as key size | record offset | record size | key.
+  HINT_HEADER_SIZE_BYTES = 4 + 8 + 4
+
+  // A record which associates a key with a value, which may be prefixed by
+  // an attributes section. Written by earlier versions; a plain value which
+  // happens to begin with ATTRIBUTES_MAGIC cannot be told apart from one with
+  // attributes, so such records are no longer written.
+  RECORD_KIND_VALUE byte = 1
+  // A record which associates a key with a value, always prefixed by the
+  // uvarint length of its attributes section, which is empty if there are
+  // no attributes.
+  RECORD_KIND_ATTRIBUTED_VALUE byte = 2
+
+  DEFAULT_MAX_SEGMENT_BYTES = 64 * 1024 * 1024
+  DEFAULT_COMPACTION_INTERVAL = time.Minute
+  DEFAULT_COMPACTION_THRESHOLD = 0.5
+)
+
+// The location of a key's most recent record in the log.
+type recordLocation struct {
+  segmentId int
+  // The offset of the start of the record in its segment.
+  offset int64
+  // The size of the record, including its header.
+  sizeBytes int
+}
+
+// A decoded record, along with where it was read from.
+type logRecord struct {
+  // One of the RECORD_KIND constants.
+  kind byte
+  key Key
+  value Value
+  location recordLocation
+}
+
+/**
+ * A KeyValueStore built on an append-only log, in the style of Bitcask.
+ *
+ * <p> Every Set appends a record to the active segment file, and an in-memory
+ * index maps each key to its most recent record. Once the active segment
+ * exceeds its size budget it is sealed, and a hint file listing the index
+ * entries of the segment is written beside it so that startup does not need
+ * to read every value.
+ *
+ * <p> On startup the index is rebuilt from hint files where present, and by
+ * replaying segments otherwise. A partially written record at the tail of
+ * the log (e.g. due to a crash mid-write) is truncated away.
+ *
+ * <p> Overwritten records are dead weight. A background goroutine
+ * periodically compacts sealed segments by copying their live records into a
+ * single segment, and deleting the originals.
+ */
+type LogStore struct {
+  // The directory which holds segment and hint files.
+  directory string
+  // The ID of the segment currently being appended to. Segment IDs increase
+  // monotonically; records in later segments supersede earlier ones.
+  activeSegmentId int
+  // The file handle of the active segment.
+  activeSegment *os.File
+  // The size of the active segment, in bytes.
+  activeSegmentSizeBytes int64
+  // Open read handles, keyed by segment ID.
+  segments map[int]*os.File
+  // Maps every key to the location of its most recent record.
+  index map[Key]recordLocation
+  // The number of bytes of superseded records, keyed by segment ID.
+  deadBytes map[int]int64
+  // The size of every segment, keyed by segment ID.
+  segmentSizeBytes map[int]int64
+  // Seal the active segment once it exceeds this size.
+  maxSegmentBytes int64
+  // Compact once this fraction of the sealed segments' bytes are dead.
+  compactionThreshold float64
+  // Closed to stop the background compaction goroutine.
+  stopCompaction chan struct{}
+  // A mutex guarding the index and segment files. Compaction only holds it
+  // briefly, so reads and writes continue to be served while it runs.
+  mutex *sync.Mutex
+  // Serializes compactions.
+  compactionMutex *sync.Mutex
+  // Logs recovery and compaction; may be nil.
+  logger *logging.Logger
+}
+
+/**
+ * Append the key/value pair to the log, and point the index at it. Return
+ * any IO error that occurred.
+ */
+func (l *LogStore) Set(ctx context.Context, key Key, value Value) error {
+  return l.SetWithAttributes(ctx, key, value, nil)
+}
+
+/**
+ * Append the key/value pair and its attributes, which may be nil, to the
+ * log. The attributes are stored as a prefix of the record's value.
+ */
+func (l *LogStore) SetWithAttributes(
+    ctx context.Context,
+    key Key,
+    value Value,
+    attributes *Attributes) error {
+  attributedValue, err := encodeAttributedValue(value, attributes)
+  if err != nil {
+    return err
+  }
+
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  // Abandon writes whose caller gave up while waiting for the log.
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+
+  if l.activeSegmentSizeBytes >= l.maxSegmentBytes {
+    if err := l.rollActiveSegment(); err != nil {
+      return err
+    }
+  }
+
+  record := encodeRecord(RECORD_KIND_ATTRIBUTED_VALUE, key, attributedValue)
+  if _, err := l.activeSegment.Write(record); err != nil {
+    return err
+  }
+
+  location := recordLocation{
+    segmentId: l.activeSegmentId,
+    offset: l.activeSegmentSizeBytes,
+    sizeBytes: len(record),
+  }
+  l.activeSegmentSizeBytes += int64(len(record))
+  l.segmentSizeBytes[l.activeSegmentId] = l.activeSegmentSizeBytes
+  l.updateIndex(key, location)
+  return nil
+}
+
+/**
+ * Read the key's most recent record from the log. Return an error if the key
+ * is missing, or the record is corrupted.
+ */
+func (l *LogStore) Get(ctx context.Context, key Key) (Value, error) {
+  value, _, err := l.GetWithAttributes(ctx, key)
+  return value, err
+}
+
+/**
+ * Read the key's most recent record and its attributes from the log. Expired
+ * records are dropped from the index, and left for compaction. Tombstones are
+ * reported as missing.
+ */
+func (l *LogStore) GetWithAttributes(ctx context.Context, key Key) (Value, *Attributes, error) {
+  value, attributes, err := l.GetVersioned(ctx, key)
+  if err == nil && attributes != nil && attributes.Deleted {
+    return EMPTY_VALUE, nil, tombstoneError(key)
+  }
+  return value, attributes, err
+}
+
+/**
+ * Read the key's most recent record and its attributes from the log,
+ * returning tombstones. Expired versioned records read as tombstones, and
+ * stay in the index.
+ */
+func (l *LogStore) GetVersioned(ctx context.Context, key Key) (Value, *Attributes, error) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  if err := ctx.Err(); err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+
+  location, ok := l.index[key]
+  if !ok {
+    return EMPTY_VALUE, nil, fmt.Errorf("%w: key %v not found", os.ErrNotExist, key)
+  }
+
+  record, err := l.readRecord(location)
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+
+  attributes, value, err := record.splitAttributes()
+  if err != nil {
+    return EMPTY_VALUE, nil, err
+  }
+
+  if attributes.Expired(time.Now()) {
+    if tombstone := expiredTombstone(attributes); tombstone != nil {
+      return EMPTY_VALUE, tombstone, nil
+    }
+    l.deadBytes[location.segmentId] += int64(location.sizeBytes)
+    delete(l.index, key)
+    return EMPTY_VALUE, nil, expiredError(key)
+  }
+  return Value(value), attributes, nil
+}
+
+/**
+ * Return every key in the index, in sorted order.
+ */
+func (l *LogStore) Keys(ctx context.Context) ([]Key, error) {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+
+  keys := make([]Key, 0, len(l.index))
+  for key := range l.index {
+    keys = append(keys, key)
+  }
+  sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+  return keys, nil
+}
+
+/**
+ * Report the size of the log, the number of live keys, and the number of
+ * dead bytes awaiting compaction.
+ */
+func (l *LogStore) Stats() map[string]int64 {
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  var sizeBytes, deadBytes int64
+  for segmentId, segmentSizeBytes := range l.segmentSizeBytes {
+    sizeBytes += segmentSizeBytes
+    deadBytes += l.deadBytes[segmentId]
+  }
+  return map[string]int64{
+    "size_bytes": sizeBytes,
+    "dead_bytes": deadBytes,
+    "keys": int64(len(l.index)),
+    "segments": int64(len(l.segments)),
+  }
+}
+
+/**
+ * Compact the sealed segments if enough of their bytes are dead. Return any
+ * error that occurred.
+ */
+func (l *LogStore) MaybeCompact() error {
+  l.mutex.Lock()
+  var totalBytes, deadBytes int64
+  for segmentId, sizeBytes := range l.segmentSizeBytes {
+    if segmentId != l.activeSegmentId {
+      totalBytes += sizeBytes
+      deadBytes += l.deadBytes[segmentId]
+    }
+  }
+  l.mutex.Unlock()
+
+  if totalBytes == 0 ||
+      float64(deadBytes) / float64(totalBytes) < l.compactionThreshold {
+    return nil
+  }
+  return l.Compact()
+}
+
+/**
+ * Copy the live records of every sealed segment into a single segment, and
+ * delete the originals. The compacted segment takes the ID of the newest
+ * sealed segment, so that it is still superseded by the active segment on
+ * replay.
+ */
+func (l *LogStore) Compact() error {
+  defer l.compactionMutex.Unlock()
+  l.compactionMutex.Lock()
+
+  // Sealed segments are immutable; they can be read without the mutex.
+  l.mutex.Lock()
+  var sealed []int
+  for segmentId := range l.segments {
+    if segmentId != l.activeSegmentId {
+      sealed = append(sealed, segmentId)
+    }
+  }
+  l.mutex.Unlock()
+
+  if len(sealed) == 0 {
+    return nil
+  }
+  sort.Ints(sealed)
+  compactedId := sealed[len(sealed) - 1]
+
+  tmpPath := l.segmentPath(compactedId) + ".compact"
+  output, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmpPath)
+
+  // Maps every copied key to its previous and compacted locations.
+  previous := make(map[Key]recordLocation)
+  compacted := make(map[Key]recordLocation)
+  writer := bufio.NewWriter(output)
+  var offset int64
+  var writeErr error
+  for _, segmentId := range sealed {
+    _, err := l.replaySegment(segmentId, func(record *logRecord) {
+      l.mutex.Lock()
+      live := l.index[record.key] == record.location
+      l.mutex.Unlock()
+      if !live || writeErr != nil {
+        return
+      }
+
+      encoded := encodeRecord(record.kind, record.key, record.value)
+      if _, writeErr = writer.Write(encoded); writeErr != nil {
+        return
+      }
+      previous[record.key] = record.location
+      compacted[record.key] = recordLocation{
+        segmentId: compactedId,
+        offset: offset,
+        sizeBytes: len(encoded),
+      }
+      offset += int64(len(encoded))
+    })
+    if err == nil {
+      err = writeErr
+    }
+    if err != nil {
+      output.Close()
+      return err
+    }
+  }
+
+  if err := writer.Flush(); err != nil {
+    output.Close()
+    return err
+  }
+  if err := output.Close(); err != nil {
+    return err
+  }
+
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+
+  // Swap in the compacted segment. The stale hint file is removed first, and
+  // the older segments last, so that a crash at any point leaves a log which
+  // replays to the same index.
+  os.Remove(l.hintPath(compactedId))
+  if err := os.Rename(tmpPath, l.segmentPath(compactedId)); err != nil {
+    return err
+  }
+
+  for _, segmentId := range sealed {
+    l.segments[segmentId].Close()
+    delete(l.segments, segmentId)
+    delete(l.segmentSizeBytes, segmentId)
+    delete(l.deadBytes, segmentId)
+    if segmentId != compactedId {
+      os.Remove(l.segmentPath(segmentId))
+      os.Remove(l.hintPath(segmentId))
+    }
+  }
+
+  segment, err := os.Open(l.segmentPath(compactedId))
+  if err != nil {
+    return err
+  }
+  l.segments[compactedId] = segment
+  l.segmentSizeBytes[compactedId] = offset
+
+  // Keys written since they were copied now live in the active segment; their
+  // compacted records are already dead.
+  for key, location := range compacted {
+    if l.index[key] == previous[key] {
+      l.index[key] = location
+    } else {
+      l.deadBytes[compactedId] += int64(location.sizeBytes)
+    }
+  }
+
+  return l.writeHintFile(compactedId)
+}
+
+// Check that the log's directory is writable.
+func (l *LogStore) CheckHealth() error {
+  return probeWritable(l.directory)
+}
+
+/**
+ * Stop background compaction, sync the active segment to disk, and close
+ * every segment file.
+ */
+func (l *LogStore) Close() error {
+  close(l.stopCompaction)
+
+  defer l.mutex.Unlock()
+  l.mutex.Lock()
+  for _, segment := range l.segments {
+    segment.Close()
+  }
+  if err := l.activeSegment.Sync(); err != nil {
+    l.activeSegment.Close()
+    return err
+  }
+  return l.activeSegment.Close()
+}
+
+/**
+ * Point the index at a new record for the key, recording the key's previous
+ * record as dead.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) updateIndex(key Key, location recordLocation) {
+  if old, ok := l.index[key]; ok {
+    l.deadBytes[old.segmentId] += int64(old.sizeBytes)
+  }
+  l.index[key] = location
+}
+
+/**
+ * Seal the active segment by writing its hint file, and open a new active
+ * segment.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) rollActiveSegment() error {
+  if err := l.activeSegment.Close(); err != nil {
+    return err
+  }
+
+  if err := l.writeHintFile(l.activeSegmentId); err != nil {
+    // Hints are an optimization; the segment will be replayed on startup.
+    l.logger.Warn("Error writing hint file", "segment", l.activeSegmentId, "err", err)
+  }
+
+  return l.openActiveSegment(l.activeSegmentId + 1)
+}
+
+/**
+ * Open (or create) the segment for appending, and make it the active segment.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) openActiveSegment(segmentId int) error {
+  path := l.segmentPath(segmentId)
+  activeSegment, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+
+  info, err := activeSegment.Stat()
+  if err != nil {
+    activeSegment.Close()
+    return err
+  }
+
+  if _, ok := l.segments[segmentId]; !ok {
+    segment, err := os.Open(path)
+    if err != nil {
+      activeSegment.Close()
+      return err
+    }
+    l.segments[segmentId] = segment
+  }
+
+  l.activeSegment = activeSegment
+  l.activeSegmentId = segmentId
+  l.activeSegmentSizeBytes = info.Size()
+  l.segmentSizeBytes[segmentId] = info.Size()
+  return nil
+}
+
+/**
+ * Read and verify the record at the location.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) readRecord(location recordLocation) (*logRecord, error) {
+  segment, ok := l.segments[location.segmentId]
+  if !ok {
+    return nil, errors.New(fmt.Sprintf("Segment %v missing", location.segmentId))
+  }
+
+  buffer := make([]byte, location.sizeBytes)
+  if _, err := segment.ReadAt(buffer, location.offset); err != nil {
+    return nil, err
+  }
+
+  record, _, err := decodeRecord(buffer)
+  if err != nil {
+    return nil, err
+  }
+  record.location = location
+  return record, nil
+}
+
+/**
+ * Invoke the callback on every record of a segment, in order. Return the
+ * offset just past the last valid record, so that a corrupted tail can be
+ * truncated, and an error if the segment contains a corrupted or partially
+ * written record.
+ */
+func (l *LogStore) replaySegment(
+    segmentId int, callback func(*logRecord)) (int64, error) {
+  file, err := os.Open(l.segmentPath(segmentId))
+  if err != nil {
+    return 0, err
+  }
+  defer file.Close()
+
+  reader := bufio.NewReader(file)
+  var offset int64
+  for {
+    header := make([]byte, RECORD_HEADER_SIZE_BYTES)
+    if _, err := io.ReadFull(reader, header); err == io.EOF {
+      return offset, nil
+    } else if err != nil {
+      return offset, errors.New(fmt.Sprintf(
+        "Truncated record header in segment %v at %v", segmentId, offset))
+    }
+
+    keySize := binary.BigEndian.Uint32(header[5:9])
+    valueSize := binary.BigEndian.Uint32(header[9:13])
+    body := make([]byte, int(keySize) + int(valueSize))
+    if _, err := io.ReadFull(reader, body); err != nil {
+      return offset, errors.New(fmt.Sprintf(
+        "Truncated record in segment %v at %v", segmentId, offset))
+    }
+
+    record, size, err := decodeRecord(append(header, body...))
+    if err != nil {
+      return offset, err
+    }
+    record.location = recordLocation{
+      segmentId: segmentId,
+      offset: offset,
+      sizeBytes: size,
+    }
+    callback(record)
+    offset += int64(size)
+  }
+}
+
+/**
+ * Write a hint file listing the index entries which point into the segment.
+ * The file is written via a temporary file, so a partial hint is never read.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) writeHintFile(segmentId int) error {
+  var hints []byte
+  for key, location := range l.index {
+    if location.segmentId != segmentId {
+      continue
+    }
+
+    header := make([]byte, HINT_HEADER_SIZE_BYTES)
+    binary.BigEndian.PutUint32(header[0:4], uint32(len(key)))
+    binary.BigEndian.PutUint64(header[4:12], uint64(location.offset))
+    binary.BigEndian.PutUint32(header[12:16], uint32(location.sizeBytes))
+    hints = append(hints, header...)
+    hints = append(hints, key...)
+  }
+
+  tmpPath := l.hintPath(segmentId) + ".tmp"
+  if err := os.WriteFile(tmpPath, hints, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, l.hintPath(segmentId))
+}
+
+/**
+ * Load the index entries of a segment from its hint file. Return an error if
+ * the hint file is missing or malformed.
+ */
+func (l *LogStore) readHintFile(segmentId int) ([]*logRecord, error) {
+  hints, err := os.ReadFile(l.hintPath(segmentId))
+  if err != nil {
+    return nil, err
+  }
+
+  var records []*logRecord
+  for len(hints) > 0 {
+    if len(hints) < HINT_HEADER_SIZE_BYTES {
+      return nil, errors.New(fmt.Sprintf("Malformed hint file for segment %v",
+segmentId))
+    }
+
+    keySize := int(binary.BigEndian.Uint32(hints[0:4]))
+    if len(hints) < HINT_HEADER_SIZE_BYTES + keySize {
+      return nil, errors.New(fmt.Sprintf("Malformed hint file for segment %v",
+segmentId))
+    }
+
+    records = append(records, &logRecord{
+      key: Key(hints[HINT_HEADER_SIZE_BYTES:HINT_HEADER_SIZE_BYTES + keySize]),
+      location: recordLocation{
+        segmentId: segmentId,
+        offset: int64(binary.BigEndian.Uint64(hints[4:12])),
+        sizeBytes: int(binary.BigEndian.Uint32(hints[12:16])),
+      },
+    })
+    hints = hints[HINT_HEADER_SIZE_BYTES + keySize:]
+  }
+  return records, nil
+}
+
+/**
+ * Rebuild the index from the segments on disk, oldest first. Sealed segments
+ * are loaded from their hint files where possible. A corrupted tail of the
+ * newest segment is truncated.
+ *
+ * <p> This method assumes the mutex is held.
+ */
+func (l *LogStore) recover() error {
+  entries, err := os.ReadDir(l.directory)
+  if err != nil {
+    return err
+  }
+
+  var segmentIds []int
+  for _, entry := range entries {
+    var segmentId int
+    if _, err := fmt.Sscanf(entry.Name(), "%d" + SEGMENT_FILE_EXTENSION, &segmentId);
+        err == nil && strings.HasSuffix(entry.Name(), SEGMENT_FILE_EXTENSION) {
+      segmentIds = append(segmentIds, segmentId)
+    }
+  }
+  sort.Ints(segmentIds)
+
+  addToIndex := func(record *logRecord) {
+    l.updateIndex(record.key, record.location)
+  }
+
+  for i, segmentId := range segmentIds {
+    segment, err := os.Open(l.segmentPath(segmentId))
+    if err != nil {
+      return err
+    }
+    l.segments[segmentId] = segment
+
+    info, err := segment.Stat()
+    if err != nil {
+      return err
+    }
+    l.segmentSizeBytes[segmentId] = info.Size()
+
+    isNewest := i == len(segmentIds) - 1
+    if !isNewest {
+      if hints, err := l.readHintFile(segmentId); err == nil {
+        for _, hint := range hints {
+          addToIndex(hint)
+        }
+        continue
+      }
+    }
+
+    validBytes, err := l.replaySegment(segmentId, addToIndex)
+    if err != nil && !isNewest {
+      return err
+    } else if err != nil {
+      // A crash interrupted the last write; drop the partial record.
+      l.logger.Warn("Truncating segment", "segment", segmentId, "valid_bytes", validBytes,
+        "err", err)
+      if err := os.Truncate(l.segmentPath(segmentId), validBytes); err != nil {
+        return err
+      }
+      l.segmentSizeBytes[segmentId] = validBytes
+    }
+  }
+
+  // Hint files only list live records, so derive the dead bytes of each
+  // segment from the index.
+  liveBytes := make(map[int]int64)
+  for _, location := range l.index {
+    liveBytes[location.segmentId] += int64(location.sizeBytes)
+  }
+  for segmentId, sizeBytes := range l.segmentSizeBytes {
+    l.deadBytes[segmentId] = sizeBytes - liveBytes[segmentId]
+  }
+
+  nextSegmentId := 0
+  if len(segmentIds) > 0 {
+    nextSegmentId = segmentIds[len(segmentIds) - 1]
+  }
+  return l.openActiveSegment(nextSegmentId)
+}
+
+// Periodically compact sealed segments, until the store is closed.
+func (l *LogStore) compactPeriodically(interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-l.stopCompaction:
+      return
+    case <-ticker.C:
+      if err := l.MaybeCompact(); err != nil {
+        l.logger.Error("Error compacting log", "err", err)
+      }
+    }
+  }
+}
+
+func (l *LogStore) segmentPath(segmentId int) string {
+  return filepath.Join(l.directory,
+    fmt.Sprintf("%08d%s", segmentId, SEGMENT_FILE_EXTENSION))
+}
+
+func (l *LogStore) hintPath(segmentId int) string {
+  return filepath.Join(l.directory,
+    fmt.Sprintf("%08d%s", segmentId, HINT_FILE_EXTENSION))
+}
+
+// Encode a key/value pair into a record, including its checksummed header.
+func encodeRecord(kind byte, key Key, value Value) []byte {
+  record := make([]byte, RECORD_HEADER_SIZE_BYTES, RECORD_HEADER_SIZE_BYTES +
+len(key) + len(value))
+  record[4] = kind
+  binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+  binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+  record = append(record, key...)
+  record = append(record, value...)
+  binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+  return record
+}
+
+/**
+ * Decode a record from the front of the buffer, returning the record and its
+ * size. Return an error if the record is truncated or fails its checksum.
+ */
+func decodeRecord(buffer []byte) (*logRecord, int, error) {
+  if len(buffer) < RECORD_HEADER_SIZE_BYTES {
+    return nil, 0, errors.New("Truncated record header")
+  }
+
+  keySize := int(binary.BigEndian.Uint32(buffer[5:9]))
+  valueSize := int(binary.BigEndian.Uint32(buffer[9:13]))
+  size := RECORD_HEADER_SIZE_BYTES + keySize + valueSize
+  if len(buffer) < size {
+    return nil, 0, errors.New("Truncated record")
+  }
+
+  if crc32.ChecksumIEEE(buffer[4:size]) != binary.BigEndian.Uint32(buffer[0:4]) {
+    return nil, 0, errors.New("Record failed its checksum")
+  }
+
+  if buffer[4] != RECORD_KIND_VALUE && buffer[4] != RECORD_KIND_ATTRIBUTED_VALUE {
+    return nil, 0, errors.New(fmt.Sprintf("Unknown record kind %v", buffer[4]))
+  }
+
+  keyEnd := RECORD_HEADER_SIZE_BYTES + keySize
+  return &logRecord{
+    kind: buffer[4],
+    key: Key(buffer[RECORD_HEADER_SIZE_BYTES:keyEnd]),
+    value: Value(buffer[keyEnd:size]),
+  }, size, nil
+}
+
+/**
+ * Encode the value of a RECORD_KIND_ATTRIBUTED_VALUE record: the length of
+ * the attributes section, the section, which may be empty, and the value.
+ */
+func encodeAttributedValue(value Value, attributes *Attributes) (Value, error) {
+  section, err := encodeAttributes(attributes)
+  if err != nil {
+    return EMPTY_VALUE, err
+  }
+  length := make([]byte, binary.MaxVarintLen64)
+  length = length[:binary.PutUvarint(length, uint64(len(section)))]
+  return Value(length) + Value(section) + value, nil
+}
+
+// Return the record's attributes, which may be nil, and its value.
+func (r *logRecord) splitAttributes() (*Attributes, []byte, error) {
+  if r.kind == RECORD_KIND_VALUE {
+    return splitAttributes([]byte(r.value))
+  }
+
+  stored := []byte(r.value)
+  length, n := binary.Uvarint(stored)
+  if n <= 0 || uint64(len(stored) - n) < length {
+    return nil, nil, errors.New("Malformed record attributes")
+  }
+  section := stored[n:n + int(length)]
+  if len(section) == 0 {
+    return nil, stored[n:], nil
+  }
+  attributes, rest, err := splitAttributes(section)
+  if err != nil {
+    return nil, nil, err
+  } else if len(rest) != 0 {
+    return nil, nil, errors.New("Malformed record attributes")
+  }
+  return attributes, stored[n + int(length):], nil
+}
+
+// Optional LogStore behaviour. Zero fields take their defaults.
+type LogStoreOptions struct {
+  // Seal the active segment once it exceeds this size.
+  MaxSegmentBytes int64
+  // How often to check whether compaction is needed.
+  CompactionInterval time.Duration
+  // Compact once this fraction of the sealed segments' bytes are dead.
+  CompactionThreshold float64
+  // Logs recovery and compaction; may be nil.
+  Logger *logging.Logger
+}
+
+// Construct a LogStore rooted at `directory`, recovering any existing log.
+// `options` may be nil.
+func MakeLogStore(directory string, options *LogStoreOptions) (*LogStore, error) {
+  if options == nil {
+    options = &LogStoreOptions{}
+  }
+
+  l := &LogStore{}
+  l.directory = directory
+  l.segments = make(map[int]*os.File)
+  l.index = make(map[Key]recordLocation)
+  l.deadBytes = make(map[int]int64)
+  l.segmentSizeBytes = make(map[int]int64)
+  l.maxSegmentBytes = options.MaxSegmentBytes
+  if l.maxSegmentBytes <= 0 {
+    l.maxSegmentBytes = DEFAULT_MAX_SEGMENT_BYTES
+  }
+  l.compactionThreshold = options.CompactionThreshold
+  if l.compactionThreshold <= 0 {
+    l.compactionThreshold = DEFAULT_COMPACTION_THRESHOLD
+  }
+  compactionInterval := options.CompactionInterval
+  if compactionInterval <= 0 {
+    compactionInterval = DEFAULT_COMPACTION_INTERVAL
+  }
+  l.stopCompaction = make(chan struct{})
+  l.mutex = &sync.Mutex{}
+  l.compactionMutex = &sync.Mutex{}
+  l.logger = options.Logger
+
+  if err := os.MkdirAll(directory, 0755); err != nil {
+    return nil, err
+  }
+
+  l.mutex.Lock()
+  err := l.recover()
+  l.mutex.Unlock()
+  if err != nil {
+    return nil, err
+  }
+
+  go l.compactPeriodically(compactionInterval)
+  return l, nil
+}
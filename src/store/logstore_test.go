@@ -0,0 +1,201 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "testing"
+)
+
+func makeTestLogStore(t *testing.T, directory string, options *LogStoreOptions) *LogStore {
+  l, err := MakeLogStore(directory, options)
+  if err != nil {
+    t.Fatalf("Error making log store: %v", err)
+  }
+  return l
+}
+
+func TestLogStoreSetsEntry(t *testing.T) {
+  ctx := context.Background()
+  l := makeTestLogStore(t, t.TempDir(), nil)
+  defer l.Close()
+
+  if err := l.Set(ctx, KEY, VALUE); err != nil {
+    t.Errorf("Error when setting %v->%v in log store: %v", KEY, VALUE, err)
+  }
+
+  if val, err := l.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Error retrieving %v from log store", KEY)
+  }
+
+  if _, err := l.Get(ctx, KEY2); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("Expected missing %v to wrap os.ErrNotExist, got %v", KEY2, err)
+  }
+}
+
+func TestLogStoreOverwritesEntry(t *testing.T) {
+  ctx := context.Background()
+  l := makeTestLogStore(t, t.TempDir(), nil)
+  defer l.Close()
+
+  l.Set(ctx, KEY, VALUE)
+  l.Set(ctx, KEY, VALUE_THAT_FITS)
+  if val, _ := l.Get(ctx, KEY); val != VALUE_THAT_FITS {
+    t.Errorf("Expected a %v->%v store", KEY, VALUE_THAT_FITS)
+  }
+}
+
+func TestLogStoreRecoversByReplay(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  l := makeTestLogStore(t, directory, nil)
+  l.Set(ctx, KEY, VALUE)
+  l.Set(ctx, KEY2, VALUE)
+  l.Set(ctx, KEY, VALUE_THAT_FITS)
+  l.Close()
+
+  l = makeTestLogStore(t, directory, nil)
+  defer l.Close()
+  if val, err := l.Get(ctx, KEY); err != nil || val != VALUE_THAT_FITS {
+    t.Errorf("Expected %v->%v after recovery", KEY, VALUE_THAT_FITS)
+  }
+
+  if val, err := l.Get(ctx, KEY2); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v after recovery", KEY2, VALUE)
+  }
+}
+
+func TestLogStoreStoresValuesBeginningWithTheAttributesMagic(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  l := makeTestLogStore(t, directory, nil)
+  value := Value(string(ATTRIBUTES_MAGIC) + "\x05hello world")
+  if err := l.Set(ctx, KEY, value); err != nil {
+    t.Fatalf("Error setting %v: %v", KEY, err)
+  }
+  l.SetWithAttributes(ctx, KEY2, value, &Attributes{ Metadata: map[string]string{ "a": "b" } })
+  l.Close()
+
+  // Both survive a replay of the log.
+  l = makeTestLogStore(t, directory, nil)
+  defer l.Close()
+  if val, stored, err := l.GetWithAttributes(ctx, KEY); err != nil || val != value || stored != nil {
+    t.Errorf("Expected %q without attributes, got %q %v (%v)", value, val, stored, err)
+  }
+  if val, stored, err := l.GetWithAttributes(ctx, KEY2); err != nil || val != value ||
+      stored == nil || stored.Metadata["a"] != "b" {
+    t.Errorf("Expected %q with its metadata, got %q %v (%v)", value, val, stored, err)
+  }
+}
+
+func TestLogStoreRecoversFromHintFiles(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  // Every record seals its segment.
+  options := &LogStoreOptions{ MaxSegmentBytes: 1 }
+  l := makeTestLogStore(t, directory, options)
+  for i := 0; i < 5; i++ {
+    l.Set(ctx, Key(fmt.Sprintf("key%v", i)), Value(fmt.Sprintf("value%v", i)))
+  }
+  l.Close()
+
+  if _, err := os.Stat(l.hintPath(0)); err != nil {
+    t.Errorf("Expected a hint file for the sealed segment: %v", err)
+  }
+
+  l = makeTestLogStore(t, directory, options)
+  defer l.Close()
+  for i := 0; i < 5; i++ {
+    key := Key(fmt.Sprintf("key%v", i))
+    if val, err := l.Get(ctx, key); err != nil || val != Value(fmt.Sprintf("value%v", i)) {
+      t.Errorf("Expected %v to be recovered, got %v, %v", key, val, err)
+    }
+  }
+}
+
+func TestLogStoreTruncatesPartialTailRecord(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  l := makeTestLogStore(t, directory, nil)
+  l.Set(ctx, KEY, VALUE)
+  l.Set(ctx, KEY2, VALUE_THAT_FITS)
+  l.Close()
+
+  // Simulate a crash part way through writing the second record.
+  path := l.segmentPath(0)
+  info, _ := os.Stat(path)
+  os.Truncate(path, info.Size() - 3)
+
+  l = makeTestLogStore(t, directory, nil)
+  defer l.Close()
+  if val, err := l.Get(ctx, KEY); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v after recovery", KEY, VALUE)
+  }
+
+  if _, err := l.Get(ctx, KEY2); err == nil {
+    t.Errorf("Expected the partial record for %v to be dropped", KEY2)
+  }
+
+  // New writes land after the truncated tail.
+  l.Set(ctx, KEY3, VALUE)
+  if val, err := l.Get(ctx, KEY3); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v after recovery", KEY3, VALUE)
+  }
+}
+
+func TestLogStoreCompactionDropsDeadRecords(t *testing.T) {
+  ctx := context.Background()
+  directory := t.TempDir()
+  options := &LogStoreOptions{ MaxSegmentBytes: 1 }
+  l := makeTestLogStore(t, directory, options)
+  for i := 0; i < 10; i++ {
+    l.Set(ctx, KEY, Value(fmt.Sprintf("value%v", i)))
+  }
+  l.Set(ctx, KEY2, VALUE)
+  // Seal the segment holding KEY2.
+  l.Set(ctx, KEY3, VALUE)
+
+  if err := l.MaybeCompact(); err != nil {
+    t.Errorf("Error compacting: %v", err)
+  }
+
+  if len(l.segments) != 2 {
+    t.Errorf("Expected the compacted and active segments, got %v", len(l.segments))
+  }
+
+  if val, err := l.Get(ctx, KEY); err != nil || val != "value9" {
+    t.Errorf("Expected %v->value9 after compaction, got %v", KEY, val)
+  }
+
+  if val, err := l.Get(ctx, KEY2); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v after compaction", KEY2, VALUE)
+  }
+  l.Close()
+
+  // The compacted log recovers to the same state.
+  l = makeTestLogStore(t, directory, options)
+  defer l.Close()
+  if val, err := l.Get(ctx, KEY); err != nil || val != "value9" {
+    t.Errorf("Expected %v->value9 after recovery, got %v", KEY, val)
+  }
+
+  if val, err := l.Get(ctx, KEY3); err != nil || val != VALUE {
+    t.Errorf("Expected %v->%v after recovery", KEY3, VALUE)
+  }
+}
+
+func TestLogStoreSkipsCompactionBelowThreshold(t *testing.T) {
+  ctx := context.Background()
+  options := &LogStoreOptions{ MaxSegmentBytes: 1 }
+  l := makeTestLogStore(t, t.TempDir(), options)
+  defer l.Close()
+  l.Set(ctx, KEY, VALUE)
+  l.Set(ctx, KEY2, VALUE)
+  l.Set(ctx, KEY3, VALUE)
+
+  l.MaybeCompact()
+  if len(l.segments) != 3 {
+    t.Errorf("Expected no compaction without dead records")
+  }
+}
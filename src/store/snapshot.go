@@ -0,0 +1,391 @@
+package store
+
+import (
+  "archive/tar"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+const (
+  // The first entry of every snapshot archive.
+  SNAPSHOT_MANIFEST_NAME = "MANIFEST.json"
+  // Archive entries for key files and blobs live under these prefixes.
+  SNAPSHOT_KEYS_PREFIX = "keys/"
+  SNAPSHOT_BLOBS_PREFIX = "blobs/"
+)
+
+// Describes every file in a snapshot archive, so that a restore can verify
+// it received each file intact.
+type SnapshotManifest struct {
+  CreatedAt time.Time `json:"created_at"`
+  Files []SnapshotFile `json:"files"`
+}
+
+// A single file in a snapshot archive.
+type SnapshotFile struct {
+  // The archive entry name, e.g. `keys/a key` or `blobs/<hash>`.
+  Name string `json:"name"`
+  SizeBytes int64 `json:"size_bytes"`
+  // The hex encoded SHA-256 of the file.
+  Sha256 string `json:"sha256"`
+}
+
+// The outcome of a restore.
+type RestoreResult struct {
+  // The number of files written.
+  Restored int
+  // The number of files already present from an earlier, interrupted
+  // restore.
+  Skipped int
+}
+
+// A store which can export a consistent snapshot of itself.
+type Snapshotter interface {
+  /**
+   * Write a point-in-time snapshot of the store to `w` as a tar archive.
+   */
+  Snapshot(w io.Writer) error
+}
+
+/**
+ * Write a consistent point-in-time snapshot of the store to `w` as a tar
+ * archive, led by a manifest of checksums.
+ *
+ * <p> The mutex is only held while every file is hard linked into a private
+ * snapshot directory. Writes replace files via rename rather than modifying
+ * them, so the links are unaffected by traffic served while the archive is
+ * written. Files are archived in their on-disk encoding; restoring an
+ * encrypted store requires its keyring.
+ */
+func (f *FileStore) Snapshot(w io.Writer) error {
+  snapshotDirectory, err := f.linkSnapshot()
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(snapshotDirectory)
+
+  manifest := &SnapshotManifest{ CreatedAt: time.Now().UTC() }
+  for _, prefix := range []string{ SNAPSHOT_KEYS_PREFIX, SNAPSHOT_BLOBS_PREFIX } {
+    names, err := listFiles(filepath.Join(snapshotDirectory, prefix))
+    if err != nil {
+      return err
+    }
+
+    for _, name := range names {
+      file, err := checksumFile(filepath.Join(snapshotDirectory, prefix, name))
+      if err != nil {
+        return err
+      }
+      file.Name = prefix + name
+      manifest.Files = append(manifest.Files, *file)
+    }
+  }
+
+  archive := tar.NewWriter(w)
+  manifestJson, err := json.Marshal(manifest)
+  if err != nil {
+    return err
+  }
+  if err := writeTarEntry(archive, SNAPSHOT_MANIFEST_NAME, manifestJson); err != nil {
+    return err
+  }
+
+  for _, file := range manifest.Files {
+    if err := writeTarFile(archive, file.Name,
+        filepath.Join(snapshotDirectory, file.Name)); err != nil {
+      return err
+    }
+  }
+  return archive.Close()
+}
+
+/**
+ * Hard link every key file and blob into a new directory beneath the
+ * temporary directory, returning its path. Files are copied if they cannot
+ * be linked, e.g. on filesystems without hard links.
+ */
+func (f *FileStore) linkSnapshot() (string, error) {
+  defer f.mutex.Unlock()
+  f.mutex.Lock()
+
+  snapshotDirectory, err := os.MkdirTemp(f.tempDirectory, "snapshot-")
+  if err != nil {
+    return "", err
+  }
+
+  sources := map[string]string{
+    SNAPSHOT_KEYS_PREFIX: f.directory,
+    SNAPSHOT_BLOBS_PREFIX: f.blobDirectory,
+  }
+  for prefix, source := range sources {
+    destination := filepath.Join(snapshotDirectory, prefix)
+    if err := os.Mkdir(destination, 0755); err != nil {
+      os.RemoveAll(snapshotDirectory)
+      return "", err
+    }
+
+    names, err := listFiles(source)
+    if err != nil {
+      os.RemoveAll(snapshotDirectory)
+      return "", err
+    }
+
+    for _, name := range names {
+      from := filepath.Join(source, name)
+      to := filepath.Join(destination, name)
+      if err := os.Link(from, to); err != nil {
+        if err := copyFile(from, to); err != nil {
+          os.RemoveAll(snapshotDirectory)
+          return "", err
+        }
+      }
+    }
+  }
+  return snapshotDirectory, nil
+}
+
+/**
+ * Restore a snapshot archive written by `FileStore.Snapshot` into
+ * `directory`, verifying every file against the manifest.
+ *
+ * <p> Restores are resumable: files already present in `directory` with a
+ * matching checksum (e.g. from an interrupted restore) are skipped. The
+ * directory must otherwise be fresh; files not listed in the manifest are
+ * reported as an error rather than overwritten.
+ */
+func RestoreSnapshot(r io.Reader, directory string) (*RestoreResult, error) {
+  archive := tar.NewReader(r)
+  header, err := archive.Next()
+  if err != nil {
+    return nil, err
+  }
+  if header.Name != SNAPSHOT_MANIFEST_NAME {
+    return nil, errors.New(fmt.Sprintf("Expected %v as the first archive entry, got %v",
+SNAPSHOT_MANIFEST_NAME, header.Name))
+  }
+
+  var manifest SnapshotManifest
+  if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+    return nil, err
+  }
+
+  expected := make(map[string]SnapshotFile)
+  for _, file := range manifest.Files {
+    if _, err := restorePath(directory, file.Name); err != nil {
+      return nil, err
+    }
+    expected[file.Name] = file
+  }
+
+  if err := checkRestoreDirectory(directory, expected); err != nil {
+    return nil, err
+  }
+
+  tmpDirectory := filepath.Join(directory, TEMP_DIRECTORY_NAME)
+  if err := os.MkdirAll(tmpDirectory, 0755); err != nil {
+    return nil, err
+  }
+
+  result := &RestoreResult{}
+  for {
+    header, err := archive.Next()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      return result, err
+    }
+
+    file, ok := expected[header.Name]
+    if !ok {
+      return result, errors.New(fmt.Sprintf("Archive entry %v missing from manifest",
+header.Name))
+    }
+
+    path, _ := restorePath(directory, file.Name)
+    if existing, err := checksumFile(path); err == nil && existing.Sha256 == file.Sha256 {
+      result.Skipped++
+      continue
+    }
+
+    // Write via a temporary file, so an interrupted restore never leaves a
+    // partial file at its final path.
+    tmpPath := filepath.Join(tmpDirectory, filepath.Base(path) + ".restore")
+    if err := writeVerifiedFile(archive, tmpPath, file); err != nil {
+      os.Remove(tmpPath)
+      return result, err
+    }
+    if err := os.Rename(tmpPath, path); err != nil {
+      return result, err
+    }
+    result.Restored++
+  }
+
+  // Every file in the manifest must now be present, e.g. in case the archive
+  // was truncated.
+  for _, file := range manifest.Files {
+    path, _ := restorePath(directory, file.Name)
+    if existing, err := checksumFile(path); err != nil || existing.Sha256 != file.Sha256 {
+      return result, errors.New(fmt.Sprintf("Snapshot file %v missing or corrupted",
+file.Name))
+    }
+  }
+  return result, nil
+}
+
+/**
+ * Return an error if the directory holds files which are not part of the
+ * snapshot being restored.
+ */
+func checkRestoreDirectory(directory string, expected map[string]SnapshotFile) error {
+  parents := map[string]string{
+    SNAPSHOT_KEYS_PREFIX: directory,
+    SNAPSHOT_BLOBS_PREFIX: filepath.Join(directory, BLOB_DIRECTORY_NAME),
+  }
+  for prefix, parent := range parents {
+    names, err := listFiles(parent)
+    if os.IsNotExist(err) {
+      continue
+    } else if err != nil {
+      return err
+    }
+
+    for _, name := range names {
+      if _, ok := expected[prefix + name]; !ok {
+        return errors.New(fmt.Sprintf(
+          "Cannot restore into %v; it contains %v, which is not in the snapshot",
+          directory, prefix + name))
+      }
+    }
+  }
+
+  if err := os.MkdirAll(filepath.Join(directory, BLOB_DIRECTORY_NAME), 0755); err != nil {
+    return err
+  }
+  // Snapshots are taken from upgraded stores, so every file has a header.
+  if err := os.MkdirAll(filepath.Join(directory, FORMAT_MARKER_NAME), 0755); err != nil {
+    return err
+  }
+  // The snapshot may hold plaintext files, e.g. if taken before encryption
+  // was enabled.
+  return os.RemoveAll(filepath.Join(directory, FORMAT_MARKER_NAME, ENCRYPTED_MARKER_NAME))
+}
+
+/**
+ * Map an archive entry name to its path beneath `directory`, rejecting names
+ * which would escape it.
+ */
+func restorePath(directory string, name string) (string, error) {
+  var parent, base string
+  if strings.HasPrefix(name, SNAPSHOT_KEYS_PREFIX) {
+    parent, base = directory, strings.TrimPrefix(name, SNAPSHOT_KEYS_PREFIX)
+  } else if strings.HasPrefix(name, SNAPSHOT_BLOBS_PREFIX) {
+    parent = filepath.Join(directory, BLOB_DIRECTORY_NAME)
+    base = strings.TrimPrefix(name, SNAPSHOT_BLOBS_PREFIX)
+  } else {
+    return "", errors.New(fmt.Sprintf("Unexpected archive entry %v", name))
+  }
+
+  if base == "" || base == "." || base == ".." || strings.ContainsRune(base, '/') {
+    return "", errors.New(fmt.Sprintf("Invalid archive entry %v", name))
+  }
+  return filepath.Join(parent, base), nil
+}
+
+// Copy `r` to `path`, returning an error if it does not match the manifest.
+func writeVerifiedFile(r io.Reader, path string, expected SnapshotFile) error {
+  output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil {
+    return err
+  }
+
+  hash := sha256.New()
+  sizeBytes, err := io.Copy(io.MultiWriter(output, hash), r)
+  if closeErr := output.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return err
+  }
+
+  if sizeBytes != expected.SizeBytes ||
+      hex.EncodeToString(hash.Sum(nil)) != expected.Sha256 {
+    return errors.New(fmt.Sprintf("Checksum mismatch for snapshot file %v",
+expected.Name))
+  }
+  return nil
+}
+
+// Return the size and checksum of a file. The name is left unset.
+func checksumFile(path string) (*SnapshotFile, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  hash := sha256.New()
+  sizeBytes, err := io.Copy(hash, file)
+  if err != nil {
+    return nil, err
+  }
+  return &SnapshotFile{
+    SizeBytes: sizeBytes,
+    Sha256: hex.EncodeToString(hash.Sum(nil)),
+  }, nil
+}
+
+func writeTarEntry(archive *tar.Writer, name string, contents []byte) error {
+  header := &tar.Header{
+    Name: name,
+    Mode: 0644,
+    Size: int64(len(contents)),
+    ModTime: time.Now(),
+  }
+  if err := archive.WriteHeader(header); err != nil {
+    return err
+  }
+  _, err := archive.Write(contents)
+  return err
+}
+
+// Stream a file into the archive without reading it into memory.
+func writeTarFile(archive *tar.Writer, name string, path string) error {
+  file, err := os.Open(path)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+
+  header := &tar.Header{
+    Name: name,
+    Mode: 0644,
+    Size: info.Size(),
+    ModTime: info.ModTime(),
+  }
+  if err := archive.WriteHeader(header); err != nil {
+    return err
+  }
+  _, err = io.Copy(archive, file)
+  return err
+}
+
+func copyFile(from string, to string) error {
+  contents, err := os.ReadFile(from)
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(to, contents, 0644)
+}
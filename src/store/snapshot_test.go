@@ -0,0 +1,103 @@
+package store
+
+import (
+  "bytes"
+  "context"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestSnapshotRestoresIntoFreshDirectory(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, &FileStoreOptions{ EnableDeduplication: true })
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE)
+  fs.Set(ctx, KEY3, VALUE_THAT_FITS)
+
+  var archive bytes.Buffer
+  if err := fs.Snapshot(&archive); err != nil {
+    t.Fatalf("Error taking snapshot: %v", err)
+  }
+
+  // Writes after the snapshot are not part of it.
+  fs.Set(ctx, KEY, VALUE_LARGE)
+
+  directory := filepath.Join(t.TempDir(), "restored")
+  result, err := RestoreSnapshot(&archive, directory)
+  if err != nil {
+    t.Fatalf("Error restoring snapshot: %v", err)
+  }
+
+  // Three key files and two blobs.
+  if result.Restored != 5 || result.Skipped != 0 {
+    t.Errorf("Unexpected restore result %+v", result)
+  }
+
+  restored, _ := MakeFileStore(directory, nil)
+  for key, value := range map[Key]Value{ KEY: VALUE, KEY2: VALUE, KEY3: VALUE_THAT_FITS } {
+    if val, err := restored.Get(ctx, key); err != nil || val != value {
+      t.Errorf("Expected %v->%v, got %v, %v", key, value, val, err)
+    }
+  }
+}
+
+func TestSnapshotRestoreIsResumable(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  fs.Set(ctx, KEY, VALUE)
+  fs.Set(ctx, KEY2, VALUE_THAT_FITS)
+
+  var archive bytes.Buffer
+  fs.Snapshot(&archive)
+
+  // Interrupt the restore part way through the archive.
+  directory := t.TempDir()
+  truncated := archive.Bytes()[:archive.Len() - 1536]
+  if _, err := RestoreSnapshot(bytes.NewReader(truncated), directory); err == nil {
+    t.Errorf("Expected an error restoring a truncated archive")
+  }
+
+  result, err := RestoreSnapshot(bytes.NewReader(archive.Bytes()), directory)
+  if err != nil {
+    t.Fatalf("Error resuming restore: %v", err)
+  }
+
+  if result.Skipped != 1 || result.Restored != 1 {
+    t.Errorf("Expected to skip the file restored earlier, got %+v", result)
+  }
+}
+
+func TestSnapshotRestoreRejectsCorruptedFiles(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  fs.Set(ctx, KEY, VALUE)
+
+  var archive bytes.Buffer
+  fs.Snapshot(&archive)
+
+  corrupted := bytes.Replace(archive.Bytes(), []byte(VALUE), []byte(VALUE_LARGE[:len(VALUE)]), 1)
+  directory := t.TempDir()
+  if _, err := RestoreSnapshot(bytes.NewReader(corrupted), directory); err == nil {
+    t.Errorf("Expected a checksum error")
+  }
+
+  if _, err := os.Stat(filepath.Join(directory, KEY)); !os.IsNotExist(err) {
+    t.Errorf("Expected the corrupted file not to be restored")
+  }
+}
+
+func TestSnapshotRestoreRejectsNonFreshDirectory(t *testing.T) {
+  ctx := context.Background()
+  fs := makeTestFileStore(t, nil)
+  fs.Set(ctx, KEY, VALUE)
+
+  var archive bytes.Buffer
+  fs.Snapshot(&archive)
+
+  directory := t.TempDir()
+  os.WriteFile(filepath.Join(directory, KEY2), []byte(VALUE), 0644)
+  if _, err := RestoreSnapshot(&archive, directory); err == nil {
+    t.Errorf("Expected an error restoring into a directory with other keys")
+  }
+}
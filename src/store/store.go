@@ -1,10 +1,20 @@
 package store
 
+import (
+  "context"
+  "errors"
+)
+
 type Key string
 type Value string
 
 var (
   EMPTY_VALUE = Value("")
+
+  // Returned (wrapped) by distributed stores which cannot serve a call right
+  // now, e.g. without a Raft leader or a replication quorum; the call may
+  // succeed if retried.
+  ErrUnavailable = errors.New("Store unavailable")
 )
 
 // Utilty methods around the Value type.
@@ -17,19 +27,56 @@ type KeyValuePair struct {
   Value Value
 }
 
-// An interface for a KeyValue store.
+/**
+ * An interface for a KeyValue store. Calls take the context of the request
+ * they serve; stores abandon calls whose context is cancelled or past its
+ * deadline, returning the context's error, where they can do so without
+ * leaving a partial write behind.
+ */
 type KeyValueStore interface {
   /**
    * Associate the {@code key} with the {@code value}.
    * If the key/value pair could not be set, return the error that occurred
    * (e.g. an IO failure if writing to disk).
    */
-  Set(key Key, value Value) error
+  Set(ctx context.Context, key Key, value Value) error
   
   /** 
    * Retrieve the value associated with this key, or
    * an error if no value is stored for this key.
    */
-  Get(key Key) (Value, error)
+  Get(ctx context.Context, key Key) (Value, error)
+
+  /**
+   * Flush any buffered state, and release the store's resources, e.g. open
+   * files and background goroutines. The store must not be used afterwards.
+   */
+  Close() error
 }
 
+// A store which reports usage statistics, e.g. for telemetry.
+type StatsReporter interface {
+  /**
+   * Return a snapshot of the store's statistics, keyed by name
+   * (e.g. "size_bytes").
+   */
+  Stats() map[string]int64
+}
+
+// A store which can remove keys.
+type Deleter interface {
+  /**
+   * Remove the key and its value. Removing a missing key is not an error.
+   */
+  Delete(ctx context.Context, key Key) error
+}
+
+// A store which can report whether it is able to serve, e.g. for a
+// readiness probe.
+type HealthChecker interface {
+  /**
+   * Return nil if the store can serve calls, otherwise an error describing
+   * why not (e.g. its disk is not writable).
+   */
+  CheckHealth() error
+}
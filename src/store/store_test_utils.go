@@ -1,5 +1,9 @@
 package store
 
+import (
+  "context"
+)
+
 // A collection of testing utilities for the KeyValueStore.
 type FakeKeyValueStore struct {
   // An ordered list of Get calls.
@@ -10,9 +14,11 @@ type FakeKeyValueStore struct {
   SetCalls []*KeyValuePair
   // The result of the next Set call.
   NextSet error
+  // Whether Close was called.
+  Closed bool
 }
 
-func (f *FakeKeyValueStore) Get(key Key) (Value, error) {
+func (f *FakeKeyValueStore) Get(ctx context.Context, key Key) (Value, error) {
   f.GetCalls = append(f.GetCalls, key)
   return f.NextGet.Value, f.NextGet.error
 }
@@ -21,7 +27,7 @@ func (f *FakeKeyValueStore) SetNextGet(v Value, err error) {
   f.NextGet = struct {Value; error} {v, err}
 }
 
-func (f *FakeKeyValueStore) Set(key Key, value Value) error {
+func (f *FakeKeyValueStore) Set(ctx context.Context, key Key, value Value) error {
   f.SetCalls = append(f.SetCalls, &KeyValuePair{ Key: key, Value: value })
   return f.NextSet
 }
@@ -29,3 +35,8 @@ func (f *FakeKeyValueStore) Set(key Key, value Value) error {
 func (f *FakeKeyValueStore) SetNextSet(e error) {
   f.NextSet = e
 }
+
+func (f *FakeKeyValueStore) Close() error {
+  f.Closed = true
+  return nil
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+  "container/list"
+  "os"
+  "sort"
+)
+
+// The on-disk size of a key's file, and its position in the access order.
+type usageEntry struct {
+  sizeBytes int64
+  accessListElement *list.Element
+}
+
+// Tracks the disk usage of a FileStore, and the order in which its keys were
+// last accessed. Access order is tracked here rather than via filesystem
+// atime, which is frequently disabled (e.g. `noatime` mounts).
+// The usage index is not synchronized; the FileStore's mutex guards it.
+type usageIndex struct {
+  entries map[Key]*usageEntry
+  // A doubly-linked list of Keys, ordered by access time. The front was
+  // accessed least recently, and should be evicted first.
+  accessList *list.List
+  // The total size of every tracked file, in bytes.
+  sizeBytes int64
+}
+
+/**
+ * Record that the key's file was written with the given size, marking it as
+ * the most recently accessed key.
+ */
+func (u *usageIndex) onWrite(key Key, sizeBytes int64) {
+  u.onResize(key, sizeBytes)
+  u.onRead(key)
+}
+
+/**
+ * Record that the key's file now has the given size, without affecting its
+ * access order, e.g. because it was re-encrypted. Untracked keys are tracked
+ * as the most recently accessed key.
+ */
+func (u *usageIndex) onResize(key Key, sizeBytes int64) {
+  if entry, ok := u.entries[key]; ok {
+    u.sizeBytes += sizeBytes - entry.sizeBytes
+    entry.sizeBytes = sizeBytes
+    return
+  }
+
+  u.entries[key] = &usageEntry{
+    sizeBytes: sizeBytes,
+    accessListElement: u.accessList.PushBack(key),
+  }
+  u.sizeBytes += sizeBytes
+}
+
+// Record that the key was read, marking it as the most recently accessed key.
+func (u *usageIndex) onRead(key Key) {
+  if entry, ok := u.entries[key]; ok {
+    u.accessList.MoveToBack(entry.accessListElement)
+  }
+}
+
+// Stop tracking the key, e.g. because its file was removed.
+func (u *usageIndex) onRemove(key Key) {
+  if entry, ok := u.entries[key]; ok {
+    u.sizeBytes -= entry.sizeBytes
+    u.accessList.Remove(entry.accessListElement)
+    delete(u.entries, key)
+  }
+}
+
+/**
+ * Return the least recently accessed key, skipping `exclude`, or false if
+ * there is no such key.
+ */
+func (u *usageIndex) leastRecentlyAccessed(exclude Key) (Key, bool) {
+  for element := u.accessList.Front(); element != nil; element = element.Next() {
+    if key := element.Value.(Key); key != exclude {
+      return key, true
+    }
+  }
+  return "", false
+}
+
+// The number of tracked files.
+func (u *usageIndex) fileCount() int {
+  return len(u.entries)
+}
+
+/**
+ * Construct a usage index from the files already in `directory`. Access
+ * order is not persisted, so files are ordered by modification time.
+ */
+func makeUsageIndex(directory string) (*usageIndex, error) {
+  u := &usageIndex{}
+  u.entries = make(map[Key]*usageEntry)
+  u.accessList = list.New()
+
+  dirEntries, err := os.ReadDir(directory)
+  if err != nil {
+    return nil, err
+  }
+
+  var files []os.FileInfo
+  for _, dirEntry := range dirEntries {
+    if dirEntry.IsDir() {
+      continue
+    }
+
+    info, err := dirEntry.Info()
+    if err != nil {
+      return nil, err
+    }
+    files = append(files, info)
+  }
+
+  sort.Slice(files, func(i, j int) bool {
+    return files[i].ModTime().Before(files[j].ModTime())
+  })
+  for _, file := range files {
+    u.onWrite(Key(file.Name()), file.Size())
+  }
+  return u, nil
+}
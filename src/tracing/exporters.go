@@ -0,0 +1,90 @@
+package tracing
+
+import (
+  "encoding/json"
+  "errors"
+  "os"
+  "sync"
+)
+
+// Keeps every exported span in memory, e.g. for tests. Create instances via
+// MakeMemoryExporter.
+type MemoryExporter struct {
+  spans []*SpanData
+  mutex *sync.Mutex
+}
+
+func MakeMemoryExporter() *MemoryExporter {
+  return &MemoryExporter{ mutex: &sync.Mutex{} }
+}
+
+func (e *MemoryExporter) Export(span *SpanData) error {
+  defer e.mutex.Unlock()
+  e.mutex.Lock()
+  e.spans = append(e.spans, span)
+  return nil
+}
+
+func (e *MemoryExporter) Close() error {
+  return nil
+}
+
+// Return the spans exported so far, in the order they ended.
+func (e *MemoryExporter) Spans() []*SpanData {
+  defer e.mutex.Unlock()
+  e.mutex.Lock()
+  return append([]*SpanData{}, e.spans...)
+}
+
+// Discard the spans exported so far.
+func (e *MemoryExporter) Reset() {
+  defer e.mutex.Unlock()
+  e.mutex.Lock()
+  e.spans = nil
+}
+
+// Appends each span to a file as a line of JSON, i.e. JSON Lines. Create
+// instances via MakeJsonFileExporter.
+type JsonFileExporter struct {
+  file *os.File
+  encoder *json.Encoder
+  // Guards `file`, which is nil once closed.
+  mutex *sync.Mutex
+}
+
+// Make an exporter appending to the file at `path`, creating it if needed.
+func MakeJsonFileExporter(path string) (*JsonFileExporter, error) {
+  file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  return &JsonFileExporter{
+    file: file,
+    encoder: json.NewEncoder(file),
+    mutex: &sync.Mutex{},
+  }, nil
+}
+
+func (e *JsonFileExporter) Export(span *SpanData) error {
+  defer e.mutex.Unlock()
+  e.mutex.Lock()
+  if e.file == nil {
+    return errors.New("Trace file exporter closed")
+  }
+  return e.encoder.Encode(span)
+}
+
+// Sync and close the file.
+func (e *JsonFileExporter) Close() error {
+  defer e.mutex.Unlock()
+  e.mutex.Lock()
+  if e.file == nil {
+    return nil
+  }
+  err := e.file.Sync()
+  if closeErr := e.file.Close(); err == nil {
+    err = closeErr
+  }
+  e.file = nil
+  return err
+}
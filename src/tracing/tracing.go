@@ -0,0 +1,332 @@
+package tracing
+
+import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+  "buildbuddy.takehome.com/src/logging"
+)
+
+const (
+  // The W3C Trace Context header, e.g.
+  // `traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`.
+  HEADER_TRACEPARENT = "traceparent"
+  TRACEPARENT_VERSION = "00"
+  // The flag marking a trace as sampled, i.e. its spans are exported.
+  FLAG_SAMPLED = 0x01
+
+  // The role of a span in a call between processes.
+  KIND_INTERNAL = "internal"
+  KIND_CLIENT = "client"
+  KIND_SERVER = "server"
+
+  STATUS_OK = "ok"
+  STATUS_ERROR = "error"
+)
+
+type TraceId [16]byte
+type SpanId [8]byte
+
+func (id TraceId) String() string {
+  return hex.EncodeToString(id[:])
+}
+
+func (id SpanId) String() string {
+  return hex.EncodeToString(id[:])
+}
+
+// Identifies a span across processes, as carried by a traceparent header.
+type SpanContext struct {
+  TraceId TraceId
+  SpanId SpanId
+  Sampled bool
+}
+
+// Return whether the trace and span IDs are set; all-zero IDs are invalid.
+func (sc SpanContext) IsValid() bool {
+  return sc.TraceId != TraceId{} && sc.SpanId != SpanId{}
+}
+
+// Return the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+  flags := 0
+  if sc.Sampled {
+    flags = FLAG_SAMPLED
+  }
+  return fmt.Sprintf("%v-%v-%v-%02x", TRACEPARENT_VERSION, sc.TraceId, sc.SpanId, flags)
+}
+
+/**
+ * Parse a traceparent header value. Later versions are accepted as long as
+ * they begin with the fields of version 00, as the specification requires.
+ */
+func ParseTraceparent(value string) (SpanContext, error) {
+  invalid := errors.New(fmt.Sprintf("Invalid traceparent %q", value))
+  parts := strings.Split(strings.TrimSpace(value), "-")
+  if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+      (parts[0] == TRACEPARENT_VERSION && len(parts) != 4) {
+    return SpanContext{}, invalid
+  }
+
+  var sc SpanContext
+  var flags [1]byte
+  for _, field := range []struct{ text string; into []byte }{
+    { parts[1], sc.TraceId[:] },
+    { parts[2], sc.SpanId[:] },
+    { parts[3], flags[:] },
+  } {
+    if len(field.text) != 2 * len(field.into) || strings.ToLower(field.text) != field.text {
+      return SpanContext{}, invalid
+    }
+    if _, err := hex.Decode(field.into, []byte(field.text)); err != nil {
+      return SpanContext{}, invalid
+    }
+  }
+  if !sc.IsValid() {
+    return SpanContext{}, invalid
+  }
+  sc.Sampled = flags[0] & FLAG_SAMPLED != 0
+  return sc, nil
+}
+
+// The record of a finished span, as exported.
+type SpanData struct {
+  Name string `json:"name"`
+  Kind string `json:"kind"`
+  Service string `json:"service,omitempty"`
+  TraceId string `json:"trace_id"`
+  SpanId string `json:"span_id"`
+  // Empty for the root span of a trace.
+  ParentSpanId string `json:"parent_span_id,omitempty"`
+  StartTime time.Time `json:"start_time"`
+  EndTime time.Time `json:"end_time"`
+  // e.g. `cache.hit` or `value.bytes`.
+  Attributes map[string]interface{} `json:"attributes,omitempty"`
+  // STATUS_OK, or STATUS_ERROR with the error's message.
+  Status string `json:"status"`
+  StatusMessage string `json:"status_message,omitempty"`
+}
+
+// Receives each span of a sampled trace once it ends.
+type Exporter interface {
+  Export(span *SpanData) error
+  // Flush and release the exporter; no spans are exported afterwards.
+  Close() error
+}
+
+type TracerOptions struct {
+  // Recorded on every span, e.g. `buildbuddy-server`.
+  ServiceName string
+  // Logs spans which could not be exported; may be nil.
+  Logger *logging.Logger
+}
+
+// Creates spans and exports them. A nil Tracer creates no spans, so
+// components may be made without one. Create instances via MakeTracer.
+type Tracer struct {
+  exporter Exporter
+  serviceName string
+  logger *logging.Logger
+  now func() time.Time
+}
+
+// Make a Tracer exporting to `exporter`. `options` may be nil.
+func MakeTracer(exporter Exporter, options *TracerOptions) *Tracer {
+  if options == nil {
+    options = &TracerOptions{}
+  }
+  t := &Tracer{}
+  t.exporter = exporter
+  t.serviceName = options.ServiceName
+  t.logger = options.Logger
+  t.now = time.Now
+  return t
+}
+
+// Close the tracer's exporter, flushing its spans. A nil Tracer has none.
+func (t *Tracer) Close() error {
+  if t == nil || t.exporter == nil {
+    return nil
+  }
+  return t.exporter.Close()
+}
+
+// A timed operation within a trace. A nil Span records nothing, so callers
+// need not check whether tracing is enabled.
+type Span struct {
+  tracer *Tracer
+  context SpanContext
+  data *SpanData
+  // Guards `data` and `ended`.
+  mutex *sync.Mutex
+  ended bool
+}
+
+/**
+ * Start a span named `name`, the child of the span in `ctx` or of its
+ * remote parent, if any, and otherwise the root of a new trace. Returns a
+ * context carrying the new span, for its children. End the span once the
+ * operation finishes.
+ */
+func (t *Tracer) Start(ctx context.Context, name string, kind string) (context.Context, *Span) {
+  if t == nil {
+    return ctx, nil
+  }
+
+  parent, hasParent := parentOf(ctx)
+  s := &Span{}
+  s.tracer = t
+  s.mutex = &sync.Mutex{}
+  s.context.SpanId = newSpanId()
+  s.context.Sampled = true
+  if hasParent {
+    s.context.TraceId = parent.TraceId
+    s.context.Sampled = parent.Sampled
+  } else {
+    s.context.TraceId = newTraceId()
+  }
+
+  s.data = &SpanData{
+    Name: name,
+    Kind: kind,
+    Service: t.serviceName,
+    TraceId: s.context.TraceId.String(),
+    SpanId: s.context.SpanId.String(),
+    StartTime: t.now(),
+    Status: STATUS_OK,
+  }
+  if hasParent {
+    s.data.ParentSpanId = parent.SpanId.String()
+  }
+  return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Return the span's context, e.g. to propagate it; invalid for a nil span.
+func (s *Span) Context() SpanContext {
+  if s == nil {
+    return SpanContext{}
+  }
+  return s.context
+}
+
+// Record an attribute of the operation, e.g. `SetAttribute("cache.hit", true)`.
+func (s *Span) SetAttribute(key string, value interface{}) {
+  if s == nil {
+    return
+  }
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+  if s.data.Attributes == nil {
+    s.data.Attributes = make(map[string]interface{})
+  }
+  s.data.Attributes[key] = value
+}
+
+// Mark the operation as failed with `err`, if it is not nil.
+func (s *Span) SetError(err error) {
+  if s == nil || err == nil {
+    return
+  }
+  defer s.mutex.Unlock()
+  s.mutex.Lock()
+  s.data.Status = STATUS_ERROR
+  s.data.StatusMessage = err.Error()
+}
+
+// End the span, exporting it if its trace is sampled. Later calls do
+// nothing.
+func (s *Span) End() {
+  if s == nil {
+    return
+  }
+  s.mutex.Lock()
+  if s.ended {
+    s.mutex.Unlock()
+    return
+  }
+  s.ended = true
+  s.data.EndTime = s.tracer.now()
+  data := s.data
+  s.mutex.Unlock()
+
+  if !s.context.Sampled || s.tracer.exporter == nil {
+    return
+  }
+  if err := s.tracer.exporter.Export(data); err != nil {
+    s.tracer.logger.Warn("Error exporting span", "span", data.Name, "err", err)
+  }
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// Return the span `ctx` carries, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+  span, _ := ctx.Value(spanKey{}).(*Span)
+  return span
+}
+
+// Return a context whose spans continue the trace of a remote parent, e.g.
+// one received in a traceparent header.
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+  return context.WithValue(ctx, remoteParentKey{}, parent)
+}
+
+// Return the context of the parent of spans started in `ctx`, if any.
+func parentOf(ctx context.Context) (SpanContext, bool) {
+  if span := SpanFromContext(ctx); span != nil {
+    return span.context, true
+  }
+  parent, ok := ctx.Value(remoteParentKey{}).(SpanContext)
+  return parent, ok && parent.IsValid()
+}
+
+// Set the traceparent header of an outgoing request to the span in `ctx`,
+// if any, so that the receiver continues its trace.
+func Inject(ctx context.Context, header http.Header) {
+  if span := SpanFromContext(ctx); span != nil {
+    header.Set(HEADER_TRACEPARENT, span.context.Traceparent())
+  }
+}
+
+// Return a context continuing the trace of an incoming request's
+// traceparent header, if it has a valid one.
+func Extract(ctx context.Context, header http.Header) context.Context {
+  parent, err := ParseTraceparent(header.Get(HEADER_TRACEPARENT))
+  if err != nil {
+    return ctx
+  }
+  return ContextWithRemoteParent(ctx, parent)
+}
+
+func newTraceId() TraceId {
+  var id TraceId
+  for id == (TraceId{}) {
+    fillRandom(id[:])
+  }
+  return id
+}
+
+func newSpanId() SpanId {
+  var id SpanId
+  for id == (SpanId{}) {
+    fillRandom(id[:])
+  }
+  return id
+}
+
+func fillRandom(id []byte) {
+  if _, err := rand.Read(id); err != nil {
+    // Fall back on the clock; IDs need only be unique, not secret.
+    nanos := time.Now().UnixNano()
+    for i := range id {
+      id[i] = byte(nanos >> (8 * (i % 8)))
+    }
+  }
+}
@@ -0,0 +1,134 @@
+package tracing
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestTraceparentRoundTrips(t *testing.T) {
+  header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+  sc, err := ParseTraceparent(header)
+  if err != nil {
+    t.Fatalf("Error parsing traceparent: %v", err)
+  }
+  if sc.TraceId.String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+      sc.SpanId.String() != "00f067aa0ba902b7" || !sc.Sampled {
+    t.Errorf("Unexpected span context %+v", sc)
+  }
+  if sc.Traceparent() != header {
+    t.Errorf("Expected %v, got %v", header, sc.Traceparent())
+  }
+
+  for _, invalid := range []string{
+      "",
+      "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+      "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+      "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+      "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+      "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+  } {
+    if _, err := ParseTraceparent(invalid); err == nil {
+      t.Errorf("Expected %q to be invalid", invalid)
+    }
+  }
+}
+
+func TestSpansContinueTraces(t *testing.T) {
+  exporter := MakeMemoryExporter()
+  tracer := MakeTracer(exporter, &TracerOptions{ ServiceName: "test" })
+
+  ctx, client := tracer.Start(context.Background(), "Client.Get", KIND_CLIENT)
+  header := http.Header{}
+  Inject(ctx, header)
+
+  // The receiving process continues the trace from the header.
+  serverCtx, server := tracer.Start(Extract(context.Background(), header),
+    "GET /get", KIND_SERVER)
+  _, child := tracer.Start(serverCtx, "Cache.Get", KIND_INTERNAL)
+  child.SetAttribute("cache.hit", false)
+  child.SetError(errors.New("miss"))
+  child.End()
+  server.End()
+  client.End()
+  client.End()
+
+  spans := exporter.Spans()
+  if len(spans) != 3 {
+    t.Fatalf("Expected 3 spans, got %v", len(spans))
+  }
+  cache, get, root := spans[0], spans[1], spans[2]
+  if root.ParentSpanId != "" || get.ParentSpanId != root.SpanId ||
+      cache.ParentSpanId != get.SpanId {
+    t.Errorf("Expected each span to be the child of the last: %+v %+v %+v", root, get, cache)
+  }
+  if cache.TraceId != root.TraceId || get.TraceId != root.TraceId {
+    t.Errorf("Expected a single trace")
+  }
+  if cache.Attributes["cache.hit"] != false || cache.Status != STATUS_ERROR ||
+      cache.StatusMessage != "miss" || cache.Service != "test" {
+    t.Errorf("Unexpected span %+v", cache)
+  }
+
+  // Spans of unsampled traces are not exported.
+  exporter.Reset()
+  unsampled := ContextWithRemoteParent(context.Background(), SpanContext{
+    TraceId: root.traceId(t), SpanId: SpanId{ 1 }, Sampled: false,
+  })
+  _, span := tracer.Start(unsampled, "ignored", KIND_SERVER)
+  span.End()
+  if len(exporter.Spans()) != 0 {
+    t.Errorf("Expected unsampled spans to be dropped")
+  }
+
+  var noop *Tracer
+  if _, span := noop.Start(context.Background(), "none", KIND_INTERNAL); span != nil {
+    t.Errorf("Expected a nil tracer to create no spans")
+  }
+}
+
+func TestJsonFileExporterWritesLines(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "traces.jsonl")
+  exporter, err := MakeJsonFileExporter(path)
+  if err != nil {
+    t.Fatalf("Error making exporter: %v", err)
+  }
+  tracer := MakeTracer(exporter, nil)
+  for _, name := range []string{ "first", "second" } {
+    _, span := tracer.Start(context.Background(), name, KIND_INTERNAL)
+    span.SetAttribute("value.bytes", 5)
+    span.End()
+  }
+  if err := exporter.Close(); err != nil {
+    t.Fatalf("Error closing exporter: %v", err)
+  }
+
+  file, _ := os.Open(path)
+  defer file.Close()
+  var names []string
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    var span SpanData
+    if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+      t.Fatalf("Error decoding span: %v", err)
+    }
+    names = append(names, span.Name)
+  }
+  if len(names) != 2 || names[0] != "first" || names[1] != "second" {
+    t.Errorf("Expected both spans, got %v", names)
+  }
+}
+
+// Parse the span's trace ID back into a TraceId.
+func (s *SpanData) traceId(t *testing.T) TraceId {
+  sc, err := ParseTraceparent("00-" + s.TraceId + "-" + s.SpanId + "-01")
+  if err != nil {
+    t.Fatalf("Error parsing span IDs: %v", err)
+  }
+  return sc.TraceId
+}